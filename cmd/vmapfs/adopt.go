@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"vmapfs/internal/farm"
+	"vmapfs/internal/state"
+)
+
+// adoptReport is the result of adopt, as written by -json
+type adoptReport struct {
+	Tree     string             `json:"tree"`
+	Links    int                `json:"links"`
+	Problems []farm.LinkProblem `json:"problems"`
+	Import   state.ImportReport `json:"import"`
+}
+
+// runAdopt turns a tree of symlinks into the source tree, such as a library
+// organised before vmapfs, into mappings with the same layout
+func runAdopt(args []string) int {
+	flags := newFlagSet("adopt", "-state FILE -tree DIR -source DIR [-dry-run] [-json]")
+	statePath := flags.String("state", "", "State file to add the mappings to (required)")
+	treePath := flags.String("tree", "", "Directory tree of symlinks to adopt (required)")
+	sourcePath := flags.String("source", "", "Source directory the links point into (required)")
+	journal := flags.Bool("journal", false, "The state file is journaled")
+	dryRun := flags.Bool("dry-run", false, "Show what would change without changing anything")
+	skipCollisions := flags.Bool("skip-collisions", false, "Adopt the other links when some collide with existing paths")
+	jsonOutput := flags.Bool("json", false, "Write the report as JSON")
+	verbose := flags.Bool("verbose", false, "Enable verbose logging")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	setupCommandLogging(*verbose)
+
+	if *statePath == "" || *treePath == "" || *sourcePath == "" {
+		fmt.Fprintln(os.Stderr, "adopt: -state, -tree and -source are required")
+		flags.Usage()
+		return exitError
+	}
+	absState, err := filepath.Abs(*statePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "adopt: %v\n", err)
+		return exitError
+	}
+
+	adoption, err := farm.Adopt(*treePath, *sourcePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "adopt: %v\n", err)
+		return exitError
+	}
+	params := importParams{
+		Records:        adoption.Records,
+		Mode:           state.ImportMerge,
+		DryRun:         *dryRun,
+		SkipCollisions: *skipCollisions,
+	}
+	imported, err := applyImport(absState, *journal, *sourcePath, params)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "adopt: %v\n", err)
+		return exitError
+	}
+
+	report := adoptReport{
+		Tree:     *treePath,
+		Links:    adoption.Links,
+		Problems: adoption.Problems,
+		Import:   imported,
+	}
+	if *jsonOutput {
+		if err := writeJSON(os.Stdout, report); err != nil {
+			fmt.Fprintf(os.Stderr, "adopt: %v\n", err)
+			return exitError
+		}
+	} else {
+		fmt.Printf("%s: %d links\n", report.Tree, report.Links)
+		if len(report.Problems) > 0 {
+			fmt.Printf("%d entries not adopted:\n", len(report.Problems))
+			for _, p := range report.Problems {
+				fmt.Printf("  %s\n", p)
+			}
+		}
+		printImportReport(os.Stdout, imported, params)
+	}
+
+	if len(report.Problems) > 0 || len(imported.Invalid) > 0 || len(imported.Collisions) > 0 {
+		return exitProblems
+	}
+	return exitOK
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"vmapfs/internal/control"
+	"vmapfs/internal/fs"
+	"vmapfs/internal/state"
+)
+
+// applyParams are the parameters of the state.apply control method
+type applyParams struct {
+	Copy   bool `json:"copy,omitempty"`
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// applyReport is the result of planning and running an apply
+type applyReport struct {
+	*fs.ApplyPlan
+	Applied bool `json:"applied"`
+}
+
+// registerApplyHandlers serves apply from a mounted instance, so that the
+// files move and the state follows them without remounting. Planning and
+// copying happen without blocking the filesystem; only the renames and the
+// state swap hold it, and the originals of copied files are removed once
+// the new state is saved.
+func registerApplyHandlers(ctl *control.Server, vfs *fs.VMapFS, sourceDir string) {
+	ctl.Handle("state.apply", func(raw json.RawMessage) (interface{}, error) {
+		var params applyParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		planned := vfs.Snapshot()
+		plan, err := fs.PlanApply(planned, sourceDir, params.Copy)
+		if err != nil {
+			return nil, err
+		}
+		report := applyReport{ApplyPlan: plan}
+		if params.DryRun || len(plan.Problems) > 0 {
+			return report, nil
+		}
+
+		run, err := plan.Stage(sourceDir)
+		if err != nil {
+			return report, err
+		}
+		moved := false
+		err = vfs.UpdateState("apply", func(current *state.FSState) (*state.FSState, error) {
+			if !state.Diff(planned, current).Empty() {
+				return nil, errors.New("the state changed while files were being copied, nothing was moved")
+			}
+			if err := run.Move(); err != nil {
+				return nil, err
+			}
+			moved = true
+			return plan.Rewrite(current), nil
+		})
+		switch {
+		case err != nil && !moved:
+			return report, run.Rollback(err)
+		case err != nil:
+			// The files have moved and the new state is in use, but it is
+			// only written with the next change, so the originals stay
+			logger.Warn("Keeping the originals of copied files, as the state was not saved: %v", err)
+			return report, err
+		}
+		run.Finish()
+		logger.Info("Applied %d moves to the source tree", len(plan.Moves))
+		report.Applied = true
+		return report, nil
+	})
+}
+
+// runApply moves source files so that their place in the source tree
+// matches their virtual path, and rewrites the mappings to follow them
+func runApply(args []string) int {
+	flags := newFlagSet("apply", "-state FILE [-source DIR] [-copy] [-dry-run]")
+	statePath := flags.String("state", "", "State file whose layout to apply (required)")
+	sourcePath := flags.String("source", "", "Source directory the state maps (required unless mounted)")
+	journal := flags.Bool("journal", false, "The state file is journaled")
+	allowCopy := flags.Bool("copy", false, "Copy files that would have to cross filesystems, then remove the originals")
+	dryRun := flags.Bool("dry-run", false, "Show the moves without making them")
+	jsonOutput := flags.Bool("json", false, "Write the report as JSON")
+	verbose := flags.Bool("verbose", false, "Enable verbose logging")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	setupCommandLogging(*verbose)
+
+	if *statePath == "" {
+		fmt.Fprintln(os.Stderr, "apply: -state is required")
+		flags.Usage()
+		return exitError
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return exitError
+	}
+	absState, err := filepath.Abs(*statePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apply: %v\n", err)
+		return exitError
+	}
+
+	params := applyParams{Copy: *allowCopy, DryRun: *dryRun}
+	var report applyReport
+	err = control.Call(control.SocketPath(absState), "state.apply", params, &report)
+	if errors.Is(err, control.ErrNotRunning) {
+		if *sourcePath == "" {
+			err = fmt.Errorf("-source is required when the filesystem is not mounted")
+		} else {
+			report, err = applyOffline(absState, *journal, filepath.Clean(*sourcePath), params)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apply: %v\n", err)
+		return exitError
+	}
+
+	if *jsonOutput {
+		if err := writeJSON(os.Stdout, report); err != nil {
+			fmt.Fprintf(os.Stderr, "apply: %v\n", err)
+			return exitError
+		}
+	} else {
+		printApplyReport(report, params)
+	}
+	if len(report.Problems) > 0 {
+		return exitProblems
+	}
+	return exitOK
+}
+
+// applyOffline applies the layout of an unmounted state file, holding its
+// lock unless nothing is changed. The moves are rolled back if the
+// rewritten state cannot be saved.
+func applyOffline(statePath string, journal bool, sourceDir string, params applyParams) (applyReport, error) {
+	var current *state.FSState
+	var store state.Store
+	var err error
+	if params.DryRun {
+		current, err = readState(statePath, journal)
+	} else {
+		store, _, err = openStore(statePath, journal, 0)
+		if err != nil {
+			return applyReport{}, err
+		}
+		defer store.Close()
+		current, err = store.LoadState()
+	}
+	if err != nil {
+		return applyReport{}, err
+	}
+
+	plan, err := fs.PlanApply(current, sourceDir, params.Copy)
+	if err != nil {
+		return applyReport{}, err
+	}
+	report := applyReport{ApplyPlan: plan}
+	if params.DryRun || len(plan.Problems) > 0 {
+		return report, nil
+	}
+	err = plan.Execute(sourceDir, func() error {
+		return store.SaveState(plan.Rewrite(current))
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Applied = true
+	return report, nil
+}
+
+// printApplyReport writes a human readable apply report
+func printApplyReport(report applyReport, params applyParams) {
+	if len(report.Problems) > 0 {
+		fmt.Printf("%d sources cannot be moved:\n", len(report.Problems))
+		for _, p := range report.Problems {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+	for _, move := range report.Moves {
+		verb := "mv"
+		if move.Copy {
+			verb = "cp"
+		}
+		fmt.Printf("  %s %s -> %s\n", verb, move.From, move.To)
+	}
+
+	switch {
+	case report.Applied:
+		fmt.Printf("Moved %d files, %d already in place\n", len(report.Moves), report.InPlace)
+	case len(report.Problems) > 0:
+		fmt.Println("Nothing moved")
+		fmt.Println("Resolve the problems to apply the layout")
+	case params.DryRun:
+		fmt.Printf("Would move %d files, %d already in place\n", len(report.Moves), report.InPlace)
+	default:
+		fmt.Println("Nothing moved")
+	}
+}
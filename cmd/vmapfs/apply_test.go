@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"vmapfs/internal/control"
+	"vmapfs/internal/fs"
+	"vmapfs/internal/state"
+)
+
+func TestApplyMounted(t *testing.T) {
+	sourceDir := t.TempDir()
+	stateDir := t.TempDir()
+	statePath := filepath.Join(stateDir, "state.json")
+	if err := os.MkdirAll(filepath.Join(sourceDir, "dl"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(sourceDir, "dl", "a.mkv"), []byte("a"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	manager, err := state.NewManager(statePath)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	defer manager.Close()
+	fsState, err := manager.LoadState()
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	fsState.Directories["/movies"] = true
+	fsState.Mappings["dl/a.mkv"] = state.FileMapping{VirtualPaths: []string{"/movies/a.mkv"}}
+	vfs, err := fs.NewVMapFS(sourceDir, fsState, manager)
+	if err != nil {
+		t.Fatalf("Failed to create filesystem: %v", err)
+	}
+
+	socket := filepath.Join(stateDir, "ctl.sock")
+	ctl := control.NewServer(socket)
+	registerApplyHandlers(ctl, vfs, sourceDir)
+	if err := ctl.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ctl.Close()
+
+	var report applyReport
+	if err := control.Call(socket, "state.apply", applyParams{}, &report); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if !report.Applied || len(report.Moves) != 1 {
+		t.Fatalf("Expected one move to be applied, got %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(sourceDir, "movies", "a.mkv")); err != nil {
+		t.Errorf("Expected the file to be moved: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(sourceDir, "dl")); !os.IsNotExist(err) {
+		t.Error("Expected the emptied source directory to be removed")
+	}
+
+	saved, err := state.ReadState(statePath)
+	if err != nil {
+		t.Fatalf("Failed to read saved state: %v", err)
+	}
+	if got := saved.Mappings["movies/a.mkv"].VirtualPaths; !reflect.DeepEqual(got, []string{"/movies/a.mkv"}) {
+		t.Errorf("Expected the saved mapping to follow the file, got %v", saved.Mappings)
+	}
+	if got := vfs.Snapshot().Mappings["movies/a.mkv"].VirtualPaths; !reflect.DeepEqual(got, []string{"/movies/a.mkv"}) {
+		t.Errorf("Expected the running state to follow the file, got %v", got)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"vmapfs/internal/audit"
+)
+
+// runAudit prints the audit log entries matching the given filters
+func runAudit(args []string) int {
+	flags := newFlagSet("audit", "-log FILE [-path PATH] [-since TIME] [-uid UID]")
+	logPath := flags.String("log", "", "Audit log written with -audit-log (required)")
+	path := flags.String("path", "", "Only show changes at or below this virtual path")
+	since := flags.String("since", "", "Only show changes since a time (RFC 3339 or YYYY-MM-DD) or for a duration (e.g. 24h)")
+	uid := flags.String("uid", "", "Only show changes made by this user ID")
+	jsonOutput := flags.Bool("json", false, "Write the entries as JSON lines")
+	verbose := flags.Bool("verbose", false, "Enable verbose logging")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	setupCommandLogging(*verbose)
+
+	if *logPath == "" {
+		fmt.Fprintln(os.Stderr, "audit: -log is required")
+		flags.Usage()
+		return exitError
+	}
+
+	filter := audit.Filter{Path: *path}
+	if *since != "" {
+		t, err := parseSince(*since, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "audit: %v\n", err)
+			return exitError
+		}
+		filter.Since = t
+	}
+	if *uid != "" {
+		n, err := strconv.ParseUint(*uid, 10, 32)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "audit: invalid uid %q\n", *uid)
+			return exitError
+		}
+		id := uint32(n)
+		filter.UID = &id
+	}
+
+	entries, err := audit.Query(*logPath, filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit: %v\n", err)
+		return exitError
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				fmt.Fprintf(os.Stderr, "audit: %v\n", err)
+				return exitError
+			}
+		}
+		return exitOK
+	}
+	printAuditEntries(entries)
+	return exitOK
+}
+
+// parseSince accepts an absolute time or a duration back from now
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+// printAuditEntries writes the entries as a table
+func printAuditEntries(entries []audit.Entry) {
+	if len(entries) == 0 {
+		fmt.Println("No matching changes")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tUID\tPID\tOP\tCHANGE")
+	for _, entry := range entries {
+		op := entry.Op
+		if entry.Via != "" {
+			op += " (" + entry.Via + ")"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n",
+			entry.Time.Local().Format("2006-01-02 15:04:05"), entry.UID, entry.PID, op, describeAuditEntry(entry))
+	}
+	w.Flush()
+}
+
+// describeAuditEntry summarises what an entry changed
+func describeAuditEntry(entry audit.Entry) string {
+	var change string
+	switch {
+	case entry.NewPath != "":
+		change = entry.Path + " -> " + entry.NewPath
+	case entry.Path != "":
+		change = entry.Path
+	default:
+		change = entry.Source
+	}
+	if entry.Name != "" {
+		change += " " + entry.Name
+	}
+	switch {
+	case entry.NewSource != "":
+		change += " [" + entry.Source + " -> " + entry.NewSource + "]"
+	case entry.Source != "" && entry.Path != "":
+		change += " [" + entry.Source + "]"
+	}
+	return change
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"vmapfs/internal/control"
+	"vmapfs/internal/fs"
+	"vmapfs/internal/state"
+)
+
+// currentState names the live state in backup diff
+const currentState = "current"
+
+// backupParams are the parameters of the backup control methods
+type backupParams struct {
+	Name string `json:"name,omitempty"`
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// backupSource reads backups and the state they are compared against,
+// either in the running instance or directly from disk
+type backupSource struct {
+	backupDir string
+	current   func() (*state.FSState, error)
+}
+
+// load returns the named backup, or the current state
+func (src backupSource) load(name string) (*state.FSState, error) {
+	if name == currentState {
+		return src.current()
+	}
+	return state.LoadBackup(src.backupDir, name)
+}
+
+// diff compares two backups or a backup and the current state
+func (src backupSource) diff(from, to string) (state.StateDiff, error) {
+	if to == "" {
+		to = currentState
+	}
+	fromState, err := src.load(from)
+	if err != nil {
+		return state.StateDiff{}, err
+	}
+	toState, err := src.load(to)
+	if err != nil {
+		return state.StateDiff{}, err
+	}
+	return state.Diff(fromState, toState), nil
+}
+
+// show returns the contents of the named backup
+func (src backupSource) show(name string) (string, error) {
+	backup, err := state.FindBackup(src.backupDir, name)
+	if err != nil {
+		return "", err
+	}
+	data, err := state.ReadBackup(backup)
+	return string(data), err
+}
+
+// registerBackupHandlers serves the backup commands from a mounted instance
+func registerBackupHandlers(ctl *control.Server, manager *state.Manager, vfs *fs.VMapFS) {
+	src := backupSource{
+		backupDir: manager.BackupDir(),
+		current: func() (*state.FSState, error) {
+			return vfs.Snapshot(), nil
+		},
+	}
+
+	ctl.Handle("backup.list", func(json.RawMessage) (interface{}, error) {
+		return state.ListBackups(src.backupDir)
+	})
+	ctl.Handle("backup.show", func(raw json.RawMessage) (interface{}, error) {
+		var params backupParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		return src.show(params.Name)
+	})
+	ctl.Handle("backup.diff", func(raw json.RawMessage) (interface{}, error) {
+		var params backupParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		return src.diff(params.From, params.To)
+	})
+	ctl.Handle("backup.restore", func(raw json.RawMessage) (interface{}, error) {
+		var params backupParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		restored, err := state.LoadBackup(src.backupDir, params.Name)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Restoring backup %s", params.Name)
+		return params.Name, vfs.ReplaceState("restore", restored)
+	})
+}
+
+// runBackup lists, shows, compares and restores state backups. While the
+// filesystem is mounted the commands go through the running instance, so a
+// restore takes effect immediately; otherwise they work on the files.
+func runBackup(args []string) int {
+	usage := "list|show|diff|restore -state FILE [NAME...]"
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: vmapfs backup %s\n", usage)
+		return exitError
+	}
+	action := args[0]
+
+	flags := newFlagSet("backup "+action, "-state FILE [NAME...]")
+	statePath := flags.String("state", "", "State file whose backups to use (required)")
+	journal := flags.Bool("journal", false, "The state file is journaled")
+	jsonOutput := flags.Bool("json", false, "Write the result as JSON")
+	verbose := flags.Bool("verbose", false, "Enable verbose logging")
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitError
+	}
+	setupCommandLogging(*verbose)
+
+	if *statePath == "" {
+		fmt.Fprintln(os.Stderr, "backup: -state is required")
+		flags.Usage()
+		return exitError
+	}
+	absState, err := filepath.Abs(*statePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %v\n", err)
+		return exitError
+	}
+	names := flags.Args()
+	socket := control.SocketPath(absState)
+	offline := backupSource{
+		backupDir: state.BackupDirFor(absState),
+		current: func() (*state.FSState, error) {
+			fsState, err := state.ReadState(absState)
+			if err == nil && *journal {
+				_, err = state.ReplayJournal(absState, fsState)
+			}
+			return fsState, err
+		},
+	}
+
+	switch {
+	case action == "list" && len(names) == 0:
+		var backups []state.Backup
+		err = control.Call(socket, "backup.list", nil, &backups)
+		if errors.Is(err, control.ErrNotRunning) {
+			backups, err = state.ListBackups(offline.backupDir)
+		}
+		if err == nil {
+			if *jsonOutput {
+				err = writeJSON(os.Stdout, backups)
+			} else {
+				printBackups(backups)
+			}
+		}
+
+	case action == "show" && len(names) == 1:
+		var data string
+		err = control.Call(socket, "backup.show", backupParams{Name: names[0]}, &data)
+		if errors.Is(err, control.ErrNotRunning) {
+			data, err = offline.show(names[0])
+		}
+		if err == nil {
+			fmt.Print(data)
+		}
+
+	case action == "diff" && (len(names) == 1 || len(names) == 2):
+		params := backupParams{From: names[0]}
+		if len(names) == 2 {
+			params.To = names[1]
+		}
+		var diff state.StateDiff
+		err = control.Call(socket, "backup.diff", params, &diff)
+		if errors.Is(err, control.ErrNotRunning) {
+			diff, err = offline.diff(params.From, params.To)
+		}
+		if err == nil {
+			if *jsonOutput {
+				err = writeJSON(os.Stdout, diff)
+			} else {
+				printStateDiff(os.Stdout, diff)
+			}
+		}
+
+	case action == "restore" && len(names) == 1:
+		err = control.Call(socket, "backup.restore", backupParams{Name: names[0]}, nil)
+		if errors.Is(err, control.ErrNotRunning) {
+			err = restoreBackup(absState, *journal, names[0])
+		}
+		if err == nil {
+			fmt.Printf("Restored %s\n", names[0])
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: vmapfs backup %s\n", usage)
+		fmt.Fprintln(os.Stderr, "  list              list backups, newest first")
+		fmt.Fprintln(os.Stderr, "  show NAME         print a backup")
+		fmt.Fprintln(os.Stderr, "  diff FROM [TO]    compare two backups, or a backup and the current state")
+		fmt.Fprintln(os.Stderr, "  restore NAME      replace the state with a backup")
+		fmt.Fprintln(os.Stderr, "NAME may be \"latest\"; diff also accepts \"current\".")
+		return exitError
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backup %s: %v\n", action, err)
+		return exitError
+	}
+	return exitOK
+}
+
+// restoreBackup replaces an unmounted state file with a backup. The state
+// being replaced is backed up first, so the restore can be undone. As when
+// restoring into a mounted instance, inode numbers are never reused.
+func restoreBackup(statePath string, journal bool, name string) error {
+	store, manager, err := openStore(statePath, journal, 0)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	restored, err := state.LoadBackup(manager.BackupDir(), name)
+	if err != nil {
+		return err
+	}
+	// Loading opens the journal, so that saving the snapshot clears it
+	current, err := store.LoadState()
+	if err != nil {
+		return err
+	}
+	// The backup does not know the inodes handed out since it was made,
+	// which must not be handed out again
+	if restored.NextInode < current.NextInode {
+		restored.NextInode = current.NextInode
+	}
+	restored.AssignInodes()
+	return store.SaveState(restored)
+}
+
+// printBackups writes the backup list as a table
+func printBackups(backups []state.Backup) {
+	if len(backups) == 0 {
+		fmt.Println("No backups")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTIME\tSIZE")
+	for _, backup := range backups {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", backup.Name, backup.Time.Format("2006-01-02 15:04:05"), backup.Size)
+	}
+	w.Flush()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"vmapfs/internal/state"
+)
+
+func TestRestoreBackupKeepsInodes(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	manager, err := state.NewManager(statePath)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	fsState, err := manager.LoadState()
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	fsState.Mappings["a.mkv"] = state.FileMapping{VirtualPaths: []string{"/a.mkv"}}
+	fsState.AssignInodes()
+	if err := manager.SaveState(fsState); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+	backupInode := fsState.Mappings["a.mkv"].Inode
+
+	// Saving again backs up the state with only a.mkv in it
+	fsState.Mappings["b.mkv"] = state.FileMapping{VirtualPaths: []string{"/b.mkv"}}
+	fsState.AssignInodes()
+	if err := manager.SaveState(fsState); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+	nextInode := fsState.NextInode
+	manager.Close()
+
+	if err := restoreBackup(statePath, false, "latest"); err != nil {
+		t.Fatalf("Failed to restore backup: %v", err)
+	}
+
+	restored, err := state.ReadState(statePath)
+	if err != nil {
+		t.Fatalf("Failed to read restored state: %v", err)
+	}
+	if _, exists := restored.Mappings["b.mkv"]; exists {
+		t.Errorf("Expected the backup without b.mkv to be restored, got %v", restored.Mappings)
+	}
+	if got := restored.Mappings["a.mkv"].Inode; got != backupInode {
+		t.Errorf("Expected a.mkv to keep inode %d, got %d", backupInode, got)
+	}
+	if restored.NextInode < nextInode {
+		t.Errorf("Expected NextInode of at least %d so that b.mkv's inode is not reused, got %d", nextInode, restored.NextInode)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"vmapfs/internal/logging"
+	"vmapfs/internal/state"
+)
+
+// Exit codes used by subcommands
+const (
+	exitOK       = 0 // Success, nothing to report
+	exitProblems = 1 // The command ran but found problems
+	exitError    = 2 // The command could not run
+)
+
+// command is a vmapfs subcommand, run as "vmapfs <name> [flags]"
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+// commands lists every subcommand. Running vmapfs without one mounts the
+// filesystem.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"fsck", "Check a state file against its source tree and optionally repair it", runFsck},
+		{"gc", "Drop mapping records that no longer carry any information", runGC},
+		{"backup", "List, show, compare and restore state backups", runBackup},
+		{"undo", "Undo the last operations of a running instance", runUndo},
+		{"redo", "Redo operations undone with vmapfs undo", runRedo},
+		{"audit", "Search the audit log of changes to the virtual tree", runAudit},
+		{"state", "Compare and three-way merge state files", runState},
+		{"export", "Write the mappings of a state as CSV, JSON lines or YAML", runExport},
+		{"import", "Merge or replace mappings from CSV, JSON lines or YAML", runImport},
+		{"adopt", "Turn a tree of symlinks into the source tree into mappings", runAdopt},
+		{"reconcile", "Fingerprint sources and relink mappings of sources that were renamed", runReconcile},
+		{"retarget", "Point a mapped virtual path at another source file", runRetarget},
+		{"rebase", "Rewrite source paths after the source tree's layout changed", runRebase},
+		{"apply", "Move source files so the source tree matches the virtual tree", runApply},
+		{"materialize", "Write the virtual tree to a directory of symlinks, hard links or copies", runMaterialize},
+	}
+}
+
+// runCommand runs the named subcommand and returns its exit code
+func runCommand(name string, args []string) int {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(args)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "vmapfs: unknown command %q\n\n", name)
+	printCommands()
+	return exitError
+}
+
+// printCommands writes the list of subcommands to stderr
+func printCommands() {
+	fmt.Fprintln(os.Stderr, "Usage: vmapfs -mount DIR -source DIR -state FILE [flags]")
+	fmt.Fprintln(os.Stderr, "       vmapfs <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+// newFlagSet creates the flag set for a subcommand
+func newFlagSet(name, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: vmapfs %s %s\n", name, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// setupCommandLogging keeps log messages out of a subcommand's output by
+// sending them to stderr, and only logs warnings unless verbose is set
+func setupCommandLogging(verbose bool) {
+	logger.SetOutput(os.Stderr)
+	if verbose {
+		logger.SetLevel(logging.LevelDebug)
+	} else {
+		logger.SetLevel(logging.LevelWarn)
+	}
+}
+
+// openStore locks the state file and wraps it in the requested store. It
+// also returns the underlying Manager, which the store closes.
+func openStore(statePath string, journal bool, compactEvery int) (state.Store, *state.Manager, error) {
+	manager, err := state.NewManager(statePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if journal {
+		logger.Info("Using journaled state storage")
+		return state.NewJournalStore(manager, compactEvery), manager, nil
+	}
+	return manager, manager, nil
+}
+
+// readState loads a state file for inspection as it is stored, without
+// registering missing directories or dropping empty records. The caller
+// should hold the state lock if it goes on to modify the state.
+func readState(statePath string, journal bool) (*state.FSState, error) {
+	fsState, err := state.ReadStateUnrepaired(statePath)
+	if err != nil {
+		return nil, err
+	}
+	if journal {
+		if _, err := state.ReplayJournal(statePath, fsState); err != nil {
+			return nil, err
+		}
+	}
+	return fsState, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"vmapfs/internal/control"
+	"vmapfs/internal/fs"
+	"vmapfs/internal/records"
+	"vmapfs/internal/state"
+)
+
+// importParams are the parameters of the state.import control method
+type importParams struct {
+	Records        []state.Record   `json:"records"`
+	Mode           state.ImportMode `json:"mode"`
+	DryRun         bool             `json:"dry_run,omitempty"`
+	SkipCollisions bool             `json:"skip_collisions,omitempty"`
+}
+
+// registerImportHandlers serves export and import from a mounted instance,
+// so that exports include unsaved changes and imports take effect at once
+func registerImportHandlers(ctl *control.Server, vfs *fs.VMapFS, sourceDir string) {
+	ctl.Handle("state.snapshot", func(json.RawMessage) (interface{}, error) {
+		return vfs.Snapshot(), nil
+	})
+	ctl.Handle("state.import", func(raw json.RawMessage) (interface{}, error) {
+		var params importParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		var report state.ImportReport
+		err := vfs.UpdateState("import", func(current *state.FSState) (*state.FSState, error) {
+			imported, result, err := current.Import(params.Records, importOptions(params, sourceDir))
+			report = result
+			if err != nil || params.DryRun || imported == nil {
+				return nil, err
+			}
+			logger.Info("Importing %d records (%s)", len(params.Records), params.Mode)
+			report.Applied = true
+			return imported, nil
+		})
+		return report, err
+	})
+}
+
+// importOptions returns the options for an import into the tree at sourceDir
+func importOptions(params importParams, sourceDir string) state.ImportOptions {
+	return state.ImportOptions{
+		Mode:           params.Mode,
+		SourceRoot:     sourceDir,
+		Reserved:       fs.ReservedNames,
+		SkipCollisions: params.SkipCollisions,
+	}
+}
+
+// runExport writes the mappings of a state as records, one per virtual
+// path, for editing in a spreadsheet or with jq
+func runExport(args []string) int {
+	flags := newFlagSet("export", "-state FILE [-format csv|jsonl|yaml] [-o FILE]")
+	statePath := flags.String("state", "", "State file to export (required)")
+	journal := flags.Bool("journal", false, "Include the state file's journal")
+	formatName := flags.String("format", "", "Output format: csv, jsonl or yaml (default from -o, else csv)")
+	output := flags.String("o", "", "Write to this file instead of stdout")
+	verbose := flags.Bool("verbose", false, "Enable verbose logging")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	setupCommandLogging(*verbose)
+
+	if *statePath == "" {
+		fmt.Fprintln(os.Stderr, "export: -state is required")
+		flags.Usage()
+		return exitError
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return exitError
+	}
+	format, err := resolveFormat(*formatName, *output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return exitError
+	}
+	absState, err := filepath.Abs(*statePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return exitError
+	}
+
+	var fsState *state.FSState
+	err = control.Call(control.SocketPath(absState), "state.snapshot", nil, &fsState)
+	if errors.Is(err, control.ErrNotRunning) {
+		fsState, err = readState(absState, *journal)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return exitError
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export: %v\n", err)
+			return exitError
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := records.Write(w, format, fsState.Records()); err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// runImport applies records to a state as a single change. Every record is
+// validated against the source tree; invalid records, and unless skipped
+// collisions, leave the state untouched.
+func runImport(args []string) int {
+	flags := newFlagSet("import", "-state FILE [-source DIR] [-mode merge|replace] [-format csv|jsonl|yaml] [-dry-run] [FILE]")
+	statePath := flags.String("state", "", "State file to import into (required)")
+	sourcePath := flags.String("source", "", "Source directory the state maps (required unless mounted)")
+	journal := flags.Bool("journal", false, "The state file is journaled")
+	mode := flags.String("mode", string(state.ImportMerge), "merge adds the records to the state, replace makes them the whole state")
+	formatName := flags.String("format", "", "Input format: csv, jsonl or yaml (default from the file name, else csv)")
+	dryRun := flags.Bool("dry-run", false, "Show what would change without changing anything")
+	skipCollisions := flags.Bool("skip-collisions", false, "Import the other records when some collide with existing paths")
+	jsonOutput := flags.Bool("json", false, "Write the report as JSON")
+	verbose := flags.Bool("verbose", false, "Enable verbose logging")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	setupCommandLogging(*verbose)
+
+	if *statePath == "" {
+		fmt.Fprintln(os.Stderr, "import: -state is required")
+		flags.Usage()
+		return exitError
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return exitError
+	}
+	inputPath := flags.Arg(0)
+	format, err := resolveFormat(*formatName, inputPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return exitError
+	}
+	absState, err := filepath.Abs(*statePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return exitError
+	}
+
+	input := io.Reader(os.Stdin)
+	if inputPath != "" && inputPath != "-" {
+		file, err := os.Open(inputPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "import: %v\n", err)
+			return exitError
+		}
+		defer file.Close()
+		input = file
+	}
+	recs, err := records.Read(input, format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return exitError
+	}
+
+	params := importParams{
+		Records:        recs,
+		Mode:           state.ImportMode(*mode),
+		DryRun:         *dryRun,
+		SkipCollisions: *skipCollisions,
+	}
+	report, err := applyImport(absState, *journal, *sourcePath, params)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return exitError
+	}
+
+	if *jsonOutput {
+		if err := writeJSON(os.Stdout, report); err != nil {
+			fmt.Fprintf(os.Stderr, "import: %v\n", err)
+			return exitError
+		}
+	} else {
+		printImportReport(os.Stdout, report, params)
+	}
+
+	if len(report.Invalid) > 0 || len(report.Collisions) > 0 {
+		return exitProblems
+	}
+	return exitOK
+}
+
+// applyImport imports records through the running instance, or into the
+// state file if the filesystem is not mounted
+func applyImport(statePath string, journal bool, sourcePath string, params importParams) (state.ImportReport, error) {
+	var report state.ImportReport
+	err := control.Call(control.SocketPath(statePath), "state.import", params, &report)
+	if !errors.Is(err, control.ErrNotRunning) {
+		return report, err
+	}
+	if sourcePath == "" {
+		return report, fmt.Errorf("-source is required when the filesystem is not mounted")
+	}
+	return importOffline(statePath, journal, filepath.Clean(sourcePath), params)
+}
+
+// importOffline imports records into an unmounted state file, holding its
+// lock unless nothing is written
+func importOffline(statePath string, journal bool, sourceDir string, params importParams) (state.ImportReport, error) {
+	var current *state.FSState
+	var store state.Store
+	var err error
+	if params.DryRun {
+		current, err = readState(statePath, journal)
+	} else {
+		store, _, err = openStore(statePath, journal, 0)
+		if err != nil {
+			return state.ImportReport{}, err
+		}
+		defer store.Close()
+		current, err = store.LoadState()
+	}
+	if err != nil {
+		return state.ImportReport{}, err
+	}
+
+	imported, report, err := current.Import(params.Records, importOptions(params, sourceDir))
+	if err != nil || params.DryRun || imported == nil {
+		return report, err
+	}
+	if err := store.SaveState(imported); err != nil {
+		return report, err
+	}
+	report.Applied = true
+	return report, nil
+}
+
+// resolveFormat returns the named format, or guesses it from a file name
+func resolveFormat(name, path string) (records.Format, error) {
+	if name != "" {
+		return records.ParseFormat(name)
+	}
+	if format, ok := records.FormatOf(path); ok {
+		return format, nil
+	}
+	return records.CSV, nil
+}
+
+// printImportReport writes a human readable import report
+func printImportReport(w io.Writer, report state.ImportReport, params importParams) {
+	fmt.Fprintf(w, "%d records (%s)\n", report.Records, report.Mode)
+	if len(report.Invalid) > 0 {
+		fmt.Fprintf(w, "%d invalid records:\n", len(report.Invalid))
+		for _, p := range report.Invalid {
+			fmt.Fprintf(w, "  %s\n", p)
+		}
+	}
+	if len(report.Collisions) > 0 {
+		fmt.Fprintf(w, "%d collisions:\n", len(report.Collisions))
+		for _, p := range report.Collisions {
+			fmt.Fprintf(w, "  %s\n", p)
+		}
+	}
+
+	switch {
+	case report.Applied:
+		fmt.Fprintln(w, "Imported:")
+	case params.DryRun && len(report.Invalid) == 0 && (len(report.Collisions) == 0 || params.SkipCollisions):
+		fmt.Fprintln(w, "Would change:")
+	default:
+		fmt.Fprintln(w, "Nothing imported")
+		if len(report.Invalid) == 0 {
+			fmt.Fprintln(w, "Resolve the collisions or use -skip-collisions")
+		}
+		return
+	}
+	printStateDiff(w, report.Changes)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"vmapfs/internal/state"
+)
+
+// fsckReport is the result of a check, as written by -json
+type fsckReport struct {
+	State    string          `json:"state"`
+	Source   string          `json:"source"`
+	Problems []state.Problem `json:"problems"`
+	Fixed    bool            `json:"fixed"`
+}
+
+// runFsck checks a state file against its source tree without mounting.
+// It exits with exitProblems if problems were found and not fixed.
+func runFsck(args []string) int {
+	flags := newFlagSet("fsck", "-state FILE -source DIR [-fix [-dry-run]] [-json]")
+	statePath := flags.String("state", "", "State file to check (required)")
+	sourcePath := flags.String("source", "", "Source directory the state maps (required)")
+	journal := flags.Bool("journal", false, "Include the state file's journal")
+	fix := flags.Bool("fix", false, "Repair the problems found")
+	dryRun := flags.Bool("dry-run", false, "With -fix, show the changes without writing them")
+	jsonOutput := flags.Bool("json", false, "Write the report as JSON")
+	verbose := flags.Bool("verbose", false, "Enable verbose logging")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	setupCommandLogging(*verbose)
+
+	if *statePath == "" || *sourcePath == "" {
+		fmt.Fprintln(os.Stderr, "fsck: -state and -source are required")
+		flags.Usage()
+		return exitError
+	}
+	sourceRoot := filepath.Clean(*sourcePath)
+	writeChanges := *fix && !*dryRun
+
+	// Hold the lock from the check to the fix, so a mounted filesystem
+	// can't change the state in between
+	var store state.Store
+	if writeChanges {
+		var err error
+		store, _, err = openStore(*statePath, *journal, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fsck: %v\n", err)
+			return exitError
+		}
+		defer store.Close()
+	}
+
+	fsState, err := readState(*statePath, *journal)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck: %v\n", err)
+		return exitError
+	}
+
+	problems, err := fsState.Check(sourceRoot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck: %v\n", err)
+		return exitError
+	}
+
+	report := fsckReport{
+		State:    *statePath,
+		Source:   sourceRoot,
+		Problems: problems,
+	}
+	if report.Problems == nil {
+		report.Problems = []state.Problem{}
+	}
+	if writeChanges && len(problems) > 0 {
+		if err := applyFixes(store, sourceRoot, problems); err != nil {
+			fmt.Fprintf(os.Stderr, "fsck: %v\n", err)
+			return exitError
+		}
+		report.Fixed = true
+	}
+
+	if *jsonOutput {
+		if err := writeJSON(os.Stdout, report); err != nil {
+			fmt.Fprintf(os.Stderr, "fsck: %v\n", err)
+			return exitError
+		}
+	} else {
+		printFsckReport(os.Stdout, report, *fix)
+	}
+
+	if len(problems) > 0 && !report.Fixed {
+		return exitProblems
+	}
+	return exitOK
+}
+
+// applyFixes repairs problems through store, which holds the state lock
+func applyFixes(store state.Store, sourceRoot string, problems []state.Problem) error {
+	// An unmounted remote usually shows up as an empty directory, which
+	// would make every mapping look stale
+	for _, p := range problems {
+		if p.Kind != state.ProblemMissingSource {
+			continue
+		}
+		entries, err := os.ReadDir(sourceRoot)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return fmt.Errorf("source root %s is empty, refusing to drop mappings (is it mounted?)", sourceRoot)
+		}
+		break
+	}
+
+	fsState, err := store.LoadState()
+	if err != nil {
+		return err
+	}
+	ops := state.FixOps(problems)
+	for _, op := range ops {
+		if err := fsState.Apply(op); err != nil {
+			return fmt.Errorf("failed to apply %s: %w", op, err)
+		}
+	}
+	return store.Record(func() *state.FSState { return fsState }, ops)
+}
+
+// printFsckReport writes a human readable report
+func printFsckReport(w io.Writer, report fsckReport, fix bool) {
+	if len(report.Problems) == 0 {
+		fmt.Fprintf(w, "%s: no problems found\n", report.State)
+		return
+	}
+
+	fmt.Fprintf(w, "%s: %d problems found\n", report.State, len(report.Problems))
+	for _, p := range report.Problems {
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+	if !fix {
+		return
+	}
+
+	ops := state.FixOps(report.Problems)
+	if report.Fixed {
+		fmt.Fprintf(w, "Applied %d changes:\n", len(ops))
+	} else {
+		fmt.Fprintf(w, "Would apply %d changes:\n", len(ops))
+	}
+	for _, op := range ops {
+		fmt.Fprintf(w, "  %s\n", op)
+	}
+}
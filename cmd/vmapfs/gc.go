@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"vmapfs/internal/state"
+)
+
+// runGC drops mapping records with neither virtual paths nor xattrs from a
+// state file. Loading a state already does this in memory; gc writes the
+// result back without having to mount.
+func runGC(args []string) int {
+	flags := newFlagSet("gc", "-state FILE [-dry-run]")
+	statePath := flags.String("state", "", "State file to compact (required)")
+	journal := flags.Bool("journal", false, "The state file is journaled")
+	dryRun := flags.Bool("dry-run", false, "List the records that would be dropped without writing")
+	verbose := flags.Bool("verbose", false, "Enable verbose logging")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	setupCommandLogging(*verbose)
+
+	if *statePath == "" {
+		fmt.Fprintln(os.Stderr, "gc: -state is required")
+		flags.Usage()
+		return exitError
+	}
+
+	var store state.Store
+	if !*dryRun {
+		var err error
+		store, _, err = openStore(*statePath, *journal, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gc: %v\n", err)
+			return exitError
+		}
+		defer store.Close()
+	}
+
+	fsState, err := readState(*statePath, *journal)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gc: %v\n", err)
+		return exitError
+	}
+	dropped := fsState.Compact()
+	for _, source := range dropped {
+		fmt.Printf("drop %s\n", source)
+	}
+
+	if len(dropped) == 0 {
+		fmt.Println("No empty records")
+		return exitOK
+	}
+	if *dryRun {
+		fmt.Printf("Would drop %d empty records\n", len(dropped))
+		return exitOK
+	}
+
+	// Loading compacts the state, so saving it writes the result
+	loaded, err := store.LoadState()
+	if err == nil {
+		err = store.SaveState(loaded)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gc: %v\n", err)
+		return exitError
+	}
+	fmt.Printf("Dropped %d empty records\n", len(dropped))
+	return exitOK
+}
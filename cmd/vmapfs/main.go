@@ -2,12 +2,17 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
+	"vmapfs/internal/audit"
+	"vmapfs/internal/control"
 	"vmapfs/internal/fs"
 	"vmapfs/internal/logging"
 	"vmapfs/internal/state"
@@ -21,11 +26,36 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	// Parse command line flags
 	mountPoint := flag.String("mount", "", "Mount point for virtual filesystem")
 	sourcePath := flag.String("source", "", "Source directory to map")
 	stateFile := flag.String("state", "", "State file path (required)")
 	verbose := flag.Bool("verbose", false, "Enable verbose logging")
+	saveDebounce := flag.Duration("save-debounce", 0, "Wait this long after the last change before saving state (0 saves after every change)")
+	journal := flag.Bool("journal", false, "Append changes to a journal next to the state file instead of rewriting it")
+	compactEvery := flag.Int("journal-compact-every", state.DefaultCompactEvery, "Fold the journal into the state file after this many changes")
+	saveMaxDelay := flag.Duration("save-max-delay", 5*time.Second, "Longest a pending change may wait to be saved when -save-debounce is set")
+	backupKeep := flag.Int("backup-keep", state.DefaultBackupPolicy.Keep, "Number of recent state backups to keep")
+	backupHourly := flag.Int("backup-hourly", 0, "Also keep the newest backup of each of this many recent hours")
+	backupDaily := flag.Int("backup-daily", 0, "Also keep the newest backup of each of this many recent days")
+	backupWeekly := flag.Int("backup-weekly", 0, "Also keep the newest backup of each of this many recent weeks")
+	backupCompress := flag.Bool("backup-compress", false, "Compress state backups with gzip")
+	historySize := flag.Int("history", fs.DefaultHistorySize, "Number of operations that can be undone (0 disables undo)")
+	auditPath := flag.String("audit-log", "", "Record every change to the virtual tree in this JSONL file")
+	auditMaxSize := flag.Int64("audit-max-size", audit.DefaultMaxSize, "Rotate the audit log once it exceeds this many bytes")
+	auditKeep := flag.Int("audit-keep", audit.DefaultKeep, "Number of rotated audit logs to keep")
+	reloadInterval := flag.Duration("reload-interval", fs.DefaultReloadInterval, "Check the state file for external edits this often (0 only reloads on SIGHUP)")
+	reconcileInterval := flag.Duration("reconcile-interval", 0, "Fingerprint sources and relink renamed ones this often (0 disables)")
+	retargetOnReplace := flag.Bool("retarget-on-replace", false, "Moving an _UNSORTED file onto a mapped file retargets the mapping to it instead of replacing it")
+	flag.Usage = func() {
+		printCommands()
+		fmt.Fprintln(os.Stderr, "\nMount flags:")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	// Configure logging based on flags
@@ -47,28 +77,77 @@ func main() {
 	cleanSource := filepath.Clean(*sourcePath)
 
 	logger.Info("Initializing state manager...")
-	stateManager, err := state.NewManager(*stateFile)
+	store, stateManager, err := openStore(*stateFile, *journal, *compactEvery)
 	if err != nil {
 		logger.Error("Failed to initialize state manager: %v", err)
 		os.Exit(1)
 	}
 
-	fsState, err := stateManager.LoadState()
+	// The backup policy is remembered, so only change it when asked to
+	if backupFlagsSet() {
+		if err := stateManager.SetBackupPolicy(state.BackupPolicy{
+			Keep:     *backupKeep,
+			Hourly:   *backupHourly,
+			Daily:    *backupDaily,
+			Weekly:   *backupWeekly,
+			Compress: *backupCompress,
+		}); err != nil {
+			logger.Error("Failed to set backup policy: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	fsState, err := store.LoadState()
 	if err != nil {
 		logger.Error("Failed to load state: %v", err)
 		os.Exit(1)
 	}
 
 	logger.Info("Creating virtual filesystem...")
-	vfs, err := fs.NewVMapFS(cleanSource, fsState, stateManager)
+	vfs, err := fs.NewVMapFS(cleanSource, fsState, store)
 	if err != nil {
 		logger.Error("Failed to create virtual filesystem: %v", err)
 		os.Exit(1)
 	}
+	vfs.SetSaveOptions(state.SaveOptions{
+		Debounce: *saveDebounce,
+		MaxDelay: *saveMaxDelay,
+	})
+
+	vfs.SetHistorySize(*historySize)
+	vfs.SetRetargetOnReplace(*retargetOnReplace)
+
+	var auditLog *audit.Log
+	if *auditPath != "" {
+		auditLog, err = audit.Open(*auditPath, *auditMaxSize, *auditKeep)
+		if err != nil {
+			logger.Error("Failed to open audit log: %v", err)
+			os.Exit(1)
+		}
+		logger.Info("Auditing changes to %s", *auditPath)
+		vfs.SetAuditLog(auditLog)
+	}
+	vfs.SetSnapshotDir(stateManager.BackupDir())
+	stopWatch := vfs.WatchState(stateManager, *reloadInterval)
+	stopReconciler := vfs.StartReconciler(*reconcileInterval)
+
+	ctl := control.NewServer(control.SocketPath(stateManager.Path()))
+	registerBackupHandlers(ctl, stateManager, vfs)
+	registerHistoryHandlers(ctl, vfs)
+	registerImportHandlers(ctl, vfs, cleanSource)
+	registerReconcileHandlers(ctl, vfs)
+	registerRetargetHandlers(ctl, vfs)
+	registerRebaseHandlers(ctl, vfs, cleanSource)
+	registerApplyHandlers(ctl, vfs, cleanSource)
+	if err := ctl.Listen(); err != nil {
+		logger.Warn("Commands cannot reach this instance: %v", err)
+	}
 
 	logger.Debug("Setting up signal handlers...")
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 
 	logger.Info("Mounting filesystem...")
 	c, err := fuse.Mount(cleanMount,
@@ -90,7 +169,9 @@ func main() {
 	go func() {
 		defer wg.Done()
 		logger.Info("Serving filesystem...")
-		if err := fusefs.Serve(c, vfs); err != nil {
+		server := fusefs.New(c, nil)
+		vfs.SetServer(server)
+		if err := server.Serve(vfs); err != nil {
 			logger.Error("FUSE server error: %v", err)
 		}
 		logger.Debug("FUSE server stopped")
@@ -107,6 +188,47 @@ func main() {
 		}
 	}()
 
+	// Reload the state file on SIGHUP
+	go func() {
+		for range hupChan {
+			logger.Info("Received SIGHUP, reloading state")
+			if err := vfs.Reload(true); err != nil {
+				logger.Error("Failed to reload state: %v", err)
+			}
+		}
+	}()
+
 	wg.Wait()
+	signal.Stop(hupChan)
+	stopWatch()
+	stopReconciler()
+	if err := ctl.Close(); err != nil {
+		logger.Warn("Failed to close control socket: %v", err)
+	}
+
+	logger.Debug("Flushing pending state changes...")
+	if err := vfs.Flush(); err != nil {
+		logger.Error("Failed to flush state: %v", err)
+		os.Exit(1)
+	}
+	if err := store.Close(); err != nil {
+		logger.Warn("Failed to release state file lock: %v", err)
+	}
+	if auditLog != nil {
+		if err := auditLog.Close(); err != nil {
+			logger.Warn("Failed to close audit log: %v", err)
+		}
+	}
 	logger.Info("Clean shutdown complete")
 }
+
+// backupFlagsSet returns true if any backup policy flag was given
+func backupFlagsSet() bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "backup-") {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"vmapfs/internal/control"
+	"vmapfs/internal/farm"
+	"vmapfs/internal/state"
+)
+
+// runMaterialize writes the virtual tree to a real directory of links or
+// copies, for hosts that cannot mount it. With -watch it keeps the
+// directory in sync with the state file until interrupted.
+func runMaterialize(args []string) int {
+	flags := newFlagSet("materialize", "-state FILE -source DIR -out DIR [-mode symlink|hardlink|copy] [-watch]")
+	statePath := flags.String("state", "", "State file to materialize (required)")
+	sourcePath := flags.String("source", "", "Source directory the state maps (required)")
+	outPath := flags.String("out", "", "Directory to write the virtual tree to (required)")
+	modeName := flags.String("mode", string(farm.ModeSymlink), "How to represent files: symlink, hardlink or copy")
+	journal := flags.Bool("journal", false, "Include the state file's journal")
+	dryRun := flags.Bool("dry-run", false, "Show what would change without changing anything")
+	watch := flags.Bool("watch", false, "Keep syncing whenever the state changes")
+	interval := flags.Duration("interval", 2*time.Second, "With -watch, how often to check the state for changes")
+	jsonOutput := flags.Bool("json", false, "Write the result as JSON")
+	verbose := flags.Bool("verbose", false, "Enable verbose logging")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	setupCommandLogging(*verbose)
+
+	if *statePath == "" || *sourcePath == "" || *outPath == "" {
+		fmt.Fprintln(os.Stderr, "materialize: -state, -source and -out are required")
+		flags.Usage()
+		return exitError
+	}
+	mode, err := farm.ParseMode(*modeName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "materialize: %v\n", err)
+		return exitError
+	}
+	absState, err := filepath.Abs(*statePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "materialize: %v\n", err)
+		return exitError
+	}
+
+	sync := func() (farm.SyncResult, error) {
+		var fsState *state.FSState
+		err := control.Call(control.SocketPath(absState), "state.snapshot", nil, &fsState)
+		if errors.Is(err, control.ErrNotRunning) {
+			fsState, err = readState(absState, *journal)
+		}
+		if err != nil {
+			return farm.SyncResult{}, err
+		}
+		return farm.Materialize(fsState, *sourcePath, *outPath, mode, *dryRun)
+	}
+
+	if !*watch {
+		result, err := sync()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "materialize: %v\n", err)
+			return exitError
+		}
+		if *jsonOutput {
+			if err := writeJSON(os.Stdout, result); err != nil {
+				fmt.Fprintf(os.Stderr, "materialize: %v\n", err)
+				return exitError
+			}
+		} else {
+			printSyncResult(result, *dryRun)
+		}
+		if len(result.Problems) > 0 {
+			return exitProblems
+		}
+		return exitOK
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	var lastStamp string
+	for {
+		if stamp := stateStamp(absState); stamp != lastStamp {
+			result, err := sync()
+			if err != nil {
+				logger.Error("Failed to materialize: %v", err)
+			} else {
+				lastStamp = stamp
+				if result.Changed() || len(result.Problems) > 0 {
+					fmt.Printf("%s %s\n", time.Now().Format("2006-01-02 15:04:05"), describeSyncResult(result))
+					for _, p := range result.Problems {
+						fmt.Printf("  %s\n", p)
+					}
+				}
+			}
+		}
+
+		select {
+		case <-sigChan:
+			return exitOK
+		case <-ticker.C:
+		}
+	}
+}
+
+// stateStamp identifies the saved version of a state file and its journal,
+// so that watching only syncs after a change
+func stateStamp(statePath string) string {
+	stamp := ""
+	for _, path := range []string{statePath, statePath + ".journal"} {
+		if info, err := os.Stat(path); err == nil {
+			stamp += fmt.Sprintf("%d:%d;", info.Size(), info.ModTime().UnixNano())
+		} else {
+			stamp += "-;"
+		}
+	}
+	return stamp
+}
+
+// printSyncResult writes a human readable summary of a materialize run
+func printSyncResult(result farm.SyncResult, dryRun bool) {
+	if len(result.Problems) > 0 {
+		fmt.Printf("%d paths not materialized:\n", len(result.Problems))
+		for _, p := range result.Problems {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+	if dryRun {
+		fmt.Printf("Would change: %s\n", describeSyncResult(result))
+	} else {
+		fmt.Println(describeSyncResult(result))
+	}
+}
+
+// describeSyncResult summarizes the counts of a materialize run
+func describeSyncResult(result farm.SyncResult) string {
+	return fmt.Sprintf("%d created, %d renamed, %d removed, %d unchanged",
+		result.Created, result.Renamed, result.Removed, result.Unchanged)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"vmapfs/internal/state"
+)
+
+// writeJSON writes v as indented JSON
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// printStateDiff writes a human readable diff, one line per added (+),
+// removed (-), moved (>) or modified (~) directory or mapping
+func printStateDiff(w io.Writer, diff state.StateDiff) {
+	if diff.Empty() {
+		fmt.Fprintln(w, "No differences")
+		return
+	}
+
+	for _, change := range diff.Directories {
+		marker := "+"
+		if change.Kind == state.ChangeRemoved {
+			marker = "-"
+		}
+		fmt.Fprintf(w, "%s dir %s\n", marker, change.Path)
+	}
+
+	for _, change := range diff.Mappings {
+		switch change.Kind {
+		case state.ChangeAdded:
+			fmt.Fprintf(w, "+ %s: %s\n", change.Source, describeMapping(*change.New))
+		case state.ChangeRemoved:
+			fmt.Fprintf(w, "- %s: %s\n", change.Source, describeMapping(*change.Old))
+		case state.ChangeMoved:
+			fmt.Fprintf(w, "> %s: %s -> %s\n", change.Source,
+				strings.Join(missingFrom(change.Old.VirtualPaths, change.New.VirtualPaths), ", "),
+				strings.Join(missingFrom(change.New.VirtualPaths, change.Old.VirtualPaths), ", "))
+		case state.ChangeModified:
+			fmt.Fprintf(w, "~ %s\n", change.Source)
+			for _, vpath := range missingFrom(change.Old.VirtualPaths, change.New.VirtualPaths) {
+				fmt.Fprintf(w, "    - %s\n", vpath)
+			}
+			for _, vpath := range missingFrom(change.New.VirtualPaths, change.Old.VirtualPaths) {
+				fmt.Fprintf(w, "    + %s\n", vpath)
+			}
+			for _, name := range changedXattrs(change.Old.Xattrs, change.New.Xattrs) {
+				fmt.Fprintf(w, "    ~ xattr %s\n", name)
+			}
+		}
+	}
+}
+
+// describeMapping summarizes a mapping's virtual paths and xattrs
+func describeMapping(mapping state.FileMapping) string {
+	parts := append([]string(nil), mapping.VirtualPaths...)
+	if len(parts) == 0 {
+		parts = append(parts, "(unmapped)")
+	}
+	if len(mapping.Xattrs) > 0 {
+		parts = append(parts, fmt.Sprintf("%d xattrs", len(mapping.Xattrs)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// missingFrom returns the entries of list that are not in other
+func missingFrom(list, other []string) []string {
+	present := make(map[string]bool, len(other))
+	for _, item := range other {
+		present[item] = true
+	}
+	var missing []string
+	for _, item := range list {
+		if !present[item] {
+			missing = append(missing, item)
+		}
+	}
+	return missing
+}
+
+// changedXattrs returns the names of xattrs that differ, sorted
+func changedXattrs(old, updated map[string][]byte) []string {
+	var names []string
+	for name, value := range old {
+		if newValue, exists := updated[name]; !exists || string(newValue) != string(value) {
+			names = append(names, name)
+		}
+	}
+	for name := range updated {
+		if _, exists := old[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
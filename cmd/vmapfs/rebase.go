@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"vmapfs/internal/control"
+	"vmapfs/internal/fs"
+	"vmapfs/internal/state"
+)
+
+// rebaseParams are the parameters of the state.rebase control method
+type rebaseParams struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	DryRun  bool   `json:"dry_run,omitempty"`
+	Partial bool   `json:"partial,omitempty"`
+}
+
+// rebaseOptions returns the options for a rebase against the tree at
+// sourceDir
+func rebaseOptions(params rebaseParams, sourceDir string) state.RebaseOptions {
+	return state.RebaseOptions{
+		From:       params.From,
+		To:         params.To,
+		SourceRoot: sourceDir,
+		Partial:    params.Partial,
+	}
+}
+
+// registerRebaseHandlers serves rebase from a mounted instance, so that a
+// changed source layout can be followed without unmounting
+func registerRebaseHandlers(ctl *control.Server, vfs *fs.VMapFS, sourceDir string) {
+	ctl.Handle("state.rebase", func(raw json.RawMessage) (interface{}, error) {
+		var params rebaseParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		var report state.RebaseReport
+		err := vfs.UpdateState("rebase", func(current *state.FSState) (*state.FSState, error) {
+			rebased, result, err := current.Rebase(rebaseOptions(params, sourceDir))
+			report = result
+			if err != nil || params.DryRun || rebased == nil {
+				return nil, err
+			}
+			logger.Info("Rebasing %d sources from %s to %s", len(result.Rebased), params.From, params.To)
+			report.Applied = true
+			return rebased, nil
+		})
+		return report, err
+	})
+}
+
+// runRebase rewrites the source paths under one prefix to another, after
+// the layout of the source tree changed
+func runRebase(args []string) int {
+	flags := newFlagSet("rebase", "-state FILE [-source DIR] -from PREFIX -to PREFIX [-dry-run] [-partial]")
+	statePath := flags.String("state", "", "State file to rebase (required)")
+	sourcePath := flags.String("source", "", "Source directory the state maps (required unless mounted)")
+	journal := flags.Bool("journal", false, "The state file is journaled")
+	from := flags.String("from", "", "Source path prefix to rewrite; segments may be glob patterns (required)")
+	to := flags.String("to", "", "Prefix that replaces the matched part of each source path")
+	dryRun := flags.Bool("dry-run", false, "Show what would change without changing anything")
+	partial := flags.Bool("partial", false, "Rebase the sources that can be when others are missing or collide")
+	jsonOutput := flags.Bool("json", false, "Write the report as JSON")
+	verbose := flags.Bool("verbose", false, "Enable verbose logging")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	setupCommandLogging(*verbose)
+
+	if *statePath == "" || *from == "" {
+		fmt.Fprintln(os.Stderr, "rebase: -state and -from are required")
+		flags.Usage()
+		return exitError
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return exitError
+	}
+	absState, err := filepath.Abs(*statePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rebase: %v\n", err)
+		return exitError
+	}
+
+	params := rebaseParams{From: *from, To: *to, DryRun: *dryRun, Partial: *partial}
+	var report state.RebaseReport
+	err = control.Call(control.SocketPath(absState), "state.rebase", params, &report)
+	if errors.Is(err, control.ErrNotRunning) {
+		if *sourcePath == "" {
+			err = fmt.Errorf("-source is required when the filesystem is not mounted")
+		} else {
+			report, err = rebaseOffline(absState, *journal, filepath.Clean(*sourcePath), params)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rebase: %v\n", err)
+		return exitError
+	}
+
+	if *jsonOutput {
+		if err := writeJSON(os.Stdout, report); err != nil {
+			fmt.Fprintf(os.Stderr, "rebase: %v\n", err)
+			return exitError
+		}
+	} else {
+		printRebaseReport(report, params)
+	}
+	if len(report.Missing) > 0 || len(report.Collisions) > 0 {
+		return exitProblems
+	}
+	return exitOK
+}
+
+// rebaseOffline rebases an unmounted state file, holding its lock unless
+// nothing is written
+func rebaseOffline(statePath string, journal bool, sourceDir string, params rebaseParams) (state.RebaseReport, error) {
+	var current *state.FSState
+	var store state.Store
+	var err error
+	if params.DryRun {
+		current, err = readState(statePath, journal)
+	} else {
+		store, _, err = openStore(statePath, journal, 0)
+		if err != nil {
+			return state.RebaseReport{}, err
+		}
+		defer store.Close()
+		current, err = store.LoadState()
+	}
+	if err != nil {
+		return state.RebaseReport{}, err
+	}
+
+	rebased, report, err := current.Rebase(rebaseOptions(params, sourceDir))
+	if err != nil || params.DryRun || rebased == nil {
+		return report, err
+	}
+	if err := store.SaveState(rebased); err != nil {
+		return report, err
+	}
+	report.Applied = true
+	return report, nil
+}
+
+// printRebaseReport writes a human readable rebase report
+func printRebaseReport(report state.RebaseReport, params rebaseParams) {
+	fmt.Printf("%d source paths match %s\n", report.Matched, report.From)
+	if len(report.Missing) > 0 {
+		fmt.Printf("%d new paths missing:\n", len(report.Missing))
+		for _, p := range report.Missing {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+	if len(report.Collisions) > 0 {
+		fmt.Printf("%d collisions:\n", len(report.Collisions))
+		for _, p := range report.Collisions {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+
+	problems := len(report.Missing) > 0 || len(report.Collisions) > 0
+	switch {
+	case report.Applied:
+		fmt.Printf("Rebased %d sources:\n", len(report.Rebased))
+	case len(report.Rebased) == 0:
+		fmt.Println("Nothing to rebase")
+		return
+	case params.DryRun && (!problems || params.Partial):
+		fmt.Printf("Would rebase %d sources:\n", len(report.Rebased))
+	default:
+		fmt.Println("Nothing rebased")
+		fmt.Println("Resolve the problems or use -partial")
+		return
+	}
+	for _, r := range report.Rebased {
+		fmt.Printf("  %s -> %s\n", r.Old, r.New)
+	}
+}
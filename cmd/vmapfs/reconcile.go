@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"vmapfs/internal/control"
+	"vmapfs/internal/fs"
+	"vmapfs/internal/state"
+)
+
+// reconcileParams are the parameters of the reconcile.run control method
+type reconcileParams struct {
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// registerReconcileHandlers serves reconcile passes and the report of the
+// last background pass from a mounted instance
+func registerReconcileHandlers(ctl *control.Server, vfs *fs.VMapFS) {
+	ctl.Handle("reconcile.run", func(raw json.RawMessage) (interface{}, error) {
+		var params reconcileParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		return vfs.Reconcile(params.DryRun)
+	})
+	ctl.Handle("reconcile.last", func(json.RawMessage) (interface{}, error) {
+		report := vfs.LastReconcile()
+		if report == nil {
+			return nil, fmt.Errorf("no reconcile pass has run yet")
+		}
+		return report, nil
+	})
+}
+
+// runReconcile fingerprints mapped sources and relinks the mappings of
+// sources that were renamed or moved by whatever manages the source tree
+func runReconcile(args []string) int {
+	flags := newFlagSet("reconcile", "-state FILE [-source DIR] [-dry-run] [-last]")
+	statePath := flags.String("state", "", "State file to reconcile (required)")
+	sourcePath := flags.String("source", "", "Source directory the state maps (required unless mounted)")
+	journal := flags.Bool("journal", false, "The state file is journaled")
+	dryRun := flags.Bool("dry-run", false, "Show what would be relinked without changing anything")
+	last := flags.Bool("last", false, "Show the report of the running instance's last pass instead")
+	jsonOutput := flags.Bool("json", false, "Write the report as JSON")
+	verbose := flags.Bool("verbose", false, "Enable verbose logging")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	setupCommandLogging(*verbose)
+
+	if *statePath == "" {
+		fmt.Fprintln(os.Stderr, "reconcile: -state is required")
+		flags.Usage()
+		return exitError
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return exitError
+	}
+	absState, err := filepath.Abs(*statePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reconcile: %v\n", err)
+		return exitError
+	}
+	socket := control.SocketPath(absState)
+
+	var report fs.ReconcileReport
+	if *last {
+		err = control.Call(socket, "reconcile.last", nil, &report)
+		if errors.Is(err, control.ErrNotRunning) {
+			err = fmt.Errorf("the filesystem is not mounted; only a running instance has a last pass")
+		}
+	} else {
+		err = control.Call(socket, "reconcile.run", reconcileParams{DryRun: *dryRun}, &report)
+		if errors.Is(err, control.ErrNotRunning) {
+			if *sourcePath == "" {
+				err = fmt.Errorf("-source is required when the filesystem is not mounted")
+			} else {
+				report, err = reconcileOffline(absState, *journal, filepath.Clean(*sourcePath), *dryRun)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reconcile: %v\n", err)
+		return exitError
+	}
+
+	if *jsonOutput {
+		if err := writeJSON(os.Stdout, report); err != nil {
+			fmt.Fprintf(os.Stderr, "reconcile: %v\n", err)
+			return exitError
+		}
+	} else {
+		printReconcileReport(report)
+	}
+	if len(report.Ambiguous) > 0 || len(report.Unmatched) > 0 {
+		return exitProblems
+	}
+	return exitOK
+}
+
+// reconcileOffline runs a reconcile pass on an unmounted state file,
+// holding its lock unless nothing is written
+func reconcileOffline(statePath string, journal bool, sourceDir string, dryRun bool) (fs.ReconcileReport, error) {
+	var current *state.FSState
+	var store state.Store
+	var err error
+	if dryRun {
+		current, err = readState(statePath, journal)
+	} else {
+		store, _, err = openStore(statePath, journal, 0)
+		if err != nil {
+			return fs.ReconcileReport{}, err
+		}
+		defer store.Close()
+		current, err = store.LoadState()
+	}
+	if err != nil {
+		return fs.ReconcileReport{}, err
+	}
+
+	vfs, err := fs.NewVMapFS(sourceDir, current, store)
+	if err != nil {
+		return fs.ReconcileReport{}, err
+	}
+	return vfs.Reconcile(dryRun)
+}
+
+// printReconcileReport writes a human readable reconcile report
+func printReconcileReport(report fs.ReconcileReport) {
+	fmt.Printf("%s: %d sources fingerprinted, %d orphaned\n",
+		report.Time.Local().Format("2006-01-02 15:04:05"), report.Fingerprinted, report.Orphaned)
+	if len(report.Relinked) > 0 {
+		if report.Applied {
+			fmt.Printf("Relinked %d sources:\n", len(report.Relinked))
+		} else {
+			fmt.Printf("Would relink %d sources:\n", len(report.Relinked))
+		}
+		for _, r := range report.Relinked {
+			fmt.Printf("  %s -> %s (%s)\n", r.Old, r.New, describeMapping(state.FileMapping{VirtualPaths: r.VirtualPaths}))
+		}
+	}
+	if len(report.Ambiguous) > 0 {
+		fmt.Printf("%d ambiguous matches:\n", len(report.Ambiguous))
+		for _, m := range report.Ambiguous {
+			fmt.Printf("  %s (%s) matches:\n", m.Source, describeMapping(state.FileMapping{VirtualPaths: m.VirtualPaths}))
+			for _, candidate := range m.Candidates {
+				fmt.Printf("    %s\n", candidate)
+			}
+		}
+	}
+	if len(report.Unmatched) > 0 {
+		fmt.Printf("%d orphaned sources without a match:\n", len(report.Unmatched))
+		for _, source := range report.Unmatched {
+			fmt.Printf("  %s\n", source)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"vmapfs/internal/control"
+	"vmapfs/internal/fs"
+	"vmapfs/internal/state"
+)
+
+// retargetParams are the parameters of the state.retarget and
+// state.source_history control methods
+type retargetParams struct {
+	Virtual string `json:"virtual"`
+	Source  string `json:"source,omitempty"`
+}
+
+// registerRetargetHandlers serves retargets and source histories from a
+// mounted instance
+func registerRetargetHandlers(ctl *control.Server, vfs *fs.VMapFS) {
+	ctl.Handle("state.retarget", func(raw json.RawMessage) (interface{}, error) {
+		var params retargetParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		return vfs.Retarget(fs.NewVirtualPath(params.Virtual), fs.NewSourcePath(params.Source))
+	})
+	ctl.Handle("state.source_history", func(raw json.RawMessage) (interface{}, error) {
+		var params retargetParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		return vfs.SourceHistory(fs.NewVirtualPath(params.Virtual))
+	})
+}
+
+// runRetarget points a mapped virtual path at another source file, such as
+// a better copy of it, or shows the sources it pointed at before
+func runRetarget(args []string) int {
+	flags := newFlagSet("retarget", "-state FILE [-source DIR] VIRTUAL SOURCE | -history VIRTUAL")
+	statePath := flags.String("state", "", "State file to change (required)")
+	sourcePath := flags.String("source", "", "Source directory the state maps (required unless mounted)")
+	journal := flags.Bool("journal", false, "The state file is journaled")
+	history := flags.Bool("history", false, "List the sources VIRTUAL pointed at before instead")
+	jsonOutput := flags.Bool("json", false, "Write the result as JSON")
+	verbose := flags.Bool("verbose", false, "Enable verbose logging")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	setupCommandLogging(*verbose)
+
+	if *statePath == "" {
+		fmt.Fprintln(os.Stderr, "retarget: -state is required")
+		flags.Usage()
+		return exitError
+	}
+	if (*history && flags.NArg() != 1) || (!*history && flags.NArg() != 2) {
+		flags.Usage()
+		return exitError
+	}
+	absState, err := filepath.Abs(*statePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "retarget: %v\n", err)
+		return exitError
+	}
+	socket := control.SocketPath(absState)
+	params := retargetParams{Virtual: fs.NewVirtualPath(flags.Arg(0)).String()}
+
+	var result interface{}
+	if *history {
+		var previous []state.PreviousSource
+		err = control.Call(socket, "state.source_history", params, &previous)
+		if errors.Is(err, control.ErrNotRunning) {
+			previous, err = sourceHistoryOffline(absState, *journal, params.Virtual)
+		}
+		if err == nil && !*jsonOutput {
+			printSourceHistory(params.Virtual, previous)
+		}
+		result = previous
+	} else {
+		params.Source = fs.NewSourcePath(flags.Arg(1)).String()
+		var retargeted fs.Retargeted
+		err = control.Call(socket, "state.retarget", params, &retargeted)
+		if errors.Is(err, control.ErrNotRunning) {
+			if *sourcePath == "" {
+				err = fmt.Errorf("-source is required when the filesystem is not mounted")
+			} else {
+				retargeted, err = retargetOffline(absState, *journal, filepath.Clean(*sourcePath), params)
+			}
+		}
+		if err == nil && !*jsonOutput {
+			printRetargeted(retargeted)
+		}
+		result = retargeted
+	}
+	if err == nil && *jsonOutput {
+		err = writeJSON(os.Stdout, result)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "retarget: %v\n", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// retargetOffline retargets a virtual path in an unmounted state file
+func retargetOffline(statePath string, journal bool, sourceDir string, params retargetParams) (fs.Retargeted, error) {
+	store, _, err := openStore(statePath, journal, 0)
+	if err != nil {
+		return fs.Retargeted{}, err
+	}
+	defer store.Close()
+	current, err := store.LoadState()
+	if err != nil {
+		return fs.Retargeted{}, err
+	}
+
+	vfs, err := fs.NewVMapFS(sourceDir, current, store)
+	if err != nil {
+		return fs.Retargeted{}, err
+	}
+	return vfs.Retarget(fs.NewVirtualPath(params.Virtual), fs.NewSourcePath(params.Source))
+}
+
+// sourceHistoryOffline reads the source history of a virtual path from an
+// unmounted state file
+func sourceHistoryOffline(statePath string, journal bool, vpath string) ([]state.PreviousSource, error) {
+	current, err := readState(statePath, journal)
+	if err != nil {
+		return nil, err
+	}
+	for _, mapping := range current.Mappings {
+		if mapping.HasVirtualPath(vpath) {
+			return mapping.History, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not mapped", vpath)
+}
+
+// printRetargeted writes a human readable description of a retarget
+func printRetargeted(r fs.Retargeted) {
+	fmt.Printf("Retargeted %s: %s -> %s\n", r.Virtual, r.Old, r.New)
+	if len(r.DroppedXattrs) > 0 {
+		fmt.Printf("  dropped xattrs of %s: %s\n", r.New, strings.Join(r.DroppedXattrs, ", "))
+	}
+}
+
+// printSourceHistory writes the sources a virtual path pointed at, oldest
+// first
+func printSourceHistory(vpath string, previous []state.PreviousSource) {
+	if len(previous) == 0 {
+		fmt.Printf("%s has not been retargeted\n", vpath)
+		return
+	}
+	for _, p := range previous {
+		fmt.Printf("%s  %s\n", p.Replaced.Local().Format("2006-01-02 15:04:05"), p.Source)
+	}
+}
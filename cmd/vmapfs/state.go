@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"vmapfs/internal/state"
+)
+
+// runState compares and merges state files, such as copies of the same
+// library organised on different machines
+func runState(args []string) int {
+	usage := "diff|merge [flags] FILE..."
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: vmapfs state %s\n", usage)
+		return exitError
+	}
+
+	switch args[0] {
+	case "diff":
+		return runStateDiff(args[1:])
+	case "merge":
+		return runStateMerge(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: vmapfs state %s\n", usage)
+		fmt.Fprintln(os.Stderr, "  diff FROM TO               show what changed from one state file to another")
+		fmt.Fprintln(os.Stderr, "  merge BASE OURS THEIRS     combine the changes OURS and THEIRS made to BASE")
+		return exitError
+	}
+}
+
+// runStateDiff shows the added, removed, moved and modified mappings and
+// directories between two state files
+func runStateDiff(args []string) int {
+	flags := newFlagSet("state diff", "[-json] FROM TO")
+	jsonOutput := flags.Bool("json", false, "Write the diff as JSON")
+	verbose := flags.Bool("verbose", false, "Enable verbose logging")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	setupCommandLogging(*verbose)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return exitError
+	}
+	states, err := readStates(flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "state diff: %v\n", err)
+		return exitError
+	}
+
+	diff := state.Diff(states[0], states[1])
+	if *jsonOutput {
+		if err := writeJSON(os.Stdout, diff); err != nil {
+			fmt.Fprintf(os.Stderr, "state diff: %v\n", err)
+			return exitError
+		}
+	} else {
+		printStateDiff(os.Stdout, diff)
+	}
+	return exitOK
+}
+
+// runStateMerge three-way merges state files. Conflicting changes keep
+// ours and are reported, so the merged state is always usable; the exit
+// status tells whether it needs a closer look.
+func runStateMerge(args []string) int {
+	flags := newFlagSet("state merge", "[-o FILE] [-json] BASE OURS THEIRS")
+	output := flags.String("o", "", "Write the merged state to this file instead of stdout")
+	jsonOutput := flags.Bool("json", false, "Report conflicts as JSON")
+	verbose := flags.Bool("verbose", false, "Enable verbose logging")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	setupCommandLogging(*verbose)
+
+	if flags.NArg() != 3 {
+		flags.Usage()
+		return exitError
+	}
+	states, err := readStates(flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "state merge: %v\n", err)
+		return exitError
+	}
+
+	merged, conflicts := state.Merge(states[0], states[1], states[2])
+	if *output != "" {
+		err = state.WriteState(*output, merged)
+	} else {
+		err = writeJSON(os.Stdout, merged)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "state merge: %v\n", err)
+		return exitError
+	}
+
+	// Conflicts go to stderr unless the merged state went to a file
+	report := os.Stderr
+	if *output != "" {
+		report = os.Stdout
+	}
+	if *jsonOutput {
+		if conflicts == nil {
+			conflicts = []state.Conflict{}
+		}
+		if err := writeJSON(report, conflicts); err != nil {
+			fmt.Fprintf(os.Stderr, "state merge: %v\n", err)
+			return exitError
+		}
+	} else {
+		for _, conflict := range conflicts {
+			fmt.Fprintf(report, "conflict %s\n", conflict)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		if !*jsonOutput {
+			fmt.Fprintf(report, "%d conflicts, kept ours\n", len(conflicts))
+		}
+		return exitProblems
+	}
+	return exitOK
+}
+
+// readStates reads the named state files
+func readStates(paths []string) ([]*state.FSState, error) {
+	states := make([]*state.FSState, len(paths))
+	for i, path := range paths {
+		fsState, err := state.ReadState(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		states[i] = fsState
+	}
+	return states, nil
+}
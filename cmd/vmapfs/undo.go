@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"vmapfs/internal/control"
+	"vmapfs/internal/fs"
+)
+
+// historyParams are the parameters of the history control methods
+type historyParams struct {
+	Count int `json:"count"`
+}
+
+// registerHistoryHandlers serves undo and redo from a mounted instance
+func registerHistoryHandlers(ctl *control.Server, vfs *fs.VMapFS) {
+	ctl.Handle("history.list", func(json.RawMessage) (interface{}, error) {
+		return vfs.History(), nil
+	})
+	ctl.Handle("history.undo", func(raw json.RawMessage) (interface{}, error) {
+		var params historyParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		logger.Info("Undoing %d operations", params.Count)
+		return vfs.Undo(params.Count)
+	})
+	ctl.Handle("history.redo", func(raw json.RawMessage) (interface{}, error) {
+		var params historyParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		logger.Info("Redoing %d operations", params.Count)
+		return vfs.Redo(params.Count)
+	})
+}
+
+// runUndo undoes the last operations made through the mount
+func runUndo(args []string) int {
+	return runHistory("undo", "history.undo", "Undid", args)
+}
+
+// runRedo repeats operations undone with vmapfs undo
+func runRedo(args []string) int {
+	return runHistory("redo", "history.redo", "Redid", args)
+}
+
+// runHistory undoes or redoes operations in the running instance. The
+// history lives in memory, so the filesystem has to be mounted.
+func runHistory(name, method, verb string, args []string) int {
+	flags := newFlagSet(name, "-state FILE [N]")
+	statePath := flags.String("state", "", "State file of the mounted filesystem (required)")
+	list := flags.Bool("list", false, "List the operations that can be undone instead")
+	jsonOutput := flags.Bool("json", false, "Write the result as JSON")
+	verbose := flags.Bool("verbose", false, "Enable verbose logging")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	setupCommandLogging(*verbose)
+
+	if *statePath == "" {
+		fmt.Fprintf(os.Stderr, "%s: -state is required\n", name)
+		flags.Usage()
+		return exitError
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return exitError
+	}
+	count := 1
+	if flags.NArg() == 1 {
+		n, err := strconv.Atoi(flags.Arg(0))
+		if err != nil || n < 1 {
+			fmt.Fprintf(os.Stderr, "%s: invalid count %q\n", name, flags.Arg(0))
+			return exitError
+		}
+		count = n
+	}
+	absState, err := filepath.Abs(*statePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return exitError
+	}
+	socket := control.SocketPath(absState)
+
+	var entries []fs.HistoryEntry
+	if *list {
+		err = control.Call(socket, "history.list", nil, &entries)
+	} else {
+		err = control.Call(socket, method, historyParams{Count: count}, &entries)
+	}
+	if errors.Is(err, control.ErrNotRunning) {
+		fmt.Fprintf(os.Stderr, "%s: the filesystem is not mounted; only a running instance has a history\n", name)
+		return exitError
+	}
+	if err == nil && *jsonOutput {
+		err = writeJSON(os.Stdout, entries)
+	} else if err == nil {
+		for _, entry := range entries {
+			if !*list {
+				fmt.Print(verb + " ")
+			}
+			printHistoryEntry(entry)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return exitError
+	}
+	return exitOK
+}
+
+// printHistoryEntry writes an entry as its time followed by its ops
+func printHistoryEntry(entry fs.HistoryEntry) {
+	fmt.Println(entry.Time.Format("2006-01-02 15:04:05"))
+	for _, op := range entry.Ops {
+		fmt.Printf("  %s\n", op)
+	}
+}
@@ -0,0 +1,244 @@
+// Package audit keeps a structured record of who changed what in the
+// virtual tree. Entries are written as JSON lines to a log file that is
+// rotated once it grows past a size limit.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"vmapfs/internal/logging"
+)
+
+var (
+	logger = logging.GetLogger().WithPrefix("audit")
+)
+
+// Default rotation limits
+const (
+	DefaultMaxSize = 10 << 20 // Rotate the log once it exceeds 10 MiB
+	DefaultKeep    = 5        // Keep this many rotated logs
+)
+
+// Entry is a single change to the virtual tree
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`
+	Path      string    `json:"path,omitempty"`       // Virtual path, the old one for moves
+	NewPath   string    `json:"new_path,omitempty"`   // New virtual path of moves
+	Source    string    `json:"source,omitempty"`     // Source path, relative to the source root
+	NewSource string    `json:"new_source,omitempty"` // New source path of relinks
+	Name      string    `json:"name,omitempty"`       // Xattr name
+	UID       uint32    `json:"uid"`
+	PID       uint32    `json:"pid"`
+	Via       string    `json:"via,omitempty"` // Command that made the change, empty for changes through the mount
+}
+
+// Log appends entries to an audit log file. When the file would grow past
+// MaxSize it is renamed to <path>.1, older logs shift up by one and the
+// oldest beyond Keep is deleted.
+type Log struct {
+	path    string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+	mu      sync.Mutex
+}
+
+// Open opens the audit log at path for appending. A maxSize or keep of zero
+// or less uses the defaults.
+func Open(path string, maxSize int64, keep int) (*Log, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if keep <= 0 {
+		keep = DefaultKeep
+	}
+	l := &Log{path: path, maxSize: maxSize, keep: keep}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	logger.Debug("Writing audit log to %s (rotating at %d bytes, keeping %d)", path, maxSize, keep)
+	return l, nil
+}
+
+// open opens the current log file, creating it if needed
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Write appends entries to the log, rotating it first if they don't fit
+func (l *Log) Write(entries ...Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var buf strings.Builder
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode audit entry: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return fmt.Errorf("audit log %s is closed", l.path)
+	}
+	if l.size > 0 && l.size+int64(buf.Len()) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.WriteString(buf.String())
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// rotate moves the current log aside and starts a new one. It must be
+// called with l.mu held.
+func (l *Log) rotate() error {
+	logger.Debug("Rotating audit log %s", l.path)
+	if err := l.file.Close(); err != nil {
+		logger.Warn("Failed to close audit log: %v", err)
+	}
+	l.file = nil
+
+	if err := os.Remove(rotatedPath(l.path, l.keep)); err != nil && !os.IsNotExist(err) {
+		logger.Warn("Failed to remove old audit log: %v", err)
+	}
+	for i := l.keep - 1; i >= 1; i-- {
+		if err := os.Rename(rotatedPath(l.path, i), rotatedPath(l.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+	if err := os.Rename(l.path, rotatedPath(l.path, 1)); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	return l.open()
+}
+
+// Close closes the log file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// rotatedPath returns the name of the n-th most recent rotated log
+func rotatedPath(path string, n int) string {
+	return path + "." + strconv.Itoa(n)
+}
+
+// Filter selects audit entries. The zero Filter matches every entry.
+type Filter struct {
+	Path  string    // Only changes at or below this virtual path
+	Since time.Time // Only changes at or after this time
+	UID   *uint32   // Only changes made by this user
+}
+
+// Match returns true if the entry passes the filter
+func (f Filter) Match(entry Entry) bool {
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if f.UID != nil && entry.UID != *f.UID {
+		return false
+	}
+	if f.Path != "" && f.Path != "/" {
+		prefix := strings.TrimSuffix(f.Path, "/")
+		return below(entry.Path, prefix) || below(entry.NewPath, prefix)
+	}
+	return true
+}
+
+// below returns true if vpath is dir or lies below it
+func below(vpath, dir string) bool {
+	return vpath == dir || strings.HasPrefix(vpath, dir+"/")
+}
+
+// Query returns the entries of the audit log at path and its rotated
+// predecessors that match filter, oldest first
+func Query(path string, filter Filter) ([]Entry, error) {
+	var files []string
+	for n := 1; ; n++ {
+		if _, err := os.Stat(rotatedPath(path, n)); err != nil {
+			break
+		}
+		files = append([]string{rotatedPath(path, n)}, files...)
+	}
+	files = append(files, path)
+
+	var entries []Entry
+	for _, name := range files {
+		matched, err := readEntries(name, filter)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, matched...)
+	}
+	return entries, nil
+}
+
+// readEntries reads the matching entries of a single log file. A missing
+// file has no entries; lines that don't parse, such as one torn by a
+// crash, are skipped.
+func readEntries(name string, filter Filter) ([]Entry, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			logger.Warn("Skipping invalid audit entry at %s:%d: %v", name, line, err)
+			continue
+		}
+		if filter.Match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return entries, nil
+}
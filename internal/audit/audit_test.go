@@ -0,0 +1,108 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := Open(path, 300, 2)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer log.Close()
+
+	base := time.Date(2024, 3, 20, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		entry := Entry{Time: base.Add(time.Duration(i) * time.Minute), Op: "mkdir", Path: "/movies", UID: 1000, PID: uint32(i)}
+		if err := log.Write(entry); err != nil {
+			t.Fatalf("Failed to write entry %d: %v", i, err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Expected %s to exist: %v", name, err)
+		}
+		if info.Size() > 300 {
+			t.Errorf("Expected %s to stay below the size limit, got %d bytes", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 rotated logs to be kept, got %v", err)
+	}
+
+	entries, err := Query(path, Filter{})
+	if err != nil {
+		t.Fatalf("Failed to query audit log: %v", err)
+	}
+	if len(entries) == 0 || len(entries) >= 10 {
+		t.Fatalf("Expected the oldest entries to be rotated out, got %d", len(entries))
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].PID != entries[i-1].PID+1 {
+			t.Fatalf("Expected entries oldest first, got PIDs %d then %d", entries[i-1].PID, entries[i].PID)
+		}
+	}
+	if last := entries[len(entries)-1].PID; last != 9 {
+		t.Errorf("Expected the newest entry last, got PID %d", last)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := Open(path, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+
+	base := time.Date(2024, 3, 20, 12, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Time: base, Op: "mkdir", Path: "/movies", UID: 1000},
+		{Time: base.Add(time.Hour), Op: "map", Path: "/movies/a.mkv", Source: "a.mkv", UID: 1001},
+		{Time: base.Add(2 * time.Hour), Op: "move", Path: "/movies/a.mkv", NewPath: "/tv/a.mkv", Source: "a.mkv", UID: 1000},
+		{Time: base.Add(3 * time.Hour), Op: "mkdir", Path: "/moviesextra", UID: 1000},
+	}
+	if err := log.Write(entries...); err != nil {
+		t.Fatalf("Failed to write entries: %v", err)
+	}
+	log.Close()
+
+	// A torn line at the end is skipped
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	file.WriteString(`{"time":"2024-03-`)
+	file.Close()
+
+	uid := uint32(1000)
+	tests := []struct {
+		name   string
+		filter Filter
+		ops    []string
+	}{
+		{"All", Filter{}, []string{"mkdir", "map", "move", "mkdir"}},
+		{"Path", Filter{Path: "/movies"}, []string{"mkdir", "map", "move"}},
+		{"NewPath", Filter{Path: "/tv/"}, []string{"move"}},
+		{"Since", Filter{Since: base.Add(90 * time.Minute)}, []string{"move", "mkdir"}},
+		{"UID", Filter{UID: &uid, Path: "/movies"}, []string{"mkdir", "move"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Query(path, tt.filter)
+			if err != nil {
+				t.Fatalf("Failed to query: %v", err)
+			}
+			if len(got) != len(tt.ops) {
+				t.Fatalf("Expected %d entries, got %+v", len(tt.ops), got)
+			}
+			for i, entry := range got {
+				if entry.Op != tt.ops[i] {
+					t.Errorf("Entry %d: expected %s, got %s", i, tt.ops[i], entry.Op)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+// Package control lets vmapfs commands talk to a running instance over a
+// Unix socket next to the state file. Each connection carries one JSON
+// request and one JSON response.
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"vmapfs/internal/logging"
+)
+
+var (
+	logger = logging.GetLogger().WithPrefix("control")
+)
+
+// ErrNotRunning indicates that no vmapfs instance is serving the socket
+var ErrNotRunning = errors.New("no running vmapfs instance")
+
+// callTimeout bounds how long a client waits for a response
+const callTimeout = 5 * time.Minute
+
+// Request is a call to a method of the running instance
+type Request struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Response is the result of a Request. Error is set if the call failed.
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// HandlerFunc serves a method. params holds the raw request parameters;
+// the returned value is encoded as the result.
+type HandlerFunc func(params json.RawMessage) (interface{}, error)
+
+// SocketPath returns the control socket path for a state file
+func SocketPath(statePath string) string {
+	return statePath + ".sock"
+}
+
+// Server serves control requests on a Unix socket
+type Server struct {
+	path     string
+	listener net.Listener
+	handlers map[string]HandlerFunc
+	wg       sync.WaitGroup
+	mu       sync.RWMutex
+}
+
+// NewServer creates a server for the socket at path. Handlers must be
+// registered before calling Listen.
+func NewServer(path string) *Server {
+	return &Server{
+		path:     path,
+		handlers: make(map[string]HandlerFunc),
+	}
+}
+
+// Handle registers fn to serve method
+func (s *Server) Handle(method string, fn HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method] = fn
+}
+
+// Listen creates the socket and starts serving requests in the background.
+// A socket left behind by an instance that has exited is replaced.
+func (s *Server) Listen() error {
+	if _, err := os.Lstat(s.path); err == nil {
+		if conn, dialErr := net.Dial("unix", s.path); dialErr == nil {
+			conn.Close()
+			return fmt.Errorf("control socket %s is in use", s.path)
+		}
+		logger.Debug("Removing stale control socket: %s", s.path)
+		if err := os.Remove(s.path); err != nil {
+			return fmt.Errorf("failed to remove stale control socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	if err := os.Chmod(s.path, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict control socket: %w", err)
+	}
+	s.listener = listener
+
+	logger.Debug("Serving control requests on %s", s.path)
+	s.wg.Add(1)
+	go s.serve()
+	return nil
+}
+
+// serve accepts connections until the listener is closed
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error("Control socket accept failed: %v", err)
+			}
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// handle serves the single request on conn
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		logger.Warn("Invalid control request: %v", err)
+		return
+	}
+
+	s.mu.RLock()
+	fn, exists := s.handlers[req.Method]
+	s.mu.RUnlock()
+
+	var resp Response
+	if !exists {
+		resp.Error = fmt.Sprintf("unknown method %q", req.Method)
+	} else {
+		logger.Debug("Control request: %s", req.Method)
+		result, err := fn(req.Params)
+		if err != nil {
+			resp.Error = err.Error()
+		} else if resp.Result, err = json.Marshal(result); err != nil {
+			resp.Error = fmt.Sprintf("failed to encode result: %v", err)
+		}
+	}
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		logger.Warn("Failed to send control response: %v", err)
+	}
+}
+
+// Close stops serving, waits for requests in progress and removes the socket
+func (s *Server) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	s.wg.Wait()
+	s.listener = nil
+	return err
+}
+
+// Call invokes method on the instance serving the socket at path, decoding
+// its result into result if it is not nil. It returns ErrNotRunning if no
+// instance is listening.
+func Call(path, method string, params, result interface{}) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+			return ErrNotRunning
+		}
+		return fmt.Errorf("failed to connect to control socket: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(callTimeout)); err != nil {
+		return err
+	}
+
+	req := Request{Method: method}
+	if params != nil {
+		if req.Params, err = json.Marshal(params); err != nil {
+			return fmt.Errorf("failed to encode parameters: %w", err)
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if result != nil && len(resp.Result) > 0 {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
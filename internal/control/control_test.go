@@ -0,0 +1,65 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestCall(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json.sock")
+
+	if err := Call(path, "echo", nil, nil); !errors.Is(err, ErrNotRunning) {
+		t.Fatalf("Expected ErrNotRunning without a server, got %v", err)
+	}
+
+	server := NewServer(path)
+	server.Handle("echo", func(raw json.RawMessage) (interface{}, error) {
+		var params map[string]string
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		return params["text"], nil
+	})
+	server.Handle("fail", func(json.RawMessage) (interface{}, error) {
+		return nil, fmt.Errorf("it broke")
+	})
+	if err := server.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	var echoed string
+	if err := Call(path, "echo", map[string]string{"text": "hello"}, &echoed); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	if echoed != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", echoed)
+	}
+
+	if err := Call(path, "fail", nil, nil); err == nil || err.Error() != "it broke" {
+		t.Errorf("Expected handler error to be returned, got %v", err)
+	}
+	if err := Call(path, "missing", nil, nil); err == nil {
+		t.Error("Expected an error for an unknown method")
+	}
+
+	if err := NewServer(path).Listen(); err == nil {
+		t.Error("Expected a second server on a live socket to be refused")
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatalf("Failed to close server: %v", err)
+	}
+	if err := Call(path, "echo", nil, nil); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Expected ErrNotRunning after Close, got %v", err)
+	}
+
+	// A new instance can take over once the old one has closed
+	restarted := NewServer(path)
+	if err := restarted.Listen(); err != nil {
+		t.Fatalf("Failed to listen on a stale socket: %v", err)
+	}
+	restarted.Close()
+}
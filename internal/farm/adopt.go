@@ -0,0 +1,176 @@
+// Package farm converts between the virtual tree and real directory trees
+// of links to the source files, as used by setups that predate vmapfs or
+// hosts that cannot mount it.
+package farm
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"vmapfs/internal/logging"
+	"vmapfs/internal/state"
+)
+
+var (
+	logger = logging.GetLogger().WithPrefix("farm")
+)
+
+// LinkProblemKind identifies why an entry of a tree cannot be adopted
+type LinkProblemKind string
+
+// Problems reported by Adopt
+const (
+	LinkOutsideSource LinkProblemKind = "outside_source" // Link points outside the source root
+	LinkBroken        LinkProblemKind = "broken"         // Link target does not exist
+	LinkDirectory     LinkProblemKind = "directory"      // Link points to a directory
+	LinkNotLink       LinkProblemKind = "not_a_link"     // Entry is a regular file or special file
+)
+
+// LinkProblem is an entry of a tree that Adopt could not turn into a mapping
+type LinkProblem struct {
+	Kind   LinkProblemKind `json:"kind"`
+	Link   string          `json:"link"`
+	Target string          `json:"target,omitempty"`
+	Detail string          `json:"detail"`
+}
+
+// String returns a short human readable description of the problem
+func (p LinkProblem) String() string {
+	if p.Target == "" {
+		return fmt.Sprintf("%s: %s (%s)", p.Kind, p.Link, p.Detail)
+	}
+	return fmt.Sprintf("%s: %s -> %s (%s)", p.Kind, p.Link, p.Target, p.Detail)
+}
+
+// Adoption is the result of walking a tree of symlinks
+type Adoption struct {
+	// Records map each usable link's place in the tree to its source, and
+	// register every directory of the tree
+	Records  []state.Record `json:"records"`
+	Problems []LinkProblem  `json:"problems"`
+	Links    int            `json:"links"`
+}
+
+// Adopt walks tree and resolves every symlink in it to a file under
+// sourceRoot. The tree's layout becomes the virtual layout: a link at
+// tree/movies/a.mkv becomes the virtual path /movies/a.mkv. Links are
+// resolved relative to their directory, and links that only reach the
+// source root through other symlinks, such as links into the tree itself,
+// are followed. Entries that can't be adopted are reported as problems.
+func Adopt(tree, sourceRoot string) (*Adoption, error) {
+	// Absolute link targets are compared against an absolute source root
+	tree, err := filepath.Abs(tree)
+	if err != nil {
+		return nil, err
+	}
+	if sourceRoot, err = filepath.Abs(sourceRoot); err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(tree); err != nil {
+		return nil, fmt.Errorf("cannot read tree: %w", err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("tree %s is not a directory", tree)
+	}
+	realRoot, err := filepath.EvalSymlinks(sourceRoot)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve source root: %w", err)
+	}
+
+	adoption := &Adoption{Problems: []LinkProblem{}}
+	err = filepath.WalkDir(tree, func(linkPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(tree, linkPath)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		vpath := path.Join("/", filepath.ToSlash(rel))
+
+		switch {
+		case entry.IsDir():
+			adoption.Records = append(adoption.Records, state.Record{Path: vpath})
+			return nil
+		case entry.Type()&fs.ModeSymlink == 0:
+			adoption.Problems = append(adoption.Problems, LinkProblem{
+				Kind:   LinkNotLink,
+				Link:   linkPath,
+				Detail: "not a symlink",
+			})
+			return nil
+		}
+
+		adoption.Links++
+		source, problem := resolveLink(linkPath, sourceRoot, realRoot)
+		if problem != nil {
+			adoption.Problems = append(adoption.Problems, *problem)
+			return nil
+		}
+		logger.Debug("Adopting %s -> %s", vpath, source)
+		adoption.Records = append(adoption.Records, state.Record{Source: source, Path: vpath})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk tree: %w", err)
+	}
+	return adoption, nil
+}
+
+// resolveLink returns the source path a symlink refers to, relative to the
+// source root, or the problem that prevents adopting it
+func resolveLink(linkPath, sourceRoot, realRoot string) (string, *LinkProblem) {
+	target, err := os.Readlink(linkPath)
+	if err != nil {
+		return "", &LinkProblem{Kind: LinkBroken, Link: linkPath, Detail: err.Error()}
+	}
+	problem := func(kind LinkProblemKind, detail string) (string, *LinkProblem) {
+		return "", &LinkProblem{Kind: kind, Link: linkPath, Target: target, Detail: detail}
+	}
+
+	// Prefer the target as written, so that a source root reached through
+	// a symlink of its own still matches
+	resolved := target
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(filepath.Dir(linkPath), resolved)
+	}
+	source, inside := within(sourceRoot, filepath.Clean(resolved))
+	if !inside {
+		real, err := filepath.EvalSymlinks(linkPath)
+		switch {
+		case os.IsNotExist(err):
+			return problem(LinkBroken, "target does not exist")
+		case err != nil:
+			return problem(LinkBroken, err.Error())
+		}
+		if source, inside = within(realRoot, real); !inside {
+			return problem(LinkOutsideSource, "target is outside the source root")
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(sourceRoot, source))
+	switch {
+	case os.IsNotExist(err):
+		return problem(LinkBroken, "target does not exist")
+	case err != nil:
+		return problem(LinkBroken, err.Error())
+	case info.IsDir():
+		return problem(LinkDirectory, "target is a directory")
+	}
+	return source, nil
+}
+
+// within returns target relative to root, and whether it lies below root
+func within(root, target string) (string, bool) {
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
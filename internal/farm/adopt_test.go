@@ -0,0 +1,75 @@
+package farm
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"vmapfs/internal/state"
+)
+
+func TestAdopt(t *testing.T) {
+	base := t.TempDir()
+	sourceRoot := filepath.Join(base, "source")
+	tree := filepath.Join(base, "library")
+	outside := filepath.Join(base, "outside.mkv")
+	for _, dir := range []string{filepath.Join(sourceRoot, "all", "show"), filepath.Join(tree, "movies"), filepath.Join(tree, "tv"), filepath.Join(tree, "empty")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+	}
+	for _, file := range []string{filepath.Join(sourceRoot, "all", "a.mkv"), filepath.Join(sourceRoot, "all", "b.mkv"), outside, filepath.Join(tree, "notes.txt")} {
+		if err := os.WriteFile(file, []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+	links := map[string]string{
+		"movies/a.mkv":     filepath.Join(sourceRoot, "all", "a.mkv"),
+		"movies/b.mkv":     "../../source/all/b.mkv",
+		"tv/again.mkv":     "../movies/a.mkv",
+		"movies/gone.mkv":  filepath.Join(sourceRoot, "all", "gone.mkv"),
+		"movies/other.mkv": outside,
+		"tv/show":          filepath.Join(sourceRoot, "all", "show"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(tree, link)); err != nil {
+			t.Fatalf("Failed to create link: %v", err)
+		}
+	}
+
+	adoption, err := Adopt(tree, sourceRoot)
+	if err != nil {
+		t.Fatalf("Adopt failed: %v", err)
+	}
+
+	expected := []state.Record{
+		{Path: "/empty"},
+		{Path: "/movies"},
+		{Source: "all/a.mkv", Path: "/movies/a.mkv"},
+		{Source: "all/b.mkv", Path: "/movies/b.mkv"},
+		{Path: "/tv"},
+		{Source: "all/a.mkv", Path: "/tv/again.mkv"},
+	}
+	if !reflect.DeepEqual(adoption.Records, expected) {
+		t.Errorf("Unexpected records:\nexpected %+v\ngot      %+v", expected, adoption.Records)
+	}
+
+	problems := make(map[string]LinkProblemKind)
+	for _, p := range adoption.Problems {
+		rel, _ := filepath.Rel(tree, p.Link)
+		problems[rel] = p.Kind
+	}
+	expectedProblems := map[string]LinkProblemKind{
+		"movies/gone.mkv":  LinkBroken,
+		"movies/other.mkv": LinkOutsideSource,
+		"tv/show":          LinkDirectory,
+		"notes.txt":        LinkNotLink,
+	}
+	if !reflect.DeepEqual(problems, expectedProblems) {
+		t.Errorf("Expected problems %v, got %v", expectedProblems, problems)
+	}
+	if adoption.Links != len(links) {
+		t.Errorf("Expected %d links, got %d", len(links), adoption.Links)
+	}
+}
@@ -0,0 +1,470 @@
+package farm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"vmapfs/internal/state"
+)
+
+// Mode is how Materialize represents a source file in the output tree
+type Mode string
+
+// Materialize modes
+const (
+	ModeSymlink  Mode = "symlink"  // Absolute symlink to the source file
+	ModeHardlink Mode = "hardlink" // Hard link, the output must be on the source's filesystem
+	ModeCopy     Mode = "copy"     // Independent copy of the source file
+)
+
+// ParseMode returns the named mode
+func ParseMode(name string) (Mode, error) {
+	switch mode := Mode(name); mode {
+	case ModeSymlink, ModeHardlink, ModeCopy:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown mode %q (want symlink, hardlink or copy)", name)
+}
+
+// ManifestName is the file in the output directory that lists what
+// Materialize created there
+const ManifestName = ".vmapfs-materialized.json"
+
+// manifest records the files and directories Materialize created, so that
+// later runs only change those
+type manifest struct {
+	Files map[string]manifestEntry `json:"files"`
+	Dirs  []string                 `json:"dirs"`
+}
+
+// manifestEntry identifies a created file, so that a file replaced or
+// edited by someone else is recognised and left alone
+type manifestEntry struct {
+	Source  string    `json:"source"`
+	Mode    Mode      `json:"mode"`
+	Inode   uint64    `json:"inode,omitempty"`
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mod_time,omitempty"`
+}
+
+// SyncProblem is a virtual path Materialize could not bring up to date
+type SyncProblem struct {
+	Path   string `json:"path"`
+	Detail string `json:"detail"`
+}
+
+// String returns a short human readable description of the problem
+func (p SyncProblem) String() string {
+	return fmt.Sprintf("%s (%s)", p.Path, p.Detail)
+}
+
+// SyncResult counts what Materialize changed
+type SyncResult struct {
+	Created   int           `json:"created"`
+	Renamed   int           `json:"renamed"`
+	Removed   int           `json:"removed"`
+	Unchanged int           `json:"unchanged"`
+	Problems  []SyncProblem `json:"problems"`
+}
+
+// Changed returns true if the run changed the output tree
+func (r SyncResult) Changed() bool {
+	return r.Created+r.Renamed+r.Removed > 0
+}
+
+// materializer holds the state of a single Materialize run
+type materializer struct {
+	out        string
+	sourceRoot string
+	mode       Mode
+	dryRun     bool
+	manifest   manifest
+	removed    map[string]bool // Files removed or renamed away by this run
+	result     SyncResult
+}
+
+// Materialize writes the virtual tree of fsState to the directory out as
+// real files pointing at the source files under sourceRoot. It works
+// incrementally: files created by earlier runs are kept if they are still
+// right, renamed if their source moved and removed if it was unmapped.
+// Files it did not create, or that were changed since, are never touched;
+// virtual paths taken by such files are reported as problems. With dryRun
+// nothing is changed and the result says what would be.
+func Materialize(fsState *state.FSState, sourceRoot, out string, mode Mode, dryRun bool) (_ SyncResult, err error) {
+	m := &materializer{
+		out:        out,
+		sourceRoot: sourceRoot,
+		mode:       mode,
+		dryRun:     dryRun,
+		removed:    make(map[string]bool),
+		result:     SyncResult{Problems: []SyncProblem{}},
+	}
+	if m.sourceRoot, err = filepath.Abs(sourceRoot); err != nil {
+		return m.result, err
+	}
+	if err := m.loadManifest(); err != nil {
+		return m.result, err
+	}
+	if !dryRun {
+		if err := os.MkdirAll(out, 0755); err != nil {
+			return m.result, err
+		}
+		// Whatever was changed before an error has to be in the manifest,
+		// or the next run would take it for files it did not create
+		defer func() {
+			if saveErr := m.saveManifest(); err == nil {
+				err = saveErr
+			}
+		}()
+	}
+
+	wanted := make(map[string]string)
+	for source, mapping := range fsState.Mappings {
+		for _, vpath := range mapping.VirtualPaths {
+			wanted[strings.TrimPrefix(vpath, "/")] = source
+		}
+	}
+
+	// Files created earlier that no longer match are removed, or renamed
+	// to where their source is wanted now
+	stale := make(map[string][]string)
+	for _, rel := range sortedKeys(m.manifest.Files) {
+		entry := m.manifest.Files[rel]
+		if !m.owned(rel, entry) {
+			logger.Warn("Leaving %s alone, it was changed since it was created", rel)
+			delete(m.manifest.Files, rel)
+			continue
+		}
+		if wanted[rel] == entry.Source && entry.Mode == mode && m.current(entry) {
+			m.result.Unchanged++
+			continue
+		}
+		// Files in the way of another source are removed right away
+		if _, taken := wanted[rel]; entry.Mode == mode && !taken {
+			stale[entry.Source] = append(stale[entry.Source], rel)
+		} else if err := m.remove(rel); err != nil {
+			return m.result, err
+		}
+	}
+
+	for _, dir := range sortedKeys(fsState.Directories) {
+		if err := m.mkdirAll(strings.TrimPrefix(dir, "/")); err != nil {
+			m.problem(strings.TrimPrefix(dir, "/"), err.Error())
+		}
+	}
+
+	for _, rel := range sortedKeys(wanted) {
+		source := wanted[rel]
+		if _, exists := m.manifest.Files[rel]; exists && !m.removed[rel] {
+			continue
+		}
+		if rel == ManifestName {
+			m.problem(rel, "name is used by the manifest")
+			continue
+		}
+
+		var err error
+		if candidates := stale[source]; len(candidates) > 0 && m.free(rel) {
+			stale[source] = candidates[1:]
+			err = m.rename(candidates[0], rel)
+		} else {
+			err = m.create(rel, source)
+		}
+		if err != nil {
+			return m.result, err
+		}
+	}
+
+	for _, rels := range stale {
+		for _, rel := range rels {
+			if err := m.remove(rel); err != nil {
+				return m.result, err
+			}
+		}
+	}
+	m.pruneDirs(fsState)
+	return m.result, nil
+}
+
+// problem reports a virtual path that could not be materialized
+func (m *materializer) problem(rel, detail string) {
+	m.result.Problems = append(m.result.Problems, SyncProblem{Path: "/" + rel, Detail: detail})
+}
+
+// owned returns true if the file at rel is still the one recorded in entry
+func (m *materializer) owned(rel string, entry manifestEntry) bool {
+	info, err := os.Lstat(filepath.Join(m.out, rel))
+	if err != nil {
+		return false
+	}
+	switch entry.Mode {
+	case ModeSymlink:
+		target, err := os.Readlink(filepath.Join(m.out, rel))
+		return err == nil && target == filepath.Join(m.sourceRoot, entry.Source)
+	case ModeHardlink:
+		return info.Mode().IsRegular() && inodeOf(info) == entry.Inode
+	case ModeCopy:
+		return info.Mode().IsRegular() && info.Size() == entry.Size && info.ModTime().Equal(entry.ModTime)
+	}
+	return false
+}
+
+// current returns true if the file recorded in entry still reflects its
+// source: hard links and copies go stale when the source file is replaced
+// or changed
+func (m *materializer) current(entry manifestEntry) bool {
+	if entry.Mode == ModeSymlink {
+		return true
+	}
+	info, err := os.Stat(filepath.Join(m.sourceRoot, entry.Source))
+	if err != nil {
+		return false
+	}
+	if entry.Mode == ModeHardlink {
+		return inodeOf(info) == entry.Inode
+	}
+	return info.Size() == entry.Size && info.ModTime().Equal(entry.ModTime)
+}
+
+// free returns true if nothing exists at rel, or would not in a dry run
+func (m *materializer) free(rel string) bool {
+	if m.removed[rel] {
+		return true
+	}
+	_, err := os.Lstat(filepath.Join(m.out, rel))
+	return os.IsNotExist(err)
+}
+
+// create makes the file for source at rel, unless something is in the way
+func (m *materializer) create(rel, source string) error {
+	target := filepath.Join(m.out, rel)
+	sourcePath := filepath.Join(m.sourceRoot, source)
+	if !m.free(rel) {
+		m.problem(rel, "exists and was not created by vmapfs")
+		return nil
+	}
+	if _, err := os.Stat(sourcePath); err != nil {
+		m.problem(rel, fmt.Sprintf("source %s is not available", source))
+		return nil
+	}
+	if m.dryRun {
+		m.result.Created++
+		return nil
+	}
+
+	if err := m.mkdirAll(path.Dir(rel)); err != nil {
+		m.problem(rel, err.Error())
+		return nil
+	}
+	var err error
+	switch m.mode {
+	case ModeSymlink:
+		err = os.Symlink(sourcePath, target)
+	case ModeHardlink:
+		err = os.Link(sourcePath, target)
+		if errors.Is(err, syscall.EXDEV) {
+			err = fmt.Errorf("cannot hard link across filesystems, use another mode")
+		}
+	case ModeCopy:
+		err = copyFile(sourcePath, target)
+	}
+	if err != nil {
+		m.problem(rel, err.Error())
+		return nil
+	}
+
+	entry, err := m.entryFor(rel, source)
+	if err != nil {
+		return err
+	}
+	m.manifest.Files[rel] = entry
+	m.result.Created++
+	return nil
+}
+
+// entryFor records the file just created at rel
+func (m *materializer) entryFor(rel, source string) (manifestEntry, error) {
+	entry := manifestEntry{Source: source, Mode: m.mode}
+	info, err := os.Lstat(filepath.Join(m.out, rel))
+	if err != nil {
+		return entry, err
+	}
+	switch m.mode {
+	case ModeHardlink:
+		entry.Inode = inodeOf(info)
+	case ModeCopy:
+		entry.Size = info.Size()
+		entry.ModTime = info.ModTime()
+	}
+	return entry, nil
+}
+
+// rename moves a file created earlier to the new virtual path of its source
+func (m *materializer) rename(from, to string) error {
+	logger.Debug("Renaming %s to %s", from, to)
+	m.result.Renamed++
+	m.removed[from] = true
+	if m.dryRun {
+		return nil
+	}
+	if err := m.mkdirAll(path.Dir(to)); err != nil {
+		m.problem(to, err.Error())
+		return nil
+	}
+	if err := os.Rename(filepath.Join(m.out, from), filepath.Join(m.out, to)); err != nil {
+		return fmt.Errorf("failed to rename %s: %w", from, err)
+	}
+	m.manifest.Files[to] = m.manifest.Files[from]
+	delete(m.manifest.Files, from)
+	return nil
+}
+
+// remove deletes a file created earlier
+func (m *materializer) remove(rel string) error {
+	logger.Debug("Removing %s", rel)
+	m.result.Removed++
+	m.removed[rel] = true
+	if m.dryRun {
+		return nil
+	}
+	if err := os.Remove(filepath.Join(m.out, rel)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", rel, err)
+	}
+	delete(m.manifest.Files, rel)
+	return nil
+}
+
+// mkdirAll creates the directory rel and its parents, remembering the ones
+// it created
+func (m *materializer) mkdirAll(rel string) error {
+	if rel == "." || rel == "" || m.dryRun {
+		return nil
+	}
+	if err := m.mkdirAll(path.Dir(rel)); err != nil {
+		return err
+	}
+	dir := filepath.Join(m.out, rel)
+	info, err := os.Lstat(dir)
+	switch {
+	case err == nil && info.IsDir():
+		return nil
+	case err == nil:
+		return fmt.Errorf("%s exists and is not a directory", rel)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	m.manifest.Dirs = append(m.manifest.Dirs, rel)
+	return nil
+}
+
+// pruneDirs removes directories created earlier that are no longer in the
+// virtual tree, if they are empty
+func (m *materializer) pruneDirs(fsState *state.FSState) {
+	var kept []string
+	// Deepest first, so that parents are empty by the time they are reached
+	sort.Sort(sort.Reverse(sort.StringSlice(m.manifest.Dirs)))
+	for _, rel := range m.manifest.Dirs {
+		if !fsState.Directories["/"+rel] && !m.dryRun {
+			if err := os.Remove(filepath.Join(m.out, rel)); err == nil || os.IsNotExist(err) {
+				continue
+			}
+		}
+		kept = append(kept, rel)
+	}
+	sort.Strings(kept)
+	m.manifest.Dirs = kept
+}
+
+// loadManifest reads what earlier runs created. A missing manifest means
+// nothing was created yet.
+func (m *materializer) loadManifest() error {
+	m.manifest = manifest{Files: make(map[string]manifestEntry)}
+	data, err := os.ReadFile(filepath.Join(m.out, ManifestName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &m.manifest); err != nil {
+		return fmt.Errorf("failed to parse manifest %s: %w", filepath.Join(m.out, ManifestName), err)
+	}
+	if m.manifest.Files == nil {
+		m.manifest.Files = make(map[string]manifestEntry)
+	}
+	return nil
+}
+
+// saveManifest replaces the manifest with what exists now
+func (m *materializer) saveManifest() error {
+	data, err := json.MarshalIndent(m.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestPath := filepath.Join(m.out, ManifestName)
+	tmp := manifestPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := os.Rename(tmp, manifestPath); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// copyFile copies a source file, keeping its modification time so that
+// copies can be told apart from edited files
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(to)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Chtimes(to, info.ModTime(), info.ModTime())
+}
+
+// inodeOf returns the inode number of a file, or 0 if it is not known
+func inodeOf(info os.FileInfo) uint64 {
+	if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+		return sys.Ino
+	}
+	return 0
+}
+
+// sortedKeys returns the keys of m, sorted
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
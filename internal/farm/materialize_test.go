@@ -0,0 +1,175 @@
+package farm
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"vmapfs/internal/state"
+)
+
+func TestMaterialize(t *testing.T) {
+	base := t.TempDir()
+	sourceRoot := filepath.Join(base, "source")
+	out := filepath.Join(base, "library")
+	if err := os.MkdirAll(sourceRoot, 0755); err != nil {
+		t.Fatalf("Failed to create source: %v", err)
+	}
+	for _, name := range []string{"a.mkv", "b.mkv", "c.mkv"} {
+		if err := os.WriteFile(filepath.Join(sourceRoot, name), []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to create source file: %v", err)
+		}
+	}
+	fsState := &state.FSState{
+		Mappings: map[string]state.FileMapping{
+			"a.mkv": {VirtualPaths: []string{"/movies/a.mkv"}},
+			"b.mkv": {VirtualPaths: []string{"/movies/b.mkv"}},
+		},
+		Directories: map[string]bool{"/": true, "/movies": true, "/empty": true},
+	}
+
+	sync := func(mode Mode) SyncResult {
+		t.Helper()
+		result, err := Materialize(fsState, sourceRoot, out, mode, false)
+		if err != nil {
+			t.Fatalf("Materialize failed: %v", err)
+		}
+		return result
+	}
+	readLink := func(rel string) string {
+		t.Helper()
+		target, err := os.Readlink(filepath.Join(out, rel))
+		if err != nil {
+			t.Fatalf("Expected a symlink at %s: %v", rel, err)
+		}
+		return target
+	}
+
+	if result := sync(ModeSymlink); result.Created != 2 || len(result.Problems) != 0 {
+		t.Fatalf("Expected 2 files to be created, got %+v", result)
+	}
+	if readLink("movies/a.mkv") != filepath.Join(sourceRoot, "a.mkv") {
+		t.Error("Expected a symlink to the source file")
+	}
+	if info, err := os.Stat(filepath.Join(out, "empty")); err != nil || !info.IsDir() {
+		t.Error("Expected empty virtual directories to be created")
+	}
+
+	t.Run("Incremental", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(out, "movies", "mine.mkv"), []byte("mine"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		fsState.Mappings["a.mkv"] = state.FileMapping{VirtualPaths: []string{"/films/a.mkv"}}
+		fsState.Mappings["c.mkv"] = state.FileMapping{VirtualPaths: []string{"/movies/mine.mkv"}}
+		delete(fsState.Mappings, "b.mkv")
+		delete(fsState.Directories, "/movies")
+		fsState.Directories["/films"] = true
+
+		result := sync(ModeSymlink)
+		if result.Renamed != 1 || result.Removed != 1 || result.Created != 0 || len(result.Problems) != 1 {
+			t.Errorf("Expected a rename, a removal and a problem, got %+v", result)
+		}
+		if readLink("films/a.mkv") != filepath.Join(sourceRoot, "a.mkv") {
+			t.Error("Expected the link to be renamed")
+		}
+		if _, err := os.Lstat(filepath.Join(out, "movies", "b.mkv")); !os.IsNotExist(err) {
+			t.Error("Expected the unmapped link to be removed")
+		}
+		if data, err := os.ReadFile(filepath.Join(out, "movies", "mine.mkv")); err != nil || string(data) != "mine" {
+			t.Error("Expected a file not created by vmapfs to be left alone")
+		}
+
+		if result := sync(ModeSymlink); result.Changed() || result.Unchanged != 1 {
+			t.Errorf("Expected nothing to change, got %+v", result)
+		}
+	})
+
+	t.Run("ModeChange", func(t *testing.T) {
+		result := sync(ModeCopy)
+		if result.Removed != 1 || result.Created != 1 {
+			t.Errorf("Expected the link to be replaced by a copy, got %+v", result)
+		}
+		copied := filepath.Join(out, "films", "a.mkv")
+		if info, err := os.Lstat(copied); err != nil || !info.Mode().IsRegular() {
+			t.Fatalf("Expected a copy, got %v", err)
+		}
+
+		// An edited copy is no longer ours
+		if err := os.WriteFile(copied, []byte("edited"), 0644); err != nil {
+			t.Fatalf("Failed to edit copy: %v", err)
+		}
+		delete(fsState.Mappings, "a.mkv")
+		if result := sync(ModeCopy); result.Removed != 0 {
+			t.Errorf("Expected the edited copy to be kept, got %+v", result)
+		}
+		if data, _ := os.ReadFile(copied); string(data) != "edited" {
+			t.Error("Expected the edited copy to be left alone")
+		}
+	})
+}
+
+func TestMaterializeSavesManifestOnError(t *testing.T) {
+	base := t.TempDir()
+	sourceRoot := filepath.Join(base, "source")
+	out := filepath.Join(base, "library")
+	for _, dir := range []string{sourceRoot, out} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+	}
+	for _, name := range []string{"a.mkv", "b.mkv"} {
+		if err := os.WriteFile(filepath.Join(sourceRoot, name), []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to create source file: %v", err)
+		}
+	}
+
+	// A link created earlier in a directory on another filesystem cannot
+	// be renamed into the output directory
+	elsewhere, err := os.MkdirTemp("/dev/shm", "vmapfs-materialize-*")
+	if err != nil {
+		t.Skipf("No second filesystem: %v", err)
+	}
+	defer os.RemoveAll(elsewhere)
+	var outStat, elsewhereStat syscall.Stat_t
+	if syscall.Stat(out, &outStat) != nil || syscall.Stat(elsewhere, &elsewhereStat) != nil || outStat.Dev == elsewhereStat.Dev {
+		t.Skip("No second filesystem")
+	}
+	if err := os.Symlink(elsewhere, filepath.Join(out, "elsewhere")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(sourceRoot, "b.mkv"), filepath.Join(elsewhere, "b.mkv")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	earlier := `{"files": {"elsewhere/b.mkv": {"source": "b.mkv", "mode": "symlink"}}, "dirs": []}`
+	if err := os.WriteFile(filepath.Join(out, ManifestName), []byte(earlier), 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	fsState := &state.FSState{
+		Mappings: map[string]state.FileMapping{
+			"a.mkv": {VirtualPaths: []string{"/a.mkv"}},
+			"b.mkv": {VirtualPaths: []string{"/b.mkv"}},
+		},
+		Directories: map[string]bool{"/": true},
+	}
+	if _, err := Materialize(fsState, sourceRoot, out, ModeSymlink, false); err == nil {
+		t.Fatal("Expected the rename across filesystems to fail")
+	}
+
+	data, err := os.ReadFile(filepath.Join(out, ManifestName))
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	var saved manifest
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	if _, exists := saved.Files["a.mkv"]; !exists {
+		t.Errorf("Expected the link created before the error to be in the manifest, got %v", saved.Files)
+	}
+	if _, exists := saved.Files["elsewhere/b.mkv"]; !exists {
+		t.Errorf("Expected the link that failed to move to stay in the manifest, got %v", saved.Files)
+	}
+}
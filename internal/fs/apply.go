@@ -0,0 +1,498 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"vmapfs/internal/logging"
+	"vmapfs/internal/state"
+)
+
+var (
+	applyLogger = logging.GetLogger().WithPrefix("apply")
+)
+
+// Move is a physical move of a source file to the place in the source tree
+// that its virtual path names
+type Move struct {
+	From    *SourcePath  `json:"from"`
+	To      *SourcePath  `json:"to"`
+	Virtual *VirtualPath `json:"virtual"`
+	// Copy is set when the move crosses filesystems, so the file is copied
+	// and the original removed once every move has succeeded
+	Copy bool `json:"copy,omitempty"`
+}
+
+// ApplyProblem is a mapped source that cannot be moved to its virtual path
+type ApplyProblem struct {
+	Source  string `json:"source"`
+	Virtual string `json:"virtual"`
+	Detail  string `json:"detail"`
+}
+
+// String returns a short human readable description of the problem
+func (p ApplyProblem) String() string {
+	return fmt.Sprintf("%s -> %s (%s)", p.Source, p.Virtual, p.Detail)
+}
+
+// ApplyPlan lists the moves that make the source tree match the virtual
+// tree. A plan with problems must not be executed.
+type ApplyPlan struct {
+	Moves    []Move         `json:"moves"`
+	Problems []ApplyProblem `json:"problems"`
+	// InPlace counts the mapped sources that are already at their virtual path
+	InPlace int `json:"in_place"`
+}
+
+// PlanApply plans moving every mapped source in fsState to the source path
+// that matches its first virtual path. Moves that cross filesystems are
+// problems unless allowCopy is set. The source tree is only read.
+func PlanApply(fsState *state.FSState, sourceRoot string, allowCopy bool) (*ApplyPlan, error) {
+	if info, err := os.Stat(sourceRoot); err != nil {
+		return nil, fmt.Errorf("cannot read source root: %w", err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("source root %s is not a directory", sourceRoot)
+	}
+
+	sources := make([]string, 0, len(fsState.Mappings))
+	for source, mapping := range fsState.Mappings {
+		if len(mapping.VirtualPaths) > 0 {
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources)
+
+	plan := &ApplyPlan{Moves: []Move{}, Problems: []ApplyProblem{}}
+	var candidates []Move
+	moving := make(map[string]bool)
+	occupied := make(map[string]bool)
+	for _, source := range sources {
+		from := NewSourcePath(source)
+		vp := NewVirtualPath(fsState.Mappings[source].VirtualPaths[0])
+		to := NewSourcePath(vp.String())
+		if to.String() == from.String() {
+			plan.InPlace++
+			continue
+		}
+		candidates = append(candidates, Move{From: from, To: to, Virtual: vp})
+		moving[from.String()] = true
+	}
+
+	for _, move := range candidates {
+		problem := func(format string, args ...interface{}) {
+			plan.Problems = append(plan.Problems, ApplyProblem{
+				Source:  move.From.String(),
+				Virtual: move.Virtual.String(),
+				Detail:  fmt.Sprintf(format, args...),
+			})
+		}
+
+		fromInfo, err := os.Lstat(move.From.FullPath(sourceRoot))
+		switch {
+		case os.IsNotExist(err):
+			problem("source does not exist")
+			continue
+		case err != nil:
+			problem("%v", err)
+			continue
+		case !fromInfo.Mode().IsRegular() && fromInfo.Mode()&os.ModeSymlink == 0:
+			problem("source is not a regular file")
+			continue
+		}
+
+		// A target may be occupied by a source that is itself moving away
+		if info, err := os.Lstat(move.To.FullPath(sourceRoot)); err == nil {
+			switch {
+			case info.IsDir():
+				problem("target is a directory")
+				continue
+			case !moving[move.To.String()]:
+				problem("target %s already exists", move.To)
+				continue
+			}
+			occupied[move.To.String()] = true
+		} else if !os.IsNotExist(err) {
+			problem("%v", err)
+			continue
+		}
+
+		ancestor, err := existingAncestor(sourceRoot, move.To)
+		if err != nil {
+			problem("%v", err)
+			continue
+		}
+		if !sameDevice(fromInfo, ancestor) {
+			if !allowCopy {
+				problem("target is on a different filesystem")
+				continue
+			}
+			move.Copy = true
+		}
+		plan.Moves = append(plan.Moves, move)
+	}
+
+	// A target that waits on a source which can't move stays occupied,
+	// which may in turn block the moves waiting on that target
+	for blocked := true; blocked; {
+		blocked = false
+		planned := make(map[string]bool, len(plan.Moves))
+		for _, move := range plan.Moves {
+			planned[move.From.String()] = true
+		}
+		moves := plan.Moves[:0]
+		for _, move := range plan.Moves {
+			if occupied[move.To.String()] && !planned[move.To.String()] {
+				plan.Problems = append(plan.Problems, ApplyProblem{
+					Source:  move.From.String(),
+					Virtual: move.Virtual.String(),
+					Detail:  fmt.Sprintf("target %s already exists and cannot be moved", move.To),
+				})
+				blocked = true
+				continue
+			}
+			moves = append(moves, move)
+		}
+		plan.Moves = moves
+	}
+
+	applyLogger.Debug("Planned %d moves, %d problems, %d in place", len(plan.Moves), len(plan.Problems), plan.InPlace)
+	return plan, nil
+}
+
+// existingAncestor returns the deepest existing directory that would
+// contain target, which is where a new file would be created
+func existingAncestor(sourceRoot string, target *SourcePath) (os.FileInfo, error) {
+	for dir := target.Parent(); ; dir = dir.Parent() {
+		info, err := os.Stat(dir.FullPath(sourceRoot))
+		switch {
+		case err == nil && !info.IsDir():
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		case err == nil:
+			return info, nil
+		case !os.IsNotExist(err):
+			return nil, err
+		case isSourceRoot(dir):
+			return nil, fmt.Errorf("source root does not exist")
+		}
+	}
+}
+
+// sameDevice returns true if two files are on the same filesystem, so that
+// one can be renamed next to the other
+func sameDevice(a, b os.FileInfo) bool {
+	statA, okA := a.Sys().(*syscall.Stat_t)
+	statB, okB := b.Sys().(*syscall.Stat_t)
+	return !okA || !okB || statA.Dev == statB.Dev
+}
+
+// Rewrite returns a copy of fsState with every moved source's mapping
+// stored under its new source path
+func (p *ApplyPlan) Rewrite(fsState *state.FSState) *state.FSState {
+	rewritten := fsState.Clone()
+	for _, move := range p.Moves {
+		delete(rewritten.Mappings, move.From.String())
+	}
+	for _, move := range p.Moves {
+		if stale, exists := rewritten.Mappings[move.To.String()]; exists {
+			applyLogger.Warn("Replacing stale mapping record of %q (%d xattrs)", move.To, len(stale.Xattrs))
+		}
+		rewritten.Mappings[move.To.String()] = fsState.Mappings[move.From.String()].Clone()
+	}
+	return rewritten
+}
+
+// applyStepKind identifies a change made to the source tree while executing
+// a plan, so that it can be undone
+type applyStepKind int
+
+const (
+	stepRename applyStepKind = iota
+	stepCopy
+	stepMkdir
+)
+
+// applyStep is a change made to the source tree, between full paths
+type applyStep struct {
+	kind     applyStepKind
+	from, to string
+}
+
+// Execute performs the moves of the plan under sourceRoot, creating the
+// directories they need. Moves into a place that another move vacates wait
+// for it, and cycles are broken through a temporary name. Nothing is ever
+// overwritten. Once every move is done commit is called, typically to save
+// the rewritten state; if a move or commit fails, everything done so far is
+// rolled back. After a successful commit, originals of copied files and
+// source directories left empty are removed.
+func (p *ApplyPlan) Execute(sourceRoot string, commit func() error) error {
+	run, err := p.Stage(sourceRoot)
+	if err != nil {
+		return err
+	}
+	if err := run.Move(); err != nil {
+		return err
+	}
+	if commit != nil {
+		if err := commit(); err != nil {
+			return run.Rollback(err)
+		}
+	}
+	run.Finish()
+	return nil
+}
+
+// ApplyRun is a plan being executed in steps, so that the slow part can
+// run without holding up the filesystem: Stage copies the files that cross
+// filesystems, Move renames everything into place, and once the rewritten
+// state is saved Finish removes what was left behind. Until then Rollback
+// undoes everything.
+type ApplyRun struct {
+	plan       *ApplyPlan
+	sourceRoot string
+	steps      []applyStep
+	// staged maps the full target path of each copied move to its copy
+	staged map[string]string
+	// originals are the temporary names of the copied files' originals
+	originals []string
+}
+
+// Stage starts executing the plan by copying the files whose moves cross
+// filesystems next to their targets. The source tree is otherwise left as
+// it is. If a copy fails, the copies made so far are removed.
+func (p *ApplyPlan) Stage(sourceRoot string) (*ApplyRun, error) {
+	if len(p.Problems) > 0 {
+		return nil, fmt.Errorf("cannot apply a plan with %d problems", len(p.Problems))
+	}
+
+	run := &ApplyRun{plan: p, sourceRoot: sourceRoot, staged: make(map[string]string)}
+	for _, move := range p.Moves {
+		if !move.Copy {
+			continue
+		}
+		from, to := move.From.FullPath(sourceRoot), move.To.FullPath(sourceRoot)
+		staged := to + ".vmapfs-copy"
+		if err := mkdirAllLogged(filepath.Dir(to), &run.steps); err != nil {
+			return nil, run.Rollback(fmt.Errorf("failed to copy %s to %s: %w", move.From, move.To, err))
+		}
+		applyLogger.Debug("Copying %s -> %s", from, staged)
+		if err := copySourceFile(from, staged); err != nil {
+			return nil, run.Rollback(fmt.Errorf("failed to copy %s to %s: %w", move.From, move.To, err))
+		}
+		run.steps = append(run.steps, applyStep{kind: stepCopy, from: from, to: staged})
+		run.staged[to] = staged
+	}
+	return run, nil
+}
+
+// Move renames every file to its target, and every copy into place with
+// its original set aside. It only renames, so it is quick. If a rename
+// fails, everything is rolled back.
+func (r *ApplyRun) Move() error {
+	// pending maps the current full path of each unmoved file to its move
+	pending := make(map[string]Move, len(r.plan.Moves))
+	for _, move := range r.plan.Moves {
+		pending[move.From.FullPath(r.sourceRoot)] = move
+	}
+
+	for len(pending) > 0 {
+		progress := false
+		for _, from := range sortedPaths(pending) {
+			move := pending[from]
+			to := move.To.FullPath(r.sourceRoot)
+			if _, blocked := pending[to]; blocked {
+				continue
+			}
+			if err := r.moveFile(from, to); err != nil {
+				return r.Rollback(fmt.Errorf("failed to move %s to %s: %w", move.From, move.To, err))
+			}
+			delete(pending, from)
+			progress = true
+		}
+		if progress {
+			continue
+		}
+
+		// Every remaining move waits for another, so they form cycles.
+		// Moving one file aside lets the rest of its cycle proceed.
+		from := sortedPaths(pending)[0]
+		aside, err := moveAside(from, &r.steps)
+		if err != nil {
+			return r.Rollback(err)
+		}
+		pending[aside] = pending[from]
+		delete(pending, from)
+	}
+	return nil
+}
+
+// Rollback undoes everything the run has done to the source tree and
+// returns cause. Calling it again does nothing.
+func (r *ApplyRun) Rollback(cause error) error {
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		var err error
+		switch step.kind {
+		case stepRename:
+			err = os.Rename(step.to, step.from)
+		case stepCopy, stepMkdir:
+			err = os.Remove(step.to)
+		}
+		if err != nil {
+			applyLogger.Error("Failed to roll back %s: %v", step.to, err)
+		}
+	}
+	if len(r.steps) > 0 {
+		applyLogger.Warn("Rolled back %d changes: %v", len(r.steps), cause)
+	}
+	r.steps = nil
+	r.originals = nil
+	return cause
+}
+
+// Finish removes the originals of copied files and the source directories
+// left empty. It must only be called once the rewritten state is saved.
+func (r *ApplyRun) Finish() {
+	for _, original := range r.originals {
+		if err := os.Remove(original); err != nil {
+			applyLogger.Warn("Failed to remove original of copied file %s: %v", original, err)
+		}
+	}
+	for _, move := range r.plan.Moves {
+		pruneEmptyDirs(r.sourceRoot, move.From.Parent())
+	}
+	r.steps = nil
+	r.originals = nil
+	applyLogger.Info("Applied %d moves", len(r.plan.Moves))
+}
+
+// moveFile renames from to to, creating missing parent directories, and
+// records each change. A copied file's staged copy is renamed to to
+// instead, and the original is kept under a temporary name until Finish,
+// which frees its path for the moves waiting on it.
+func (r *ApplyRun) moveFile(from, to string) error {
+	if err := mkdirAllLogged(filepath.Dir(to), &r.steps); err != nil {
+		return err
+	}
+	// rename(2) silently replaces an existing file
+	if _, err := os.Lstat(to); err == nil {
+		return fmt.Errorf("target already exists")
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if staged, copied := r.staged[to]; copied {
+		aside, err := moveAside(from, &r.steps)
+		if err != nil {
+			return err
+		}
+		r.originals = append(r.originals, aside)
+		from = staged
+	}
+	applyLogger.Debug("Renaming %s -> %s", from, to)
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	r.steps = append(r.steps, applyStep{kind: stepRename, from: from, to: to})
+	return nil
+}
+
+// moveAside renames a file to a temporary name next to it and returns
+// the new name
+func moveAside(from string, steps *[]applyStep) (string, error) {
+	aside := from + ".vmapfs-apply"
+	if _, err := os.Lstat(aside); err == nil {
+		return "", fmt.Errorf("temporary file %s already exists", aside)
+	}
+	if err := os.Rename(from, aside); err != nil {
+		return "", fmt.Errorf("failed to move %s aside: %w", from, err)
+	}
+	*steps = append(*steps, applyStep{kind: stepRename, from: from, to: aside})
+	return aside, nil
+}
+
+// mkdirAllLogged creates dir and its missing parents, recording each one
+// it creates so that a rollback removes them again
+func mkdirAllLogged(dir string, steps *[]applyStep) error {
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if err := mkdirAllLogged(filepath.Dir(dir), steps); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	*steps = append(*steps, applyStep{kind: stepMkdir, to: dir})
+	return nil
+}
+
+// copySourceFile copies a file across filesystems, keeping its mode and
+// modification time
+func copySourceFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(to)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Chtimes(to, info.ModTime(), info.ModTime())
+}
+
+// pruneEmptyDirs removes dir and its parents while they are empty, stopping
+// at the source root
+func pruneEmptyDirs(sourceRoot string, dir *SourcePath) {
+	for ; !isSourceRoot(dir); dir = dir.Parent() {
+		entries, err := os.ReadDir(dir.FullPath(sourceRoot))
+		if err != nil || len(entries) > 0 {
+			return
+		}
+		if err := os.Remove(dir.FullPath(sourceRoot)); err != nil {
+			return
+		}
+		applyLogger.Debug("Removed empty source directory %s", dir)
+	}
+}
+
+// isSourceRoot returns true if sp is the source root itself
+func isSourceRoot(sp *SourcePath) bool {
+	return sp.String() == "." || sp.String() == ""
+}
+
+// sortedPaths returns the keys of pending in sorted order, so that moves
+// run in a predictable order
+func sortedPaths(pending map[string]Move) []string {
+	paths := make([]string, 0, len(pending))
+	for path := range pending {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,250 @@
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"vmapfs/internal/state"
+)
+
+func TestApply(t *testing.T) {
+	writeFiles := func(t *testing.T, root string, files map[string]string) {
+		t.Helper()
+		for name, content := range files {
+			full := filepath.Join(root, name)
+			if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+			if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to create file: %v", err)
+			}
+		}
+	}
+	readFiles := func(t *testing.T, root string) map[string]string {
+		t.Helper()
+		files := make(map[string]string)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, _ := filepath.Rel(root, path)
+			data, err := os.ReadFile(path)
+			files[filepath.ToSlash(rel)] = string(data)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Failed to read tree: %v", err)
+		}
+		return files
+	}
+	stateOf := func(mappings map[string][]string) *state.FSState {
+		fsState := &state.FSState{Mappings: map[string]state.FileMapping{}, Directories: map[string]bool{"/": true}}
+		for source, paths := range mappings {
+			fsState.Mappings[source] = state.FileMapping{VirtualPaths: paths}
+		}
+		return fsState
+	}
+
+	t.Run("Plan", func(t *testing.T) {
+		root := t.TempDir()
+		writeFiles(t, root, map[string]string{
+			"done.txt":       "done",
+			"dl/a.mkv":       "a",
+			"dl/b.mkv":       "b",
+			"taken.txt":      "taken",
+			"dl/blocked.mkv": "blocked",
+		})
+		fsState := stateOf(map[string][]string{
+			"done.txt":       {"/done.txt"},
+			"dl/a.mkv":       {"/movies/a.mkv", "/favourites/a.mkv"},
+			"dl/b.mkv":       {"/dl/a.mkv"},
+			"dl/blocked.mkv": {"/taken.txt"},
+			"gone.mkv":       {"/movies/gone.mkv"},
+		})
+
+		plan, err := PlanApply(fsState, root, false)
+		if err != nil {
+			t.Fatalf("PlanApply failed: %v", err)
+		}
+		if plan.InPlace != 1 {
+			t.Errorf("Expected 1 source in place, got %d", plan.InPlace)
+		}
+		moves := make(map[string]string)
+		for _, move := range plan.Moves {
+			moves[move.From.String()] = move.To.String()
+		}
+		want := map[string]string{"dl/a.mkv": "movies/a.mkv", "dl/b.mkv": "dl/a.mkv"}
+		if !reflect.DeepEqual(moves, want) {
+			t.Errorf("Expected moves %v, got %v", want, moves)
+		}
+		problems := make(map[string]bool)
+		for _, p := range plan.Problems {
+			problems[p.Source] = true
+		}
+		if !problems["dl/blocked.mkv"] || !problems["gone.mkv"] || len(problems) != 2 {
+			t.Errorf("Expected problems for dl/blocked.mkv and gone.mkv, got %v", plan.Problems)
+		}
+		if err := plan.Execute(root, nil); err == nil {
+			t.Error("Expected executing a plan with problems to fail")
+		}
+
+		// Plans travel over the control socket as JSON
+		data, err := json.Marshal(plan)
+		if err != nil {
+			t.Fatalf("Failed to marshal plan: %v", err)
+		}
+		var decoded ApplyPlan
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("Failed to unmarshal plan: %v", err)
+		}
+		if !reflect.DeepEqual(&decoded, plan) {
+			t.Errorf("Expected plan to round trip, got %+v", decoded)
+		}
+	})
+
+	t.Run("ExecuteCycle", func(t *testing.T) {
+		root := t.TempDir()
+		writeFiles(t, root, map[string]string{
+			"x.txt":    "x",
+			"y.txt":    "y",
+			"old/z.md": "z",
+		})
+		xattrs := map[string][]byte{"user.tag": []byte("z")}
+		fsState := stateOf(map[string][]string{
+			"x.txt":    {"/y.txt"},
+			"y.txt":    {"/x.txt"},
+			"old/z.md": {"/notes/deep/z.md"},
+		})
+		fsState.Mappings["old/z.md"] = state.FileMapping{VirtualPaths: []string{"/notes/deep/z.md"}, Xattrs: xattrs}
+
+		plan, err := PlanApply(fsState, root, false)
+		if err != nil {
+			t.Fatalf("PlanApply failed: %v", err)
+		}
+		if len(plan.Problems) > 0 {
+			t.Fatalf("Unexpected problems: %v", plan.Problems)
+		}
+		committed := false
+		if err := plan.Execute(root, func() error { committed = true; return nil }); err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+		if !committed {
+			t.Error("Expected commit to be called")
+		}
+
+		want := map[string]string{"x.txt": "y", "y.txt": "x", "notes/deep/z.md": "z"}
+		if got := readFiles(t, root); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected files %v, got %v", want, got)
+		}
+		if _, err := os.Stat(filepath.Join(root, "old")); !os.IsNotExist(err) {
+			t.Error("Expected the emptied source directory to be removed")
+		}
+
+		rewritten := plan.Rewrite(fsState)
+		if got := rewritten.Mappings["x.txt"].VirtualPaths; !reflect.DeepEqual(got, []string{"/x.txt"}) {
+			t.Errorf("Expected x.txt to be mapped to /x.txt, got %v", got)
+		}
+		if got := rewritten.Mappings["notes/deep/z.md"]; !reflect.DeepEqual(got.Xattrs, xattrs) {
+			t.Errorf("Expected xattrs to follow the move, got %v", got.Xattrs)
+		}
+		if _, exists := rewritten.Mappings["old/z.md"]; exists {
+			t.Error("Expected the old source path to be gone")
+		}
+		if _, exists := fsState.Mappings["old/z.md"]; !exists {
+			t.Error("Expected Rewrite to leave the original state alone")
+		}
+
+		again, err := PlanApply(rewritten, root, false)
+		if err != nil {
+			t.Fatalf("PlanApply failed: %v", err)
+		}
+		if len(again.Moves) != 0 || again.InPlace != 3 {
+			t.Errorf("Expected everything in place, got %d moves and %d in place", len(again.Moves), again.InPlace)
+		}
+	})
+
+	t.Run("StagedCopy", func(t *testing.T) {
+		root := t.TempDir()
+		files := map[string]string{"a.txt": "a", "b.txt": "b"}
+		writeFiles(t, root, files)
+		fsState := stateOf(map[string][]string{
+			"a.txt": {"/far/a.txt"},
+			"b.txt": {"/a.txt"},
+		})
+
+		plan, err := PlanApply(fsState, root, false)
+		if err != nil {
+			t.Fatalf("PlanApply failed: %v", err)
+		}
+		// Pretend far is another filesystem
+		for i := range plan.Moves {
+			plan.Moves[i].Copy = plan.Moves[i].From.String() == "a.txt"
+		}
+
+		run, err := plan.Stage(root)
+		if err != nil {
+			t.Fatalf("Stage failed: %v", err)
+		}
+		want := map[string]string{"a.txt": "a", "b.txt": "b", "far/a.txt.vmapfs-copy": "a"}
+		if got := readFiles(t, root); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected only the copy to be staged, got %v", got)
+		}
+		failure := errors.New("state changed")
+		if err := run.Rollback(failure); !errors.Is(err, failure) {
+			t.Fatalf("Expected the rollback cause, got %v", err)
+		}
+		if got := readFiles(t, root); !reflect.DeepEqual(got, files) {
+			t.Errorf("Expected the staged copy to be removed, got %v", got)
+		}
+		if _, err := os.Stat(filepath.Join(root, "far")); !os.IsNotExist(err) {
+			t.Error("Expected the staging directory to be removed")
+		}
+
+		run, err = plan.Stage(root)
+		if err != nil {
+			t.Fatalf("Stage failed: %v", err)
+		}
+		if err := run.Move(); err != nil {
+			t.Fatalf("Move failed: %v", err)
+		}
+		want = map[string]string{"a.txt": "b", "far/a.txt": "a", "a.txt.vmapfs-apply": "a"}
+		if got := readFiles(t, root); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected the original to be kept aside until Finish, got %v", got)
+		}
+		run.Finish()
+		want = map[string]string{"a.txt": "b", "far/a.txt": "a"}
+		if got := readFiles(t, root); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected files %v, got %v", want, got)
+		}
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		root := t.TempDir()
+		files := map[string]string{"a.txt": "a", "b.txt": "b", "in/c.txt": "c"}
+		writeFiles(t, root, files)
+		fsState := stateOf(map[string][]string{
+			"a.txt":    {"/b.txt"},
+			"b.txt":    {"/new/dir/b.txt"},
+			"in/c.txt": {"/c.txt"},
+		})
+
+		plan, err := PlanApply(fsState, root, false)
+		if err != nil {
+			t.Fatalf("PlanApply failed: %v", err)
+		}
+		failure := errors.New("save failed")
+		if err := plan.Execute(root, func() error { return failure }); !errors.Is(err, failure) {
+			t.Fatalf("Expected the commit error, got %v", err)
+		}
+		if got := readFiles(t, root); !reflect.DeepEqual(got, files) {
+			t.Errorf("Expected files to be restored to %v, got %v", files, got)
+		}
+		if _, err := os.Stat(filepath.Join(root, "new")); !os.IsNotExist(err) {
+			t.Error("Expected created directories to be removed")
+		}
+	})
+}
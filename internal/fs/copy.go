@@ -0,0 +1,242 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// openSources counts the source files each process has open for reading
+// through the mount. Files cannot be written, so a file a process creates
+// can only be a copy (cp) of one of them.
+type openSources struct {
+	byPID map[uint32]map[string]int
+	mu    sync.Mutex
+}
+
+// opened records that process pid opened sp
+func (o *openSources) opened(pid uint32, sp *SourcePath) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.byPID == nil {
+		o.byPID = make(map[uint32]map[string]int)
+	}
+	if o.byPID[pid] == nil {
+		o.byPID[pid] = make(map[string]int)
+	}
+	o.byPID[pid][sp.String()]++
+}
+
+// closed records that process pid closed sp
+func (o *openSources) closed(pid uint32, sp *SourcePath) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	open := o.byPID[pid]
+	if open[sp.String()]--; open[sp.String()] <= 0 {
+		delete(open, sp.String())
+	}
+	if len(open) == 0 {
+		delete(o.byPID, pid)
+	}
+}
+
+// of returns the sources process pid has open, in sorted order
+func (o *openSources) of(pid uint32) []*SourcePath {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	spaths := make([]string, 0, len(o.byPID[pid]))
+	for spath := range o.byPID[pid] {
+		spaths = append(spaths, spath)
+	}
+	sort.Strings(spaths)
+	sources := make([]*SourcePath, len(spaths))
+	for i, spath := range spaths {
+		sources[i] = NewSourcePath(spath)
+	}
+	return sources
+}
+
+// copyCandidate is a source a file being copied may turn out to be
+type copyCandidate struct {
+	source *SourcePath
+	file   *os.File
+}
+
+// copyTarget is a file being created in the mount by cp. It is both the
+// node and the handle. Every write is compared with the sources the copying
+// process has open, and those it differs from are dropped; a write that
+// matches none fails. When the file is closed having received the whole of
+// a non-empty source, it becomes another virtual path of that source.
+// Otherwise the close fails and nothing is mapped, so no written data is
+// ever discarded silently.
+type copyTarget struct {
+	dir        *Dir
+	path       *VirtualPath
+	candidates []copyCandidate
+	written    int64
+	failed     bool
+	mapped     *File
+	mu         sync.Mutex
+}
+
+// newCopyTarget opens the candidate sources of a copy to vp in dir
+func newCopyTarget(dir *Dir, vp *VirtualPath, sources []*SourcePath) *copyTarget {
+	target := &copyTarget{dir: dir, path: vp}
+	for _, sp := range sources {
+		file, err := os.Open(sp.FullPath(dir.fs.sourceDir))
+		if err != nil {
+			fileLogger.Debug("Cannot compare copy with %q: %v", sp.String(), err)
+			continue
+		}
+		target.candidates = append(target.candidates, copyCandidate{source: sp, file: file})
+	}
+	return target
+}
+
+// Attr implements the Node interface. Until the copy is complete it is an
+// empty regular file that grows as it is written.
+func (c *copyTarget) Attr(ctx context.Context, a *fuse.Attr) error {
+	c.mu.Lock()
+	mapped := c.mapped
+	written := c.written
+	c.mu.Unlock()
+
+	if mapped != nil {
+		return mapped.Attr(ctx, a)
+	}
+	a.Mode = 0644
+	a.Size = safeInt64ToUint64(written)
+	a.Uid = c.dir.fs.uid
+	a.Gid = c.dir.fs.gid
+	return nil
+}
+
+// Write implements the HandleWriter interface, checking that the data is
+// the same as in at least one candidate source. Only sequential writes are
+// accepted.
+func (c *copyTarget) Write(_ context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.failed || c.mapped != nil {
+		return syscall.EIO
+	}
+	if req.Offset != c.written {
+		fileLogger.Warn("Cannot copy to %q: writes must be sequential", c.path.String())
+		c.fail()
+		return syscall.EIO
+	}
+
+	buf := make([]byte, len(req.Data))
+	var matching []copyCandidate
+	for _, candidate := range c.candidates {
+		n, err := candidate.file.ReadAt(buf, req.Offset)
+		if (err == nil || err == io.EOF) && bytes.Equal(buf[:n], req.Data) {
+			matching = append(matching, candidate)
+		} else {
+			candidate.file.Close()
+		}
+	}
+	c.candidates = matching
+	if len(matching) == 0 {
+		fileLogger.Warn("Cannot create %q: the data written is not a copy of a file in the mount", c.path.String())
+		c.fail()
+		return syscall.EIO
+	}
+
+	c.written += int64(len(req.Data))
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// Flush implements the HandleFlusher interface. Closing a complete copy maps
+// it; closing anything else fails.
+func (c *copyTarget) Flush(_ context.Context, req *fuse.FlushRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.mapped != nil {
+		return nil
+	}
+	if c.failed {
+		return syscall.EIO
+	}
+
+	// Creating an empty file is not taken for a copy
+	var source *SourcePath
+	for _, candidate := range c.candidates {
+		if c.written == 0 {
+			break
+		}
+		if info, err := candidate.file.Stat(); err == nil && info.Size() == c.written {
+			source = candidate.source
+			break
+		}
+	}
+	if source == nil {
+		fileLogger.Warn("Cannot create %q: closed before a whole file was copied", c.path.String())
+		c.fail()
+		return syscall.EIO
+	}
+
+	vfs := c.dir.fs
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	if _, exists := vfs.pathMapper.GetSourcePath(c.path); exists || vfs.pathMapper.IsDirectory(c.path) {
+		fileLogger.Warn("Copy target appeared meanwhile: %q", c.path.String())
+		c.fail()
+		return syscall.EEXIST
+	}
+	if err := vfs.pathMapper.AddMapping(c.path, source); err != nil {
+		fileLogger.Warn("Cannot copy to %q: %v", c.path.String(), err)
+		c.fail()
+		return ToFuseError(NewFSError(OpCreate, c.path.String(), err))
+	}
+	if err := vfs.saveState(req.Hdr()); err != nil {
+		fileLogger.Error("Failed to save state: %v", err)
+		c.fail()
+		return err
+	}
+
+	fileLogger.Info("Copied %q to %q", source.String(), c.path.String())
+	c.mapped = vfs.fileNode(c.path, source)
+	c.closeCandidates()
+	return nil
+}
+
+// Release implements the HandleReleaser interface. The kernel is made to
+// look the name up again, which gives the mapped file or, if the copy
+// failed, nothing.
+func (c *copyTarget) Release(_ context.Context, _ *fuse.ReleaseRequest) error {
+	c.mu.Lock()
+	c.closeCandidates()
+	c.mu.Unlock()
+
+	go c.dir.fs.invalidateEntries(c.dir, []string{c.path.Base()})
+	return nil
+}
+
+// fail gives up on the copy. It must be called with c.mu held.
+func (c *copyTarget) fail() {
+	c.failed = true
+	c.closeCandidates()
+}
+
+// closeCandidates closes the candidate sources. It must be called with c.mu
+// held.
+func (c *copyTarget) closeCandidates() {
+	for _, candidate := range c.candidates {
+		candidate.file.Close()
+	}
+	c.candidates = nil
+}
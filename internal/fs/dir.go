@@ -3,7 +3,6 @@ package fs
 import (
 	"context"
 	"os"
-	"strings"
 	"syscall"
 
 	"vmapfs/internal/logging"
@@ -28,6 +27,16 @@ type Dir struct {
 func (d *Dir) Attr(_ context.Context, a *fuse.Attr) error {
 	dirLogger.Trace("Getting attributes for directory: %q", d.path.String())
 
+	a.Inode = d.fs.dirInode(d.path)
+
+	// Snapshots are read-only
+	if d.fs.readOnly {
+		a.Mode = os.ModeDir | 0555
+		a.Uid = d.fs.uid
+		a.Gid = d.fs.gid
+		return nil
+	}
+
 	// Root directory has special handling
 	if d.path.IsRoot() {
 		dirLogger.Trace("Setting root directory attributes")
@@ -51,23 +60,26 @@ func (d *Dir) Lookup(_ context.Context, name string) (fusefs.Node, error) {
 	dirLogger.Debug("Looking up %q in directory %q", name, d.path.String())
 	childPath := NewVirtualPath(d.path.String() + "/" + name)
 
-	if d.path.IsRoot() && name == "_UNSORTED" {
+	if d.isMountRoot() && name == "_UNSORTED" {
 		dirLogger.Debug("Returning UnsortedDir for _UNSORTED")
-		return NewUnsortedDir(d.fs, NewSourcePath("")), nil
+		return d.fs.unsortedDirNode(NewSourcePath("")), nil
+	}
+	if d.isMountRoot() && name == snapshotsDirName && d.fs.snapshots != nil {
+		dirLogger.Debug("Returning SnapshotsDir for %s", snapshotsDirName)
+		return &SnapshotsDir{fs: d.fs}, nil
 	}
 
-	if _, exists := d.fs.state.Directories[childPath.String()]; exists {
+	d.fs.mu.RLock()
+	defer d.fs.mu.RUnlock()
+
+	if d.fs.pathMapper.IsDirectory(childPath) {
 		dirLogger.Debug("Found virtual directory: %q", childPath.String())
-		return &Dir{fs: d.fs, path: childPath}, nil
+		return d.fs.dirNode(childPath), nil
 	}
 
 	if sourcePath, exists := d.fs.pathMapper.GetSourcePath(childPath); exists {
 		dirLogger.Debug("Found mapped file: %q -> %q", childPath.String(), sourcePath.String())
-		return &File{
-			fs:         d.fs,
-			path:       childPath,
-			sourcePath: sourcePath,
-		}, nil
+		return d.fs.fileNode(childPath, sourcePath), nil
 	}
 
 	dirLogger.Debug("Path not found: %q", childPath.String())
@@ -79,55 +91,33 @@ func (d *Dir) ReadDirAll(_ context.Context) ([]fuse.Dirent, error) {
 	dirLogger.Debug("Reading directory contents: %q", d.path.String())
 	var entries []fuse.Dirent
 
-	entries = append(entries, fuse.Dirent{Name: ".", Type: fuse.DT_Dir})
-	entries = append(entries, fuse.Dirent{Name: "..", Type: fuse.DT_Dir})
+	d.fs.mu.RLock()
+	defer d.fs.mu.RUnlock()
+
+	entries = append(entries, fuse.Dirent{Inode: d.fs.dirInodeLocked(d.path), Name: ".", Type: fuse.DT_Dir})
+	entries = append(entries, fuse.Dirent{Inode: d.fs.dirInodeLocked(d.path.Parent()), Name: "..", Type: fuse.DT_Dir})
 
-	if d.path.IsRoot() {
+	if d.isMountRoot() {
 		dirLogger.Trace("Adding _UNSORTED to root directory listing")
 		entries = append(entries, fuse.Dirent{
-			Name: "_UNSORTED",
-			Type: fuse.DT_Dir,
+			Inode: unsortedInode(NewSourcePath("")),
+			Name:  "_UNSORTED",
+			Type:  fuse.DT_Dir,
 		})
 	}
 
-	prefix := d.path.String() + "/"
-	if d.path.IsRoot() {
-		prefix = "/"
-	}
-
-	d.fs.mu.RLock()
-	dirLogger.Trace("Scanning for virtual directories with prefix: %q", prefix)
-	for dirPath := range d.fs.state.Directories {
-		if dirPath == "/" {
-			continue
-		}
-		if strings.HasPrefix(dirPath, prefix) {
-			relPath := strings.TrimPrefix(dirPath, prefix)
-			if !strings.Contains(relPath, "/") {
-				dirLogger.Trace("Found virtual directory: %q", relPath)
-				entries = append(entries, fuse.Dirent{
-					Name: relPath,
-					Type: fuse.DT_Dir,
-				})
-			}
-		}
-	}
-
-	dirLogger.Trace("Scanning for mapped files with prefix: %q", prefix)
-	for _, mapping := range d.fs.pathMapper.mappings {
-		vpath := mapping.VirtualPath
-		if vpath != "" && strings.HasPrefix(vpath, prefix) {
-			relPath := strings.TrimPrefix(vpath, prefix)
-			if !strings.Contains(relPath, "/") {
-				dirLogger.Trace("Found mapped file: %q", relPath)
-				entries = append(entries, fuse.Dirent{
-					Name: relPath,
-					Type: fuse.DT_File,
-				})
-			}
+	children, _ := d.fs.pathMapper.ReadDir(d.path)
+	for _, child := range children {
+		entry := fuse.Dirent{Name: child.Name, Type: fuse.DT_File}
+		if child.IsDir {
+			entry.Type = fuse.DT_Dir
+			entry.Inode = d.fs.dirInodeLocked(NewVirtualPath(d.path.String() + "/" + child.Name))
+		} else {
+			entry.Inode = d.fs.fileInodeLocked(NewSourcePath(child.Source))
 		}
+		dirLogger.Trace("Found entry: %q (type=%v)", child.Name, entry.Type)
+		entries = append(entries, entry)
 	}
-	d.fs.mu.RUnlock()
 
 	dirLogger.Debug("Directory %q contains %d entries", d.path.String(), len(entries))
 	return entries, nil
@@ -138,14 +128,27 @@ func (d *Dir) Mkdir(_ context.Context, req *fuse.MkdirRequest) (fusefs.Node, err
 	dirLogger.Info("Creating new directory %q in %q", req.Name, d.path.String())
 	newPath := NewVirtualPath(d.path.String() + "/" + req.Name)
 
+	if d.fs.readOnly {
+		return nil, ToFuseError(NewFSError(OpMkdir, newPath.String(), ErrReadOnly))
+	}
+	if d.isMountRoot() && isReservedName(req.Name) {
+		dirLogger.Warn("Cannot create reserved directory %q", req.Name)
+		return nil, ToFuseError(NewFSError(OpMkdir, newPath.String(), ErrAlreadyExists))
+	}
+
 	if _, isUnsorted := d.fs.pathMapper.GetSourcePath(d.path); isUnsorted {
 		dirLogger.Warn("Attempted to create directory in _UNSORTED: %s", newPath.String())
 		return nil, syscall.EPERM
 	}
 
 	d.fs.mu.Lock()
-	d.fs.state.Directories[newPath.String()] = true
-	err := d.fs.stateManager.SaveState(d.fs.state)
+	if _, exists := d.fs.pathMapper.GetSourcePath(newPath); exists || d.fs.pathMapper.IsDirectory(newPath) {
+		d.fs.mu.Unlock()
+		dirLogger.Warn("Path already exists: %q", newPath.String())
+		return nil, ToFuseError(NewFSError(OpMkdir, newPath.String(), ErrAlreadyExists))
+	}
+	d.fs.pathMapper.AddDirectory(newPath)
+	err := d.fs.saveState(req.Hdr())
 	d.fs.mu.Unlock()
 
 	if err != nil {
@@ -154,64 +157,42 @@ func (d *Dir) Mkdir(_ context.Context, req *fuse.MkdirRequest) (fusefs.Node, err
 	}
 
 	dirLogger.Info("Successfully created directory: %s", newPath.String())
-	return &Dir{fs: d.fs, path: newPath}, nil
+	return d.fs.dirNode(newPath), nil
 }
 
 // Remove implements the NodeRemover interface, removing a file or directory.
+// Directories must be empty, as with rmdir(2).
 func (d *Dir) Remove(_ context.Context, req *fuse.RemoveRequest) error {
 	dirLogger.Info("Removing %q from directory %q (isDir=%v)", req.Name, d.path.String(), req.Dir)
 	childPath := NewVirtualPath(d.path.String() + "/" + req.Name)
 
-	d.fs.mu.RLock()
-	if req.Dir {
-		if _, exists := d.fs.state.Directories[childPath.String()]; !exists {
-			d.fs.mu.RUnlock()
-			dirLogger.Warn("Directory not found: %q", childPath.String())
-			return syscall.ENOENT
-		}
+	if d.fs.readOnly {
+		return ToFuseError(NewFSError(OpRemove, childPath.String(), ErrReadOnly))
+	}
 
-		dirLogger.Debug("Bulk unmapping children under: %q", childPath.String())
-		prefix := childPath.String() + "/"
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
 
-		// Collect all virtual paths that are children of the directory being deleted
-		toUnmap := []*VirtualPath{}
-		for _, mapping := range d.fs.pathMapper.mappings {
-			if strings.HasPrefix(mapping.VirtualPath, prefix) {
-				toUnmap = append(toUnmap, NewVirtualPath(mapping.VirtualPath))
-			}
+	if req.Dir {
+		if err := d.fs.pathMapper.RemoveDirectory(childPath); err != nil {
+			dirLogger.Warn("Cannot remove directory %q: %v", childPath.String(), err)
+			return ToFuseError(NewFSError(OpRemove, childPath.String(), err))
 		}
-
-		d.fs.mu.RUnlock()
-		d.fs.mu.Lock()
-
-		for _, vp := range toUnmap {
-			dirLogger.Debug("Unmapping: %q", vp.String())
-			d.fs.pathMapper.RemoveMapping(vp)
+	} else {
+		if d.fs.pathMapper.IsDirectory(childPath) {
+			dirLogger.Warn("Cannot unlink directory: %q", childPath.String())
+			return ToFuseError(NewFSError(OpRemove, childPath.String(), ErrIsDirectory))
 		}
-
-		delete(d.fs.state.Directories, childPath.String())
-		err := d.fs.stateManager.SaveState(d.fs.state)
-		d.fs.mu.Unlock()
-
-		if err != nil {
-			dirLogger.Error("Failed to save state: %v", err)
-			return err
+		if _, exists := d.fs.pathMapper.GetSourcePath(childPath); !exists {
+			dirLogger.Warn("Mapping not found: %q", childPath.String())
+			return ToFuseError(NewFSError(OpRemove, childPath.String(), ErrPathNotFound))
 		}
 
-		dirLogger.Info("Directory and all child mappings removed: %q", childPath.String())
-		return nil
+		dirLogger.Debug("Removing file mapping: %q", childPath.String())
+		d.fs.pathMapper.RemoveMapping(childPath)
 	}
-	d.fs.mu.RUnlock()
-
-	// If it's not a directory, just remove the file mapping
-	d.fs.mu.Lock()
-	dirLogger.Debug("Removing file mapping: %q", childPath.String())
-	d.fs.pathMapper.RemoveMapping(childPath)
 
-	err := d.fs.stateManager.SaveState(d.fs.state)
-	d.fs.mu.Unlock()
-
-	if err != nil {
+	if err := d.fs.saveState(req.Hdr()); err != nil {
 		dirLogger.Error("Failed to save state: %v", err)
 		return err
 	}
@@ -220,13 +201,22 @@ func (d *Dir) Remove(_ context.Context, req *fuse.RemoveRequest) error {
 	return nil
 }
 
-// Rename implements the NodeRenamer interface, renaming/moving a file or directory.
+// Rename implements the NodeRenamer interface, renaming/moving a file or
+// directory. An existing target is replaced following rename(2) rules.
 func (d *Dir) Rename(_ context.Context, req *fuse.RenameRequest, newDir fusefs.Node) error {
 	dirLogger.Info("Renaming %q to %q", req.OldName, req.NewName)
 
 	var targetPath string
 	switch target := newDir.(type) {
 	case *Dir:
+		if d.fs.readOnly || target.fs != d.fs {
+			dirLogger.Warn("Cannot rename into or out of a snapshot")
+			return syscall.EROFS
+		}
+		if target.isMountRoot() && isReservedName(req.NewName) {
+			dirLogger.Warn("Cannot rename onto reserved name %q", req.NewName)
+			return syscall.EEXIST
+		}
 		targetPath = target.path.String()
 	case *UnsortedDir:
 		dirLogger.Warn("Cannot move to _UNSORTED directory")
@@ -244,41 +234,21 @@ func (d *Dir) Rename(_ context.Context, req *fuse.RenameRequest, newDir fusefs.N
 	d.fs.mu.Lock()
 	defer d.fs.mu.Unlock()
 
-	if _, isDir := d.fs.state.Directories[oldPath.String()]; isDir {
-		dirLogger.Debug("Moving directory from %q to %q", oldPath.String(), newPath.String())
-		delete(d.fs.state.Directories, oldPath.String())
-		d.fs.state.Directories[newPath.String()] = true
-
-		oldPrefix := oldPath.String() + "/"
-		newPrefix := newPath.String() + "/"
-		for spath, mapping := range d.fs.pathMapper.mappings {
-			if strings.HasPrefix(mapping.VirtualPath, oldPrefix) {
-				newVpath := newPrefix + strings.TrimPrefix(mapping.VirtualPath, oldPrefix)
-				dirLogger.Trace("Updating mapping: %q -> %q", mapping.VirtualPath, newVpath)
-				mapping.VirtualPath = newVpath
-				d.fs.pathMapper.mappings[spath] = mapping
-			}
-		}
-	} else {
-		sourcePath, exists := d.fs.pathMapper.GetSourcePath(oldPath)
-		if !exists {
-			dirLogger.Warn("Source path not found: %q", oldPath.String())
-			return syscall.ENOENT
-		}
-
+	if sourcePath, exists := d.fs.pathMapper.GetSourcePath(oldPath); exists {
 		// 🚫 Prevent renaming a directory-mapped path
 		fullSource := sourcePath.FullPath(d.fs.sourceDir)
 		if info, err := os.Stat(fullSource); err == nil && info.IsDir() {
 			dirLogger.Warn("Attempted to rename mapped directory: %q", fullSource)
 			return syscall.EISDIR
 		}
+	}
 
-		dirLogger.Debug("Moving file from %q to %q", oldPath.String(), newPath.String())
-		d.fs.pathMapper.RemoveMapping(oldPath)
-		d.fs.pathMapper.AddMapping(newPath, sourcePath)
+	if err := d.fs.pathMapper.Move(oldPath, newPath); err != nil {
+		dirLogger.Warn("Cannot rename %q to %q: %v", oldPath.String(), newPath.String(), err)
+		return ToFuseError(NewFSError(OpRename, oldPath.String(), err))
 	}
 
-	if err := d.fs.stateManager.SaveState(d.fs.state); err != nil {
+	if err := d.fs.saveState(req.Hdr()); err != nil {
 		dirLogger.Error("Failed to save state: %v", err)
 		return err
 	}
@@ -286,3 +256,118 @@ func (d *Dir) Rename(_ context.Context, req *fuse.RenameRequest, newDir fusefs.N
 	dirLogger.Info("Successfully completed rename operation")
 	return nil
 }
+
+// Link implements the NodeLinker interface. Hard linking a mapped or unsorted
+// file (ln, cp -l) adds another virtual path for the same source.
+func (d *Dir) Link(_ context.Context, req *fuse.LinkRequest, old fusefs.Node) (fusefs.Node, error) {
+	dirLogger.Info("Linking %q into %q", req.NewName, d.path.String())
+
+	var sourcePath *SourcePath
+	switch target := old.(type) {
+	case *File:
+		sourcePath = target.sourcePath
+	case *UnsortedFile:
+		sourcePath = target.path
+	default:
+		dirLogger.Warn("Cannot link node of type %T", old)
+		return nil, syscall.EPERM
+	}
+
+	newPath := NewVirtualPath(d.path.String() + "/" + req.NewName)
+
+	if d.fs.readOnly {
+		return nil, syscall.EROFS
+	}
+	if d.isMountRoot() && isReservedName(req.NewName) {
+		return nil, syscall.EEXIST
+	}
+
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+
+	if d.fs.pathMapper.IsDirectory(newPath) {
+		dirLogger.Warn("Link target is a directory: %q", newPath.String())
+		return nil, syscall.EEXIST
+	}
+	if _, exists := d.fs.pathMapper.GetSourcePath(newPath); exists {
+		dirLogger.Warn("Link target already exists: %q", newPath.String())
+		return nil, syscall.EEXIST
+	}
+
+	dirLogger.Debug("Adding mapping %q -> %q", newPath.String(), sourcePath.String())
+	if err := d.fs.pathMapper.AddMapping(newPath, sourcePath); err != nil {
+		dirLogger.Warn("Cannot link %q: %v", newPath.String(), err)
+		return nil, ToFuseError(NewFSError(OpLink, newPath.String(), err))
+	}
+
+	if err := d.fs.saveState(req.Hdr()); err != nil {
+		dirLogger.Error("Failed to save state: %v", err)
+		return nil, err
+	}
+
+	dirLogger.Info("Successfully linked %q", newPath.String())
+	return d.fs.fileNode(newPath, sourcePath), nil
+}
+
+// Create implements the NodeCreater interface. Files cannot be written, so
+// the only file that can be created is a copy (cp) of a file of the mount
+// the creating process has open, which like a hard link adds another
+// virtual path for the same source. The mapping is only made once the
+// whole file has been written unchanged, see copyTarget.
+func (d *Dir) Create(_ context.Context, req *fuse.CreateRequest, _ *fuse.CreateResponse) (fusefs.Node, fusefs.Handle, error) {
+	dirLogger.Info("Creating %q in %q", req.Name, d.path.String())
+
+	newPath := NewVirtualPath(d.path.String() + "/" + req.Name)
+
+	if d.fs.readOnly {
+		return nil, nil, syscall.EROFS
+	}
+	if d.isMountRoot() && isReservedName(req.Name) {
+		return nil, nil, syscall.EEXIST
+	}
+
+	sources := d.fs.openFiles.of(req.Pid)
+	if len(sources) == 0 {
+		dirLogger.Warn("Cannot create %q: only copies of files in the mount can be created", newPath.String())
+		return nil, nil, syscall.EPERM
+	}
+
+	d.fs.mu.RLock()
+	_, exists := d.fs.pathMapper.GetSourcePath(newPath)
+	exists = exists || d.fs.pathMapper.IsDirectory(newPath)
+	d.fs.mu.RUnlock()
+	if exists {
+		dirLogger.Warn("Create target already exists: %q", newPath.String())
+		return nil, nil, syscall.EEXIST
+	}
+
+	target := newCopyTarget(d, newPath, sources)
+	return target, target, nil
+}
+
+// isMountRoot returns true for the root of the mounted filesystem, which
+// also holds _UNSORTED and .snapshots. The roots of snapshots are not.
+func (d *Dir) isMountRoot() bool {
+	return d.path.IsRoot() && !d.fs.readOnly
+}
+
+// ReservedNames are the names the mount root uses for its own directories,
+// which cannot appear at the root of the virtual tree
+var ReservedNames = []string{"_UNSORTED", snapshotsDirName}
+
+// isReservedName returns true for names the mount root uses for its own
+// directories
+func isReservedName(name string) bool {
+	for _, reserved := range ReservedNames {
+		if name == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// Forget implements the NodeForgetter interface, dropping the node once the
+// kernel no longer refers to it.
+func (d *Dir) Forget() {
+	d.fs.nodes.forget(nodeKey{path: d.path.String()}, d)
+}
@@ -2,11 +2,16 @@ package fs
 
 import (
 	"context"
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"syscall"
 	"testing"
 	"time"
 
+	"vmapfs/internal/audit"
 	"vmapfs/internal/state"
 
 	"bazil.org/fuse"
@@ -44,6 +49,7 @@ func setupTestFS(t *testing.T) (*VMapFS, string, string, func()) {
 	}
 
 	cleanup := func() {
+		stateManager.Close()
 		os.RemoveAll(sourceDir)
 		os.RemoveAll(stateDir)
 	}
@@ -269,3 +275,552 @@ func TestDirOperations(t *testing.T) {
 		}
 	})
 }
+
+func TestPOSIXSemantics(t *testing.T) {
+	vfs, sourceDir, _, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	root, _ := vfs.Root()
+	rootDir := root.(*Dir)
+
+	for _, tf := range []string{"a.mkv", "b.mkv", "c.mkv"} {
+		if err := os.WriteFile(filepath.Join(sourceDir, tf), []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	mkdir := func(t *testing.T, dir *Dir, name string) *Dir {
+		t.Helper()
+		node, err := dir.Mkdir(ctx, &fuse.MkdirRequest{Name: name})
+		if err != nil {
+			t.Fatalf("Failed to create directory %q: %v", name, err)
+		}
+		return node.(*Dir)
+	}
+	mapFile := func(vpath, source string) {
+		vfs.pathMapper.AddMapping(NewVirtualPath(vpath), NewSourcePath(source))
+	}
+
+	t.Run("RmdirNotEmpty", func(t *testing.T) {
+		full := mkdir(t, rootDir, "full")
+		mapFile("/full/a.mkv", "a.mkv")
+
+		err := rootDir.Remove(ctx, &fuse.RemoveRequest{Name: "full", Dir: true})
+		if err != syscall.ENOTEMPTY {
+			t.Errorf("Expected ENOTEMPTY, got %v", err)
+		}
+		if _, err := full.Lookup(ctx, "a.mkv"); err != nil {
+			t.Error("Children should survive a failed rmdir")
+		}
+	})
+
+	t.Run("RmdirOnFile", func(t *testing.T) {
+		full, _ := rootDir.Lookup(ctx, "full")
+		err := full.(*Dir).Remove(ctx, &fuse.RemoveRequest{Name: "a.mkv", Dir: true})
+		if err != syscall.ENOTDIR {
+			t.Errorf("Expected ENOTDIR, got %v", err)
+		}
+	})
+
+	t.Run("UnlinkDirectory", func(t *testing.T) {
+		err := rootDir.Remove(ctx, &fuse.RemoveRequest{Name: "full"})
+		if err != syscall.EISDIR {
+			t.Errorf("Expected EISDIR, got %v", err)
+		}
+	})
+
+	t.Run("RemoveMissing", func(t *testing.T) {
+		err := rootDir.Remove(ctx, &fuse.RemoveRequest{Name: "missing.mkv"})
+		if err != syscall.ENOENT {
+			t.Errorf("Expected ENOENT, got %v", err)
+		}
+	})
+
+	t.Run("MkdirExisting", func(t *testing.T) {
+		_, err := rootDir.Mkdir(ctx, &fuse.MkdirRequest{Name: "full"})
+		if err != syscall.EEXIST {
+			t.Errorf("Expected EEXIST, got %v", err)
+		}
+	})
+
+	t.Run("RenameFileReplacesFile", func(t *testing.T) {
+		mkdir(t, rootDir, "replace")
+		mapFile("/replace/old.mkv", "b.mkv")
+		mapFile("/replace/target.mkv", "c.mkv")
+
+		replace, _ := rootDir.Lookup(ctx, "replace")
+		err := replace.(*Dir).Rename(ctx, &fuse.RenameRequest{OldName: "old.mkv", NewName: "target.mkv"}, replace)
+		if err != nil {
+			t.Fatalf("Failed to rename over existing file: %v", err)
+		}
+
+		sp, exists := vfs.pathMapper.GetSourcePath(NewVirtualPath("/replace/target.mkv"))
+		if !exists || sp.String() != "b.mkv" {
+			t.Error("Expected target to point at the renamed source")
+		}
+		if vfs.pathMapper.IsPathMapped(NewSourcePath("c.mkv")) {
+			t.Error("Expected replaced source to lose its mapping")
+		}
+		if entries, _ := vfs.pathMapper.ReadDir(NewVirtualPath("/replace")); len(entries) != 1 {
+			t.Errorf("Expected a single entry after replacing, got %v", entries)
+		}
+	})
+
+	t.Run("RenameOntoDirectory", func(t *testing.T) {
+		err := rootDir.Rename(ctx, &fuse.RenameRequest{OldName: "replace", NewName: "full"}, rootDir)
+		if err != syscall.ENOTEMPTY {
+			t.Errorf("Expected ENOTEMPTY renaming onto a non-empty directory, got %v", err)
+		}
+
+		replace, _ := rootDir.Lookup(ctx, "replace")
+		err = replace.(*Dir).Rename(ctx, &fuse.RenameRequest{OldName: "target.mkv", NewName: "full"}, rootDir)
+		if err != syscall.EISDIR {
+			t.Errorf("Expected EISDIR renaming a file onto a directory, got %v", err)
+		}
+	})
+
+	t.Run("RenameDirectoryOntoFile", func(t *testing.T) {
+		mkdir(t, rootDir, "lonely")
+		err := rootDir.Rename(ctx, &fuse.RenameRequest{OldName: "lonely", NewName: "target.mkv"}, mustLookup(t, rootDir, "replace"))
+		if err != syscall.ENOTDIR {
+			t.Errorf("Expected ENOTDIR, got %v", err)
+		}
+	})
+
+	t.Run("RenameDirectoryReplacesEmptyDirectory", func(t *testing.T) {
+		mkdir(t, rootDir, "empty")
+		err := rootDir.Rename(ctx, &fuse.RenameRequest{OldName: "full", NewName: "empty"}, rootDir)
+		if err != nil {
+			t.Fatalf("Failed to rename over empty directory: %v", err)
+		}
+		if _, err := mustLookup(t, rootDir, "empty").Lookup(ctx, "a.mkv"); err != nil {
+			t.Error("Expected contents to move into the replaced directory")
+		}
+	})
+
+	t.Run("RenameIntoSelf", func(t *testing.T) {
+		parent := mkdir(t, rootDir, "parent")
+		mkdir(t, parent, "child")
+		err := rootDir.Rename(ctx, &fuse.RenameRequest{OldName: "parent", NewName: "moved"}, mustLookup(t, parent, "child"))
+		if err != syscall.EINVAL {
+			t.Errorf("Expected EINVAL, got %v", err)
+		}
+	})
+
+	t.Run("RenameNested", func(t *testing.T) {
+		show := mkdir(t, rootDir, "Show")
+		season := mkdir(t, show, "Season 01")
+		mkdir(t, season, "Extras")
+		mapFile("/Show/Season 01/ep.mkv", "a.mkv")
+
+		if err := rootDir.Rename(ctx, &fuse.RenameRequest{OldName: "Show", NewName: "Renamed"}, rootDir); err != nil {
+			t.Fatalf("Failed to rename directory: %v", err)
+		}
+
+		renamed := mustLookup(t, rootDir, "Renamed")
+		movedSeason := mustLookup(t, renamed, "Season 01")
+		if _, err := movedSeason.Lookup(ctx, "Extras"); err != nil {
+			t.Error("Expected nested directory to move along")
+		}
+		if _, err := movedSeason.Lookup(ctx, "ep.mkv"); err != nil {
+			t.Error("Expected nested file to move along")
+		}
+		if vfs.state.Directories["/Show/Season 01"] {
+			t.Error("Expected old nested directory to be gone from state")
+		}
+		if !vfs.state.Directories["/Renamed/Season 01/Extras"] {
+			t.Error("Expected nested directories to be renamed in state")
+		}
+	})
+}
+
+func mustLookup(t *testing.T, dir *Dir, name string) *Dir {
+	t.Helper()
+	node, err := dir.Lookup(context.Background(), name)
+	if err != nil {
+		t.Fatalf("Failed to lookup %q: %v", name, err)
+	}
+	return node.(*Dir)
+}
+
+func TestDebouncedSaves(t *testing.T) {
+	vfs, _, stateDir, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	vfs.SetSaveOptions(state.SaveOptions{Debounce: time.Hour, MaxDelay: time.Hour})
+
+	root, _ := vfs.Root()
+	if _, err := root.(*Dir).Mkdir(ctx, &fuse.MkdirRequest{Name: "pending"}); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	statePath := filepath.Join(stateDir, "state.json")
+	onDisk, err := state.ReadState(statePath)
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if onDisk.Directories["/pending"] {
+		t.Error("Expected the change to wait for the debounce window")
+	}
+
+	if err := vfs.Flush(); err != nil {
+		t.Fatalf("Failed to flush state: %v", err)
+	}
+	onDisk, err = state.ReadState(statePath)
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if !onDisk.Directories["/pending"] {
+		t.Error("Expected Flush to write the pending change")
+	}
+}
+
+func TestJournaledState(t *testing.T) {
+	sourceDir := t.TempDir()
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	for _, tf := range []string{"a.mkv", "b.mkv"} {
+		if err := os.WriteFile(filepath.Join(sourceDir, tf), []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	openStore := func() (*state.JournalStore, *state.FSState) {
+		manager, err := state.NewManager(statePath)
+		if err != nil {
+			t.Fatalf("Failed to create state manager: %v", err)
+		}
+		store := state.NewJournalStore(manager, 0)
+		fsState, err := store.LoadState()
+		if err != nil {
+			t.Fatalf("Failed to load state: %v", err)
+		}
+		return store, fsState
+	}
+
+	store, fsState := openStore()
+	vfs, err := NewVMapFS(sourceDir, fsState, store)
+	if err != nil {
+		t.Fatalf("Failed to create virtual filesystem: %v", err)
+	}
+
+	ctx := context.Background()
+	root, _ := vfs.Root()
+	rootDir := root.(*Dir)
+	unsorted, _ := rootDir.Lookup(ctx, "_UNSORTED")
+
+	movies, err := rootDir.Mkdir(ctx, &fuse.MkdirRequest{Name: "movies"})
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	for _, name := range []string{"a.mkv", "b.mkv"} {
+		if err := unsorted.(*UnsortedDir).Rename(ctx, &fuse.RenameRequest{OldName: name, NewName: name}, movies); err != nil {
+			t.Fatalf("Failed to move %q from _UNSORTED: %v", name, err)
+		}
+	}
+	fileNode, _ := movies.(*Dir).Lookup(ctx, "a.mkv")
+	if err := fileNode.(*File).Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.tag", Xattr: []byte("tag")}); err != nil {
+		t.Fatalf("Failed to set xattr: %v", err)
+	}
+	if err := movies.(*Dir).Rename(ctx, &fuse.RenameRequest{OldName: "b.mkv", NewName: "a.mkv"}, movies); err != nil {
+		t.Fatalf("Failed to rename over existing file: %v", err)
+	}
+	if err := rootDir.Rename(ctx, &fuse.RenameRequest{OldName: "movies", NewName: "films"}, rootDir); err != nil {
+		t.Fatalf("Failed to rename directory: %v", err)
+	}
+	// Reuse the old name while the state still holds the old paths
+	movies, err = rootDir.Mkdir(ctx, &fuse.MkdirRequest{Name: "movies"})
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	films, _ := rootDir.Lookup(ctx, "films")
+	if err := films.(*Dir).Rename(ctx, &fuse.RenameRequest{OldName: "a.mkv", NewName: "a.mkv"}, movies); err != nil {
+		t.Fatalf("Failed to move file back: %v", err)
+	}
+
+	snapshot := vfs.Snapshot()
+	expected, _ := json.Marshal(snapshot.Mappings)
+	expectedDirs := snapshot.Directories
+	expectedInodes := snapshot.DirectoryInodes
+	store.Close()
+
+	store, replayed := openStore()
+	defer store.Close()
+
+	got, _ := json.Marshal(replayed.Mappings)
+	if string(got) != string(expected) {
+		t.Errorf("Replayed mappings differ:\nexpected %s\ngot      %s", expected, got)
+	}
+	if !reflect.DeepEqual(replayed.Directories, expectedDirs) {
+		t.Errorf("Replayed directories differ: expected %v, got %v", expectedDirs, replayed.Directories)
+	}
+	if !reflect.DeepEqual(replayed.DirectoryInodes, expectedInodes) || expectedInodes["/films"] == expectedInodes["/movies"] {
+		t.Errorf("Replayed directory inodes differ: expected %v, got %v", expectedInodes, replayed.DirectoryInodes)
+	}
+}
+
+func TestJournaledDebouncedSaves(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	manager, err := state.NewManager(statePath)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	store := state.NewJournalStore(manager, 2)
+	defer store.Close()
+	fsState, err := store.LoadState()
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	vfs, err := NewVMapFS(t.TempDir(), fsState, store)
+	if err != nil {
+		t.Fatalf("Failed to create virtual filesystem: %v", err)
+	}
+	vfs.SetSaveOptions(state.SaveOptions{Debounce: time.Hour, MaxDelay: time.Hour})
+
+	// Readers run while the journal records and compacts, which the race
+	// detector checks
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				vfs.Snapshot()
+			}
+		}
+	}()
+
+	ctx := context.Background()
+	root, _ := vfs.Root()
+	for i := 0; i < 5; i++ {
+		if _, err := root.(*Dir).Mkdir(ctx, &fuse.MkdirRequest{Name: "dir" + strconv.Itoa(i)}); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := vfs.Flush(); err != nil {
+			t.Fatalf("Failed to flush state: %v", err)
+		}
+	}
+	if !vfs.Snapshot().Directories["/dir4"] {
+		t.Error("Expected every directory to be kept")
+	}
+}
+
+func TestReplaceState(t *testing.T) {
+	vfs, sourceDir, stateDir, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := os.WriteFile(filepath.Join(sourceDir, "a.mkv"), []byte("test"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	root, _ := vfs.Root()
+	rootDir := root.(*Dir)
+	if _, err := rootDir.Mkdir(ctx, &fuse.MkdirRequest{Name: "old"}); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	before := vfs.Snapshot()
+
+	restored := &state.FSState{
+		Mappings: map[string]state.FileMapping{
+			"a.mkv": {VirtualPaths: []string{"/restored/a.mkv"}},
+		},
+		Directories: map[string]bool{"/": true, "/restored": true},
+		Version:     state.CurrentVersion,
+	}
+	if err := vfs.ReplaceState("restore", restored); err != nil {
+		t.Fatalf("Failed to replace state: %v", err)
+	}
+
+	if _, err := rootDir.Lookup(ctx, "old"); err != syscall.ENOENT {
+		t.Errorf("Expected replaced directory to be gone, got %v", err)
+	}
+	restoredDir := mustLookup(t, rootDir, "restored")
+	if _, err := restoredDir.Lookup(ctx, "a.mkv"); err != nil {
+		t.Errorf("Expected restored mapping to be visible: %v", err)
+	}
+	if !before.Directories["/old"] {
+		t.Error("Expected the snapshot to be unaffected by the replacement")
+	}
+
+	onDisk, err := state.ReadState(filepath.Join(stateDir, "state.json"))
+	if err != nil {
+		t.Fatalf("Failed to read state: %v", err)
+	}
+	if !onDisk.Directories["/restored"] || onDisk.Directories["/old"] {
+		t.Errorf("Expected the replacement to be saved, got %v", onDisk.Directories)
+	}
+
+	// Changes after the replacement apply to the new state
+	if _, err := restoredDir.Mkdir(ctx, &fuse.MkdirRequest{Name: "more"}); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if !vfs.Snapshot().Directories["/restored/more"] {
+		t.Error("Expected new directory in the replaced state")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	vfs, sourceDir, stateDir, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	auditPath := filepath.Join(stateDir, "audit.jsonl")
+	log, err := audit.Open(auditPath, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer log.Close()
+	vfs.SetAuditLog(log)
+
+	ctx := context.Background()
+	if err := os.WriteFile(filepath.Join(sourceDir, "a.mkv"), []byte("test"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	alice := fuse.Header{Uid: 1000, Pid: 42}
+	bob := fuse.Header{Uid: 1001, Pid: 43}
+
+	root, _ := vfs.Root()
+	rootDir := root.(*Dir)
+	unsorted, _ := rootDir.Lookup(ctx, "_UNSORTED")
+	movies, err := rootDir.Mkdir(ctx, &fuse.MkdirRequest{Header: alice, Name: "movies"})
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := unsorted.(*UnsortedDir).Rename(ctx, &fuse.RenameRequest{Header: alice, OldName: "a.mkv", NewName: "a.mkv"}, movies); err != nil {
+		t.Fatalf("Failed to map file: %v", err)
+	}
+	if err := movies.(*Dir).Rename(ctx, &fuse.RenameRequest{Header: bob, OldName: "a.mkv", NewName: "b.mkv"}, movies); err != nil {
+		t.Fatalf("Failed to rename file: %v", err)
+	}
+	fileNode, _ := movies.(*Dir).Lookup(ctx, "b.mkv")
+	if err := fileNode.(*File).Setxattr(ctx, &fuse.SetxattrRequest{Header: bob, Name: "user.tag", Xattr: []byte("tag")}); err != nil {
+		t.Fatalf("Failed to set xattr: %v", err)
+	}
+	if _, err := vfs.Undo(1); err != nil {
+		t.Fatalf("Failed to undo: %v", err)
+	}
+
+	entries, err := audit.Query(auditPath, audit.Filter{})
+	if err != nil {
+		t.Fatalf("Failed to query audit log: %v", err)
+	}
+	expected := []audit.Entry{
+		{Op: "mkdir", Path: "/movies", UID: 1000, PID: 42},
+		{Op: "map", Path: "/movies/a.mkv", Source: "a.mkv", UID: 1000, PID: 42},
+		{Op: "move", Path: "/movies/a.mkv", NewPath: "/movies/b.mkv", Source: "a.mkv", UID: 1001, PID: 43},
+		{Op: "setxattr", Path: "/movies/b.mkv", Source: "a.mkv", Name: "user.tag", UID: 1001, PID: 43},
+		{Op: "rmxattr", Path: "/movies/b.mkv", Source: "a.mkv", Name: "user.tag", UID: uint32(os.Getuid()), PID: uint32(os.Getpid()), Via: "undo"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d audit entries, got %+v", len(expected), entries)
+	}
+	for i, entry := range entries {
+		if entry.Time.IsZero() {
+			t.Errorf("Entry %d has no timestamp", i)
+		}
+		entry.Time = time.Time{}
+		if entry != expected[i] {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, expected[i], entry)
+		}
+	}
+}
+
+func TestAuditReplaceState(t *testing.T) {
+	vfs, _, stateDir, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	before := &state.FSState{
+		Mappings: map[string]state.FileMapping{
+			"a.mkv": {VirtualPaths: []string{"/movies/a.mkv"}, Xattrs: map[string][]byte{"user.tag": []byte("tag")}},
+			"b.mkv": {VirtualPaths: []string{"/b.mkv"}},
+			"c.mkv": {VirtualPaths: []string{"/c.mkv"}},
+		},
+		Directories: map[string]bool{"/": true, "/movies": true},
+		Version:     state.CurrentVersion,
+	}
+	if err := vfs.ReplaceState("restore", before); err != nil {
+		t.Fatalf("Failed to replace state: %v", err)
+	}
+
+	auditPath := filepath.Join(stateDir, "audit.jsonl")
+	log, err := audit.Open(auditPath, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer log.Close()
+	vfs.SetAuditLog(log)
+
+	after := &state.FSState{
+		Mappings: map[string]state.FileMapping{
+			"a.mkv":     {VirtualPaths: []string{"/tv/a.mkv"}},
+			"new/b.mkv": {VirtualPaths: []string{"/b.mkv"}},
+			"d.mkv":     {VirtualPaths: []string{"/d.mkv"}},
+		},
+		Directories: map[string]bool{"/": true, "/tv": true},
+		Version:     state.CurrentVersion,
+	}
+	if err := vfs.ReplaceState("import", after); err != nil {
+		t.Fatalf("Failed to replace state: %v", err)
+	}
+
+	entries, err := audit.Query(auditPath, audit.Filter{})
+	if err != nil {
+		t.Fatalf("Failed to query audit log: %v", err)
+	}
+	uid, pid := uint32(os.Getuid()), uint32(os.Getpid())
+	expected := []audit.Entry{
+		{Op: "mkdir", Path: "/tv", UID: uid, PID: pid, Via: "import"},
+		{Op: "relink", Path: "/b.mkv", Source: "b.mkv", NewSource: "new/b.mkv", UID: uid, PID: pid, Via: "import"},
+		{Op: "move", Path: "/movies/a.mkv", NewPath: "/tv/a.mkv", Source: "a.mkv", UID: uid, PID: pid, Via: "import"},
+		{Op: "rmxattr", Path: "/tv/a.mkv", Source: "a.mkv", Name: "user.tag", UID: uid, PID: pid, Via: "import"},
+		{Op: "unmap", Path: "/c.mkv", Source: "c.mkv", UID: uid, PID: pid, Via: "import"},
+		{Op: "map", Path: "/d.mkv", Source: "d.mkv", UID: uid, PID: pid, Via: "import"},
+		{Op: "rmdir", Path: "/movies", UID: uid, PID: pid, Via: "import"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d audit entries, got %+v", len(expected), entries)
+	}
+	for i, entry := range entries {
+		entry.Time = time.Time{}
+		if entry != expected[i] {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, expected[i], entry)
+		}
+	}
+}
+
+func TestLoadDropsConflictingPaths(t *testing.T) {
+	stateDir := t.TempDir()
+	statePath := filepath.Join(stateDir, "state.json")
+	manager, err := state.NewManager(statePath)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	defer manager.Close()
+
+	fsState, err := manager.LoadState()
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	fsState.Mappings["a.mkv"] = state.FileMapping{VirtualPaths: []string{"/same.mkv"}}
+	fsState.Mappings["b.mkv"] = state.FileMapping{VirtualPaths: []string{"/same.mkv", "/b.mkv"}}
+	if err := manager.SaveState(fsState); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	if _, err := NewVMapFS(t.TempDir(), fsState, manager); err != nil {
+		t.Fatalf("Failed to create virtual filesystem: %v", err)
+	}
+	saved, err := state.ReadState(statePath)
+	if err != nil {
+		t.Fatalf("Failed to read state: %v", err)
+	}
+	if got := saved.Mappings["b.mkv"].VirtualPaths; !reflect.DeepEqual(got, []string{"/b.mkv"}) {
+		t.Errorf("Expected the losing path to be dropped from the saved state, got %v", got)
+	}
+	if got := saved.Mappings["a.mkv"].VirtualPaths; !reflect.DeepEqual(got, []string{"/same.mkv"}) {
+		t.Errorf("Expected a.mkv to keep its path, got %v", got)
+	}
+}
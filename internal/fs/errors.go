@@ -29,6 +29,19 @@ var (
 
 	// ErrAlreadyExists indicates path already exists
 	ErrAlreadyExists = errors.New("path already exists")
+
+	// ErrIsDirectory indicates a file operation on a directory
+	ErrIsDirectory = errors.New("is a directory")
+
+	// ErrNotDirectory indicates a directory operation on a file
+	ErrNotDirectory = errors.New("not a directory")
+
+	// ErrMoveIntoSelf indicates attempt to move a directory below itself
+	ErrMoveIntoSelf = errors.New("cannot move a directory into itself")
+
+	// ErrMultiplePaths indicates a source with other virtual paths where
+	// only one may be changed
+	ErrMultiplePaths = errors.New("source has more than one virtual path")
 )
 
 // FSError (renamed to Error because of linter) wraps filesystem
@@ -77,6 +90,16 @@ func ToFuseError(err error) error {
 			return syscall.ENOTEMPTY
 		case errors.Is(fsErr.Err, ErrAlreadyExists):
 			return syscall.EEXIST
+		case errors.Is(fsErr.Err, ErrIsDirectory):
+			return syscall.EISDIR
+		case errors.Is(fsErr.Err, ErrNotDirectory):
+			return syscall.ENOTDIR
+		case errors.Is(fsErr.Err, ErrMoveIntoSelf):
+			return syscall.EINVAL
+		case errors.Is(fsErr.Err, ErrMultiplePaths):
+			return syscall.EMLINK
+		case errors.Is(fsErr.Err, os.ErrNotExist):
+			return syscall.ENOENT
 		default:
 			errLogger.Debug("Unknown FSError type, returning EIO: %v", fsErr)
 			return syscall.EIO
@@ -109,16 +132,18 @@ func NewFSError(op string, path string, err error) *Error {
 
 // Common operation names for consistent logging and error reporting
 const (
-	OpLookup  = "lookup"  // Looking up a path
-	OpReadDir = "readdir" // Reading directory contents
-	OpOpen    = "open"    // Opening a file
-	OpRead    = "read"    // Reading from a file
-	OpCreate  = "create"  // Creating a new file
-	OpMkdir   = "mkdir"   // Creating a new directory
-	OpRemove  = "remove"  // Removing a file or directory
-	OpRename  = "rename"  // Renaming/moving a file or directory
-	OpSetattr = "setattr" // Setting file attributes
-	OpGetattr = "getattr" // Getting file attributes
+	OpLookup   = "lookup"   // Looking up a path
+	OpReadDir  = "readdir"  // Reading directory contents
+	OpOpen     = "open"     // Opening a file
+	OpRead     = "read"     // Reading from a file
+	OpCreate   = "create"   // Creating a new file
+	OpLink     = "link"     // Linking a file to another path
+	OpMkdir    = "mkdir"    // Creating a new directory
+	OpRemove   = "remove"   // Removing a file or directory
+	OpRename   = "rename"   // Renaming/moving a file or directory
+	OpSetattr  = "setattr"  // Setting file attributes
+	OpGetattr  = "getattr"  // Getting file attributes
+	OpRetarget = "retarget" // Pointing a virtual path at another source
 )
 
 // IsTemporary returns true if the error is likely temporary and the
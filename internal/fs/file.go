@@ -44,6 +44,7 @@ func (f *File) Attr(_ context.Context, a *fuse.Attr) error {
 	}
 
 	// Copy file attributes
+	a.Inode = f.fs.fileInode(f.sourcePath)
 	a.Mode = info.Mode()
 	a.Size = safeInt64ToUint64(info.Size())
 	a.Mtime = info.ModTime()
@@ -81,11 +82,15 @@ func (f *File) Open(_ context.Context, req *fuse.OpenRequest, resp *fuse.OpenRes
 
 	// Enable direct IO for better performance
 	resp.Flags |= fuse.OpenDirectIO
+	f.fs.openFiles.opened(req.Pid, f.sourcePath)
 
 	fileLogger.Debug("Successfully opened file %q", f.path.String())
 	return &FileHandle{
-		file: file,
-		path: f.path.String(),
+		file:      file,
+		path:      f.path.String(),
+		source:    f.sourcePath,
+		pid:       req.Pid,
+		openFiles: f.fs.openFiles,
 	}, nil
 }
 
@@ -121,6 +126,9 @@ func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
 	defer f.mu.Unlock()
 
 	fileLogger.Debug("Setting xattr %q for file %q (source: %q, size: %d bytes)", req.Name, f.path.String(), f.sourcePath.String(), len(req.Xattr))
+	if f.fs.readOnly {
+		return syscall.EROFS
+	}
 	f.fs.mu.Lock()
 	defer f.fs.mu.Unlock()
 
@@ -130,7 +138,7 @@ func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
 	f.fs.pathMapper.SetXattr(f.sourcePath, req.Name, value)
 
 	// Save the updated state
-	if err := f.fs.stateManager.SaveState(f.fs.state); err != nil {
+	if err := f.fs.saveState(req.Hdr()); err != nil {
 		fileLogger.Error("Failed to save state after setting xattr: %v", err)
 		return err
 	}
@@ -168,6 +176,9 @@ func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) er
 	defer f.mu.Unlock()
 
 	fileLogger.Debug("Removing xattr %q for file %q (source: %q)", req.Name, f.path.String(), f.sourcePath.String())
+	if f.fs.readOnly {
+		return syscall.EROFS
+	}
 	f.fs.mu.Lock()
 	defer f.fs.mu.Unlock()
 
@@ -183,7 +194,7 @@ func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) er
 	}
 
 	f.fs.pathMapper.RemoveXattr(f.sourcePath, req.Name)
-	if err := f.fs.stateManager.SaveState(f.fs.state); err != nil {
+	if err := f.fs.saveState(req.Hdr()); err != nil {
 		fileLogger.Error("Failed to save state after removing xattr: %v", err)
 		return err
 	}
@@ -195,9 +206,12 @@ func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) er
 // FileHandle represents an open file handle.
 // It manages access to an open file descriptor from the source filesystem.
 type FileHandle struct {
-	file *os.File
-	path string // For logging purposes
-	mu   sync.RWMutex
+	file      *os.File
+	path      string       // For logging purposes
+	source    *SourcePath  // Source file that is open
+	pid       uint32       // Process that opened it
+	openFiles *openSources // Tracks the handle while it is open
+	mu        sync.RWMutex
 }
 
 // Read implements the HandleReader interface, reading data from the file.
@@ -226,5 +240,12 @@ func (fh *FileHandle) Release(_ context.Context, _ *fuse.ReleaseRequest) error {
 	defer fh.mu.Unlock()
 
 	fileLogger.Debug("Closing file %q", fh.path)
+	fh.openFiles.closed(fh.pid, fh.source)
 	return fh.file.Close()
 }
+
+// Forget implements the NodeForgetter interface, dropping the node once the
+// kernel no longer refers to it.
+func (f *File) Forget() {
+	f.fs.nodes.forget(nodeKey{path: f.path.String()}, f)
+}
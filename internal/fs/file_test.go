@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 
 	"bazil.org/fuse"
@@ -167,6 +168,155 @@ func TestFileOperations(t *testing.T) {
 		}
 	})
 
+	// Test hard linking a mapped file adds a second virtual path
+	t.Run("FileLink", func(t *testing.T) {
+		root, _ := vfs.Root()
+		mappedDir, err := root.(*Dir).Lookup(ctx, "mapped")
+		if err != nil {
+			t.Fatalf("Failed to lookup mapped directory: %v", err)
+		}
+
+		fileNode, err := mappedDir.(*Dir).Lookup(ctx, "testfile.txt")
+		if err != nil {
+			t.Fatalf("Failed to lookup file: %v", err)
+		}
+
+		linkDir, err := root.(*Dir).Mkdir(ctx, &fuse.MkdirRequest{Name: "links"})
+		if err != nil {
+			t.Fatalf("Failed to create links directory: %v", err)
+		}
+
+		linked, err := linkDir.(*Dir).Link(ctx, &fuse.LinkRequest{NewName: "copy.txt"}, fileNode)
+		if err != nil {
+			t.Fatalf("Failed to link file: %v", err)
+		}
+		if linked.(*File).sourcePath.String() != "testfile.txt" {
+			t.Errorf("Expected link to point at testfile.txt, got %q", linked.(*File).sourcePath.String())
+		}
+
+		if _, err := mappedDir.(*Dir).Lookup(ctx, "testfile.txt"); err != nil {
+			t.Error("Original path should still exist after link")
+		}
+		if _, err := linkDir.(*Dir).Lookup(ctx, "copy.txt"); err != nil {
+			t.Error("Linked path should exist")
+		}
+
+		if _, err := linkDir.(*Dir).Link(ctx, &fuse.LinkRequest{NewName: "copy.txt"}, fileNode); err != syscall.EEXIST {
+			t.Errorf("Expected EEXIST linking onto an existing path, got %v", err)
+		}
+
+		if err := os.Remove(testFilePath); err != nil {
+			t.Fatalf("Failed to remove source file: %v", err)
+		}
+		if _, err := linkDir.(*Dir).Link(ctx, &fuse.LinkRequest{NewName: "gone.txt"}, fileNode); err != syscall.ENOENT {
+			t.Errorf("Expected ENOENT linking a missing source, got %v", err)
+		}
+		if err := os.WriteFile(testFilePath, testContent, 0644); err != nil {
+			t.Fatalf("Failed to restore source file: %v", err)
+		}
+	})
+
+	// Test copying a mapped file with cp adds a virtual path like a link,
+	// once the data written turns out to be the file's
+	t.Run("FileCopy", func(t *testing.T) {
+		root, _ := vfs.Root()
+		mappedDir, err := root.(*Dir).Lookup(ctx, "mapped")
+		if err != nil {
+			t.Fatalf("Failed to lookup mapped directory: %v", err)
+		}
+		fileNode, err := mappedDir.(*Dir).Lookup(ctx, "testfile.txt")
+		if err != nil {
+			t.Fatalf("Failed to lookup file: %v", err)
+		}
+
+		create := func(name string, pid uint32) (*copyTarget, error) {
+			req := &fuse.CreateRequest{Header: fuse.Header{Pid: pid}, Name: name, Flags: fuse.OpenWriteOnly}
+			node, _, err := root.(*Dir).Create(ctx, req, &fuse.CreateResponse{})
+			if err != nil {
+				return nil, err
+			}
+			return node.(*copyTarget), nil
+		}
+		write := func(target *copyTarget, offset int64, data []byte) error {
+			return target.Write(ctx, &fuse.WriteRequest{Offset: offset, Data: data}, &fuse.WriteResponse{})
+		}
+		mapped := func(name string) bool {
+			_, exists := vfs.pathMapper.GetSourcePath(NewVirtualPath("/" + name))
+			return exists
+		}
+
+		if _, err := create("cp.txt", 42); err != syscall.EPERM {
+			t.Errorf("Expected EPERM creating a file that is not a copy, got %v", err)
+		}
+
+		open := &fuse.OpenRequest{Header: fuse.Header{Pid: 42}, Flags: fuse.OpenReadOnly}
+		handle, err := fileNode.(*File).Open(ctx, open, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatalf("Failed to open file: %v", err)
+		}
+
+		if _, err := create("cp.txt", 43); err != syscall.EPERM {
+			t.Errorf("Expected EPERM creating a file from another process, got %v", err)
+		}
+
+		// Writing something else, like an editor's swap file, fails
+		other, err := create("other.swp", 42)
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		if err := write(other, 0, []byte("not the file")); err != syscall.EIO {
+			t.Errorf("Expected EIO writing other data, got %v", err)
+		}
+		if err := other.Flush(ctx, &fuse.FlushRequest{}); err != syscall.EIO || mapped("other.swp") {
+			t.Errorf("Expected closing a failed copy to fail without mapping it, got %v", err)
+		}
+		other.Release(ctx, &fuse.ReleaseRequest{})
+
+		// Closing a partial copy fails
+		partial, err := create("partial.txt", 42)
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		if err := write(partial, 0, testContent[:4]); err != nil {
+			t.Errorf("Expected the start of the file to be accepted, got %v", err)
+		}
+		if err := partial.Flush(ctx, &fuse.FlushRequest{}); err != syscall.EIO || mapped("partial.txt") {
+			t.Errorf("Expected closing a partial copy to fail without mapping it, got %v", err)
+		}
+		partial.Release(ctx, &fuse.ReleaseRequest{})
+
+		copied, err := create("cp.txt", 42)
+		if err != nil {
+			t.Fatalf("Failed to create copy: %v", err)
+		}
+		for _, offset := range []int{0, 4} {
+			end := offset + 4
+			if offset > 0 {
+				end = len(testContent)
+			}
+			if err := write(copied, int64(offset), testContent[offset:end]); err != nil {
+				t.Fatalf("Expected the copied data to be accepted, got %v", err)
+			}
+		}
+		if mapped("cp.txt") {
+			t.Error("Expected the copy to be mapped only once it is closed")
+		}
+		if err := copied.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+			t.Fatalf("Failed to close copy: %v", err)
+		}
+		copied.Release(ctx, &fuse.ReleaseRequest{})
+		if sp, exists := vfs.pathMapper.GetSourcePath(NewVirtualPath("/cp.txt")); !exists || sp.String() != "testfile.txt" {
+			t.Error("Expected the copy to be mapped to the source")
+		}
+
+		if err := handle.(*FileHandle).Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+			t.Fatalf("Failed to close file: %v", err)
+		}
+		if _, err := create("again.txt", 42); err != syscall.EPERM {
+			t.Errorf("Expected EPERM once the process closed the file, got %v", err)
+		}
+	})
+
 	// Test file rename (moved after FileXattrOperations)
 	t.Run("FileRename", func(t *testing.T) {
 		root, _ := vfs.Root()
@@ -0,0 +1,287 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"vmapfs/internal/logging"
+	"vmapfs/internal/state"
+)
+
+var (
+	historyLogger = logging.GetLogger().WithPrefix("history")
+
+	// ErrNothingToUndo indicates that the undo history is empty
+	ErrNothingToUndo = errors.New("nothing to undo")
+
+	// ErrNothingToRedo indicates that there is no undone operation to redo
+	ErrNothingToRedo = errors.New("nothing to redo")
+)
+
+// DefaultHistorySize is how many operations can be undone by default
+const DefaultHistorySize = 100
+
+// HistoryEntry is a completed filesystem operation, such as a rename, along
+// with the ops that reverse it
+type HistoryEntry struct {
+	Time time.Time  `json:"time"`
+	Ops  []state.Op `json:"ops"`  // Ops made by the operation, in order
+	Undo []state.Op `json:"undo"` // Ops that reverse Ops, in order
+}
+
+// history holds the operations that can be undone, oldest first, and the
+// ones that have been undone and can be redone, most recently undone last
+type history struct {
+	size int
+	undo []HistoryEntry
+	redo []HistoryEntry
+}
+
+// push records a completed operation. A new operation makes the undone
+// ones unreachable, so the redo stack is cleared.
+func (h *history) push(entry HistoryEntry) {
+	if h.size <= 0 {
+		return
+	}
+	h.undo = append(h.undo, entry)
+	if excess := len(h.undo) - h.size; excess > 0 {
+		h.undo = append([]HistoryEntry(nil), h.undo[excess:]...)
+	}
+	h.redo = nil
+}
+
+// clear forgets every operation, for when the state is replaced wholesale
+func (h *history) clear() {
+	h.undo = nil
+	h.redo = nil
+}
+
+// SetHistorySize bounds how many operations can be undone. A size of zero
+// disables the history.
+func (vfs *VMapFS) SetHistorySize(size int) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	vfsLogger.Debug("Keeping up to %d operations for undo", size)
+	vfs.history.size = size
+	if excess := len(vfs.history.undo) - size; excess > 0 {
+		vfs.history.undo = vfs.history.undo[excess:]
+	}
+}
+
+// History returns the operations that can be undone, most recent first
+func (vfs *VMapFS) History() []HistoryEntry {
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+
+	entries := make([]HistoryEntry, 0, len(vfs.history.undo))
+	for i := len(vfs.history.undo) - 1; i >= 0; i-- {
+		entries = append(entries, vfs.history.undo[i])
+	}
+	return entries
+}
+
+// Undo reverses the last n operations, most recent first, and returns the
+// entries that were undone. It stops at the first operation that can no
+// longer be reversed, leaving that operation in place.
+func (vfs *VMapFS) Undo(n int) ([]HistoryEntry, error) {
+	return vfs.step(n, "undo", &vfs.history.undo, &vfs.history.redo, ErrNothingToUndo, func(entry HistoryEntry) []state.Op {
+		return entry.Undo
+	})
+}
+
+// Redo repeats the last n undone operations and returns their entries
+func (vfs *VMapFS) Redo(n int) ([]HistoryEntry, error) {
+	return vfs.step(n, "redo", &vfs.history.redo, &vfs.history.undo, ErrNothingToRedo, func(entry HistoryEntry) []state.Op {
+		return entry.Ops
+	})
+}
+
+// step replays up to n entries taken from the end of from, moving each
+// replayed entry onto to. The changes are saved and audited like any other
+// operation, as made by the via command, and the kernel's cache of the
+// affected entries is invalidated.
+func (vfs *VMapFS) step(n int, via string, from, to *[]HistoryEntry, empty error, opsOf func(HistoryEntry) []state.Op) ([]HistoryEntry, error) {
+	vfs.mu.Lock()
+	if len(*from) == 0 {
+		vfs.mu.Unlock()
+		return nil, empty
+	}
+
+	var done []HistoryEntry
+	var replayErr error
+	for ; n > 0 && len(*from) > 0; n-- {
+		entry := (*from)[len(*from)-1]
+		if replayErr = vfs.replay(opsOf(entry)); replayErr != nil {
+			break
+		}
+		*from = (*from)[:len(*from)-1]
+		*to = append(*to, entry)
+		done = append(done, entry)
+	}
+
+	names := affectedRootNames(done)
+	vfs.auditOps(safeIntToUint32(os.Getuid()), safeIntToUint32(os.Getpid()), via)
+	saveErr := vfs.persistOps()
+	vfs.mu.Unlock()
+
+	vfs.invalidateEntries(vfs.root, names)
+	if replayErr != nil {
+		return done, replayErr
+	}
+	return done, saveErr
+}
+
+// replay applies ops through the path mapper. If one of them fails, the
+// ones already applied are reversed, so the state is left as it was. It
+// must be called with vfs.mu held.
+func (vfs *VMapFS) replay(ops []state.Op) error {
+	start := len(vfs.txUndo)
+	for _, op := range ops {
+		historyLogger.Debug("Replaying %s", op)
+		if err := vfs.applyOp(op); err != nil {
+			historyLogger.Warn("Cannot replay %s: %v", op, err)
+			vfs.rollback(start)
+			return fmt.Errorf("cannot replay %s: %w", op, err)
+		}
+	}
+	return nil
+}
+
+// rollback reverses the ops the operation in progress recorded after the
+// first start of them and forgets them, leaving the state as it was before.
+// It must be called with vfs.mu held.
+func (vfs *VMapFS) rollback(start int) {
+	applied := append([]state.Op(nil), vfs.txUndo[start:]...)
+	for i := len(applied) - 1; i >= 0; i-- {
+		if err := vfs.applyOp(applied[i]); err != nil {
+			historyLogger.Error("Failed to roll back %s: %v", applied[i], err)
+		}
+	}
+	vfs.txOps, vfs.txUndo = vfs.txOps[:start], vfs.txUndo[:start]
+}
+
+// applyOp performs op through the path mapper, except for inode ops, which
+// the path mapper knows nothing of. It must be called with vfs.mu held.
+func (vfs *VMapFS) applyOp(op state.Op) error {
+	if op.Kind != state.OpInode {
+		return vfs.pathMapper.Apply(op)
+	}
+	// Directory inodes are kept by path
+	inverse := vfs.syncedState().InodeOf(op)
+	if err := vfs.state.Apply(op); err != nil {
+		return err
+	}
+	vfs.recordOp(op, inverse)
+	return nil
+}
+
+// affectedRootNames returns the root entries below which the entries'
+// ops made changes. Xattrs are not cached by the kernel, so xattr ops
+// don't count.
+func affectedRootNames(entries []HistoryEntry) []string {
+	var paths []string
+	for _, entry := range entries {
+		for _, op := range entry.Ops {
+			switch op.Kind {
+			case state.OpMap, state.OpUnmap:
+				// The source also appears in or disappears from _UNSORTED
+				paths = append(paths, "/_UNSORTED")
+			case state.OpSetXattr, state.OpRemoveXattr, state.OpFingerprint, state.OpInode:
+				continue
+			case state.OpRelink, state.OpRetarget:
+				// The sources swap places in _UNSORTED
+				paths = append(paths, "/_UNSORTED")
+			}
+			paths = append(paths, op.Path, op.NewPath)
+		}
+	}
+	return rootNamesOf(paths)
+}
+
+// Apply performs op through the mapper, as if the filesystem operation that
+// recorded it was repeated. Unlike state.FSState.Apply it refuses ops that
+// no longer fit the current tree, such as a move onto an existing path.
+func (pm *PathMapper) Apply(op state.Op) error {
+	switch op.Kind {
+	case state.OpMap:
+		vp := NewVirtualPath(op.Path)
+		if pm.tree.lookup(op.Path) != nil {
+			return ErrAlreadyExists
+		}
+		if err := pm.AddMapping(vp, NewSourcePath(op.Source)); err != nil {
+			return fmt.Errorf("cannot map %s: %w", op.Source, err)
+		}
+
+	case state.OpUnmap:
+		if sp, exists := pm.GetSourcePath(NewVirtualPath(op.Path)); !exists || sp.String() != op.Source {
+			return ErrPathNotFound
+		}
+		pm.RemoveMapping(NewVirtualPath(op.Path))
+
+	case state.OpMove:
+		if sp, exists := pm.GetSourcePath(NewVirtualPath(op.Path)); !exists || sp.String() != op.Source {
+			return ErrPathNotFound
+		}
+		if pm.tree.lookup(op.NewPath) != nil {
+			return ErrAlreadyExists
+		}
+		pm.moveFile(op.Source, op.Path, op.NewPath)
+
+	case state.OpMkdir:
+		pm.AddDirectory(NewVirtualPath(op.Path))
+		if !pm.IsDirectory(NewVirtualPath(op.Path)) {
+			return ErrNotDirectory
+		}
+
+	case state.OpRmdir:
+		return pm.RemoveDirectory(NewVirtualPath(op.Path))
+
+	case state.OpRenameDir:
+		if !pm.IsDirectory(NewVirtualPath(op.Path)) {
+			return ErrPathNotFound
+		}
+		if pm.tree.lookup(op.NewPath) != nil {
+			return ErrAlreadyExists
+		}
+		pm.RenameDirectory(NewVirtualPath(op.Path), NewVirtualPath(op.NewPath))
+
+	case state.OpSetXattr:
+		pm.SetXattr(NewSourcePath(op.Source), op.Name, op.Value)
+
+	case state.OpRemoveXattr:
+		pm.RemoveXattr(NewSourcePath(op.Source), op.Name)
+
+	case state.OpRelink:
+		return pm.Relink(NewSourcePath(op.Source), NewSourcePath(op.NewSource))
+
+	case state.OpFingerprint:
+		pm.SetFingerprint(NewSourcePath(op.Source), op.Fingerprint)
+
+	case state.OpRetarget:
+		if _, exists := pm.mappings[op.Source]; !exists {
+			return ErrPathNotFound
+		}
+		if _, taken := pm.mappings[op.NewSource]; taken {
+			return ErrAlreadyExists
+		}
+		pm.moveRecord(op.Kind, op.Source, op.NewSource, op.Path, op.History, op.Fingerprint)
+
+	case state.OpForget:
+		mapping, exists := pm.mappings[op.Source]
+		if !exists {
+			return nil
+		}
+		if !mapping.IsEmpty() {
+			return ErrAlreadyExists
+		}
+		delete(pm.mappings, op.Source)
+		pm.record(op, op)
+
+	default:
+		return fmt.Errorf("cannot apply %s op", op.Kind)
+	}
+	return nil
+}
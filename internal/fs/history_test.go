@@ -0,0 +1,205 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"vmapfs/internal/state"
+
+	"bazil.org/fuse"
+)
+
+func TestUndoRedo(t *testing.T) {
+	vfs, sourceDir, stateDir, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, name := range []string{"a.mkv", "show/e1.mkv", "show/e2.mkv"} {
+		full := filepath.Join(sourceDir, name)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("Failed to create source directory: %v", err)
+		}
+		if err := os.WriteFile(full, []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	root, _ := vfs.Root()
+	rootDir := root.(*Dir)
+	unsorted, _ := rootDir.Lookup(ctx, "_UNSORTED")
+
+	movies, err := rootDir.Mkdir(ctx, &fuse.MkdirRequest{Name: "movies"})
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	tv, err := rootDir.Mkdir(ctx, &fuse.MkdirRequest{Name: "tv"})
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := unsorted.(*UnsortedDir).Rename(ctx, &fuse.RenameRequest{OldName: "a.mkv", NewName: "a.mkv"}, movies); err != nil {
+		t.Fatalf("Failed to map file: %v", err)
+	}
+	if err := unsorted.(*UnsortedDir).Rename(ctx, &fuse.RenameRequest{OldName: "show", NewName: "show"}, tv); err != nil {
+		t.Fatalf("Failed to map directory: %v", err)
+	}
+	fileNode, _ := movies.(*Dir).Lookup(ctx, "a.mkv")
+	if err := fileNode.(*File).Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.tag", Xattr: []byte("tag")}); err != nil {
+		t.Fatalf("Failed to set xattr: %v", err)
+	}
+	withXattr := vfs.Snapshot()
+
+	// The fat-fingered move
+	if err := movies.(*Dir).Rename(ctx, &fuse.RenameRequest{OldName: "a.mkv", NewName: "a.mkv"}, tv); err != nil {
+		t.Fatalf("Failed to move file: %v", err)
+	}
+	moved := vfs.Snapshot()
+
+	if got := len(vfs.History()); got != 6 {
+		t.Fatalf("Expected 6 operations in the history, got %d", got)
+	}
+
+	t.Run("UndoMove", func(t *testing.T) {
+		undone, err := vfs.Undo(1)
+		if err != nil {
+			t.Fatalf("Failed to undo: %v", err)
+		}
+		if len(undone) != 1 || undone[0].Ops[0].Kind != state.OpMove {
+			t.Fatalf("Expected the move to be undone, got %+v", undone)
+		}
+		if !reflect.DeepEqual(vfs.Snapshot(), withXattr) {
+			t.Errorf("Expected the state before the move, got %+v", vfs.Snapshot())
+		}
+
+		onDisk, err := state.ReadState(filepath.Join(stateDir, "state.json"))
+		if err != nil {
+			t.Fatalf("Failed to read state: %v", err)
+		}
+		if got := onDisk.Mappings["a.mkv"].VirtualPaths; !reflect.DeepEqual(got, []string{"/movies/a.mkv"}) {
+			t.Errorf("Expected the undo to be saved, got %v", got)
+		}
+	})
+
+	t.Run("Redo", func(t *testing.T) {
+		if _, err := vfs.Redo(1); err != nil {
+			t.Fatalf("Failed to redo: %v", err)
+		}
+		if !reflect.DeepEqual(vfs.Snapshot(), moved) {
+			t.Errorf("Expected the state after the move, got %+v", vfs.Snapshot())
+		}
+		if _, err := vfs.Redo(1); !errors.Is(err, ErrNothingToRedo) {
+			t.Errorf("Expected ErrNothingToRedo, got %v", err)
+		}
+	})
+
+	t.Run("UndoRemoveKeepsXattrs", func(t *testing.T) {
+		if err := tv.(*Dir).Remove(ctx, &fuse.RemoveRequest{Name: "a.mkv"}); err != nil {
+			t.Fatalf("Failed to remove file: %v", err)
+		}
+		if _, err := vfs.Undo(1); err != nil {
+			t.Fatalf("Failed to undo: %v", err)
+		}
+		if !reflect.DeepEqual(vfs.Snapshot(), moved) {
+			t.Errorf("Expected the removed file to be back, got %+v", vfs.Snapshot())
+		}
+	})
+
+	t.Run("NewOperationClearsRedo", func(t *testing.T) {
+		if _, err := vfs.Undo(1); err != nil {
+			t.Fatalf("Failed to undo: %v", err)
+		}
+		if _, err := rootDir.Mkdir(ctx, &fuse.MkdirRequest{Name: "music"}); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if _, err := vfs.Redo(1); !errors.Is(err, ErrNothingToRedo) {
+			t.Errorf("Expected ErrNothingToRedo after a new operation, got %v", err)
+		}
+	})
+
+	t.Run("UndoAll", func(t *testing.T) {
+		undone, err := vfs.Undo(100)
+		if err != nil {
+			t.Fatalf("Failed to undo: %v", err)
+		}
+		if len(undone) != 6 {
+			t.Errorf("Expected 6 operations to be undone, got %d", len(undone))
+		}
+		snapshot := vfs.Snapshot()
+		if len(snapshot.Mappings) != 0 || !reflect.DeepEqual(snapshot.Directories, map[string]bool{"/": true}) {
+			t.Errorf("Expected an empty state, got %+v", snapshot)
+		}
+		if _, err := vfs.Undo(1); !errors.Is(err, ErrNothingToUndo) {
+			t.Errorf("Expected ErrNothingToUndo, got %v", err)
+		}
+
+		if _, err := vfs.Redo(100); err != nil {
+			t.Fatalf("Failed to redo: %v", err)
+		}
+		if got := vfs.Snapshot(); !got.Directories["/music"] || !reflect.DeepEqual(got.Mappings, withXattr.Mappings) {
+			t.Errorf("Expected every operation to be redone, got %+v", got)
+		}
+	})
+}
+
+func TestUndoRollsBack(t *testing.T) {
+	vfs, sourceDir, _, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, name := range []string{"a.mkv", "b.mkv"} {
+		if err := os.WriteFile(filepath.Join(sourceDir, name), []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	root, _ := vfs.Root()
+	rootDir := root.(*Dir)
+	unsorted, _ := rootDir.Lookup(ctx, "_UNSORTED")
+	for _, name := range []string{"a.mkv", "b.mkv"} {
+		if err := unsorted.(*UnsortedDir).Rename(ctx, &fuse.RenameRequest{OldName: name, NewName: name}, rootDir); err != nil {
+			t.Fatalf("Failed to map %q: %v", name, err)
+		}
+	}
+	if err := rootDir.Rename(ctx, &fuse.RenameRequest{OldName: "b.mkv", NewName: "a.mkv"}, rootDir); err != nil {
+		t.Fatalf("Failed to rename over existing file: %v", err)
+	}
+	before := vfs.Snapshot()
+
+	// Undoing the rename has to map a.mkv again, which is gone by now
+	if err := os.Remove(filepath.Join(sourceDir, "a.mkv")); err != nil {
+		t.Fatalf("Failed to remove source file: %v", err)
+	}
+	if _, err := vfs.Undo(1); err == nil {
+		t.Fatal("Expected undo to fail")
+	}
+	if !reflect.DeepEqual(vfs.Snapshot(), before) {
+		t.Errorf("Expected a failed undo to leave the state alone, got %+v", vfs.Snapshot())
+	}
+	if got := len(vfs.History()); got != 3 {
+		t.Errorf("Expected the failed operation to stay in the history, got %d entries", got)
+	}
+}
+
+func TestHistorySize(t *testing.T) {
+	vfs, _, _, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	vfs.SetHistorySize(2)
+	root, _ := vfs.Root()
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := root.(*Dir).Mkdir(context.Background(), &fuse.MkdirRequest{Name: name}); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+	}
+
+	entries := vfs.History()
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 operations in the history, got %d", len(entries))
+	}
+	if entries[0].Ops[0].Path != "/c" || entries[1].Ops[0].Path != "/b" {
+		t.Errorf("Expected the most recent operations first, got %+v", entries)
+	}
+}
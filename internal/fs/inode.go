@@ -0,0 +1,154 @@
+package fs
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"vmapfs/internal/state"
+
+	fusefs "bazil.org/fuse/fs"
+)
+
+// unsortedInodeBit is set in the inodes of _UNSORTED entries, which are
+// derived from their source paths. The inodes stored in the state count up
+// from one and never get near it.
+const unsortedInodeBit = 1 << 63
+
+// nodeKey identifies a node by what it shows: a virtual path, or a source
+// path under _UNSORTED
+type nodeKey struct {
+	unsorted bool
+	path     string
+}
+
+// nodeCache hands out the same node for the same entry for as long as the
+// kernel holds on to it, so that the FUSE server keeps giving it the same
+// node ID. Nodes are dropped when the kernel forgets them.
+type nodeCache struct {
+	nodes map[nodeKey]fusefs.Node
+	mu    sync.Mutex
+}
+
+// get returns the cached node for key if valid accepts it, or else caches
+// and returns the one create makes
+func (nc *nodeCache) get(key nodeKey, valid func(fusefs.Node) bool, create func() fusefs.Node) fusefs.Node {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	if node, exists := nc.nodes[key]; exists && valid(node) {
+		return node
+	}
+	if nc.nodes == nil {
+		nc.nodes = make(map[nodeKey]fusefs.Node)
+	}
+	node := create()
+	nc.nodes[key] = node
+	return node
+}
+
+// forget drops node from the cache, unless another node has replaced it
+func (nc *nodeCache) forget(key nodeKey, node fusefs.Node) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	if nc.nodes[key] == node {
+		delete(nc.nodes, key)
+	}
+}
+
+// dirNode returns the node of the virtual directory vp
+func (vfs *VMapFS) dirNode(vp *VirtualPath) *Dir {
+	node := vfs.nodes.get(nodeKey{path: vp.String()},
+		func(node fusefs.Node) bool {
+			_, isDir := node.(*Dir)
+			return isDir
+		},
+		func() fusefs.Node {
+			return &Dir{fs: vfs, path: vp}
+		})
+	return node.(*Dir)
+}
+
+// fileNode returns the node of the virtual path vp mapped to sp
+func (vfs *VMapFS) fileNode(vp *VirtualPath, sp *SourcePath) *File {
+	node := vfs.nodes.get(nodeKey{path: vp.String()},
+		func(node fusefs.Node) bool {
+			file, isFile := node.(*File)
+			return isFile && file.sourcePath.String() == sp.String()
+		},
+		func() fusefs.Node {
+			return &File{fs: vfs, path: vp, sourcePath: sp}
+		})
+	return node.(*File)
+}
+
+// unsortedDirNode returns the _UNSORTED node of the source directory sp
+func (vfs *VMapFS) unsortedDirNode(sp *SourcePath) *UnsortedDir {
+	node := vfs.nodes.get(nodeKey{unsorted: true, path: sp.String()},
+		func(node fusefs.Node) bool {
+			_, isDir := node.(*UnsortedDir)
+			return isDir
+		},
+		func() fusefs.Node {
+			return NewUnsortedDir(vfs, sp)
+		})
+	return node.(*UnsortedDir)
+}
+
+// unsortedFileNode returns the _UNSORTED node of the source file sp
+func (vfs *VMapFS) unsortedFileNode(sp *SourcePath) *UnsortedFile {
+	node := vfs.nodes.get(nodeKey{unsorted: true, path: sp.String()},
+		func(node fusefs.Node) bool {
+			_, isFile := node.(*UnsortedFile)
+			return isFile
+		},
+		func() fusefs.Node {
+			return &UnsortedFile{fs: vfs, path: sp}
+		})
+	return node.(*UnsortedFile)
+}
+
+// dirInode returns the persisted inode of the virtual directory vp, or zero
+// to let the FUSE server make one up. Snapshots share the mount with the
+// live tree and the same numbers, so they always make them up.
+func (vfs *VMapFS) dirInode(vp *VirtualPath) uint64 {
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+	return vfs.dirInodeLocked(vp)
+}
+
+// dirInodeLocked is dirInode for callers that hold vfs.mu
+func (vfs *VMapFS) dirInodeLocked(vp *VirtualPath) uint64 {
+	if vfs.readOnly {
+		return 0
+	}
+	if vp.IsRoot() {
+		return state.RootInode
+	}
+	return vfs.state.DirectoryInodes[vfs.pathMapper.recordedPath(vp)]
+}
+
+// fileInode returns the persisted inode of the source sp, which all of its
+// virtual paths share, or zero to let the FUSE server make one up
+func (vfs *VMapFS) fileInode(sp *SourcePath) uint64 {
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+	return vfs.fileInodeLocked(sp)
+}
+
+// fileInodeLocked is fileInode for callers that hold vfs.mu
+func (vfs *VMapFS) fileInodeLocked(sp *SourcePath) uint64 {
+	if vfs.readOnly {
+		return 0
+	}
+	return vfs.state.Mappings[sp.String()].Inode
+}
+
+// unsortedInode returns the inode of the _UNSORTED entry of sp. Unsorted
+// entries are not stored in the state, so it is derived from the source
+// path, which keeps it stable for as long as the source stays put.
+func unsortedInode(sp *SourcePath) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(sp.String()))
+	return hash.Sum64() | unsortedInodeBit
+}
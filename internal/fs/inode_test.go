@@ -0,0 +1,198 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"vmapfs/internal/state"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+)
+
+func TestInodes(t *testing.T) {
+	vfs, sourceDir, stateDir, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	for _, name := range []string{"a.mkv", "b.mkv", "c.mkv"} {
+		if err := os.WriteFile(filepath.Join(sourceDir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	inodeOf := func(node fusefs.Node) uint64 {
+		t.Helper()
+		var attr fuse.Attr
+		if err := node.Attr(ctx, &attr); err != nil {
+			t.Fatalf("Attr failed: %v", err)
+		}
+		return attr.Inode
+	}
+	lookup := func(vfs *VMapFS, vpath ...string) fusefs.Node {
+		t.Helper()
+		node, _ := vfs.Root()
+		for _, name := range vpath {
+			var err error
+			if node, err = node.(fusefs.NodeStringLookuper).Lookup(ctx, name); err != nil {
+				t.Fatalf("Failed to lookup %v: %v", vpath, err)
+			}
+		}
+		return node
+	}
+
+	root := lookup(vfs).(*Dir)
+	unsorted := lookup(vfs, "_UNSORTED").(*UnsortedDir)
+	movies, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "movies"})
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	for _, name := range []string{"a.mkv", "b.mkv"} {
+		if err := unsorted.Rename(ctx, &fuse.RenameRequest{OldName: name, NewName: name}, movies); err != nil {
+			t.Fatalf("Failed to move %q from _UNSORTED: %v", name, err)
+		}
+	}
+
+	rootInode, moviesInode := inodeOf(root), inodeOf(movies)
+	aInode, bInode := inodeOf(lookup(vfs, "movies", "a.mkv")), inodeOf(lookup(vfs, "movies", "b.mkv"))
+	seen := make(map[uint64]bool)
+	for _, inode := range []uint64{rootInode, moviesInode, aInode, bInode} {
+		if inode == 0 || seen[inode] {
+			t.Fatalf("Expected distinct inodes, got root=%d movies=%d a=%d b=%d", rootInode, moviesInode, aInode, bInode)
+		}
+		seen[inode] = true
+	}
+	if rootInode != state.RootInode {
+		t.Errorf("Expected the root to have inode %d, got %d", state.RootInode, rootInode)
+	}
+
+	t.Run("SameNode", func(t *testing.T) {
+		if lookup(vfs, "movies") != movies || lookup(vfs, "movies", "a.mkv") != lookup(vfs, "movies", "a.mkv") {
+			t.Error("Expected lookups to return the same node")
+		}
+		file := lookup(vfs, "movies", "a.mkv").(*File)
+		file.Forget()
+		if lookup(vfs, "movies", "a.mkv") == file {
+			t.Error("Expected a forgotten node to be replaced")
+		}
+	})
+
+	t.Run("Unsorted", func(t *testing.T) {
+		inode := inodeOf(lookup(vfs, "_UNSORTED", "c.mkv"))
+		if inode&unsortedInodeBit == 0 || inode != unsortedInode(NewSourcePath("c.mkv")) {
+			t.Errorf("Expected an inode derived from the source path, got %d", inode)
+		}
+	})
+
+	t.Run("Link", func(t *testing.T) {
+		linked, err := root.Link(ctx, &fuse.LinkRequest{NewName: "a.mkv"}, lookup(vfs, "movies", "a.mkv"))
+		if err != nil {
+			t.Fatalf("Failed to link: %v", err)
+		}
+		if inode := inodeOf(linked); inode != aInode {
+			t.Errorf("Expected a hard link to share inode %d, got %d", aInode, inode)
+		}
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		if err := root.Rename(ctx, &fuse.RenameRequest{OldName: "movies", NewName: "films"}, root); err != nil {
+			t.Fatalf("Failed to rename directory: %v", err)
+		}
+		films := lookup(vfs, "films")
+		if err := films.(*Dir).Rename(ctx, &fuse.RenameRequest{OldName: "a.mkv", NewName: "A.mkv"}, films); err != nil {
+			t.Fatalf("Failed to rename file: %v", err)
+		}
+		if inode := inodeOf(films); inode != moviesInode {
+			t.Errorf("Expected the renamed directory to keep inode %d, got %d", moviesInode, inode)
+		}
+		if inode := inodeOf(lookup(vfs, "films", "A.mkv")); inode != aInode {
+			t.Errorf("Expected the renamed file to keep inode %d, got %d", aInode, inode)
+		}
+
+		if _, err := vfs.Undo(2); err != nil {
+			t.Fatalf("Undo failed: %v", err)
+		}
+		if inode := inodeOf(lookup(vfs, "movies")); inode != moviesInode {
+			t.Errorf("Expected undo to keep inode %d, got %d", moviesInode, inode)
+		}
+		if _, err := vfs.Redo(2); err != nil {
+			t.Fatalf("Redo failed: %v", err)
+		}
+	})
+
+	t.Run("Restart", func(t *testing.T) {
+		saved, err := state.ReadState(filepath.Join(stateDir, "state.json"))
+		if err != nil {
+			t.Fatalf("Failed to read state: %v", err)
+		}
+		restarted, err := NewVMapFS(sourceDir, saved, nil)
+		if err != nil {
+			t.Fatalf("Failed to create virtual filesystem: %v", err)
+		}
+		for _, tc := range []struct {
+			vpath []string
+			want  uint64
+		}{
+			{[]string{"films"}, moviesInode},
+			{[]string{"films", "A.mkv"}, aInode},
+			{[]string{"films", "b.mkv"}, bInode},
+			{[]string{"a.mkv"}, aInode},
+		} {
+			if inode := inodeOf(lookup(restarted, tc.vpath...)); inode != tc.want {
+				t.Errorf("Expected %v to keep inode %d after a restart, got %d", tc.vpath, tc.want, inode)
+			}
+		}
+	})
+
+	t.Run("ReadDir", func(t *testing.T) {
+		for _, vpath := range [][]string{{}, {"films"}, {"_UNSORTED"}} {
+			dir := lookup(vfs, vpath...)
+			entries, err := dir.(fusefs.HandleReadDirAller).ReadDirAll(ctx)
+			if err != nil {
+				t.Fatalf("ReadDirAll failed: %v", err)
+			}
+			for _, entry := range entries {
+				want := inodeOf(dir)
+				switch entry.Name {
+				case ".":
+				case "..":
+					want = rootInode
+				default:
+					want = inodeOf(lookup(vfs, append(vpath, entry.Name)...))
+				}
+				if entry.Inode != want {
+					t.Errorf("Expected %v/%s to be listed with inode %d, got %d", vpath, entry.Name, want, entry.Inode)
+				}
+			}
+		}
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		frozen := vfs.newFrozenFS(vfs.Snapshot())
+		if inode := inodeOf(lookup(frozen, "films", "b.mkv")); inode != 0 {
+			t.Errorf("Expected snapshots to leave inodes to the server, got %d", inode)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		next := vfs.Snapshot().NextInode
+		backup := &state.FSState{
+			Mappings:    map[string]state.FileMapping{"a.mkv": {VirtualPaths: []string{"/a.mkv"}, Inode: aInode}},
+			Directories: map[string]bool{"/": true},
+			NextInode:   aInode + 1,
+			Version:     state.CurrentVersion,
+		}
+		if err := vfs.ReplaceState("restore", backup); err != nil {
+			t.Fatalf("Failed to replace state: %v", err)
+		}
+		dir, err := lookup(vfs).(*Dir).Mkdir(ctx, &fuse.MkdirRequest{Name: "new"})
+		if err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if inode := inodeOf(dir); inode < next {
+			t.Errorf("Expected a number not handed out before (from %d), got %d", next, inode)
+		}
+	})
+}
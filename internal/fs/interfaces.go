@@ -20,6 +20,7 @@ type Directory interface {
 	fs.NodeMkdirer
 	fs.NodeRemover
 	fs.NodeRenamer
+	fs.NodeLinker
 }
 
 // FileInterface represents a file in the virtual filesystem
@@ -3,7 +3,9 @@ package fs
 import (
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"vmapfs/internal/logging"
 	"vmapfs/internal/state"
@@ -35,6 +37,17 @@ func (sp *SourcePath) String() string {
 	return sp.path
 }
 
+// MarshalText encodes the path as its string form, for JSON output
+func (sp *SourcePath) MarshalText() ([]byte, error) {
+	return []byte(sp.path), nil
+}
+
+// UnmarshalText decodes a path written by MarshalText
+func (sp *SourcePath) UnmarshalText(text []byte) error {
+	*sp = *NewSourcePath(string(text))
+	return nil
+}
+
 // FullPath returns the absolute path by joining with the source root
 func (sp *SourcePath) FullPath(sourceRoot string) string {
 	full := filepath.Join(sourceRoot, sp.path)
@@ -80,6 +93,17 @@ func (vp *VirtualPath) String() string {
 	return vp.path
 }
 
+// MarshalText encodes the path as its string form, for JSON output
+func (vp *VirtualPath) MarshalText() ([]byte, error) {
+	return []byte(vp.path), nil
+}
+
+// UnmarshalText decodes a path written by MarshalText
+func (vp *VirtualPath) UnmarshalText(text []byte) error {
+	*vp = *NewVirtualPath(string(text))
+	return nil
+}
+
 // Parent returns a VirtualPath representing the parent directory
 func (vp *VirtualPath) Parent() *VirtualPath {
 	return NewVirtualPath(filepath.Dir(vp.path))
@@ -95,68 +119,233 @@ func (vp *VirtualPath) IsRoot() bool {
 	return vp.path == "/"
 }
 
-// PathMapper handles mapping between virtual and source paths.
+// PathMapper handles mapping between virtual and source paths. The tree is
+// authoritative: after a directory rename, the mappings and directories
+// hold the old paths below it until Sync.
 type PathMapper struct {
-	mappings   map[string]state.FileMapping // source path -> FileMapping
-	sourceRoot string
-	logger     *logging.Logger
+	mappings    map[string]state.FileMapping  // source path -> FileMapping
+	directories map[string]bool               // registered virtual directories
+	recorded    map[string]*treeNode          // virtual path in the mappings -> file node
+	tree        *virtualTree                  // hierarchy of directories and mapped files
+	renamed     []*treeNode                   // directories renamed since the last Sync
+	renamedFrom []string                      // the paths they were renamed from
+	recorder    func(op, undo state.Op)       // receives every mutation, may be nil
+	mover       func(moved map[string]string) // receives the directories Sync moves, may be nil
+	repairs     []state.Op                    // conflicting virtual paths dropped when indexing
+	sourceRoot  string
+	logger      *logging.Logger
 }
 
-// NewPathMapper creates a new PathMapper instance with the given source root
-// and initial mappings.
-func NewPathMapper(sourceRoot string, mappings map[string]state.FileMapping) *PathMapper {
+// NewPathMapper creates a new PathMapper instance with the given source root,
+// initial mappings and virtual directories. A nil directories map starts out
+// with just the root directory.
+func NewPathMapper(sourceRoot string, mappings map[string]state.FileMapping, directories map[string]bool) *PathMapper {
 	logger := logging.GetLogger().WithPrefix("pathmap")
 	logger.Debug("Creating new path mapper for root: %s", sourceRoot)
 
-	return &PathMapper{
-		mappings:   mappings,
-		sourceRoot: sourceRoot,
-		logger:     logger,
+	if directories == nil {
+		directories = map[string]bool{"/": true}
+	}
+
+	pm := &PathMapper{
+		mappings:    mappings,
+		directories: directories,
+		sourceRoot:  sourceRoot,
+		logger:      logger,
+	}
+	pm.rebuildIndex()
+	return pm
+}
+
+// SetRecorder registers fn to be called with every state mutation made
+// through the mapper, in order. Along with each op fn receives the op that
+// reverses it.
+func (pm *PathMapper) SetRecorder(fn func(op, undo state.Op)) {
+	pm.recorder = fn
+}
+
+// SetDirectoryMover registers fn to be called with the directories whose
+// paths Sync rewrites, old path to new, so that whatever is kept by
+// directory path can follow
+func (pm *PathMapper) SetDirectoryMover(fn func(moved map[string]string)) {
+	pm.mover = fn
+}
+
+// record passes op and its inverse to the recorder, if there is one
+func (pm *PathMapper) record(op, undo state.Op) {
+	pm.logger.Trace("Recording op: %s (undo: %s)", op, undo)
+	if pm.recorder != nil {
+		pm.recorder(op, undo)
+	}
+}
+
+// rebuildIndex recreates the virtual->source index and the virtual tree from
+// the mappings and directories. Sources are indexed in sorted order, so that
+// of two sources claiming the same virtual path the first keeps it, as in
+// state.Check. Virtual paths that lose to another source or to a directory
+// are dropped from their mapping, so that the mappings only ever hold what
+// the tree shows, and the unmaps are kept for Repairs.
+func (pm *PathMapper) rebuildIndex() {
+	pm.recorded = make(map[string]*treeNode, len(pm.mappings))
+	pm.tree = newVirtualTree()
+	pm.renamed, pm.renamedFrom = nil, nil
+	pm.repairs = nil
+
+	for dir := range pm.directories {
+		if pm.tree.mkdirAll(dir) == nil {
+			pm.logger.Warn("Directory %q conflicts with a mapped file", dir)
+			continue
+		}
+		pm.registerDirectories(dir)
+	}
+
+	sources := make([]string, 0, len(pm.mappings))
+	for spath := range pm.mappings {
+		sources = append(sources, spath)
+	}
+	sort.Strings(sources)
+
+	for _, spath := range sources {
+		for _, vpath := range pm.mappings[spath].VirtualPaths {
+			if existing, dup := pm.recorded[vpath]; dup {
+				pm.logger.Warn("Virtual path %q is mapped to both %q and %q, dropping it from %q", vpath, existing.source, spath, spath)
+				pm.repairs = append(pm.repairs, state.Op{Kind: state.OpUnmap, Source: spath, Path: vpath})
+				continue
+			}
+			node := pm.tree.addFile(vpath, spath)
+			if node == nil {
+				pm.logger.Warn("Mapped file %q of %q conflicts with a directory, dropping it", vpath, spath)
+				pm.repairs = append(pm.repairs, state.Op{Kind: state.OpUnmap, Source: spath, Path: vpath})
+				continue
+			}
+			node.stored = vpath
+			pm.registerDirectories(parentVirtual(vpath))
+			pm.recorded[vpath] = node
+		}
+	}
+
+	for _, op := range pm.repairs {
+		mapping := pm.mappings[op.Source]
+		mapping.VirtualPaths = removeVirtualPath(mapping.VirtualPaths, op.Path)
+		pm.putMapping(op.Source, mapping)
 	}
+	pm.logger.Debug("Indexed %d virtual paths and %d directories", len(pm.recorded), len(pm.directories))
 }
 
-// IsPathMapped returns true if the source path has a virtual mapping
+// Repairs returns the unmap ops of the virtual paths that were dropped
+// from the mappings when the mapper was created, because another source or
+// a directory already had them, so that the repair can be saved
+func (pm *PathMapper) Repairs() []state.Op {
+	return pm.repairs
+}
+
+// removeVirtualPath returns paths without the first occurrence of vpath,
+// or nil if nothing is left
+func removeVirtualPath(paths []string, vpath string) []string {
+	for i, p := range paths {
+		if p == vpath {
+			paths = append(paths[:i:i], paths[i+1:]...)
+			break
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	return paths
+}
+
+// IsPathMapped returns true if the source path has at least one virtual mapping
 func (pm *PathMapper) IsPathMapped(sp *SourcePath) bool {
 	mapping, exists := pm.mappings[sp.String()]
-	// Consider it mapped only if it exists and has a non-empty virtual path
-	mapped := exists && mapping.VirtualPath != ""
-	pm.logger.Trace("Checking if path is mapped: %q (exists=%v, virtual_path=%q, mapped=%v)", sp.String(), exists, mapping.VirtualPath, mapped)
+	// Consider it mapped only if it exists and has at least one virtual path
+	mapped := exists && len(mapping.VirtualPaths) > 0
+	pm.logger.Trace("Checking if path is mapped: %q (exists=%v, virtual_paths=%q, mapped=%v)", sp.String(), exists, mapping.VirtualPaths, mapped)
 	return mapped
 }
 
-// GetVirtualPath returns the virtual path for a source path, if one exists
+// GetVirtualPath returns the first virtual path for a source path, if one exists
 func (pm *PathMapper) GetVirtualPath(sp *SourcePath) (*VirtualPath, bool) {
 	mapping, exists := pm.mappings[sp.String()]
-	pm.logger.Trace("Looking up virtual path: %q -> %q (exists=%v)", sp.String(), mapping.VirtualPath, exists)
-	if !exists {
+	pm.logger.Trace("Looking up virtual path: %q -> %q (exists=%v)", sp.String(), mapping.VirtualPaths, exists)
+	if !exists || len(mapping.VirtualPaths) == 0 {
 		return nil, false
 	}
-	return NewVirtualPath(mapping.VirtualPath), true
+	return NewVirtualPath(pm.currentPath(mapping.VirtualPaths[0])), true
+}
+
+// GetVirtualPaths returns every virtual path a source path is mapped to
+func (pm *PathMapper) GetVirtualPaths(sp *SourcePath) []*VirtualPath {
+	mapping := pm.mappings[sp.String()]
+	paths := make([]*VirtualPath, 0, len(mapping.VirtualPaths))
+	for _, vpath := range mapping.VirtualPaths {
+		paths = append(paths, NewVirtualPath(pm.currentPath(vpath)))
+	}
+	pm.logger.Trace("Looking up virtual paths: %q -> %d paths", sp.String(), len(paths))
+	return paths
+}
+
+// currentPath returns the virtual path a path recorded in a mapping is at
+// in the tree, which differs below a directory renamed since the last Sync
+func (pm *PathMapper) currentPath(vpath string) string {
+	if node := pm.recorded[vpath]; node != nil {
+		return node.path()
+	}
+	return vpath
+}
+
+// recordedPath returns the path vp is recorded under in the mappings or
+// directories, which differs below a directory renamed since the last Sync
+func (pm *PathMapper) recordedPath(vp *VirtualPath) string {
+	if node := pm.tree.lookup(vp.String()); node != nil && node.stored != "" {
+		return node.stored
+	}
+	return vp.String()
 }
 
 // GetSourcePath returns the source path for a virtual path, if one exists
 func (pm *PathMapper) GetSourcePath(vp *VirtualPath) (*SourcePath, bool) {
-	for spath, mapping := range pm.mappings {
-		if mapping.VirtualPath == vp.String() {
-			pm.logger.Trace("Looking up source path: %q -> %q (exists=true)", vp.String(), spath)
-			return NewSourcePath(spath), true
-		}
+	node := pm.tree.lookup(vp.String())
+	exists := node != nil && !node.isDir()
+	pm.logger.Trace("Looking up source path: %q (exists=%v)", vp.String(), exists)
+	if !exists {
+		return nil, false
 	}
-	pm.logger.Trace("Source path not found for: %q", vp.String())
-	return nil, false
+	return NewSourcePath(node.source), true
 }
 
-// AddMapping creates a new virtual->source path mapping
-func (pm *PathMapper) AddMapping(vp *VirtualPath, sp *SourcePath) {
+// AddMapping adds a virtual path for a source path. A source may be mapped
+// to any number of virtual paths; a virtual path that already points at a
+// different source is moved over to this one. It fails if the source
+// cannot be stat'd or is a directory, or if a directory or file is in the
+// way of vp.
+func (pm *PathMapper) AddMapping(vp *VirtualPath, sp *SourcePath) error {
 	fullPath := sp.FullPath(pm.sourceRoot)
 	info, err := os.Stat(fullPath)
 	if err != nil {
 		pm.logger.Warn("Cannot stat source path %q: %v", fullPath, err)
-		return
+		return err
 	}
 	if info.IsDir() {
 		pm.logger.Warn("Rejecting directory mapping: %q", sp.String())
-		return
+		return ErrIsDirectory
+	}
+	if pm.IsDirectory(vp) {
+		pm.logger.Warn("Cannot map %q: a directory is in the way", vp.String())
+		return ErrIsDirectory
+	}
+	for parent := vp.Parent(); !parent.IsRoot(); parent = parent.Parent() {
+		if node := pm.tree.lookup(parent.String()); node != nil && !node.isDir() {
+			pm.logger.Warn("Cannot map %q: %q is a file", vp.String(), parent.String())
+			return ErrNotDirectory
+		}
+	}
+
+	if existing, exists := pm.GetSourcePath(vp); exists {
+		if existing.String() == sp.String() {
+			pm.logger.Trace("Mapping already exists: %q -> %q", vp.String(), sp.String())
+			return nil
+		}
+		pm.RemoveMapping(vp)
 	}
 
 	pm.logger.Debug("Adding mapping: %q -> %q", vp.String(), sp.String())
@@ -164,20 +353,65 @@ func (pm *PathMapper) AddMapping(vp *VirtualPath, sp *SourcePath) {
 	if !exists {
 		mapping = state.FileMapping{Xattrs: make(map[string][]byte)}
 	}
-	mapping.VirtualPath = vp.String()
+	pm.settle(vp.String())
+	node := pm.tree.addFile(vp.String(), sp.String())
+	if node == nil {
+		pm.logger.Warn("Cannot map %q: a file is in the way", vp.String())
+		return ErrNotDirectory
+	}
+
+	pm.registerDirectories(vp.Parent().String())
+
+	node.stored = vp.String()
+	mapping.VirtualPaths = append(mapping.VirtualPaths, vp.String())
 	pm.mappings[sp.String()] = mapping
+	pm.recorded[vp.String()] = node
+	pm.record(
+		state.Op{Kind: state.OpMap, Source: sp.String(), Path: vp.String()},
+		state.Op{Kind: state.OpUnmap, Source: sp.String(), Path: vp.String()},
+	)
+	return nil
 }
 
-// RemoveMapping removes a virtual->source path mapping
+// RemoveMapping removes a single virtual->source path mapping. Other virtual
+// paths of the same source are left untouched.
 func (pm *PathMapper) RemoveMapping(vp *VirtualPath) {
 	pm.logger.Debug("Removing mapping for: %q", vp.String())
-	for spath, mapping := range pm.mappings {
-		if mapping.VirtualPath == vp.String() {
-			mapping.VirtualPath = ""
-			pm.mappings[spath] = mapping
-			return
+	node := pm.tree.lookup(vp.String())
+	if node == nil || node.isDir() {
+		return
+	}
+	spath := node.source
+	delete(pm.recorded, node.stored)
+	pm.tree.remove(vp.String())
+
+	mapping := pm.mappings[spath]
+	for i, vpath := range mapping.VirtualPaths {
+		if vpath != node.stored {
+			continue
 		}
+		mapping.VirtualPaths = append(mapping.VirtualPaths[:i:i], mapping.VirtualPaths[i+1:]...)
+		if len(mapping.VirtualPaths) == 0 {
+			mapping.VirtualPaths = nil
+		}
+		pm.putMapping(spath, mapping)
+		pm.record(
+			state.Op{Kind: state.OpUnmap, Source: spath, Path: vp.String()},
+			state.Op{Kind: state.OpMap, Source: spath, Path: vp.String()},
+		)
+		return
+	}
+}
+
+// putMapping stores the mapping record of a source, dropping it once it
+// has neither virtual paths nor xattrs left
+func (pm *PathMapper) putMapping(spath string, mapping state.FileMapping) {
+	if mapping.IsEmpty() {
+		pm.logger.Trace("Dropping empty mapping record: %q", spath)
+		delete(pm.mappings, spath)
+		return
 	}
+	pm.mappings[spath] = mapping
 }
 
 // GetXattrs returns the extended attributes for a source path
@@ -200,20 +434,160 @@ func (pm *PathMapper) SetXattr(sp *SourcePath, name string, value []byte) {
 	if mapping.Xattrs == nil {
 		mapping.Xattrs = make(map[string][]byte)
 	}
+	undo := state.Op{Kind: state.OpRemoveXattr, Source: sp.String(), Name: name}
+	if old, exists := mapping.Xattrs[name]; exists {
+		undo = state.Op{Kind: state.OpSetXattr, Source: sp.String(), Name: name, Value: old}
+	}
 	mapping.Xattrs[name] = value
 	pm.mappings[sp.String()] = mapping
+	pm.record(state.Op{Kind: state.OpSetXattr, Source: sp.String(), Name: name, Value: value}, undo)
 }
 
 // RemoveXattr removes an extended attribute for a source path
 func (pm *PathMapper) RemoveXattr(sp *SourcePath, name string) {
 	pm.logger.Debug("Removing xattr %q for source path %q", name, sp.String())
 	if mapping, exists := pm.mappings[sp.String()]; exists && mapping.Xattrs != nil {
+		old, exists := mapping.Xattrs[name]
+		if !exists {
+			return
+		}
 		delete(mapping.Xattrs, name)
 		if len(mapping.Xattrs) == 0 {
 			mapping.Xattrs = nil
 		}
-		pm.mappings[sp.String()] = mapping
+		pm.putMapping(sp.String(), mapping)
+		pm.record(
+			state.Op{Kind: state.OpRemoveXattr, Source: sp.String(), Name: name},
+			state.Op{Kind: state.OpSetXattr, Source: sp.String(), Name: name, Value: old},
+		)
+	}
+}
+
+// GetFingerprint returns the recorded fingerprint of a source path, if any
+func (pm *PathMapper) GetFingerprint(sp *SourcePath) *state.Fingerprint {
+	return pm.mappings[sp.String()].Fingerprint
+}
+
+// SetFingerprint records the fingerprint of a mapped source path. Sources
+// without a mapping record are left alone, as a fingerprint by itself
+// carries no information.
+func (pm *PathMapper) SetFingerprint(sp *SourcePath, fingerprint *state.Fingerprint) {
+	mapping, exists := pm.mappings[sp.String()]
+	if !exists {
+		return
+	}
+	pm.logger.Trace("Setting fingerprint of %q", sp.String())
+	old := mapping.Fingerprint
+	mapping.Fingerprint = fingerprint
+	pm.mappings[sp.String()] = mapping
+	pm.record(
+		state.Op{Kind: state.OpFingerprint, Source: sp.String(), Fingerprint: fingerprint},
+		state.Op{Kind: state.OpFingerprint, Source: sp.String(), Fingerprint: old},
+	)
+}
+
+// Relink moves the whole mapping record of a source, with its virtual paths
+// and xattrs, to another source path, for when the source file was renamed
+// outside of vmapfs. The new source path must not have a record yet.
+func (pm *PathMapper) Relink(oldSource, newSource *SourcePath) error {
+	mapping, exists := pm.mappings[oldSource.String()]
+	if !exists {
+		return ErrPathNotFound
+	}
+	if _, taken := pm.mappings[newSource.String()]; taken {
+		return ErrAlreadyExists
+	}
+
+	pm.logger.Debug("Relinking %q -> %q", oldSource.String(), newSource.String())
+	var vpath string
+	if len(mapping.VirtualPaths) > 0 {
+		vpath = pm.currentPath(mapping.VirtualPaths[0])
+	}
+	pm.moveRecord(state.OpRelink, oldSource.String(), newSource.String(), vpath, nil, nil)
+	return nil
+}
+
+// Retarget points a mapped virtual path at another source file, for when a
+// better copy of the file turns up. The mapping record moves with its
+// xattrs, and the old source is added to the record's history and becomes
+// unmapped. The old source must have no other virtual path, since those
+// would be retargeted too. The new source must be a file without virtual
+// paths; the names of xattrs it had of its own are returned, as they are
+// dropped.
+func (pm *PathMapper) Retarget(vp *VirtualPath, newSource *SourcePath, when time.Time) ([]string, error) {
+	oldSp, exists := pm.GetSourcePath(vp)
+	if !exists {
+		return nil, ErrPathNotFound
+	}
+	oldSpath := oldSp.String()
+	if oldSpath == newSource.String() {
+		return nil, ErrAlreadyExists
+	}
+	info, err := os.Stat(newSource.FullPath(pm.sourceRoot))
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrIsDirectory
+	}
+	if pm.IsPathMapped(newSource) {
+		return nil, ErrAlreadyExists
+	}
+	if len(pm.mappings[oldSpath].VirtualPaths) > 1 {
+		return nil, ErrMultiplePaths
+	}
+	var dropped []string
+	if existing, exists := pm.mappings[newSource.String()]; exists {
+		for name := range existing.Xattrs {
+			dropped = append(dropped, name)
+		}
+		sort.Strings(dropped)
+		if len(dropped) > 0 {
+			pm.logger.Warn("Dropping xattrs %v of %q", dropped, newSource.String())
+		}
+		for _, name := range dropped {
+			pm.RemoveXattr(newSource, name)
+		}
+		if _, exists := pm.mappings[newSource.String()]; exists {
+			// What is left carries no information, so there is nothing to
+			// bring back on undo
+			delete(pm.mappings, newSource.String())
+			pm.record(
+				state.Op{Kind: state.OpForget, Source: newSource.String()},
+				state.Op{Kind: state.OpForget, Source: newSource.String()},
+			)
+		}
+	}
+
+	pm.logger.Debug("Retargeting %q from %q to %q", vp.String(), oldSpath, newSource.String())
+	mapping := pm.mappings[oldSpath]
+	history := append(append([]state.PreviousSource(nil), mapping.History...),
+		state.PreviousSource{Source: oldSpath, Replaced: when.UTC()})
+	pm.moveRecord(state.OpRetarget, oldSpath, newSource.String(), vp.String(), history, nil)
+	return dropped, nil
+}
+
+// moveRecord moves the mapping record of one source to another that has
+// none and records it as an op of kind, with vpath naming the virtual path
+// it was made for. A retarget gives the record history and fingerprint; a
+// relink keeps those it has, as state.FSState.Apply does.
+func (pm *PathMapper) moveRecord(kind state.OpKind, oldSpath, newSpath, vpath string, history []state.PreviousSource, fingerprint *state.Fingerprint) {
+	mapping := pm.mappings[oldSpath]
+	do := state.Op{Kind: kind, Source: oldSpath, NewSource: newSpath, Path: vpath}
+	undo := state.Op{Kind: kind, Source: newSpath, NewSource: oldSpath, Path: vpath}
+	if kind == state.OpRetarget {
+		do.History, do.Fingerprint = history, fingerprint
+		undo.History, undo.Fingerprint = mapping.History, mapping.Fingerprint
+		mapping.History, mapping.Fingerprint = history, fingerprint
+	}
+	delete(pm.mappings, oldSpath)
+	pm.mappings[newSpath] = mapping
+	for _, mapped := range mapping.VirtualPaths {
+		if node := pm.recorded[mapped]; node != nil && node.source == oldSpath {
+			node.source = newSpath
+		}
 	}
+	pm.record(do, undo)
 }
 
 // ListXattrs lists all extended attributes for a source path
@@ -250,7 +624,7 @@ func (pm *PathMapper) UnmappedSourcePaths() []*SourcePath {
 			return err
 		}
 		sp := NewSourcePath(relPath)
-		if mapping, exists := pm.mappings[sp.String()]; !exists || mapping.VirtualPath == "" {
+		if mapping, exists := pm.mappings[sp.String()]; !exists || len(mapping.VirtualPaths) == 0 {
 			pm.logger.Trace("Found unmapped path: %q", sp.String())
 			unmapped = append(unmapped, sp)
 		}
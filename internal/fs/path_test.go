@@ -1,8 +1,11 @@
 package fs
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"vmapfs/internal/state"
 )
@@ -118,11 +121,11 @@ func TestPathMapper(t *testing.T) {
 
 	// Initialize PathMapper with some initial mappings
 	initialMappings := map[string]state.FileMapping{
-		"file1.txt":      {VirtualPath: "/mapped/file1.txt"},
-		"dir1/file2.txt": {VirtualPath: "/mapped/dir1/file2.txt"},
+		"file1.txt":      {VirtualPaths: []string{"/mapped/file1.txt"}},
+		"dir1/file2.txt": {VirtualPaths: []string{"/mapped/dir1/file2.txt"}},
 	}
 
-	pm := NewPathMapper(tempDir, initialMappings)
+	pm := NewPathMapper(tempDir, initialMappings, nil)
 
 	t.Run("GetSourcePath", func(t *testing.T) {
 		vp := NewVirtualPath("/mapped/file1.txt")
@@ -149,7 +152,9 @@ func TestPathMapper(t *testing.T) {
 	t.Run("AddMapping", func(t *testing.T) {
 		vp := NewVirtualPath("/new/path.txt")
 		sp := NewSourcePath("dir1/dir2/file3.txt")
-		pm.AddMapping(vp, sp)
+		if err := pm.AddMapping(vp, sp); err != nil {
+			t.Fatalf("AddMapping failed: %v", err)
+		}
 
 		gotSP, exists := pm.GetSourcePath(vp)
 		if !exists {
@@ -158,6 +163,89 @@ func TestPathMapper(t *testing.T) {
 		if gotSP.String() != sp.String() {
 			t.Errorf("Expected source path %q, got %q", sp.String(), gotSP.String())
 		}
+
+		for _, tc := range []struct {
+			vpath, source string
+			want          error
+		}{
+			{"/new/missing.txt", "missing.txt", os.ErrNotExist},
+			{"/new/dir1", "dir1", ErrIsDirectory},
+			{"/new", "file1.txt", ErrIsDirectory},
+			{"/new/path.txt/below.txt", "file1.txt", ErrNotDirectory},
+		} {
+			if err := pm.AddMapping(NewVirtualPath(tc.vpath), NewSourcePath(tc.source)); !errors.Is(err, tc.want) {
+				t.Errorf("Expected mapping %q to %q to fail with %v, got %v", tc.vpath, tc.source, tc.want, err)
+			}
+			if _, exists := pm.GetSourcePath(NewVirtualPath(tc.vpath)); exists {
+				t.Errorf("Expected no mapping at %q", tc.vpath)
+			}
+		}
+	})
+
+	t.Run("MultipleVirtualPaths", func(t *testing.T) {
+		sp := NewSourcePath("dir1/file2.txt")
+		second := NewVirtualPath("/by-type/file2.txt")
+		pm.AddMapping(second, sp)
+
+		if vps := pm.GetVirtualPaths(sp); len(vps) != 2 {
+			t.Fatalf("Expected 2 virtual paths, got %d", len(vps))
+		}
+		for _, vp := range []string{"/mapped/dir1/file2.txt", "/by-type/file2.txt"} {
+			gotSP, exists := pm.GetSourcePath(NewVirtualPath(vp))
+			if !exists || gotSP.String() != sp.String() {
+				t.Errorf("Expected %q to map to %q", vp, sp.String())
+			}
+		}
+
+		pm.SetXattr(sp, "user.tag", []byte("shared"))
+		pm.RemoveMapping(second)
+
+		if !pm.IsPathMapped(sp) {
+			t.Error("Expected source to stay mapped through its remaining virtual path")
+		}
+		if _, exists := pm.GetSourcePath(second); exists {
+			t.Error("Expected removed virtual path to be gone")
+		}
+		if attrs, _ := pm.GetXattrs(sp); string(attrs["user.tag"]) != "shared" {
+			t.Error("Expected xattrs to survive removal of one virtual path")
+		}
+	})
+
+	t.Run("DropsEmptyRecords", func(t *testing.T) {
+		sp := NewSourcePath("dir1/dir2/file3.txt")
+		vp := NewVirtualPath("/new/path.txt")
+
+		pm.SetXattr(sp, "user.tag", []byte("keep"))
+		pm.RemoveMapping(vp)
+		if _, exists := pm.mappings[sp.String()]; !exists {
+			t.Fatal("Expected record with xattrs to survive removal of its last virtual path")
+		}
+
+		pm.RemoveXattr(sp, "user.tag")
+		if _, exists := pm.mappings[sp.String()]; exists {
+			t.Error("Expected record without virtual paths or xattrs to be dropped")
+		}
+
+		pm.AddMapping(vp, sp)
+		pm.RemoveMapping(vp)
+		if _, exists := pm.mappings[sp.String()]; exists {
+			t.Error("Expected unmapped record without xattrs to be dropped")
+		}
+	})
+
+	t.Run("RenameDirectory", func(t *testing.T) {
+		pm.RenameDirectory(NewVirtualPath("/mapped/dir1"), NewVirtualPath("/renamed/dir1"))
+
+		if _, exists := pm.GetSourcePath(NewVirtualPath("/mapped/dir1/file2.txt")); exists {
+			t.Error("Expected old virtual path to be gone after rename")
+		}
+		sp, exists := pm.GetSourcePath(NewVirtualPath("/renamed/dir1/file2.txt"))
+		if !exists || sp.String() != "dir1/file2.txt" {
+			t.Error("Expected mapping to be reachable at its renamed virtual path")
+		}
+		if vp, _ := pm.GetVirtualPath(NewSourcePath("dir1/file2.txt")); vp.String() != "/renamed/dir1/file2.txt" {
+			t.Errorf("Expected stored virtual path to be updated, got %q", vp.String())
+		}
 	})
 
 	t.Run("RemoveMapping", func(t *testing.T) {
@@ -185,4 +273,122 @@ func TestPathMapper(t *testing.T) {
 			t.Error("Expected file1.txt to be in unmapped paths")
 		}
 	})
+
+	t.Run("DuplicatePath", func(t *testing.T) {
+		// Map iteration order varies, so a winner picked by it would change
+		// between runs
+		for i := 0; i < 20; i++ {
+			claimed := map[string]state.FileMapping{
+				"c.txt": {VirtualPaths: []string{"/same.txt"}},
+				"a.txt": {VirtualPaths: []string{"/same.txt"}},
+				"b.txt": {VirtualPaths: []string{"/same.txt"}},
+			}
+			sp, exists := NewPathMapper(tempDir, claimed, nil).GetSourcePath(NewVirtualPath("/same.txt"))
+			if !exists || sp.String() != "a.txt" {
+				t.Fatalf("Expected the first source in sorted order to keep the path, got %v", sp)
+			}
+		}
+
+		// The losers are dropped from their mappings, so that nothing
+		// still claims a path the tree does not show
+		claimed := map[string]state.FileMapping{
+			"a.txt": {VirtualPaths: []string{"/same.txt"}},
+			"b.txt": {VirtualPaths: []string{"/same.txt"}, Xattrs: map[string][]byte{"user.tag": []byte("b")}},
+			"c.txt": {VirtualPaths: []string{"/same.txt", "/c.txt"}},
+			"d.txt": {VirtualPaths: []string{"/dir"}},
+		}
+		pm := NewPathMapper(tempDir, claimed, map[string]bool{"/": true, "/dir": true})
+		expected := map[string]state.FileMapping{
+			"a.txt": {VirtualPaths: []string{"/same.txt"}},
+			"b.txt": {Xattrs: map[string][]byte{"user.tag": []byte("b")}},
+			"c.txt": {VirtualPaths: []string{"/c.txt"}},
+		}
+		if !reflect.DeepEqual(claimed, expected) {
+			t.Errorf("Expected mappings %v, got %v", expected, claimed)
+		}
+		repairs := []state.Op{
+			{Kind: state.OpUnmap, Source: "b.txt", Path: "/same.txt"},
+			{Kind: state.OpUnmap, Source: "c.txt", Path: "/same.txt"},
+			{Kind: state.OpUnmap, Source: "d.txt", Path: "/dir"},
+		}
+		if !reflect.DeepEqual(pm.Repairs(), repairs) {
+			t.Errorf("Expected repairs %v, got %v", repairs, pm.Repairs())
+		}
+		if pm.IsPathMapped(NewSourcePath("b.txt")) {
+			t.Error("Expected b.txt to be unmapped")
+		}
+	})
+}
+
+// benchmarkMapper builds a PathMapper holding n mappings without touching
+// the filesystem, the same way state loading does.
+func benchmarkMapper(b *testing.B, sourceRoot string, n int) *PathMapper {
+	b.Helper()
+	mappings := make(map[string]state.FileMapping, n)
+	for i := 0; i < n; i++ {
+		source := fmt.Sprintf("source/%d/file-%d.mkv", i%1000, i)
+		mappings[source] = state.FileMapping{
+			VirtualPaths: []string{fmt.Sprintf("/library/%d/file-%d.mkv", i%1000, i)},
+		}
+	}
+	return NewPathMapper(sourceRoot, mappings, nil)
+}
+
+var benchmarkSizes = []int{1000, 100000, 1000000}
+
+func BenchmarkGetSourcePath(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("mappings=%d", n), func(b *testing.B) {
+			pm := benchmarkMapper(b, b.TempDir(), n)
+			paths := make([]*VirtualPath, 1024)
+			for i := range paths {
+				j := (i * 7919) % n
+				paths[i] = NewVirtualPath(fmt.Sprintf("/library/%d/file-%d.mkv", j%1000, j))
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, exists := pm.GetSourcePath(paths[i%len(paths)]); !exists {
+					b.Fatal("Expected mapping to exist")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRenameDirectory(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		for _, dir := range []string{"/library/0", "/library"} {
+			b.Run(fmt.Sprintf("mappings=%d/dir=%s", n, dir), func(b *testing.B) {
+				pm := benchmarkMapper(b, b.TempDir(), n)
+				oldDir, newDir := NewVirtualPath(dir), NewVirtualPath(dir+"-renamed")
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					pm.RenameDirectory(oldDir, newDir)
+					pm.RenameDirectory(newDir, oldDir)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkAddRemoveMapping(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("mappings=%d", n), func(b *testing.B) {
+			sourceRoot := b.TempDir()
+			if err := os.WriteFile(filepath.Join(sourceRoot, "extra.mkv"), []byte("test"), 0644); err != nil {
+				b.Fatalf("Failed to create test file: %v", err)
+			}
+			pm := benchmarkMapper(b, sourceRoot, n)
+			sp := NewSourcePath("extra.mkv")
+			vp := NewVirtualPath("/library/extra.mkv")
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pm.AddMapping(vp, sp)
+				pm.RemoveMapping(vp)
+			}
+		})
+	}
 }
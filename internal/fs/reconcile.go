@@ -0,0 +1,302 @@
+package fs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"vmapfs/internal/logging"
+	"vmapfs/internal/state"
+)
+
+var (
+	reconcileLogger = logging.GetLogger().WithPrefix("reconcile")
+)
+
+// Relink is an orphaned mapping re-pointed at the source it was found at
+type Relink struct {
+	Old          string   `json:"old"`
+	New          string   `json:"new"`
+	VirtualPaths []string `json:"virtual_paths"`
+}
+
+// AmbiguousMatch is an orphaned mapping that could not be relinked because
+// its fingerprint matches several unmapped sources, or because a matching
+// source also matches other orphans
+type AmbiguousMatch struct {
+	Source       string   `json:"source"`
+	VirtualPaths []string `json:"virtual_paths"`
+	Candidates   []string `json:"candidates"`
+}
+
+// ReconcileReport describes a reconcile pass
+type ReconcileReport struct {
+	Time time.Time `json:"time"`
+	// Fingerprinted counts the mapped sources whose fingerprint was taken
+	Fingerprinted int `json:"fingerprinted"`
+	// Orphaned counts the mapped sources that no longer exist
+	Orphaned  int              `json:"orphaned"`
+	Relinked  []Relink         `json:"relinked"`
+	Ambiguous []AmbiguousMatch `json:"ambiguous"`
+	// Unmatched are orphaned sources without a fingerprint, or without a
+	// matching unmapped source
+	Unmatched []string `json:"unmatched"`
+	Applied   bool     `json:"applied"`
+}
+
+// reconciler serializes reconcile passes and keeps the last report
+type reconciler struct {
+	mu     sync.Mutex
+	last   *ReconcileReport
+	lastMu sync.Mutex
+}
+
+// orphan is a mapped source that no longer exists
+type orphan struct {
+	source  string
+	mapping state.FileMapping
+}
+
+// Reconcile takes the fingerprint of every mapped source that lacks one or
+// has changed, and relinks mappings whose source has disappeared to the
+// unmapped source with the same fingerprint, keeping their virtual paths
+// and xattrs. Only sources without any mapping record are candidates. An
+// orphan is only relinked if exactly one candidate matches it and that
+// candidate matches no other orphan; everything else is reported. Relinks
+// are saved, audited and can be undone like any other operation. With
+// dryRun nothing is changed.
+func (vfs *VMapFS) Reconcile(dryRun bool) (ReconcileReport, error) {
+	vfs.reconciler.mu.Lock()
+	defer vfs.reconciler.mu.Unlock()
+
+	report := ReconcileReport{
+		Time:      time.Now(),
+		Relinked:  []Relink{},
+		Ambiguous: []AmbiguousMatch{},
+		Unmatched: []string{},
+	}
+
+	// The source tree is read without holding the lock, as hashing files
+	// on a remote mount can take a long time
+	vfs.mu.Lock()
+	current := vfs.syncedState()
+	mappings := make(map[string]state.FileMapping, len(current.Mappings))
+	recorded := make(map[string]bool, len(current.Mappings))
+	for source, mapping := range current.Mappings {
+		recorded[source] = true
+		if len(mapping.VirtualPaths) > 0 {
+			mappings[source] = mapping.Clone()
+		}
+	}
+	vfs.mu.Unlock()
+
+	updates := make(map[string]*state.Fingerprint)
+	var orphans []orphan
+	for _, source := range sortedSources(mappings) {
+		mapping := mappings[source]
+		full := NewSourcePath(source).FullPath(vfs.sourceDir)
+		info, err := os.Stat(full)
+		switch {
+		case os.IsNotExist(err):
+			orphans = append(orphans, orphan{source: source, mapping: mapping})
+			continue
+		case err != nil:
+			reconcileLogger.Warn("Cannot check source %q: %v", source, err)
+			continue
+		case !info.Mode().IsRegular() || mapping.Fingerprint.Current(info):
+			continue
+		}
+		fingerprint, err := state.ComputeFingerprint(full)
+		if err != nil {
+			reconcileLogger.Warn("Cannot fingerprint source %q: %v", source, err)
+			continue
+		}
+		updates[source] = fingerprint
+	}
+	report.Fingerprinted = len(updates)
+	report.Orphaned = len(orphans)
+
+	candidates, err := vfs.fingerprintCandidates(orphans, recorded)
+	if err != nil {
+		return report, err
+	}
+
+	// Each candidate may only be claimed by one orphan
+	matches := make(map[string][]string, len(orphans))
+	claims := make(map[string]int)
+	sortedCandidates := sortedSources(candidates)
+	for _, o := range orphans {
+		if o.mapping.Fingerprint == nil {
+			continue
+		}
+		for _, candidate := range sortedCandidates {
+			if o.mapping.Fingerprint.Matches(candidates[candidate]) {
+				matches[o.source] = append(matches[o.source], candidate)
+				claims[candidate]++
+			}
+		}
+	}
+	var relinks []Relink
+	for _, o := range orphans {
+		found := matches[o.source]
+		switch {
+		case len(found) == 0:
+			report.Unmatched = append(report.Unmatched, o.source)
+		case len(found) == 1 && claims[found[0]] == 1:
+			relinks = append(relinks, Relink{Old: o.source, New: found[0], VirtualPaths: o.mapping.VirtualPaths})
+		default:
+			reconcileLogger.Warn("Orphaned source %q matches %d sources, not relinking", o.source, len(found))
+			report.Ambiguous = append(report.Ambiguous, AmbiguousMatch{
+				Source:       o.source,
+				VirtualPaths: o.mapping.VirtualPaths,
+				Candidates:   found,
+			})
+		}
+	}
+
+	if dryRun {
+		report.Relinked = append(report.Relinked, relinks...)
+		vfs.reconciler.setLast(report)
+		return report, nil
+	}
+
+	vfs.mu.Lock()
+	for _, source := range sortedSources(updates) {
+		vfs.pathMapper.SetFingerprint(NewSourcePath(source), updates[source])
+	}
+	// Fingerprints are bookkeeping, so they are saved but not audited or
+	// offered for undo
+	saveErr := vfs.persistOps()
+
+	var paths []string
+	for _, relink := range relinks {
+		// The tree may have changed while the sources were read
+		oldSource, newSource := NewSourcePath(relink.Old), NewSourcePath(relink.New)
+		if !vfs.pathMapper.IsPathMapped(oldSource) {
+			continue
+		}
+		if err := vfs.pathMapper.Relink(oldSource, newSource); err != nil {
+			reconcileLogger.Warn("Cannot relink %q to %q: %v", relink.Old, relink.New, err)
+			continue
+		}
+		vfs.pathMapper.SetFingerprint(newSource, candidates[relink.New])
+		reconcileLogger.Info("Relinked %q to %q", relink.Old, relink.New)
+		report.Relinked = append(report.Relinked, relink)
+		paths = append(paths, relink.VirtualPaths...)
+	}
+	if len(report.Relinked) > 0 {
+		paths = append(paths, "/_UNSORTED")
+		if err := vfs.commitOps(safeIntToUint32(os.Getuid()), safeIntToUint32(os.Getpid()), "reconcile"); err != nil && saveErr == nil {
+			saveErr = err
+		}
+	}
+	vfs.mu.Unlock()
+
+	vfs.invalidateEntries(vfs.root, rootNamesOf(paths))
+	report.Applied = true
+	vfs.reconciler.setLast(report)
+	return report, saveErr
+}
+
+// fingerprintCandidates returns the fingerprints of the sources that have
+// no mapping record and the same size as an orphan with a fingerprint
+func (vfs *VMapFS) fingerprintCandidates(orphans []orphan, recorded map[string]bool) (map[string]*state.Fingerprint, error) {
+	sizes := make(map[int64]bool)
+	for _, o := range orphans {
+		if o.mapping.Fingerprint != nil {
+			sizes[o.mapping.Fingerprint.Size] = true
+		}
+	}
+	candidates := make(map[string]*state.Fingerprint)
+	if len(sizes) == 0 {
+		return candidates, nil
+	}
+
+	err := filepath.WalkDir(vfs.sourceDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			reconcileLogger.Warn("Cannot read %q: %v", path, err)
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(vfs.sourceDir, path)
+		if err != nil {
+			return err
+		}
+		source := NewSourcePath(rel).String()
+		if recorded[source] {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || !sizes[info.Size()] {
+			return nil
+		}
+		fingerprint, err := state.ComputeFingerprint(path)
+		if err != nil {
+			reconcileLogger.Warn("Cannot fingerprint %q: %v", source, err)
+			return nil
+		}
+		candidates[source] = fingerprint
+		return nil
+	})
+	return candidates, err
+}
+
+// LastReconcile returns the report of the last reconcile pass, or nil if
+// there was none
+func (vfs *VMapFS) LastReconcile() *ReconcileReport {
+	vfs.reconciler.lastMu.Lock()
+	defer vfs.reconciler.lastMu.Unlock()
+	return vfs.reconciler.last
+}
+
+// setLast remembers the report of a reconcile pass
+func (r *reconciler) setLast(report ReconcileReport) {
+	r.lastMu.Lock()
+	defer r.lastMu.Unlock()
+	r.last = &report
+}
+
+// StartReconciler runs a reconcile pass every interval until the returned
+// function is called. An interval of zero or less disables it.
+func (vfs *VMapFS) StartReconciler(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	if interval <= 0 {
+		return func() { close(done) }
+	}
+
+	reconcileLogger.Info("Reconciling mappings every %v", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				report, err := vfs.Reconcile(false)
+				if err != nil {
+					reconcileLogger.Error("Failed to reconcile: %v", err)
+					continue
+				}
+				reconcileLogger.Debug("Reconciled: %d fingerprinted, %d orphaned, %d relinked, %d ambiguous",
+					report.Fingerprinted, report.Orphaned, len(report.Relinked), len(report.Ambiguous))
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// sortedSources returns the keys of m in sorted order
+func sortedSources[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,118 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"vmapfs/internal/state"
+)
+
+func TestReconcile(t *testing.T) {
+	vfs, sourceDir, stateDir, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	write := func(name, content string) {
+		t.Helper()
+		full := filepath.Join(sourceDir, name)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+	write("a.mkv", "alpha")
+	write("b.mkv", "bravo")
+	write("c.mkv", "charlie")
+
+	vfs.mu.Lock()
+	vfs.pathMapper.AddMapping(NewVirtualPath("/movies/A.mkv"), NewSourcePath("a.mkv"))
+	vfs.pathMapper.SetXattr(NewSourcePath("a.mkv"), "user.rating", []byte("5"))
+	vfs.pathMapper.AddMapping(NewVirtualPath("/movies/B.mkv"), NewSourcePath("b.mkv"))
+	vfs.pathMapper.AddMapping(NewVirtualPath("/movies/C.mkv"), NewSourcePath("c.mkv"))
+	vfs.txOps, vfs.txUndo = nil, nil
+	vfs.mu.Unlock()
+
+	report, err := vfs.Reconcile(false)
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if report.Fingerprinted != 3 || report.Orphaned != 0 {
+		t.Errorf("Expected 3 fingerprinted and no orphans, got %+v", report)
+	}
+	if len(vfs.History()) != 0 {
+		t.Error("Expected fingerprints to stay out of the undo history")
+	}
+	if report, _ := vfs.Reconcile(false); report.Fingerprinted != 0 {
+		t.Errorf("Expected unchanged sources not to be fingerprinted again, got %d", report.Fingerprinted)
+	}
+
+	// a.mkv is renamed, b.mkv turns up twice and c.mkv disappears
+	if err := os.MkdirAll(filepath.Join(sourceDir, "new"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.Rename(filepath.Join(sourceDir, "a.mkv"), filepath.Join(sourceDir, "new", "a.renamed.mkv")); err != nil {
+		t.Fatalf("Failed to rename: %v", err)
+	}
+	os.Remove(filepath.Join(sourceDir, "b.mkv"))
+	os.Remove(filepath.Join(sourceDir, "c.mkv"))
+	write("copy1/b.mkv", "bravo")
+	write("copy2/b.mkv", "bravo")
+
+	dryRun, err := vfs.Reconcile(true)
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if dryRun.Applied || len(dryRun.Relinked) != 1 {
+		t.Errorf("Expected a dry run to find one relink, got %+v", dryRun)
+	}
+	if sp, _ := vfs.pathMapper.GetSourcePath(NewVirtualPath("/movies/A.mkv")); sp.String() != "a.mkv" {
+		t.Errorf("Expected a dry run to change nothing, got %s", sp)
+	}
+
+	report, err = vfs.Reconcile(false)
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if report.Orphaned != 3 {
+		t.Errorf("Expected 3 orphans, got %d", report.Orphaned)
+	}
+	want := []Relink{{Old: "a.mkv", New: "new/a.renamed.mkv", VirtualPaths: []string{"/movies/A.mkv"}}}
+	if !reflect.DeepEqual(report.Relinked, want) {
+		t.Errorf("Expected relinks %v, got %v", want, report.Relinked)
+	}
+	if len(report.Ambiguous) != 1 || report.Ambiguous[0].Source != "b.mkv" || len(report.Ambiguous[0].Candidates) != 2 {
+		t.Errorf("Expected b.mkv to be ambiguous, got %v", report.Ambiguous)
+	}
+	if !reflect.DeepEqual(report.Unmatched, []string{"c.mkv"}) {
+		t.Errorf("Expected c.mkv to be unmatched, got %v", report.Unmatched)
+	}
+	if last := vfs.LastReconcile(); last == nil || !last.Applied {
+		t.Error("Expected the last report to be kept")
+	}
+
+	newSource := NewSourcePath("new/a.renamed.mkv")
+	if sp, _ := vfs.pathMapper.GetSourcePath(NewVirtualPath("/movies/A.mkv")); sp.String() != newSource.String() {
+		t.Errorf("Expected /movies/A.mkv to be relinked, got %s", sp)
+	}
+	if xattrs, _ := vfs.pathMapper.GetXattrs(newSource); string(xattrs["user.rating"]) != "5" {
+		t.Errorf("Expected xattrs to be kept, got %v", xattrs)
+	}
+
+	savedState, err := state.ReadState(filepath.Join(stateDir, "state.json"))
+	if err != nil {
+		t.Fatalf("Failed to read state: %v", err)
+	}
+	if mapping := savedState.Mappings["new/a.renamed.mkv"]; !mapping.HasVirtualPath("/movies/A.mkv") || mapping.Fingerprint == nil {
+		t.Errorf("Expected the relink and fingerprint to be saved, got %+v", mapping)
+	}
+
+	if _, err := vfs.Undo(1); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	if sp, _ := vfs.pathMapper.GetSourcePath(NewVirtualPath("/movies/A.mkv")); sp.String() != "a.mkv" {
+		t.Errorf("Expected undo to restore the old source, got %s", sp)
+	}
+}
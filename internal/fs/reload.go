@@ -0,0 +1,147 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"vmapfs/internal/logging"
+	"vmapfs/internal/state"
+)
+
+var (
+	reloadLogger = logging.GetLogger().WithPrefix("reload")
+
+	// ErrReloadConflict indicates that an external edit of the state file
+	// conflicted with changes made through the mount and was rejected
+	ErrReloadConflict = errors.New("external state edit conflicts with changes made through the mount")
+)
+
+// DefaultReloadInterval is how often the state file is checked for
+// external edits by default
+const DefaultReloadInterval = 2 * time.Second
+
+// WatchState checks the state file managed by manager for edits made by
+// other processes every interval and merges them into the filesystem. An
+// interval of zero or less only remembers the manager, so that Reload can
+// be triggered by hand. The returned function stops watching.
+func (vfs *VMapFS) WatchState(manager *state.Manager, interval time.Duration) (stop func()) {
+	vfs.mu.Lock()
+	vfs.manager = manager
+	vfs.mu.Unlock()
+
+	done := make(chan struct{})
+	if interval > 0 {
+		reloadLogger.Debug("Checking %s for external edits every %v", manager.Path(), interval)
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if err := vfs.Reload(false); err != nil {
+						reloadLogger.Error("Failed to reload state: %v", err)
+					}
+				}
+			}
+		}()
+	}
+	return func() { close(done) }
+}
+
+// Reload merges edits made to the state file by other processes into the
+// filesystem. Unless force is set nothing happens if the file is unchanged
+// since it was last read or written. Edits that conflict with changes made
+// through the mount are rejected as a whole: the state in memory is saved
+// over them and the edited file is kept as a backup.
+func (vfs *VMapFS) Reload(force bool) error {
+	vfs.mu.Lock()
+	names, err := vfs.reloadLocked(force)
+	vfs.mu.Unlock()
+
+	vfs.invalidateEntries(vfs.root, names)
+	return err
+}
+
+// reloadLocked implements Reload, returning the root entries whose cached
+// entries should be invalidated. It must be called with vfs.mu held.
+func (vfs *VMapFS) reloadLocked(force bool) ([]string, error) {
+	if vfs.manager == nil {
+		return nil, fmt.Errorf("state file is not watched")
+	}
+	if !force {
+		changed, err := vfs.manager.ExternalChange()
+		if err != nil || !changed {
+			return nil, err
+		}
+	}
+
+	base, edited, err := vfs.manager.ReadExternal()
+	if err != nil {
+		reloadLogger.Error("Rejecting unreadable state file edit: %v", err)
+		return nil, vfs.rejectExternal(err)
+	}
+
+	merged, conflicts := state.Merge(base, vfs.syncedState(), edited)
+	if len(conflicts) > 0 {
+		for _, conflict := range conflicts {
+			reloadLogger.Warn("Conflicting state file edit: %s", conflict)
+		}
+		return nil, vfs.rejectExternal(fmt.Errorf("%w (%d conflicts)", ErrReloadConflict, len(conflicts)))
+	}
+
+	diff := state.Diff(vfs.state, merged)
+	if diff.Empty() {
+		if state.Diff(edited, vfs.state).Empty() {
+			reloadLogger.Debug("State file edit changes nothing")
+			return nil, nil
+		}
+		// The edit made changes that were also made through the mount
+		return nil, vfs.saveSnapshotLocked()
+	}
+
+	reloadLogger.Info("Merging state file edit (%d mappings, %d directories changed)", len(diff.Mappings), len(diff.Directories))
+	merged.AssignInodes()
+	vfs.state = merged
+	vfs.pathMapper = NewPathMapper(vfs.sourceDir, merged.Mappings, merged.Directories)
+	vfs.pathMapper.SetRecorder(vfs.recordOp)
+	vfs.pathMapper.SetDirectoryMover(merged.MoveDirectoryInodes)
+	vfs.txOps = nil
+	vfs.txUndo = nil
+	vfs.history.clear()
+
+	return diffRootNames(diff), vfs.saveSnapshotLocked()
+}
+
+// rejectExternal saves the state in memory over an external edit, which
+// the save keeps as a backup, and returns reason. It must be called with
+// vfs.mu held.
+func (vfs *VMapFS) rejectExternal(reason error) error {
+	if err := vfs.saveSnapshotLocked(); err != nil {
+		return fmt.Errorf("%v; failed to save state: %w", reason, err)
+	}
+	reloadLogger.Warn("Kept the rejected state file as a backup in %s", vfs.manager.BackupDir())
+	return reason
+}
+
+// diffRootNames returns the root entries below which a diff makes changes
+func diffRootNames(diff state.StateDiff) []string {
+	var paths []string
+	for _, change := range diff.Directories {
+		paths = append(paths, change.Path)
+	}
+	for _, change := range diff.Mappings {
+		for _, mapping := range []*state.FileMapping{change.Old, change.New} {
+			if mapping != nil {
+				paths = append(paths, mapping.VirtualPaths...)
+			}
+		}
+	}
+	if len(diff.Mappings) > 0 {
+		// Sources may also have appeared in or disappeared from _UNSORTED
+		paths = append(paths, "/_UNSORTED")
+	}
+	return rootNamesOf(paths)
+}
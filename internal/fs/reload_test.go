@@ -0,0 +1,166 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vmapfs/internal/state"
+
+	"bazil.org/fuse"
+)
+
+func TestReload(t *testing.T) {
+	vfs, sourceDir, stateDir, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, name := range []string{"a.mkv", "b.mkv", "c.mkv"} {
+		if err := os.WriteFile(filepath.Join(sourceDir, name), []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	statePath := filepath.Join(stateDir, "state.json")
+	stop := vfs.WatchState(vfs.store.(*state.Manager), 0)
+	defer stop()
+
+	root, _ := vfs.Root()
+	rootDir := root.(*Dir)
+	unsorted, _ := rootDir.Lookup(ctx, "_UNSORTED")
+	movies, err := rootDir.Mkdir(ctx, &fuse.MkdirRequest{Name: "movies"})
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := unsorted.(*UnsortedDir).Rename(ctx, &fuse.RenameRequest{OldName: "a.mkv", NewName: "a.mkv"}, movies); err != nil {
+		t.Fatalf("Failed to map file: %v", err)
+	}
+
+	// edit changes the state file the way an external script would
+	edit := func(fn func(s *state.FSState)) {
+		t.Helper()
+		onDisk, err := state.ReadState(statePath)
+		if err != nil {
+			t.Fatalf("Failed to read state: %v", err)
+		}
+		fn(onDisk)
+		data, _ := json.MarshalIndent(onDisk, "", "  ")
+		if err := os.WriteFile(statePath, data, 0644); err != nil {
+			t.Fatalf("Failed to edit state: %v", err)
+		}
+	}
+
+	t.Run("Unchanged", func(t *testing.T) {
+		if err := vfs.Reload(false); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+	})
+
+	t.Run("MergesEdit", func(t *testing.T) {
+		edit(func(s *state.FSState) {
+			s.Mappings["b.mkv"] = state.FileMapping{VirtualPaths: []string{"/tv/b.mkv"}}
+		})
+		if err := vfs.Reload(false); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+		tv := mustLookup(t, rootDir, "tv")
+		if _, err := tv.Lookup(ctx, "b.mkv"); err != nil {
+			t.Errorf("Expected the edited mapping to be visible: %v", err)
+		}
+		if _, err := mustLookup(t, rootDir, "movies").Lookup(ctx, "a.mkv"); err != nil {
+			t.Errorf("Expected the existing mapping to be kept: %v", err)
+		}
+	})
+
+	t.Run("MergesEditOnSave", func(t *testing.T) {
+		edit(func(s *state.FSState) {
+			s.Mappings["c.mkv"] = state.FileMapping{VirtualPaths: []string{"/tv/c.mkv"}}
+		})
+		// Saving a change made through the mount must not overwrite the edit
+		if _, err := rootDir.Mkdir(ctx, &fuse.MkdirRequest{Name: "music"}); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		onDisk, err := state.ReadState(statePath)
+		if err != nil {
+			t.Fatalf("Failed to read state: %v", err)
+		}
+		if !onDisk.Directories["/music"] || !onDisk.Mappings["c.mkv"].HasVirtualPath("/tv/c.mkv") {
+			t.Errorf("Expected both changes to be saved, got %+v", onDisk)
+		}
+	})
+
+	t.Run("MergesEditOnDebouncedSave", func(t *testing.T) {
+		vfs.SetSaveOptions(state.SaveOptions{Debounce: time.Hour, MaxDelay: time.Hour})
+		defer vfs.SetSaveOptions(state.SaveOptions{})
+		if _, err := rootDir.Mkdir(ctx, &fuse.MkdirRequest{Name: "books"}); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		edit(func(s *state.FSState) {
+			s.Directories["/podcasts"] = true
+		})
+
+		if err := vfs.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+		onDisk, err := state.ReadState(statePath)
+		if err != nil {
+			t.Fatalf("Failed to read state: %v", err)
+		}
+		if !onDisk.Directories["/books"] || !onDisk.Directories["/podcasts"] {
+			t.Errorf("Expected both changes to be saved, got %v", onDisk.Directories)
+		}
+		if err := vfs.Flush(); err != nil {
+			t.Errorf("Expected nothing left to save, got %v", err)
+		}
+	})
+
+	t.Run("RejectsConflict", func(t *testing.T) {
+		// Keep the change made through the mount unsaved while the script
+		// edits the file
+		vfs.SetSaveOptions(state.SaveOptions{Debounce: time.Hour, MaxDelay: time.Hour})
+		defer vfs.SetSaveOptions(state.SaveOptions{})
+		fileNode, _ := mustLookup(t, rootDir, "movies").Lookup(ctx, "a.mkv")
+		if err := fileNode.(*File).Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.tag", Xattr: []byte("mount")}); err != nil {
+			t.Fatalf("Failed to set xattr: %v", err)
+		}
+		edit(func(s *state.FSState) {
+			mapping := s.Mappings["a.mkv"]
+			mapping.Xattrs = map[string][]byte{"user.tag": []byte("script")}
+			s.Mappings["a.mkv"] = mapping
+			s.Directories["/script"] = true
+		})
+
+		if err := vfs.Reload(false); !errors.Is(err, ErrReloadConflict) {
+			t.Fatalf("Expected ErrReloadConflict, got %v", err)
+		}
+		onDisk, err := state.ReadState(statePath)
+		if err != nil {
+			t.Fatalf("Failed to read state: %v", err)
+		}
+		if onDisk.Directories["/script"] || string(onDisk.Mappings["a.mkv"].Xattrs["user.tag"]) != "mount" {
+			t.Errorf("Expected the conflicting edit to be rejected, got %+v", onDisk)
+		}
+		latest, err := state.LoadBackup(state.BackupDirFor(statePath), "latest")
+		if err != nil {
+			t.Fatalf("Failed to load backup: %v", err)
+		}
+		if !latest.Directories["/script"] {
+			t.Error("Expected the rejected edit to be kept as a backup")
+		}
+	})
+
+	t.Run("RejectsUnreadable", func(t *testing.T) {
+		if err := os.WriteFile(statePath, []byte("{not json"), 0644); err != nil {
+			t.Fatalf("Failed to edit state: %v", err)
+		}
+		if err := vfs.Reload(false); err == nil {
+			t.Error("Expected an unreadable edit to be rejected")
+		}
+		if _, err := state.ReadState(statePath); err != nil {
+			t.Errorf("Expected the state to be saved over the unreadable edit: %v", err)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"vmapfs/internal/state"
+)
+
+// Retargeted describes a virtual path pointed at a new source
+type Retargeted struct {
+	Virtual string `json:"virtual"`
+	Old     string `json:"old"`
+	New     string `json:"new"`
+	// DroppedXattrs are the names of xattrs the new source had of its own
+	DroppedXattrs []string `json:"dropped_xattrs,omitempty"`
+}
+
+// SetRetargetOnReplace makes moving a file out of _UNSORTED onto a mapped
+// file retarget the mapped file to it, as vmapfs retarget does, instead of
+// replacing it
+func (vfs *VMapFS) SetRetargetOnReplace(enabled bool) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	if enabled {
+		vfsLogger.Info("Moving unsorted files onto mapped files retargets them")
+	}
+	vfs.retargetOnReplace = enabled
+}
+
+// Retarget points the mapped virtual path vp at the source file sp, keeping
+// its name and xattrs. The old source must have no other virtual path; it
+// is recorded in the mapping's history and shows up in _UNSORTED again. The
+// change is saved, audited and can be undone.
+func (vfs *VMapFS) Retarget(vp *VirtualPath, sp *SourcePath) (Retargeted, error) {
+	if vfs.readOnly {
+		return Retargeted{}, ErrReadOnly
+	}
+
+	vfs.mu.Lock()
+	result, err := vfs.retargetLocked(vp, sp)
+	if err == nil {
+		err = vfs.commitOps(safeIntToUint32(os.Getuid()), safeIntToUint32(os.Getpid()), "retarget")
+	}
+	vfs.mu.Unlock()
+
+	if result.Old != "" {
+		vfs.invalidateEntries(vfs.root, rootNamesOf([]string{"/_UNSORTED", result.Virtual}))
+	}
+	return result, err
+}
+
+// retargetLocked retargets vp to sp through the path mapper. It must be
+// called with vfs.mu held.
+func (vfs *VMapFS) retargetLocked(vp *VirtualPath, sp *SourcePath) (Retargeted, error) {
+	old, exists := vfs.pathMapper.GetSourcePath(vp)
+	if !exists {
+		return Retargeted{}, NewFSError(OpRetarget, vp.String(), ErrPathNotFound)
+	}
+	dropped, err := vfs.pathMapper.Retarget(vp, sp, time.Now())
+	if errors.Is(err, ErrMultiplePaths) {
+		return Retargeted{}, NewFSError(OpRetarget, vp.String(), err)
+	}
+	if err != nil {
+		// The virtual path was checked, so the problem is the source
+		return Retargeted{}, NewFSError(OpRetarget, sp.String(), err)
+	}
+	vfsLogger.Info("Retargeted %q from %q to %q", vp.String(), old.String(), sp.String())
+
+	return Retargeted{Virtual: vp.String(), Old: old.String(), New: sp.String(), DroppedXattrs: dropped}, nil
+}
+
+// SourceHistory returns the sources the mapped virtual path vp pointed at
+// before it was retargeted, oldest first
+func (vfs *VMapFS) SourceHistory(vp *VirtualPath) ([]state.PreviousSource, error) {
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+
+	sp, exists := vfs.pathMapper.GetSourcePath(vp)
+	if !exists {
+		return nil, NewFSError(OpRetarget, vp.String(), ErrPathNotFound)
+	}
+	return vfs.state.Mappings[sp.String()].History, nil
+}
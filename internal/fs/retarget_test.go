@@ -0,0 +1,171 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"vmapfs/internal/state"
+
+	"bazil.org/fuse"
+)
+
+func TestRetarget(t *testing.T) {
+	vfs, sourceDir, stateDir, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	for _, name := range []string{"old/X.720p.mkv", "new/X.1080p.mkv", "new/X.2160p.mkv", "other.mkv"} {
+		full := filepath.Join(sourceDir, name)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(full, []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	vp := NewVirtualPath("/movies/X (2010)/X (2010).mkv")
+	vfs.mu.Lock()
+	vfs.pathMapper.AddMapping(vp, NewSourcePath("old/X.720p.mkv"))
+	vfs.pathMapper.AddMapping(NewVirtualPath("/favourites/X.mkv"), NewSourcePath("old/X.720p.mkv"))
+	vfs.pathMapper.SetXattr(NewSourcePath("old/X.720p.mkv"), "user.rating", []byte("5"))
+	vfs.pathMapper.AddMapping(NewVirtualPath("/other.mkv"), NewSourcePath("other.mkv"))
+	// An xattr set on the new source while it was unsorted
+	vfs.pathMapper.SetXattr(NewSourcePath("new/X.1080p.mkv"), "user.note", []byte("new"))
+	vfs.txOps, vfs.txUndo = nil, nil
+	vfs.mu.Unlock()
+
+	t.Run("Errors", func(t *testing.T) {
+		for _, tc := range []struct {
+			name   string
+			vpath  string
+			source string
+			want   error
+		}{
+			{"Unmapped", "/movies/missing.mkv", "new/X.1080p.mkv", ErrPathNotFound},
+			{"SameSource", vp.String(), "old/X.720p.mkv", ErrAlreadyExists},
+			{"MappedSource", vp.String(), "other.mkv", ErrAlreadyExists},
+			{"Directory", vp.String(), "new", ErrIsDirectory},
+			{"MissingSource", vp.String(), "new/gone.mkv", os.ErrNotExist},
+			{"LinkedPath", vp.String(), "new/X.1080p.mkv", ErrMultiplePaths},
+		} {
+			if _, err := vfs.Retarget(NewVirtualPath(tc.vpath), NewSourcePath(tc.source)); !errors.Is(err, tc.want) {
+				t.Errorf("%s: expected %v, got %v", tc.name, tc.want, err)
+			}
+		}
+		if len(vfs.History()) != 0 {
+			t.Error("Expected failed retargets to change nothing")
+		}
+		if sp, _ := vfs.pathMapper.GetSourcePath(NewVirtualPath("/favourites/X.mkv")); sp.String() != "old/X.720p.mkv" {
+			t.Errorf("Expected the other virtual path to keep its source, got %s", sp)
+		}
+
+		vfs.mu.Lock()
+		vfs.pathMapper.RemoveMapping(NewVirtualPath("/favourites/X.mkv"))
+		vfs.txOps, vfs.txUndo = nil, nil
+		vfs.mu.Unlock()
+	})
+
+	t.Run("Retarget", func(t *testing.T) {
+		result, err := vfs.Retarget(vp, NewSourcePath("new/X.1080p.mkv"))
+		if err != nil {
+			t.Fatalf("Retarget failed: %v", err)
+		}
+		if result.Old != "old/X.720p.mkv" || result.New != "new/X.1080p.mkv" ||
+			len(result.DroppedXattrs) != 1 || result.DroppedXattrs[0] != "user.note" {
+			t.Errorf("Unexpected result %+v", result)
+		}
+
+		if sp, _ := vfs.pathMapper.GetSourcePath(vp); sp.String() != "new/X.1080p.mkv" {
+			t.Errorf("Expected %s to be retargeted, got %s", vp, sp)
+		}
+		if vfs.pathMapper.IsPathMapped(NewSourcePath("old/X.720p.mkv")) {
+			t.Error("Expected the old source to be unmapped")
+		}
+		xattrs, _ := vfs.pathMapper.GetXattrs(NewSourcePath("new/X.1080p.mkv"))
+		if string(xattrs["user.rating"]) != "5" || xattrs["user.note"] != nil {
+			t.Errorf("Expected the mapping's xattrs only, got %v", xattrs)
+		}
+		history, err := vfs.SourceHistory(vp)
+		if err != nil || len(history) != 1 || history[0].Source != "old/X.720p.mkv" {
+			t.Errorf("Expected the old source in the history, got %v (%v)", history, err)
+		}
+
+		saved, err := state.ReadState(filepath.Join(stateDir, "state.json"))
+		if err != nil {
+			t.Fatalf("Failed to read state: %v", err)
+		}
+		if mapping := saved.Mappings["new/X.1080p.mkv"]; !mapping.HasVirtualPath(vp.String()) || len(mapping.History) != 1 {
+			t.Errorf("Expected the retarget to be saved, got %+v", mapping)
+		}
+	})
+
+	t.Run("Undo", func(t *testing.T) {
+		if _, err := vfs.Undo(1); err != nil {
+			t.Fatalf("Undo failed: %v", err)
+		}
+		if sp, _ := vfs.pathMapper.GetSourcePath(vp); sp.String() != "old/X.720p.mkv" {
+			t.Errorf("Expected undo to restore the old source, got %s", sp)
+		}
+		if history, _ := vfs.SourceHistory(vp); len(history) != 0 {
+			t.Errorf("Expected undo to drop the history entry, got %v", history)
+		}
+		if xattrs, _ := vfs.pathMapper.GetXattrs(NewSourcePath("new/X.1080p.mkv")); string(xattrs["user.note"]) != "new" {
+			t.Errorf("Expected undo to restore the new source's xattrs, got %v", xattrs)
+		}
+
+		if _, err := vfs.Redo(1); err != nil {
+			t.Fatalf("Redo failed: %v", err)
+		}
+		if sp, _ := vfs.pathMapper.GetSourcePath(vp); sp.String() != "new/X.1080p.mkv" {
+			t.Errorf("Expected redo to retarget again, got %s", sp)
+		}
+	})
+
+	t.Run("RenameOntoMapped", func(t *testing.T) {
+		vfs.SetRetargetOnReplace(true)
+		ctx := context.Background()
+		root, _ := vfs.Root()
+		unsortedNode, err := root.(*Dir).Lookup(ctx, "_UNSORTED")
+		if err != nil {
+			t.Fatalf("Failed to lookup _UNSORTED: %v", err)
+		}
+		unsortedNew, err := unsortedNode.(*UnsortedDir).Lookup(ctx, "new")
+		if err != nil {
+			t.Fatalf("Failed to lookup _UNSORTED/new: %v", err)
+		}
+		target, err := root.(*Dir).Lookup(ctx, "movies")
+		if err == nil {
+			target, err = target.(*Dir).Lookup(ctx, "X (2010)")
+		}
+		if err != nil {
+			t.Fatalf("Failed to lookup target directory: %v", err)
+		}
+
+		renameReq := &fuse.RenameRequest{OldName: "X.2160p.mkv", NewName: "X (2010).mkv"}
+		favourite := NewVirtualPath("/favourites/X.mkv")
+		vfs.mu.Lock()
+		vfs.pathMapper.AddMapping(favourite, NewSourcePath("new/X.1080p.mkv"))
+		vfs.mu.Unlock()
+		if err := unsortedNew.(*UnsortedDir).Rename(ctx, renameReq, target); err != syscall.EMLINK {
+			t.Errorf("Expected EMLINK moving onto a file with another virtual path, got %v", err)
+		}
+		vfs.mu.Lock()
+		vfs.pathMapper.RemoveMapping(favourite)
+		vfs.mu.Unlock()
+
+		if err := unsortedNew.(*UnsortedDir).Rename(ctx, renameReq, target); err != nil {
+			t.Fatalf("Failed to move onto mapped file: %v", err)
+		}
+		if sp, _ := vfs.pathMapper.GetSourcePath(vp); sp.String() != "new/X.2160p.mkv" {
+			t.Errorf("Expected the rename to retarget the file, got %s", sp)
+		}
+		history, _ := vfs.SourceHistory(vp)
+		if len(history) != 2 || history[1].Source != "new/X.1080p.mkv" {
+			t.Errorf("Expected both previous sources in the history, got %v", history)
+		}
+	})
+}
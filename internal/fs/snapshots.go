@@ -0,0 +1,191 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+
+	"vmapfs/internal/logging"
+	"vmapfs/internal/state"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+)
+
+var (
+	snapshotLogger = logging.GetLogger().WithPrefix("snapshots")
+)
+
+const (
+	// snapshotsDirName is the hidden root directory exposing state backups.
+	// Like a ZFS snapdir it can be entered but is not listed, so media
+	// servers scanning the mount don't index every snapshot.
+	snapshotsDirName = ".snapshots"
+
+	// snapshotNameFormat names snapshots by the time of their backup. Backups
+	// taken within the same second fall back to snapshotPreciseNameFormat.
+	snapshotNameFormat        = "2006-01-02T15:04:05"
+	snapshotPreciseNameFormat = "2006-01-02T15:04:05.000000"
+
+	// maxSnapshotViews bounds how many loaded snapshots are kept in memory
+	maxSnapshotViews = 4
+)
+
+// snapshotViews loads backups as read-only filesystems on demand and keeps
+// the most recently used ones
+type snapshotViews struct {
+	backupDir string
+	views     map[string]*VMapFS // backup name -> frozen filesystem
+	recent    []string           // backup names, most recently used last
+	mu        sync.Mutex
+}
+
+// SetSnapshotDir exposes the backups in backupDir as read-only trees under
+// /.snapshots
+func (vfs *VMapFS) SetSnapshotDir(backupDir string) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	vfsLogger.Debug("Exposing backups from %s under /%s", backupDir, snapshotsDirName)
+	vfs.snapshots = &snapshotViews{
+		backupDir: backupDir,
+		views:     make(map[string]*VMapFS),
+	}
+}
+
+// newFrozenFS creates a read-only filesystem over the same source tree that
+// renders fsState. Its path mapper is never modified: every node refuses
+// changes with EROFS.
+func (vfs *VMapFS) newFrozenFS(fsState *state.FSState) *VMapFS {
+	frozen := &VMapFS{
+		sourceDir:  vfs.sourceDir,
+		state:      fsState,
+		pathMapper: NewPathMapper(vfs.sourceDir, fsState.Mappings, fsState.Directories),
+		uid:        vfs.uid,
+		gid:        vfs.gid,
+		openFiles:  vfs.openFiles,
+		readOnly:   true,
+	}
+	frozen.root = &Dir{fs: frozen, path: NewVirtualPath("/")}
+	return frozen
+}
+
+// snapshotNames maps snapshot directory names to backup names
+func snapshotNames(backups []state.Backup) map[string]string {
+	perSecond := make(map[string]int, len(backups))
+	for _, backup := range backups {
+		perSecond[backup.Time.Format(snapshotNameFormat)]++
+	}
+
+	names := make(map[string]string, len(backups))
+	for _, backup := range backups {
+		name := backup.Time.Format(snapshotNameFormat)
+		if perSecond[name] > 1 {
+			name = backup.Time.Format(snapshotPreciseNameFormat)
+		}
+		names[name] = backup.Name
+	}
+	return names
+}
+
+// view returns the frozen filesystem for a backup, loading it if needed
+func (sv *snapshotViews) view(parent *VMapFS, backupName string) (*VMapFS, error) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	if view, exists := sv.views[backupName]; exists {
+		sv.touch(backupName)
+		return view, nil
+	}
+
+	snapshotLogger.Debug("Loading snapshot from backup %s", backupName)
+	fsState, err := state.LoadBackup(sv.backupDir, backupName)
+	if err != nil {
+		return nil, err
+	}
+	view := parent.newFrozenFS(fsState)
+
+	sv.views[backupName] = view
+	sv.touch(backupName)
+	for len(sv.recent) > maxSnapshotViews {
+		snapshotLogger.Trace("Dropping snapshot %s from memory", sv.recent[0])
+		delete(sv.views, sv.recent[0])
+		sv.recent = sv.recent[1:]
+	}
+	return view, nil
+}
+
+// touch marks a backup as the most recently used. It must be called with
+// sv.mu held.
+func (sv *snapshotViews) touch(backupName string) {
+	for i, name := range sv.recent {
+		if name == backupName {
+			sv.recent = append(sv.recent[:i], sv.recent[i+1:]...)
+			break
+		}
+	}
+	sv.recent = append(sv.recent, backupName)
+}
+
+// SnapshotsDir is the /.snapshots directory. Each entry is the root of a
+// read-only tree rendered from a state backup.
+type SnapshotsDir struct {
+	fs *VMapFS
+}
+
+// Attr implements the Node interface, returning directory attributes.
+func (d *SnapshotsDir) Attr(_ context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	a.Uid = d.fs.uid
+	a.Gid = d.fs.gid
+	return nil
+}
+
+// Lookup implements the NodeStringLookuper interface, returning the root of
+// the named snapshot.
+func (d *SnapshotsDir) Lookup(_ context.Context, name string) (fusefs.Node, error) {
+	snapshotLogger.Debug("Looking up snapshot %q", name)
+	backups, err := state.ListBackups(d.fs.snapshots.backupDir)
+	if err != nil {
+		snapshotLogger.Error("Failed to list backups: %v", err)
+		return nil, ToFuseError(err)
+	}
+
+	backupName, exists := snapshotNames(backups)[name]
+	if !exists {
+		return nil, syscall.ENOENT
+	}
+	view, err := d.fs.snapshots.view(d.fs, backupName)
+	if err != nil {
+		snapshotLogger.Error("Failed to load snapshot %q: %v", name, err)
+		return nil, syscall.EIO
+	}
+	return view.root, nil
+}
+
+// ReadDirAll implements the HandleReadDirAller interface, listing one entry
+// per backup.
+func (d *SnapshotsDir) ReadDirAll(_ context.Context) ([]fuse.Dirent, error) {
+	backups, err := state.ListBackups(d.fs.snapshots.backupDir)
+	if err != nil {
+		snapshotLogger.Error("Failed to list backups: %v", err)
+		return nil, ToFuseError(err)
+	}
+
+	entries := []fuse.Dirent{
+		{Name: ".", Type: fuse.DT_Dir},
+		{Name: "..", Type: fuse.DT_Dir},
+	}
+	names := make([]string, 0, len(backups))
+	for name := range snapshotNames(backups) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entries = append(entries, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+	}
+	snapshotLogger.Debug("Listing %d snapshots", len(entries)-2)
+	return entries, nil
+}
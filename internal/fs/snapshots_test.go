@@ -0,0 +1,118 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestSnapshots(t *testing.T) {
+	vfs, sourceDir, stateDir, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := os.WriteFile(filepath.Join(sourceDir, "a.mkv"), []byte("test"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	vfs.SetSnapshotDir(filepath.Join(stateDir, ".vmapfs-backups"))
+
+	root, _ := vfs.Root()
+	rootDir := root.(*Dir)
+	unsorted, _ := rootDir.Lookup(ctx, "_UNSORTED")
+	movies, err := rootDir.Mkdir(ctx, &fuse.MkdirRequest{Name: "movies"})
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := unsorted.(*UnsortedDir).Rename(ctx, &fuse.RenameRequest{OldName: "a.mkv", NewName: "a.mkv"}, movies); err != nil {
+		t.Fatalf("Failed to map file: %v", err)
+	}
+	// The backup taken before this change holds /movies/a.mkv
+	if err := movies.(*Dir).Rename(ctx, &fuse.RenameRequest{OldName: "a.mkv", NewName: "renamed.mkv"}, movies); err != nil {
+		t.Fatalf("Failed to rename file: %v", err)
+	}
+
+	rootEntries, _ := rootDir.ReadDirAll(ctx)
+	for _, entry := range rootEntries {
+		if entry.Name == snapshotsDirName {
+			t.Errorf("Expected %s to be hidden from the root listing", snapshotsDirName)
+		}
+	}
+	if _, err := rootDir.Mkdir(ctx, &fuse.MkdirRequest{Name: snapshotsDirName}); err != syscall.EEXIST {
+		t.Errorf("Expected creating %s to fail with EEXIST, got %v", snapshotsDirName, err)
+	}
+	if err := os.WriteFile(filepath.Join(sourceDir, "b.mkv"), []byte("test"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	for _, name := range ReservedNames {
+		if err := movies.(*Dir).Rename(ctx, &fuse.RenameRequest{OldName: "renamed.mkv", NewName: name}, rootDir); err != syscall.EEXIST {
+			t.Errorf("Expected renaming onto %s to fail with EEXIST, got %v", name, err)
+		}
+		if err := unsorted.(*UnsortedDir).Rename(ctx, &fuse.RenameRequest{OldName: "b.mkv", NewName: name}, rootDir); err != syscall.EEXIST {
+			t.Errorf("Expected moving an unsorted file onto %s to fail with EEXIST, got %v", name, err)
+		}
+	}
+	if err := os.Remove(filepath.Join(sourceDir, "b.mkv")); err != nil {
+		t.Fatalf("Failed to remove test file: %v", err)
+	}
+
+	node, err := rootDir.Lookup(ctx, snapshotsDirName)
+	if err != nil {
+		t.Fatalf("Failed to look up %s: %v", snapshotsDirName, err)
+	}
+	snapshots := node.(*SnapshotsDir)
+	entries, err := snapshots.ReadDirAll(ctx)
+	if err != nil {
+		t.Fatalf("Failed to list snapshots: %v", err)
+	}
+	names := entries[2:]
+	if len(names) == 0 {
+		t.Fatal("Expected at least one snapshot")
+	}
+
+	// The newest snapshot is the state just before the rename
+	node, err = snapshots.Lookup(ctx, names[len(names)-1].Name)
+	if err != nil {
+		t.Fatalf("Failed to look up snapshot: %v", err)
+	}
+	snapshotRoot := node.(*Dir)
+	if snapshotEntries, _ := snapshotRoot.ReadDirAll(ctx); len(snapshotEntries) != 3 {
+		t.Errorf("Expected snapshot root to hold only movies, got %v", snapshotEntries)
+	}
+	snapshotMovies := mustLookup(t, snapshotRoot, "movies")
+	node, err = snapshotMovies.Lookup(ctx, "a.mkv")
+	if err != nil {
+		t.Fatalf("Expected the old name in the snapshot: %v", err)
+	}
+	snapshotFile := node.(*File)
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		if _, err := snapshotMovies.Mkdir(ctx, &fuse.MkdirRequest{Name: "new"}); err != syscall.EROFS {
+			t.Errorf("Expected mkdir to fail with EROFS, got %v", err)
+		}
+		if err := snapshotMovies.Remove(ctx, &fuse.RemoveRequest{Name: "a.mkv"}); err != syscall.EROFS {
+			t.Errorf("Expected remove to fail with EROFS, got %v", err)
+		}
+		if err := snapshotMovies.Rename(ctx, &fuse.RenameRequest{OldName: "a.mkv", NewName: "b.mkv"}, snapshotMovies); err != syscall.EROFS {
+			t.Errorf("Expected rename to fail with EROFS, got %v", err)
+		}
+		if err := movies.(*Dir).Rename(ctx, &fuse.RenameRequest{OldName: "renamed.mkv", NewName: "x.mkv"}, snapshotMovies); err != syscall.EROFS {
+			t.Errorf("Expected rename into a snapshot to fail with EROFS, got %v", err)
+		}
+		if err := snapshotFile.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.tag", Xattr: []byte("x")}); err != syscall.EROFS {
+			t.Errorf("Expected setxattr to fail with EROFS, got %v", err)
+		}
+	})
+
+	t.Run("LinkOutOfSnapshot", func(t *testing.T) {
+		if _, err := movies.(*Dir).Link(ctx, &fuse.LinkRequest{NewName: "a.mkv"}, snapshotFile); err != nil {
+			t.Fatalf("Failed to link file out of snapshot: %v", err)
+		}
+		if _, err := movies.(*Dir).Lookup(ctx, "a.mkv"); err != nil {
+			t.Errorf("Expected linked file in the live tree: %v", err)
+		}
+	})
+}
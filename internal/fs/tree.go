@@ -0,0 +1,440 @@
+package fs
+
+import (
+	"strings"
+
+	"vmapfs/internal/state"
+)
+
+// treeNode is an entry in the in-memory virtual tree. Directories have a
+// non-nil children map; files carry the source path they are mapped to.
+// stored is the virtual path the node is recorded under in the mappings or
+// directories, which lags behind its place in the tree after a directory
+// rename until PathMapper.Sync; it is empty for directories that are not
+// registered.
+type treeNode struct {
+	name     string
+	parent   *treeNode
+	children map[string]*treeNode
+	source   string
+	stored   string
+}
+
+func newDirNode(name string) *treeNode {
+	return &treeNode{name: name, children: make(map[string]*treeNode)}
+}
+
+func (n *treeNode) isDir() bool {
+	return n.children != nil
+}
+
+// attach links child below n, replacing any existing child of the same name
+func (n *treeNode) attach(child *treeNode) {
+	child.parent = n
+	n.children[child.name] = child
+}
+
+// detach unlinks n from its parent
+func (n *treeNode) detach() {
+	if n.parent != nil {
+		delete(n.parent.children, n.name)
+		n.parent = nil
+	}
+}
+
+// path returns the virtual path of n by walking up to the root
+func (n *treeNode) path() string {
+	var names []string
+	for node := n; node.parent != nil; node = node.parent {
+		names = append(names, node.name)
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return "/" + strings.Join(names, "/")
+}
+
+// walk calls fn for n and every node below it, passing each node's virtual
+// path given that n lives at vpath.
+func (n *treeNode) walk(vpath string, fn func(vpath string, node *treeNode)) {
+	fn(vpath, n)
+	for name, child := range n.children {
+		child.walk(joinVirtual(vpath, name), fn)
+	}
+}
+
+// joinVirtual appends a single name to a virtual directory path
+func joinVirtual(dir, name string) string {
+	if dir == "/" {
+		return "/" + name
+	}
+	return dir + "/" + name
+}
+
+// splitVirtual splits a clean virtual path into its components
+func splitVirtual(vpath string) []string {
+	trimmed := strings.Trim(vpath, "/")
+	if trimmed == "" {
+		return nil
+	}
+	return strings.Split(trimmed, "/")
+}
+
+// virtualTree is a hierarchical view of the virtual directories and mapped
+// files, so that listing a directory or moving a subtree doesn't require
+// scanning every mapping.
+type virtualTree struct {
+	root *treeNode
+}
+
+func newVirtualTree() *virtualTree {
+	return &virtualTree{root: newDirNode("")}
+}
+
+// lookup returns the node at vpath, or nil if there is none
+func (t *virtualTree) lookup(vpath string) *treeNode {
+	node := t.root
+	for _, name := range splitVirtual(vpath) {
+		if !node.isDir() {
+			return nil
+		}
+		child, exists := node.children[name]
+		if !exists {
+			return nil
+		}
+		node = child
+	}
+	return node
+}
+
+// contains returns true if n is attached to the tree
+func (t *virtualTree) contains(n *treeNode) bool {
+	for n.parent != nil {
+		n = n.parent
+	}
+	return n == t.root
+}
+
+// mkdirAll returns the directory node at vpath, creating it and any missing
+// parents. It returns nil if a file is in the way.
+func (t *virtualTree) mkdirAll(vpath string) *treeNode {
+	node := t.root
+	for _, name := range splitVirtual(vpath) {
+		child, exists := node.children[name]
+		if !exists {
+			child = newDirNode(name)
+			node.attach(child)
+		}
+		if !child.isDir() {
+			return nil
+		}
+		node = child
+	}
+	return node
+}
+
+// addFile places a file node for source at vpath, creating parent
+// directories as needed. It returns nil if a directory is in the way.
+func (t *virtualTree) addFile(vpath, source string) *treeNode {
+	parent := t.mkdirAll(parentVirtual(vpath))
+	if parent == nil {
+		return nil
+	}
+	name := baseVirtual(vpath)
+	if existing, exists := parent.children[name]; exists && existing.isDir() {
+		return nil
+	}
+	node := &treeNode{name: name, source: source}
+	parent.attach(node)
+	return node
+}
+
+// remove detaches and returns the node at vpath, or nil if there is none
+func (t *virtualTree) remove(vpath string) *treeNode {
+	node := t.lookup(vpath)
+	if node == nil || node == t.root {
+		return nil
+	}
+	node.detach()
+	return node
+}
+
+// move re-links the node at oldPath so it lives at newPath. Moving a
+// directory carries its whole subtree along.
+func (t *virtualTree) move(oldPath, newPath string) *treeNode {
+	node := t.lookup(oldPath)
+	if node == nil || node == t.root {
+		return nil
+	}
+	parent := t.mkdirAll(parentVirtual(newPath))
+	if parent == nil {
+		return nil
+	}
+	node.detach()
+	node.name = baseVirtual(newPath)
+	parent.attach(node)
+	return node
+}
+
+func parentVirtual(vpath string) string {
+	i := strings.LastIndex(vpath, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return vpath[:i]
+}
+
+func baseVirtual(vpath string) string {
+	return vpath[strings.LastIndex(vpath, "/")+1:]
+}
+
+// DirEntry describes a single child of a virtual directory
+type DirEntry struct {
+	Name   string
+	IsDir  bool
+	Source string // Source path of a file
+}
+
+// IsDirectory returns true if vp is a registered virtual directory
+func (pm *PathMapper) IsDirectory(vp *VirtualPath) bool {
+	node := pm.tree.lookup(vp.String())
+	return node != nil && node.isDir() && node.stored != ""
+}
+
+// AddDirectory registers a new virtual directory along with any missing
+// parent directories
+func (pm *PathMapper) AddDirectory(vp *VirtualPath) {
+	pm.logger.Debug("Adding directory: %q", vp.String())
+	if pm.tree.mkdirAll(vp.String()) == nil {
+		pm.logger.Warn("Cannot create directory %q: a file is in the way", vp.String())
+		return
+	}
+	pm.registerDirectories(vp.String())
+}
+
+// registerDirectories marks vpath and all of its parents as directories,
+// recording a mkdir for each one that is new, outermost first. The tree
+// nodes must already exist.
+func (pm *PathMapper) registerDirectories(vpath string) {
+	pm.settle(vpath)
+	var added []string
+	node := pm.tree.lookup(vpath)
+	for dir := vpath; node != nil && node.stored == ""; dir, node = parentVirtual(dir), node.parent {
+		pm.logger.Trace("Registering directory: %q", dir)
+		pm.directories[dir] = true
+		node.stored = dir
+		added = append(added, dir)
+	}
+	for i := len(added) - 1; i >= 0; i-- {
+		pm.record(
+			state.Op{Kind: state.OpMkdir, Path: added[i]},
+			state.Op{Kind: state.OpRmdir, Path: added[i]},
+		)
+	}
+}
+
+// RemoveDirectory removes an empty virtual directory
+func (pm *PathMapper) RemoveDirectory(vp *VirtualPath) error {
+	pm.logger.Debug("Removing directory: %q", vp.String())
+	node := pm.tree.lookup(vp.String())
+	switch {
+	case node == nil:
+		return ErrPathNotFound
+	case !node.isDir():
+		return ErrNotDirectory
+	case node == pm.tree.root:
+		return ErrInvalidPath
+	case len(node.children) > 0:
+		return ErrDirectoryNotEmpty
+	}
+
+	// The state keeps the directory's inode under its path, so the path
+	// must be up to date when the rmdir is recorded
+	if node.stored != vp.String() {
+		pm.Sync()
+	}
+	pm.tree.remove(vp.String())
+	delete(pm.directories, vp.String())
+	pm.record(
+		state.Op{Kind: state.OpRmdir, Path: vp.String()},
+		state.Op{Kind: state.OpMkdir, Path: vp.String()},
+	)
+	return nil
+}
+
+// Move renames a file or directory with rename(2) semantics: an existing
+// file target is replaced, an existing directory target is replaced only
+// if it is empty, and a directory cannot be moved below itself.
+func (pm *PathMapper) Move(oldPath, newPath *VirtualPath) error {
+	pm.logger.Debug("Moving %q to %q", oldPath.String(), newPath.String())
+	src := pm.tree.lookup(oldPath.String())
+	if src == nil || src == pm.tree.root {
+		return ErrPathNotFound
+	}
+	if oldPath.String() == newPath.String() {
+		return nil
+	}
+
+	if src.isDir() && strings.HasPrefix(newPath.String(), oldPath.String()+"/") {
+		return ErrMoveIntoSelf
+	}
+
+	if dst := pm.tree.lookup(newPath.String()); dst != nil {
+		switch {
+		case src.isDir() && !dst.isDir():
+			return ErrNotDirectory
+		case !src.isDir() && dst.isDir():
+			return ErrIsDirectory
+		case dst.isDir():
+			if err := pm.RemoveDirectory(newPath); err != nil {
+				return err
+			}
+		case dst.source == src.source:
+			// Both names are links to the same source; rename(2) does nothing
+			return nil
+		default:
+			pm.logger.Debug("Replacing existing mapping at %q", newPath.String())
+			pm.RemoveMapping(newPath)
+		}
+	}
+
+	if src.isDir() {
+		pm.RenameDirectory(oldPath, newPath)
+		return nil
+	}
+	pm.moveFile(src.source, oldPath.String(), newPath.String())
+	return nil
+}
+
+// moveFile re-points a single mapped virtual path without touching the source
+func (pm *PathMapper) moveFile(spath, oldVpath, newVpath string) {
+	pm.settle(newVpath)
+	node := pm.tree.move(oldVpath, newVpath)
+	if node == nil {
+		pm.logger.Warn("Cannot move %q to %q", oldVpath, newVpath)
+		return
+	}
+	pm.logger.Trace("Updating mapping: %q -> %q", node.stored, newVpath)
+	mapping := pm.mappings[spath]
+	for i, p := range mapping.VirtualPaths {
+		if p == node.stored {
+			mapping.VirtualPaths[i] = newVpath
+		}
+	}
+	delete(pm.recorded, node.stored)
+	pm.recorded[newVpath] = node
+	node.stored = newVpath
+	pm.record(
+		state.Op{Kind: state.OpMove, Source: spath, Path: oldVpath, NewPath: newVpath},
+		state.Op{Kind: state.OpMove, Source: spath, Path: newVpath, NewPath: oldVpath},
+	)
+}
+
+// RenameDirectory moves a virtual directory and everything below it to a new
+// location. Only the tree node moves, so a rename costs the same however
+// much is below the directory: the mappings and directories keep the old
+// paths below it until Sync rewrites them, which happens before the state
+// is read as a whole, or before a path is written that one of the old
+// paths could clash with.
+func (pm *PathMapper) RenameDirectory(oldDir, newDir *VirtualPath) {
+	pm.logger.Debug("Renaming directory %q to %q", oldDir.String(), newDir.String())
+	node := pm.tree.move(oldDir.String(), newDir.String())
+	if node == nil {
+		pm.logger.Warn("Cannot rename directory %q to %q", oldDir.String(), newDir.String())
+		return
+	}
+
+	pm.renamed = append(pm.renamed, node)
+	pm.renamedFrom = append(pm.renamedFrom, oldDir.String())
+	pm.record(
+		state.Op{Kind: state.OpRenameDir, Path: oldDir.String(), NewPath: newDir.String()},
+		state.Op{Kind: state.OpRenameDir, Path: newDir.String(), NewPath: oldDir.String()},
+	)
+}
+
+// settle syncs before vpath is written to the mappings or directories if
+// it is at or below a directory renamed since the last Sync, as an old
+// path left there by the rename could be the same
+func (pm *PathMapper) settle(vpath string) {
+	for _, from := range pm.renamedFrom {
+		if vpath == from || strings.HasPrefix(vpath, from+"/") {
+			pm.Sync()
+			return
+		}
+	}
+}
+
+// Sync rewrites the paths in the mappings and directories below the
+// directories renamed since the last Sync to where they are in the tree.
+// The directories that moved are passed to the function set with
+// SetDirectoryMover, old path to new.
+func (pm *PathMapper) Sync() {
+	if len(pm.renamed) == 0 {
+		return
+	}
+	pm.logger.Debug("Syncing the paths below %d renamed directories", len(pm.renamed))
+
+	stale := make(map[*treeNode]string)
+	for _, dir := range pm.renamed {
+		if !pm.tree.contains(dir) {
+			continue
+		}
+		dir.walk(dir.path(), func(vpath string, n *treeNode) {
+			if n.stored != "" && n.stored != vpath {
+				stale[n] = vpath
+			}
+		})
+	}
+	pm.renamed, pm.renamedFrom = nil, nil
+
+	// Every old path is taken out before any new one is put in, as one
+	// node's new path may be another's old one
+	moved := make(map[string]string)
+	bySource := make(map[string]map[string]string)
+	for n, vpath := range stale {
+		if n.isDir() {
+			delete(pm.directories, n.stored)
+			moved[n.stored] = vpath
+			continue
+		}
+		delete(pm.recorded, n.stored)
+		if bySource[n.source] == nil {
+			bySource[n.source] = make(map[string]string)
+		}
+		bySource[n.source][n.stored] = vpath
+	}
+	for n, vpath := range stale {
+		if n.isDir() {
+			pm.directories[vpath] = true
+		} else {
+			pm.recorded[vpath] = n
+		}
+		n.stored = vpath
+	}
+	for spath, paths := range bySource {
+		mapping := pm.mappings[spath]
+		for i, p := range mapping.VirtualPaths {
+			if vpath, exists := paths[p]; exists {
+				mapping.VirtualPaths[i] = vpath
+			}
+		}
+	}
+
+	if len(moved) > 0 && pm.mover != nil {
+		pm.mover(moved)
+	}
+}
+
+// ReadDir lists the children of a virtual directory
+func (pm *PathMapper) ReadDir(vp *VirtualPath) ([]DirEntry, bool) {
+	node := pm.tree.lookup(vp.String())
+	if node == nil || !node.isDir() {
+		return nil, false
+	}
+
+	entries := make([]DirEntry, 0, len(node.children))
+	for name, child := range node.children {
+		entries = append(entries, DirEntry{Name: name, IsDir: child.isDir(), Source: child.source})
+	}
+	return entries, true
+}
@@ -0,0 +1,175 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"vmapfs/internal/state"
+)
+
+func TestVirtualTree(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, tf := range []string{"a.mkv", "b.mkv", "c.mkv"} {
+		if err := os.WriteFile(filepath.Join(tempDir, tf), []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	directories := map[string]bool{
+		"/":                     true,
+		"/shows":                true,
+		"/shows/Show":           true,
+		"/shows/Show/Season 01": true,
+	}
+	mappings := map[string]state.FileMapping{
+		"a.mkv": {VirtualPaths: []string{"/shows/Show/Season 01/a.mkv"}},
+		"b.mkv": {VirtualPaths: []string{"/shows/Show/Season 01/b.mkv"}},
+	}
+	pm := NewPathMapper(tempDir, mappings, directories)
+
+	readNames := func(t *testing.T, vpath string) []string {
+		t.Helper()
+		entries, exists := pm.ReadDir(NewVirtualPath(vpath))
+		if !exists {
+			t.Fatalf("Expected %q to be listable", vpath)
+		}
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	t.Run("ReadDir", func(t *testing.T) {
+		names := readNames(t, "/shows/Show/Season 01")
+		if len(names) != 2 || names[0] != "a.mkv" || names[1] != "b.mkv" {
+			t.Errorf("Expected [a.mkv b.mkv], got %v", names)
+		}
+
+		entries, _ := pm.ReadDir(NewVirtualPath("/shows"))
+		if len(entries) != 1 || !entries[0].IsDir || entries[0].Name != "Show" {
+			t.Errorf("Expected /shows to contain only the Show directory, got %v", entries)
+		}
+	})
+
+	t.Run("AddAndRemoveMapping", func(t *testing.T) {
+		pm.AddMapping(NewVirtualPath("/shows/Show/Season 01/c.mkv"), NewSourcePath("c.mkv"))
+		if names := readNames(t, "/shows/Show/Season 01"); len(names) != 3 {
+			t.Errorf("Expected 3 entries after adding a mapping, got %v", names)
+		}
+
+		pm.RemoveMapping(NewVirtualPath("/shows/Show/Season 01/c.mkv"))
+		if names := readNames(t, "/shows/Show/Season 01"); len(names) != 2 {
+			t.Errorf("Expected 2 entries after removing a mapping, got %v", names)
+		}
+	})
+
+	t.Run("RenameSubtree", func(t *testing.T) {
+		pm.AddDirectory(NewVirtualPath("/tv"))
+		pm.RenameDirectory(NewVirtualPath("/shows/Show"), NewVirtualPath("/tv/Show"))
+
+		if pm.IsDirectory(NewVirtualPath("/shows/Show/Season 01")) {
+			t.Error("Expected nested directory to leave its old location")
+		}
+		if !pm.IsDirectory(NewVirtualPath("/tv/Show/Season 01")) {
+			t.Error("Expected nested directory to move with its parent")
+		}
+		sp, exists := pm.GetSourcePath(NewVirtualPath("/tv/Show/Season 01/a.mkv"))
+		if !exists || sp.String() != "a.mkv" {
+			t.Error("Expected nested file to move with its parent")
+		}
+		if !mappings["b.mkv"].HasVirtualPath("/shows/Show/Season 01/b.mkv") {
+			t.Errorf("Expected stored mapping to wait for a sync, got %q", mappings["b.mkv"].VirtualPaths)
+		}
+		if vp, _ := pm.GetVirtualPath(NewSourcePath("b.mkv")); vp.String() != "/tv/Show/Season 01/b.mkv" {
+			t.Errorf("Expected the moved virtual path before a sync, got %q", vp.String())
+		}
+		pm.Sync()
+		if !mappings["b.mkv"].HasVirtualPath("/tv/Show/Season 01/b.mkv") {
+			t.Errorf("Expected stored mapping to be rewritten, got %q", mappings["b.mkv"].VirtualPaths)
+		}
+		if names := readNames(t, "/shows"); len(names) != 0 {
+			t.Errorf("Expected /shows to be empty, got %v", names)
+		}
+	})
+
+	t.Run("RemoveDirectory", func(t *testing.T) {
+		if err := pm.RemoveDirectory(NewVirtualPath("/tv/Show")); err != ErrDirectoryNotEmpty {
+			t.Errorf("Expected ErrDirectoryNotEmpty, got %v", err)
+		}
+
+		pm.RemoveMapping(NewVirtualPath("/tv/Show/Season 01/a.mkv"))
+		pm.RemoveMapping(NewVirtualPath("/tv/Show/Season 01/b.mkv"))
+		if err := pm.RemoveDirectory(NewVirtualPath("/tv/Show/Season 01")); err != nil {
+			t.Errorf("Failed to remove empty directory: %v", err)
+		}
+		if pm.IsDirectory(NewVirtualPath("/tv/Show/Season 01")) {
+			t.Error("Expected directory to be removed")
+		}
+	})
+}
+
+func TestRenameDirectorySync(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, tf := range []string{"a.mkv", "b.mkv", "c.mkv"} {
+		if err := os.WriteFile(filepath.Join(tempDir, tf), []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	directories := map[string]bool{"/": true, "/a": true, "/a/sub": true, "/b": true}
+	mappings := map[string]state.FileMapping{
+		"a.mkv": {VirtualPaths: []string{"/a/sub/a.mkv"}},
+		"b.mkv": {VirtualPaths: []string{"/b/b.mkv"}},
+	}
+	pm := NewPathMapper(tempDir, mappings, directories)
+	var moved map[string]string
+	pm.SetDirectoryMover(func(dirs map[string]string) { moved = dirs })
+
+	// Swap /a and /b, so that each one's new path is the other's old one
+	pm.RenameDirectory(NewVirtualPath("/a"), NewVirtualPath("/c"))
+	pm.RenameDirectory(NewVirtualPath("/b"), NewVirtualPath("/a"))
+	pm.RenameDirectory(NewVirtualPath("/c"), NewVirtualPath("/b"))
+	if moved != nil || !mappings["a.mkv"].HasVirtualPath("/a/sub/a.mkv") {
+		t.Fatalf("Expected renames to leave the stored paths alone, got %v", mappings)
+	}
+	if sp, exists := pm.GetSourcePath(NewVirtualPath("/b/sub/a.mkv")); !exists || sp.String() != "a.mkv" {
+		t.Errorf("Expected a.mkv at /b/sub/a.mkv, got %v", sp)
+	}
+	if paths := pm.GetVirtualPaths(NewSourcePath("b.mkv")); len(paths) != 1 || paths[0].String() != "/a/b.mkv" {
+		t.Errorf("Expected b.mkv at /a/b.mkv, got %v", paths)
+	}
+
+	// Writing a path below an old name syncs first
+	if err := pm.AddMapping(NewVirtualPath("/a/c.mkv"), NewSourcePath("c.mkv")); err != nil {
+		t.Fatalf("Failed to add mapping: %v", err)
+	}
+	want := map[string]string{"/a": "/b", "/a/sub": "/b/sub", "/b": "/a"}
+	if !reflect.DeepEqual(moved, want) {
+		t.Errorf("Expected moved directories %v, got %v", want, moved)
+	}
+	wantDirs := map[string]bool{"/": true, "/a": true, "/b": true, "/b/sub": true}
+	if !reflect.DeepEqual(directories, wantDirs) {
+		t.Errorf("Expected directories %v, got %v", wantDirs, directories)
+	}
+	for source, vpath := range map[string]string{"a.mkv": "/b/sub/a.mkv", "b.mkv": "/a/b.mkv", "c.mkv": "/a/c.mkv"} {
+		if got := mappings[source].VirtualPaths; len(got) != 1 || got[0] != vpath {
+			t.Errorf("Expected %s to be stored at %s, got %q", source, vpath, got)
+		}
+	}
+
+	// Undoing a rename before a sync puts everything back
+	moved = nil
+	pm.RenameDirectory(NewVirtualPath("/b"), NewVirtualPath("/d"))
+	if err := pm.Apply(state.Op{Kind: state.OpRenameDir, Path: "/d", NewPath: "/b"}); err != nil {
+		t.Fatalf("Failed to undo rename: %v", err)
+	}
+	pm.Sync()
+	if len(moved) != 0 || !mappings["a.mkv"].HasVirtualPath("/b/sub/a.mkv") || !reflect.DeepEqual(directories, wantDirs) {
+		t.Errorf("Expected the state to be unchanged, got moved %v, directories %v and %v", moved, directories, mappings["a.mkv"])
+	}
+}
@@ -33,6 +33,7 @@ func NewUnsortedDir(fs *VMapFS, path *SourcePath) *UnsortedDir {
 
 func (d *UnsortedDir) Attr(_ context.Context, a *fuse.Attr) error {
 	unsortedLogger.Trace("Getting attributes for path: %q", d.path.String())
+	a.Inode = unsortedInode(d.path)
 
 	// If this is the root _UNSORTED dir, return standard attrs
 	if d.path.String() == "" {
@@ -87,14 +88,11 @@ func (d *UnsortedDir) Lookup(_ context.Context, name string) (fusefs.Node, error
 			return nil, syscall.ENOENT
 		}
 		unsortedLogger.Debug("Returning directory: %q", childPath.String())
-		return NewUnsortedDir(d.fs, childPath), nil
+		return d.fs.unsortedDirNode(childPath), nil
 	}
 
 	unsortedLogger.Debug("Returning file: %q", childPath.String())
-	return &UnsortedFile{
-		fs:   d.fs,
-		path: childPath,
-	}, nil
+	return d.fs.unsortedFileNode(childPath), nil
 }
 
 func (d *UnsortedDir) ReadDirAll(_ context.Context) ([]fuse.Dirent, error) {
@@ -150,8 +148,9 @@ func (d *UnsortedDir) ReadDirAll(_ context.Context) ([]fuse.Dirent, error) {
 
 		unsortedLogger.Trace("Adding entry: %q (type=%v)", entry.Name(), entryType)
 		dirEntries = append(dirEntries, fuse.Dirent{
-			Name: entry.Name(),
-			Type: entryType,
+			Inode: unsortedInode(childPath),
+			Name:  entry.Name(),
+			Type:  entryType,
 		})
 	}
 
@@ -171,6 +170,14 @@ func (d *UnsortedDir) Rename(_ context.Context, req *fuse.RenameRequest, newDir
 		unsortedLogger.Error("Invalid target directory type")
 		return syscall.EINVAL
 	}
+	if targetDir.fs.readOnly {
+		unsortedLogger.Warn("Cannot move into a snapshot")
+		return syscall.EROFS
+	}
+	if targetDir.isMountRoot() && isReservedName(req.NewName) {
+		unsortedLogger.Warn("Cannot move onto reserved name %q", req.NewName)
+		return syscall.EEXIST
+	}
 
 	sourcePath := filepath.Join(d.path.String(), req.OldName)
 	sp := NewSourcePath(sourcePath)
@@ -187,13 +194,36 @@ func (d *UnsortedDir) Rename(_ context.Context, req *fuse.RenameRequest, newDir
 	if !info.IsDir() {
 		unsortedLogger.Info("Moving file %q -> %q", sp.String(), newBasePath)
 		d.fs.mu.Lock()
-		d.fs.pathMapper.AddMapping(NewVirtualPath(newBasePath), sp)
-		err := d.fs.stateManager.SaveState(d.fs.state)
+		if d.fs.pathMapper.IsDirectory(NewVirtualPath(newBasePath)) {
+			d.fs.mu.Unlock()
+			unsortedLogger.Warn("Cannot replace directory %q with a file", newBasePath)
+			return ToFuseError(NewFSError(OpRename, newBasePath, ErrIsDirectory))
+		}
+		vp := NewVirtualPath(newBasePath)
+		_, replacing := d.fs.pathMapper.GetSourcePath(vp)
+		retarget := replacing && d.fs.retargetOnReplace
+		if retarget {
+			if _, err := d.fs.retargetLocked(vp, sp); err != nil {
+				d.fs.mu.Unlock()
+				unsortedLogger.Warn("Cannot retarget %q: %v", newBasePath, err)
+				return ToFuseError(err)
+			}
+		} else if err := d.fs.pathMapper.AddMapping(vp, sp); err != nil {
+			d.fs.mu.Unlock()
+			unsortedLogger.Warn("Cannot map %q: %v", newBasePath, err)
+			return ToFuseError(NewFSError(OpRename, newBasePath, err))
+		}
+		err := d.fs.saveState(req.Hdr())
 		d.fs.mu.Unlock()
 		if err != nil {
 			unsortedLogger.Error("Failed to save state: %v", err)
 			return err
 		}
+		if retarget {
+			// The kernel now takes the target for the unsorted file; looking
+			// it up again gives back the mapped file and its inode
+			go d.fs.invalidateEntries(targetDir, []string{req.NewName})
+		}
 		unsortedLogger.Info("File moved successfully")
 		return nil
 	}
@@ -234,14 +264,29 @@ func (d *UnsortedDir) Rename(_ context.Context, req *fuse.RenameRequest, newDir
 
 	// Create the parent virtual directory path
 	d.fs.mu.Lock()
-	d.fs.state.Directories[newBasePath] = true
+	start := len(d.fs.txUndo)
+	d.fs.pathMapper.AddDirectory(NewVirtualPath(newBasePath))
 
+	// A move that cannot map every file is undone, rather than leaving
+	// files behind
+	var mapErr error
 	for _, pair := range filesToMap {
 		unsortedLogger.Debug("Mapping file %q -> %q", pair.source.String(), pair.target.String())
-		d.fs.pathMapper.AddMapping(pair.target, pair.source)
+		if err := d.fs.pathMapper.AddMapping(pair.target, pair.source); err != nil {
+			unsortedLogger.Warn("Cannot map %q: %v", pair.target.String(), err)
+			if mapErr == nil {
+				mapErr = NewFSError(OpRename, pair.target.String(), err)
+			}
+		}
+	}
+	if mapErr != nil {
+		d.fs.rollback(start)
+		d.fs.mu.Unlock()
+		unsortedLogger.Warn("Undid moving %q: %v", sp.String(), mapErr)
+		return ToFuseError(mapErr)
 	}
 
-	err = d.fs.stateManager.SaveState(d.fs.state)
+	err = d.fs.saveState(req.Hdr())
 	d.fs.mu.Unlock()
 	if err != nil {
 		unsortedLogger.Error("Failed to save mapped children: %v", err)
@@ -293,6 +338,7 @@ func (f *UnsortedFile) Attr(_ context.Context, a *fuse.Attr) error {
 		return err
 	}
 
+	a.Inode = unsortedInode(f.path)
 	a.Mode = info.Mode()
 	a.Size = uint64(info.Size())
 	a.Mtime = info.ModTime()
@@ -321,7 +367,8 @@ func (f *UnsortedFile) Open(_ context.Context, req *fuse.OpenRequest, resp *fuse
 	}
 
 	resp.Flags |= fuse.OpenDirectIO
-	return &FileHandle{file: file}, nil
+	f.fs.openFiles.opened(req.Pid, f.path)
+	return &FileHandle{file: file, path: f.path.String(), source: f.path, pid: req.Pid, openFiles: f.fs.openFiles}, nil
 }
 
 // Getxattr retrieves an extended attribute.
@@ -357,7 +404,7 @@ func (f *UnsortedFile) Setxattr(ctx context.Context, req *fuse.SetxattrRequest)
 	copy(value, req.Xattr)
 	f.fs.pathMapper.SetXattr(f.path, req.Name, value)
 
-	if err := f.fs.stateManager.SaveState(f.fs.state); err != nil {
+	if err := f.fs.saveState(req.Hdr()); err != nil {
 		unsortedLogger.Error("Failed to save state after setting xattr: %v", err)
 		return err
 	}
@@ -404,7 +451,7 @@ func (f *UnsortedFile) Removexattr(ctx context.Context, req *fuse.RemovexattrReq
 	}
 
 	f.fs.pathMapper.RemoveXattr(f.path, req.Name)
-	if err := f.fs.stateManager.SaveState(f.fs.state); err != nil {
+	if err := f.fs.saveState(req.Hdr()); err != nil {
 		unsortedLogger.Error("Failed to save state after removing xattr: %v", err)
 		return err
 	}
@@ -412,3 +459,15 @@ func (f *UnsortedFile) Removexattr(ctx context.Context, req *fuse.RemovexattrReq
 	unsortedLogger.Trace("Xattr %q removed successfully", req.Name)
 	return nil
 }
+
+// Forget implements the NodeForgetter interface, dropping the node once the
+// kernel no longer refers to it.
+func (d *UnsortedDir) Forget() {
+	d.fs.nodes.forget(nodeKey{unsorted: true, path: d.path.String()}, d)
+}
+
+// Forget implements the NodeForgetter interface, dropping the node once the
+// kernel no longer refers to it.
+func (f *UnsortedFile) Forget() {
+	f.fs.nodes.forget(nodeKey{unsorted: true, path: f.path.String()}, f)
+}
@@ -239,3 +239,83 @@ func TestUnsortedDirectory(t *testing.T) {
 		}
 	})
 }
+
+func TestUnsortedMoveNestedDirectory(t *testing.T) {
+	vfs, sourceDir, _, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	for _, tf := range []string{
+		"Show/Season 01/ep1.mkv",
+		"Show/Season 02/Extras/featurette.mkv",
+	} {
+		fullPath := filepath.Join(sourceDir, tf)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(fullPath, []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	root, _ := vfs.Root()
+	tv, err := root.(*Dir).Mkdir(ctx, &fuse.MkdirRequest{Name: "tv"})
+	if err != nil {
+		t.Fatalf("Failed to create target directory: %v", err)
+	}
+
+	unsortedNode, err := root.(*Dir).Lookup(ctx, "_UNSORTED")
+	if err != nil {
+		t.Fatalf("Failed to lookup _UNSORTED: %v", err)
+	}
+
+	renameReq := &fuse.RenameRequest{OldName: "Show", NewName: "Show"}
+	if err := unsortedNode.(*UnsortedDir).Rename(ctx, renameReq, tv); err != nil {
+		t.Fatalf("Failed to move directory from _UNSORTED: %v", err)
+	}
+
+	node := tv
+	for _, name := range []string{"Show", "Season 02", "Extras"} {
+		node, err = node.(*Dir).Lookup(ctx, name)
+		if err != nil {
+			t.Fatalf("Failed to lookup nested directory %q: %v", name, err)
+		}
+	}
+	if _, err := node.(*Dir).Lookup(ctx, "featurette.mkv"); err != nil {
+		t.Errorf("Expected deeply nested file to be reachable: %v", err)
+	}
+
+	for _, dir := range []string{"/tv/Show/Season 01", "/tv/Show/Season 02/Extras"} {
+		if !vfs.state.Directories[dir] {
+			t.Errorf("Expected %q to be registered in state", dir)
+		}
+	}
+
+	// A move that cannot map every file changes nothing
+	if err := os.WriteFile(filepath.Join(sourceDir, "Show", "Season 01", "ep2.mkv"), []byte("test"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	films, err := root.(*Dir).Mkdir(ctx, &fuse.MkdirRequest{Name: "films"})
+	if err != nil {
+		t.Fatalf("Failed to create target directory: %v", err)
+	}
+	if _, err := films.(*Dir).Mkdir(ctx, &fuse.MkdirRequest{Name: "ep2.mkv"}); err != nil {
+		t.Fatalf("Failed to create directory in the way: %v", err)
+	}
+	history := len(vfs.History())
+	renameReq = &fuse.RenameRequest{OldName: "Season 01", NewName: "films"}
+	showNode, err := unsortedNode.(*UnsortedDir).Lookup(ctx, "Show")
+	if err != nil {
+		t.Fatalf("Failed to lookup _UNSORTED/Show: %v", err)
+	}
+	if err := showNode.(*UnsortedDir).Rename(ctx, renameReq, root); err != syscall.EISDIR {
+		t.Errorf("Expected EISDIR moving onto a directory in the way, got %v", err)
+	}
+	if _, exists := vfs.pathMapper.GetSourcePath(NewVirtualPath("/films/ep1.mkv")); exists {
+		t.Error("Expected the files already mapped to be rolled back")
+	}
+	if len(vfs.History()) != history {
+		t.Error("Expected a failed move to leave no history entry")
+	}
+}
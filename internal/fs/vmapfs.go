@@ -1,13 +1,17 @@
 package fs
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
+	"vmapfs/internal/audit"
 	"vmapfs/internal/logging"
 	"vmapfs/internal/state"
 
@@ -23,19 +27,34 @@ var (
 // It manages the mapping between virtual and source paths, handles
 // FUSE operations, and maintains filesystem state.
 type VMapFS struct {
-	sourceDir    string         // Root directory of source files
-	state        *state.FSState // Current filesystem state
-	stateManager *state.Manager // Manages state persistence
-	pathMapper   *PathMapper    // Handles path mapping
-	conn         *fuse.Conn     // FUSE connection
-	uid          uint32         // User ID for filesystem operations
-	gid          uint32         // Group ID for filesystem operations
-	mu           sync.RWMutex   // Protects state access
+	sourceDir         string               // Root directory of source files
+	state             *state.FSState       // Current filesystem state
+	store             state.Store          // Persists state
+	manager           *state.Manager       // Owns the state file, for reloading external edits; may be nil
+	saver             *state.SaveScheduler // Coalesces saves, nil when saving synchronously
+	txOps             []state.Op           // Ops recorded by the operation in progress
+	txUndo            []state.Op           // Inverses of txOps, in the same order
+	history           history              // Completed operations, for undo and redo
+	reconciler        reconciler           // Serializes reconcile passes
+	audit             *audit.Log           // Records who changed what, may be nil
+	pendingOps        []state.Op           // Ops waiting on the save scheduler
+	opsMu             sync.Mutex           // Protects pendingOps
+	pathMapper        *PathMapper          // Handles path mapping
+	root              *Dir                 // Root node, handed to the FUSE server once
+	nodes             nodeCache            // Nodes handed to the FUSE server, for stable node IDs
+	server            *fusefs.Server       // Serves the mount, for cache invalidation
+	snapshots         *snapshotViews       // Backups exposed under /.snapshots, may be nil
+	openFiles         *openSources         // Sources processes have open, which they may copy
+	readOnly          bool                 // Frozen view of a snapshot, refuses changes
+	retargetOnReplace bool                 // Moving an unsorted file onto a mapped one retargets it
+	conn              *fuse.Conn           // FUSE connection
+	uid               uint32               // User ID for filesystem operations
+	gid               uint32               // Group ID for filesystem operations
+	mu                sync.RWMutex         // Protects state access
 }
 
 // NewVMapFS creates a new virtual filesystem instance.
-// NewVMapFS creates a new virtual filesystem instance.
-func NewVMapFS(sourceDir string, state *state.FSState, stateManager *state.Manager) (*VMapFS, error) {
+func NewVMapFS(sourceDir string, state *state.FSState, store state.Store) (*VMapFS, error) {
 	vfsLogger.Info("Creating new virtual filesystem")
 	vfsLogger.Debug("Source directory: %s", sourceDir)
 
@@ -57,28 +76,480 @@ func NewVMapFS(sourceDir string, state *state.FSState, stateManager *state.Manag
 
 	// Initialize path mapper with mappings from state
 	vfsLogger.Debug("Initializing path mapper with %d mappings", len(state.Mappings))
-	pathMapper := NewPathMapper(sourceDir, state.Mappings)
+	pathMapper := NewPathMapper(sourceDir, state.Mappings, state.Directories)
 
 	vfs := &VMapFS{
-		sourceDir:    sourceDir,
-		state:        state,
-		stateManager: stateManager,
-		pathMapper:   pathMapper,
-		uid:          uid,
-		gid:          gid,
+		sourceDir:  sourceDir,
+		state:      state,
+		store:      store,
+		pathMapper: pathMapper,
+		uid:        uid,
+		gid:        gid,
+		history:    history{size: DefaultHistorySize},
+		openFiles:  &openSources{},
+	}
+
+	vfs.root = &Dir{fs: vfs, path: NewVirtualPath("/")}
+	pathMapper.SetRecorder(vfs.recordOp)
+	pathMapper.SetDirectoryMover(state.MoveDirectoryInodes)
+
+	// States saved before inodes were persisted, or edited by hand, may
+	// lack some, and the latter may map a path twice
+	ops := pathMapper.Repairs()
+	if len(ops) > 0 {
+		vfsLogger.Warn("Dropped %d conflicting virtual paths, see vmapfs fsck", len(ops))
+	}
+	ops = append(ops, state.AssignInodes()...)
+	if len(ops) > 0 && store != nil {
+		if err := store.Record(vfs.syncedState, ops); err != nil {
+			vfsLogger.Warn("Failed to save repaired state: %v", err)
+		}
 	}
 
 	vfsLogger.Info("Virtual filesystem created successfully")
 	return vfs, nil
 }
 
+// SetSaveOptions configures how state changes are persisted. A zero
+// Debounce (the default) saves synchronously after every change.
+func (vfs *VMapFS) SetSaveOptions(opts state.SaveOptions) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	if opts.Debounce <= 0 {
+		vfsLogger.Info("Saving state synchronously after every change")
+		vfs.saver = nil
+		return
+	}
+	vfsLogger.Info("Coalescing state saves (debounce=%v, max delay=%v)", opts.Debounce, opts.MaxDelay)
+	vfs.saver = state.NewSaveScheduler(vfs.writeState, opts)
+}
+
+// recordOp collects an op made by the operation in progress, along with the
+// op that reverses it. It is called by the path mapper with vfs.mu held.
+func (vfs *VMapFS) recordOp(op, undo state.Op) {
+	vfs.txOps = append(vfs.txOps, op)
+	vfs.txUndo = append(vfs.txUndo, undo)
+
+	// Number whatever op created, so that its inode survives restarts
+	for _, assigned := range vfs.state.TrackInodes(op) {
+		vfs.txOps = append(vfs.txOps, assigned)
+		vfs.txUndo = append(vfs.txUndo, state.Op{Kind: state.OpInode, Source: assigned.Source, Path: assigned.Path})
+	}
+}
+
+// SetAuditLog records every change made through the filesystem in log
+func (vfs *VMapFS) SetAuditLog(log *audit.Log) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	vfs.audit = log
+}
+
+// saveState persists the ops recorded by the operation that just completed,
+// attributing them to the process in hdr, and adds the operation to the
+// undo history. It must be called with vfs.mu held; when saves are
+// coalesced it only schedules the write.
+func (vfs *VMapFS) saveState(hdr *fuse.Header) error {
+	return vfs.commitOps(hdr.Uid, hdr.Pid, "")
+}
+
+// commitOps is saveState for operations that did not come through the
+// mount: via names what made them, such as a command.
+func (vfs *VMapFS) commitOps(uid, pid uint32, via string) error {
+	vfs.auditOps(uid, pid, via)
+	if len(vfs.txOps) > 0 {
+		undo := make([]state.Op, 0, len(vfs.txUndo))
+		for i := len(vfs.txUndo) - 1; i >= 0; i-- {
+			undo = append(undo, vfs.txUndo[i])
+		}
+		vfs.history.push(HistoryEntry{
+			Time: time.Now(),
+			Ops:  append([]state.Op(nil), vfs.txOps...),
+			Undo: undo,
+		})
+	}
+	return vfs.persistOps()
+}
+
+// auditOps writes the ops recorded since the last save to the audit log.
+// via names the command that made them, if they did not come through the
+// mount. It must be called with vfs.mu held.
+func (vfs *VMapFS) auditOps(uid, pid uint32, via string) {
+	if vfs.audit == nil || len(vfs.txOps) == 0 {
+		return
+	}
+
+	now := time.Now()
+	entries := make([]audit.Entry, 0, len(vfs.txOps))
+	for _, op := range vfs.txOps {
+		if op.Kind == state.OpFingerprint || op.Kind == state.OpInode {
+			// Fingerprints and inodes are bookkeeping rather than changes
+			// to the tree
+			continue
+		}
+		entry := audit.Entry{
+			Time:      now,
+			Op:        string(op.Kind),
+			Path:      op.Path,
+			NewPath:   op.NewPath,
+			Source:    op.Source,
+			NewSource: op.NewSource,
+			Name:      op.Name,
+			UID:       uid,
+			PID:       pid,
+			Via:       via,
+		}
+		if entry.Path == "" && entry.Source != "" {
+			// Xattr ops only name the source
+			if vp, mapped := vfs.pathMapper.GetVirtualPath(NewSourcePath(op.Source)); mapped {
+				entry.Path = vp.String()
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if err := vfs.audit.Write(entries...); err != nil {
+		vfsLogger.Error("Failed to write audit log: %v", err)
+	}
+}
+
+// auditDiff writes the changes a whole new state makes to the audit log,
+// attributed to the vmapfs process and the via command. A mapping record
+// that moved to another source unchanged is logged as a relink.
+func (vfs *VMapFS) auditDiff(diff state.StateDiff, via string) {
+	now := time.Now()
+	uid, pid := safeIntToUint32(os.Getuid()), safeIntToUint32(os.Getpid())
+	entry := func(op state.OpKind, vpath, source string) audit.Entry {
+		return audit.Entry{Time: now, Op: string(op), Path: vpath, Source: source, UID: uid, PID: pid, Via: via}
+	}
+
+	var entries []audit.Entry
+	for _, change := range diff.Directories {
+		if change.Kind == state.ChangeAdded {
+			entries = append(entries, entry(state.OpMkdir, change.Path, ""))
+		}
+	}
+
+	// Records that moved to another source show as removed and added
+	added := make(map[string]state.MappingChange)
+	for _, change := range diff.Mappings {
+		if change.Kind == state.ChangeAdded && len(change.New.VirtualPaths) > 0 {
+			added[change.New.VirtualPaths[0]] = change
+		}
+	}
+	relinked := make(map[string]bool)
+	for _, change := range diff.Mappings {
+		if change.Kind != state.ChangeRemoved || len(change.Old.VirtualPaths) == 0 {
+			continue
+		}
+		if to, exists := added[change.Old.VirtualPaths[0]]; exists && change.Old.Equal(*to.New) && !relinked[to.Source] {
+			relink := entry(state.OpRelink, change.Old.VirtualPaths[0], change.Source)
+			relink.NewSource = to.Source
+			entries = append(entries, relink)
+			relinked[change.Source] = true
+			relinked[to.Source] = true
+		}
+	}
+
+	for _, change := range diff.Mappings {
+		if relinked[change.Source] {
+			continue
+		}
+		var old, updated state.FileMapping
+		if change.Old != nil {
+			old = *change.Old
+		}
+		if change.New != nil {
+			updated = *change.New
+		}
+		var unmapped, mapped []string
+		for _, vpath := range old.VirtualPaths {
+			if !updated.HasVirtualPath(vpath) {
+				unmapped = append(unmapped, vpath)
+			}
+		}
+		for _, vpath := range updated.VirtualPaths {
+			if !old.HasVirtualPath(vpath) {
+				mapped = append(mapped, vpath)
+			}
+		}
+		if len(unmapped) == 1 && len(mapped) == 1 {
+			move := entry(state.OpMove, unmapped[0], change.Source)
+			move.NewPath = mapped[0]
+			entries = append(entries, move)
+		} else {
+			for _, vpath := range unmapped {
+				entries = append(entries, entry(state.OpUnmap, vpath, change.Source))
+			}
+			for _, vpath := range mapped {
+				entries = append(entries, entry(state.OpMap, vpath, change.Source))
+			}
+		}
+
+		vpath := ""
+		if len(updated.VirtualPaths) > 0 {
+			vpath = updated.VirtualPaths[0]
+		} else if len(old.VirtualPaths) > 0 {
+			vpath = old.VirtualPaths[0]
+		}
+		for _, name := range sortedXattrNames(old.Xattrs, updated.Xattrs) {
+			value, set := updated.Xattrs[name]
+			previous, had := old.Xattrs[name]
+			var xattr audit.Entry
+			switch {
+			case !set:
+				xattr = entry(state.OpRemoveXattr, vpath, change.Source)
+			case !had || !bytes.Equal(value, previous):
+				xattr = entry(state.OpSetXattr, vpath, change.Source)
+			default:
+				continue
+			}
+			xattr.Name = name
+			entries = append(entries, xattr)
+		}
+	}
+
+	for _, change := range diff.Directories {
+		if change.Kind == state.ChangeRemoved {
+			entries = append(entries, entry(state.OpRmdir, change.Path, ""))
+		}
+	}
+	if len(entries) == 0 {
+		return
+	}
+	if err := vfs.audit.Write(entries...); err != nil {
+		vfsLogger.Error("Failed to write audit log: %v", err)
+	}
+}
+
+// sortedXattrNames returns the xattr names set in either map, sorted
+func sortedXattrNames(a, b map[string][]byte) []string {
+	var names []string
+	for name := range a {
+		names = append(names, name)
+	}
+	for name := range b {
+		if _, exists := a[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// persistOps persists the ops recorded since the last save without adding
+// them to the history. It must be called with vfs.mu held.
+func (vfs *VMapFS) persistOps() error {
+	ops := vfs.txOps
+	vfs.txOps = nil
+	vfs.txUndo = nil
+
+	if vfs.saver != nil {
+		vfs.opsMu.Lock()
+		vfs.pendingOps = append(vfs.pendingOps, ops...)
+		vfs.opsMu.Unlock()
+		vfs.saver.Schedule()
+		return nil
+	}
+	return vfs.recordOps(ops)
+}
+
+// recordOps saves ops through the store. If the state file was edited
+// since it was last saved, the edit is merged rather than overwritten. It
+// must be called with vfs.mu held for writing.
+func (vfs *VMapFS) recordOps(ops []state.Op) error {
+	err := vfs.store.Record(vfs.syncedState, ops)
+	if errors.Is(err, state.ErrExternalChange) && vfs.manager != nil {
+		// Merge the edit rather than overwrite it. The merged state is saved
+		// in full, so it includes ops.
+		names, reloadErr := vfs.reloadLocked(true)
+		go vfs.invalidateEntries(vfs.root, names)
+		if errors.Is(reloadErr, ErrReloadConflict) {
+			// The edit was rejected and the state saved over it
+			return nil
+		}
+		return reloadErr
+	}
+	return err
+}
+
+// saveSnapshotLocked saves the whole state, which includes any ops still
+// waiting on the save scheduler. It must be called with vfs.mu held.
+func (vfs *VMapFS) saveSnapshotLocked() error {
+	vfs.opsMu.Lock()
+	vfs.pendingOps = nil
+	vfs.opsMu.Unlock()
+	return vfs.store.SaveState(vfs.syncedState())
+}
+
+// syncedState brings the paths the state holds up to date with directory
+// renames, which the path mapper leaves to later, and returns it. It must
+// be called with vfs.mu held for writing.
+func (vfs *VMapFS) syncedState() *state.FSState {
+	vfs.pathMapper.Sync()
+	return vfs.state
+}
+
+// writeState persists the ops waiting on the save scheduler, taking the
+// state lock itself. It takes it for writing, as stores such as the journal
+// update the state's bookkeeping when they save, and merging an edit of the
+// state file replaces the state.
+func (vfs *VMapFS) writeState() error {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	vfs.opsMu.Lock()
+	ops := vfs.pendingOps
+	vfs.pendingOps = nil
+	vfs.opsMu.Unlock()
+
+	if err := vfs.recordOps(ops); err != nil {
+		vfs.opsMu.Lock()
+		vfs.pendingOps = append(ops, vfs.pendingOps...)
+		vfs.opsMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Flush writes any state changes that are still waiting on the save
+// scheduler. It is a no-op when saving synchronously.
+func (vfs *VMapFS) Flush() error {
+	vfs.mu.RLock()
+	saver := vfs.saver
+	vfs.mu.RUnlock()
+
+	if saver == nil {
+		return nil
+	}
+	vfsLogger.Debug("Flushing pending state changes")
+	return saver.Flush()
+}
+
 // Root implements the fusefs.FS interface, returning the root directory node.
 func (vfs *VMapFS) Root() (fusefs.Node, error) {
 	vfsLogger.Trace("Getting root directory node")
-	return &Dir{
-		fs:   vfs,
-		path: NewVirtualPath("/"),
-	}, nil
+	return vfs.root, nil
+}
+
+// SetServer tells the filesystem which server is serving it, so that it can
+// invalidate the kernel's caches when the state changes outside of a FUSE
+// request.
+func (vfs *VMapFS) SetServer(server *fusefs.Server) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	vfs.server = server
+}
+
+// Snapshot returns a copy of the current state
+func (vfs *VMapFS) Snapshot() *state.FSState {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	return vfs.syncedState().Clone()
+}
+
+// ReplaceState swaps the whole state for newState, for example to restore a
+// backup, and saves it. Changes still waiting to be saved are written
+// first, so the replaced state ends up in a backup. The differences are
+// written to the audit log as made by the via command. The undo history is
+// cleared, as it no longer applies to the new state.
+func (vfs *VMapFS) ReplaceState(via string, newState *state.FSState) error {
+	return vfs.UpdateState(via, func(*state.FSState) (*state.FSState, error) {
+		return newState, nil
+	})
+}
+
+// UpdateState replaces the state with the one fn derives from a copy of
+// the current state, as a single change that no filesystem operation can
+// interleave with. If fn returns an error or a nil state, nothing changes.
+// Otherwise the new state is saved like in ReplaceState.
+func (vfs *VMapFS) UpdateState(via string, fn func(current *state.FSState) (*state.FSState, error)) error {
+	if err := vfs.Flush(); err != nil {
+		return fmt.Errorf("failed to save pending changes: %w", err)
+	}
+
+	vfs.mu.Lock()
+	newState, err := fn(vfs.syncedState().Clone())
+	if err != nil || newState == nil {
+		vfs.mu.Unlock()
+		return err
+	}
+	names := vfs.rootNames()
+
+	vfsLogger.Info("Replacing state (%d mappings, %d directories)", len(newState.Mappings), len(newState.Directories))
+	pathMapper := NewPathMapper(vfs.sourceDir, newState.Mappings, newState.Directories)
+	if repairs := pathMapper.Repairs(); len(repairs) > 0 {
+		vfsLogger.Warn("Dropped %d conflicting virtual paths from the new state", len(repairs))
+	}
+	// A restored backup does not know the inodes handed out since it was
+	// made, which must not be handed out again
+	if newState.NextInode < vfs.state.NextInode {
+		newState.NextInode = vfs.state.NextInode
+	}
+	newState.AssignInodes()
+	if vfs.audit != nil {
+		vfs.auditDiff(state.Diff(vfs.state, newState), via)
+	}
+	vfs.state = newState
+	vfs.pathMapper = pathMapper
+	vfs.pathMapper.SetRecorder(vfs.recordOp)
+	vfs.pathMapper.SetDirectoryMover(newState.MoveDirectoryInodes)
+	vfs.txOps = nil
+	vfs.txUndo = nil
+	vfs.history.clear()
+
+	err = vfs.saveSnapshotLocked()
+	names = append(names, vfs.rootNames()...)
+	vfs.mu.Unlock()
+
+	vfs.invalidateEntries(vfs.root, names)
+	return err
+}
+
+// rootNames lists the names in the root directory. It must be called with
+// vfs.mu held.
+func (vfs *VMapFS) rootNames() []string {
+	entries, _ := vfs.pathMapper.ReadDir(vfs.root.path)
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	return names
+}
+
+// rootNamesOf returns the distinct root entries that virtual paths lie in
+func rootNamesOf(paths []string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, vpath := range paths {
+		parts := splitVirtual(vpath)
+		if len(parts) == 0 || seen[parts[0]] {
+			continue
+		}
+		seen[parts[0]] = true
+		names = append(names, parts[0])
+	}
+	return names
+}
+
+// invalidateEntries drops the kernel's cached entries for names in dir,
+// along with everything cached below them, and dir's own attributes. It
+// must not be called from within a FUSE request on dir, or with vfs.mu held.
+func (vfs *VMapFS) invalidateEntries(dir fusefs.Node, names []string) {
+	vfs.mu.RLock()
+	server := vfs.server
+	vfs.mu.RUnlock()
+	if server == nil {
+		return
+	}
+
+	for _, name := range names {
+		if err := server.InvalidateEntry(dir, name); err != nil && err != fuse.ErrNotCached {
+			vfsLogger.Debug("Failed to invalidate entry %q: %v", name, err)
+		}
+	}
+	if err := server.InvalidateNodeData(dir); err != nil && err != fuse.ErrNotCached {
+		vfsLogger.Debug("Failed to invalidate directory: %v", err)
+	}
 }
 
 func waitForMount(mountpoint string) error {
@@ -126,7 +597,9 @@ func (vfs *VMapFS) Mount(mountPoint string) error {
 	_, cancel := context.WithCancel(context.Background())
 	go func() {
 		defer cancel()
-		if err := fusefs.Serve(c, vfs); err != nil {
+		server := fusefs.New(c, nil)
+		vfs.SetServer(server)
+		if err := server.Serve(vfs); err != nil {
 			vfsLogger.Error("FUSE server error: %v", err)
 		}
 	}()
@@ -142,9 +615,12 @@ func (vfs *VMapFS) Mount(mountPoint string) error {
 	return nil
 }
 
-// Unmount cleanly unmounts the filesystem.
+// Unmount cleanly unmounts the filesystem, flushing any pending state first.
 func (vfs *VMapFS) Unmount(mountPoint string) error {
 	vfsLogger.Info("Unmounting filesystem from: %s", mountPoint)
+	if err := vfs.Flush(); err != nil {
+		vfsLogger.Error("Failed to flush state: %v", err)
+	}
 	if vfs.conn != nil {
 		err := fuse.Unmount(mountPoint)
 		if err != nil {
@@ -2,6 +2,7 @@ package logging
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"sync"
@@ -96,6 +97,14 @@ func (l *Logger) SetLevel(level LogLevel) {
 	l.level = level
 }
 
+// SetOutput redirects log messages to w. Loggers created with WithPrefix
+// share their parent's output.
+func (l *Logger) SetOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logger.SetOutput(w)
+}
+
 // shouldLog determines if a message at the given level should be logged
 func (l *Logger) shouldLog(level LogLevel) bool {
 	l.mu.RLock()
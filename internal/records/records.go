@@ -0,0 +1,365 @@
+// Package records reads and writes state records as CSV, JSON lines or
+// YAML, for bulk editing mappings in a spreadsheet or with jq.
+package records
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"vmapfs/internal/state"
+)
+
+// Format is a file format for records
+type Format string
+
+// Supported formats
+const (
+	CSV   Format = "csv"
+	JSONL Format = "jsonl"
+	YAML  Format = "yaml"
+)
+
+// csvHeader names the columns of a CSV file. Xattrs are a JSON object of
+// base64 encoded values, or empty.
+var csvHeader = []string{"source", "path", "xattrs"}
+
+// ParseFormat returns the named format
+func ParseFormat(name string) (Format, error) {
+	switch Format(strings.ToLower(name)) {
+	case CSV:
+		return CSV, nil
+	case JSONL, "json":
+		return JSONL, nil
+	case YAML, "yml":
+		return YAML, nil
+	}
+	return "", fmt.Errorf("unknown format %q (want csv, jsonl or yaml)", name)
+}
+
+// FormatOf guesses the format of a file from its extension
+func FormatOf(path string) (Format, bool) {
+	format, err := ParseFormat(strings.TrimPrefix(filepath.Ext(path), "."))
+	return format, err == nil
+}
+
+// Write writes records in the given format
+func Write(w io.Writer, format Format, records []state.Record) error {
+	switch format {
+	case CSV:
+		return writeCSV(w, records)
+	case JSONL:
+		encoder := json.NewEncoder(w)
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	case YAML:
+		return writeYAML(w, records)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// Read reads records in the given format
+func Read(r io.Reader, format Format) ([]state.Record, error) {
+	switch format {
+	case CSV:
+		return readCSV(r)
+	case JSONL:
+		return readJSONL(r)
+	case YAML:
+		return readYAML(r)
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+func writeCSV(w io.Writer, records []state.Record) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, record := range records {
+		xattrs := ""
+		if len(record.Xattrs) > 0 {
+			data, err := json.Marshal(record.Xattrs)
+			if err != nil {
+				return err
+			}
+			xattrs = string(data)
+		}
+		if err := writer.Write([]string{record.Source, record.Path, xattrs}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func readCSV(r io.Reader) ([]state.Record, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	// Columns are found by name, so they can be reordered in a spreadsheet
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, name := range csvHeader[:2] {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing %q column", name)
+		}
+	}
+	cell := func(row []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	var records []state.Record
+	for n, row := range rows[1:] {
+		record := state.Record{Source: cell(row, "source"), Path: cell(row, "path")}
+		if xattrs := cell(row, "xattrs"); xattrs != "" {
+			if err := json.Unmarshal([]byte(xattrs), &record.Xattrs); err != nil {
+				return nil, fmt.Errorf("line %d: invalid xattrs: %w", n+2, err)
+			}
+		}
+		if record.Source == "" && record.Path == "" && len(record.Xattrs) == 0 {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func readJSONL(r io.Reader) ([]state.Record, error) {
+	var records []state.Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var record state.Record
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// writeYAML writes records as a YAML sequence of mappings. Strings are
+// written double quoted, which makes JSON string syntax valid YAML.
+func writeYAML(w io.Writer, records []state.Record) error {
+	bw := bufio.NewWriter(w)
+	if len(records) == 0 {
+		fmt.Fprintln(bw, "[]")
+	}
+	for _, record := range records {
+		prefix := "- "
+		field := func(key, value string) {
+			fmt.Fprintf(bw, "%s%s: %s\n", prefix, key, quote(value))
+			prefix = "  "
+		}
+		if record.Source != "" {
+			field("source", record.Source)
+		}
+		if record.Path != "" {
+			field("path", record.Path)
+		}
+		if len(record.Xattrs) > 0 {
+			fmt.Fprintf(bw, "%sxattrs:\n", prefix)
+			for _, name := range sortedNames(record.Xattrs) {
+				fmt.Fprintf(bw, "    %s: %s\n", quote(name), quote(base64.StdEncoding.EncodeToString(record.Xattrs[name])))
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// readYAML reads the YAML written by writeYAML, tolerating the changes a
+// person is likely to make by hand: comments on their own lines or after a
+// value, blank lines, plain or single quoted scalars and different
+// indentation. It is not a general YAML parser: flow collections, anchors,
+// tags and multi-line scalars are not supported.
+func readYAML(r io.Reader) ([]state.Record, error) {
+	var records []state.Record
+	var current *state.Record
+	inXattrs := false
+	xattrIndent := 0
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" || trimmed == "[]" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("line %d: %s", n, fmt.Sprintf(format, args...))
+		}
+
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			records = append(records, state.Record{})
+			current = &records[len(records)-1]
+			inXattrs = false
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))
+			indent += 2
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+		}
+		if current == nil {
+			return nil, fail("expected a list item")
+		}
+
+		key, value, ok := splitKeyValue(trimmed)
+		if !ok {
+			return nil, fail("expected key: value")
+		}
+		name, err := unquote(key)
+		if err != nil {
+			return nil, fail("%v", err)
+		}
+		scalar, err := unquote(value)
+		if err != nil {
+			return nil, fail("%v", err)
+		}
+
+		if inXattrs && indent > xattrIndent {
+			decoded, err := base64.StdEncoding.DecodeString(scalar)
+			if err != nil {
+				return nil, fail("xattr %s is not base64: %v", name, err)
+			}
+			if current.Xattrs == nil {
+				current.Xattrs = make(map[string][]byte)
+			}
+			current.Xattrs[name] = decoded
+			continue
+		}
+		inXattrs = false
+
+		switch name {
+		case "source":
+			current.Source = scalar
+		case "path":
+			current.Path = scalar
+		case "xattrs":
+			if scalar != "" && scalar != "{}" {
+				return nil, fail("xattrs must be a block mapping")
+			}
+			inXattrs = true
+			xattrIndent = indent
+		default:
+			return nil, fail("unknown key %q", name)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// splitKeyValue splits "key: value" at the first colon outside quotes
+func splitKeyValue(s string) (key, value string, ok bool) {
+	var quoteChar byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoteChar != 0:
+			if c == '\\' && quoteChar == '"' {
+				i++
+			} else if c == quoteChar {
+				quoteChar = 0
+			}
+		case c == '"' || c == '\'':
+			quoteChar = c
+		case c == ':' && (i+1 == len(s) || s[i+1] == ' '):
+			return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// quote writes s as a YAML double quoted scalar
+func quote(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// unquote reads a YAML scalar that is double quoted, single quoted or plain,
+// followed by an optional comment
+func unquote(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'") {
+		end := closingQuote(s)
+		if end < 0 {
+			return "", fmt.Errorf("invalid quoted string %s", s)
+		}
+		if rest := strings.TrimSpace(s[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %s after quoted string", rest)
+		}
+		s = s[:end+1]
+	}
+	switch {
+	case strings.HasPrefix(s, `"`):
+		var value string
+		if err := json.Unmarshal([]byte(s), &value); err != nil {
+			return "", fmt.Errorf("invalid quoted string %s", s)
+		}
+		return value, nil
+	case strings.HasPrefix(s, "'"):
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case s == "~" || s == "null" || strings.HasPrefix(s, "#"):
+		return "", nil
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	return s, nil
+}
+
+// closingQuote returns the index of the quote closing the quoted scalar at
+// the start of s, or -1 if it is not closed. Double quoted scalars escape
+// with a backslash, single quoted ones by doubling the quote.
+func closingQuote(s string) int {
+	quoteChar := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quoteChar == '"' && s[i] == '\\':
+			i++
+		case s[i] != quoteChar:
+		case quoteChar == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		default:
+			return i
+		}
+	}
+	return -1
+}
+
+// sortedNames returns the names of xattrs in sorted order
+func sortedNames(xattrs map[string][]byte) []string {
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,70 @@
+package records
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"vmapfs/internal/state"
+)
+
+func TestRoundTrip(t *testing.T) {
+	records := []state.Record{
+		{Path: "/empty"},
+		{Source: "movies/a, \"quoted\".mkv", Path: "/movies/a.mkv", Xattrs: map[string][]byte{
+			"user.tag":    []byte("favourite"),
+			"user.binary": {0, 1, 2, 255},
+		}},
+		{Source: "movies/a, \"quoted\".mkv", Path: "/best/a: the movie.mkv"},
+		{Source: "tagged.mkv", Xattrs: map[string][]byte{"user.tag": []byte("x")}},
+	}
+
+	for _, format := range []Format{CSV, JSONL, YAML} {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Write(&buf, format, records); err != nil {
+				t.Fatalf("Failed to write: %v", err)
+			}
+			read, err := Read(&buf, format)
+			if err != nil {
+				t.Fatalf("Failed to read: %v\n%s", err, buf.String())
+			}
+			if !reflect.DeepEqual(read, records) {
+				t.Errorf("Records changed in a round trip:\nexpected %+v\ngot      %+v", records, read)
+			}
+		})
+	}
+}
+
+func TestReadHandEditedYAML(t *testing.T) {
+	input := `# edited by hand
+- source: movies/a.mkv
+  path: '/movies/It''s a.mkv'   
+  xattrs: # base64
+      user.tag: ZmF2b3VyaXRl
+- source: "movies/b.mkv" # was c.mkv
+  path: "/a # b.mkv"   # moved
+
+- # a directory
+  path: /empty # a directory
+`
+	records, err := Read(strings.NewReader(input), YAML)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	expected := []state.Record{
+		{Source: "movies/a.mkv", Path: "/movies/It's a.mkv", Xattrs: map[string][]byte{"user.tag": []byte("favourite")}},
+		{Source: "movies/b.mkv", Path: "/a # b.mkv"},
+		{Path: "/empty"},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Unexpected records:\nexpected %+v\ngot      %+v", expected, records)
+	}
+
+	for _, bad := range []string{`- path: "/a" b`, `- path: "/a`, `- path: '/a''`} {
+		if _, err := Read(strings.NewReader(bad), YAML); err == nil {
+			t.Errorf("Expected %s to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrLocked indicates the state file is already in use by another process
+var ErrLocked = errors.New("state file is locked by another process")
+
+// writeFileAtomic replaces path with data so that readers and a crash at
+// any point see either the old or the new contents, never a partial file.
+// The data is written to a temporary file in the same directory, synced,
+// renamed over path, and the directory is synced to persist the rename.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer func() {
+		// Only does anything if we failed before the rename
+		_ = os.Remove(tmpPath)
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions on temporary file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory so that renames and new entries in it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// fileLock is an advisory flock(2) on a lock file next to the state file.
+// The state file itself can't be locked because atomic saves replace it.
+type fileLock struct {
+	file *os.File
+}
+
+// acquireLock takes an exclusive, non-blocking lock on path, recording our
+// pid in it so that a refused process can say who holds the lock.
+func acquireLock(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %w", path, err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			holder := "unknown"
+			if data, readErr := os.ReadFile(path); readErr == nil {
+				if pid, convErr := strconv.Atoi(strings.TrimSpace(string(data))); convErr == nil {
+					holder = strconv.Itoa(pid)
+				}
+			}
+			return nil, fmt.Errorf("%w (held by pid %s via %s)", ErrLocked, holder, path)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &fileLock{file: f}, nil
+}
+
+// release drops the lock and closes the lock file
+func (l *fileLock) release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	defer func() { l.file = nil }()
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		l.file.Close()
+		return fmt.Errorf("failed to unlock: %w", err)
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,331 @@
+package state
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupTimeFormat names backups by the microsecond so that saves in quick
+// succession don't overwrite each other. Backups written by older versions
+// are named by the second, see legacyBackupTimeFormat.
+const (
+	backupTimeFormat       = "20060102-150405.000000"
+	legacyBackupTimeFormat = "20060102-150405"
+	backupPolicyFile       = "policy.json"
+)
+
+// BackupPolicy controls which backups of the state file are kept. Besides
+// the Keep most recent backups, the newest backup of each of the last
+// Hourly hours, Daily days and Weekly weeks is kept, so a burst of saves
+// can't wipe out older history.
+type BackupPolicy struct {
+	Keep     int  `json:"keep"`
+	Hourly   int  `json:"hourly,omitempty"`
+	Daily    int  `json:"daily,omitempty"`
+	Weekly   int  `json:"weekly,omitempty"`
+	Compress bool `json:"compress,omitempty"` // gzip new backups
+}
+
+// DefaultBackupPolicy keeps the five most recent backups
+var DefaultBackupPolicy = BackupPolicy{Keep: 5}
+
+// Backup describes a backup of the state file
+type Backup struct {
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`
+	Time       time.Time `json:"time"`
+	Size       int64     `json:"size"`
+	Compressed bool      `json:"compressed,omitempty"`
+}
+
+// BackupDirFor returns the directory holding the backups of a state file
+func BackupDirFor(statePath string) string {
+	return filepath.Join(filepath.Dir(statePath), ".vmapfs-backups")
+}
+
+// BackupDir returns the directory holding the backups of the state file
+func (sm *Manager) BackupDir() string {
+	return sm.backupDir
+}
+
+// SetBackupPolicy changes the backup policy. The policy is remembered in
+// the backup directory, so that tools using the same state file later
+// prune backups the same way.
+func (sm *Manager) SetBackupPolicy(policy BackupPolicy) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if policy.Keep < 1 {
+		policy.Keep = 1
+	}
+	data, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(sm.backupDir, backupPolicyFile), data, 0600); err != nil {
+		return fmt.Errorf("failed to write backup policy: %w", err)
+	}
+	logger.Info("Backup policy: keep %d recent, %d hourly, %d daily, %d weekly (compress=%v)",
+		policy.Keep, policy.Hourly, policy.Daily, policy.Weekly, policy.Compress)
+	sm.policy = policy
+	return nil
+}
+
+// readBackupPolicy loads the remembered backup policy, or the default if
+// none was set
+func readBackupPolicy(backupDir string) (BackupPolicy, error) {
+	data, err := os.ReadFile(filepath.Join(backupDir, backupPolicyFile))
+	if os.IsNotExist(err) {
+		return DefaultBackupPolicy, nil
+	}
+	if err != nil {
+		return DefaultBackupPolicy, err
+	}
+	policy := DefaultBackupPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return DefaultBackupPolicy, err
+	}
+	if policy.Keep < 1 {
+		policy.Keep = 1
+	}
+	return policy, nil
+}
+
+// ListBackups returns the backups in backupDir, newest first
+func ListBackups(backupDir string) ([]Backup, error) {
+	entries, err := os.ReadDir(backupDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]Backup, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		backup, ok := parseBackupName(entry.Name())
+		if !ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backup.Path = filepath.Join(backupDir, entry.Name())
+		backup.Size = info.Size()
+		backups = append(backups, backup)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// parseBackupName recognizes backup file names and the time they encode
+func parseBackupName(name string) (Backup, bool) {
+	backup := Backup{Name: name}
+	stamp := name
+	if strings.HasSuffix(stamp, ".gz") {
+		backup.Compressed = true
+		stamp = strings.TrimSuffix(stamp, ".gz")
+	}
+	if !strings.HasPrefix(stamp, "state-") || !strings.HasSuffix(stamp, ".json") {
+		return backup, false
+	}
+	stamp = strings.TrimSuffix(strings.TrimPrefix(stamp, "state-"), ".json")
+
+	for _, layout := range []string{backupTimeFormat, legacyBackupTimeFormat} {
+		if t, err := time.ParseInLocation(layout, stamp, time.Local); err == nil {
+			backup.Time = t
+			return backup, true
+		}
+	}
+	return backup, false
+}
+
+// FindBackup looks up a backup by name. The name "latest" refers to the
+// newest backup.
+func FindBackup(backupDir, name string) (Backup, error) {
+	backups, err := ListBackups(backupDir)
+	if err != nil {
+		return Backup{}, err
+	}
+	if name == "latest" && len(backups) > 0 {
+		return backups[0], nil
+	}
+	for _, backup := range backups {
+		if backup.Name == name {
+			return backup, nil
+		}
+	}
+	return Backup{}, fmt.Errorf("no backup named %q in %s", name, backupDir)
+}
+
+// ReadBackup returns the contents of a backup, decompressing it if needed
+func ReadBackup(backup Backup) ([]byte, error) {
+	f, err := os.Open(backup.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if !backup.Compressed {
+		return io.ReadAll(f)
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress backup %s: %w", backup.Name, err)
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// LoadBackup reads and parses the named backup, upgrading it to the
+// current schema version
+func LoadBackup(backupDir, name string) (*FSState, error) {
+	backup, err := FindBackup(backupDir, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ReadBackup(backup)
+	if err != nil {
+		return nil, err
+	}
+	state, _, err := parseState(data)
+	if err != nil {
+		return nil, fmt.Errorf("backup %s: %w", backup.Name, err)
+	}
+	return state, nil
+}
+
+// createBackup copies the current state file into the backup directory,
+// unless it is identical to the newest backup, and prunes old backups
+func (sm *Manager) createBackup() error {
+	data, err := os.ReadFile(sm.statePath)
+	if os.IsNotExist(err) || (err == nil && len(data) == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	backups, err := ListBackups(sm.backupDir)
+	if err != nil {
+		return err
+	}
+	if len(backups) > 0 {
+		if latest, readErr := ReadBackup(backups[0]); readErr == nil && bytes.Equal(latest, data) {
+			logger.Trace("State unchanged since backup %s, skipping", backups[0].Name)
+			return nil
+		}
+	}
+
+	name, payload, err := sm.newBackup(data)
+	if err != nil {
+		return err
+	}
+
+	backupPath := filepath.Join(sm.backupDir, name)
+	logger.Debug("Creating backup: %s", backupPath)
+	if err := writeFileAtomic(backupPath, payload, 0600); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	return sm.pruneBackups()
+}
+
+// newBackup picks an unused backup name and encodes data per the policy
+func (sm *Manager) newBackup(data []byte) (string, []byte, error) {
+	ext := ".json"
+	payload := data
+	if sm.policy.Compress {
+		ext = ".json.gz"
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return "", nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return "", nil, err
+		}
+		payload = buf.Bytes()
+	}
+
+	now := time.Now()
+	for {
+		name := "state-" + now.Format(backupTimeFormat) + ext
+		if _, err := os.Stat(filepath.Join(sm.backupDir, name)); os.IsNotExist(err) {
+			return name, payload, nil
+		}
+		now = now.Add(time.Microsecond)
+	}
+}
+
+// pruneBackups removes the backups the policy doesn't keep
+func (sm *Manager) pruneBackups() error {
+	backups, err := ListBackups(sm.backupDir)
+	if err != nil {
+		return err
+	}
+
+	keep := sm.policy.retained(backups)
+	for _, backup := range backups {
+		if keep[backup.Name] {
+			continue
+		}
+		logger.Debug("Removing old backup: %s", backup.Path)
+		if err := os.Remove(backup.Path); err != nil {
+			return fmt.Errorf("failed to remove old backup %s: %w", backup.Path, err)
+		}
+	}
+	return nil
+}
+
+// retained returns the names of the backups the policy keeps, given all
+// backups newest first
+func (p BackupPolicy) retained(backups []Backup) map[string]bool {
+	keep := make(map[string]bool)
+	for i := 0; i < p.Keep && i < len(backups); i++ {
+		keep[backups[i].Name] = true
+	}
+
+	buckets := []struct {
+		count int
+		key   func(time.Time) string
+	}{
+		{p.Hourly, func(t time.Time) string { return t.Format("2006010215") }},
+		{p.Daily, func(t time.Time) string { return t.Format("20060102") }},
+		{p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+	}
+
+	// Keep the newest backup of each of the most recent buckets
+	for _, bucket := range buckets {
+		seen := make(map[string]bool)
+		for _, backup := range backups {
+			if len(seen) >= bucket.count {
+				break
+			}
+			key := bucket.key(backup.Time)
+			if !seen[key] {
+				seen[key] = true
+				keep[backup.Name] = true
+			}
+		}
+	}
+	return keep
+}
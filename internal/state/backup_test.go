@@ -0,0 +1,162 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackups(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	manager, err := NewManager(statePath)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	if err := manager.SetBackupPolicy(BackupPolicy{Keep: 10, Compress: true}); err != nil {
+		t.Fatalf("Failed to set backup policy: %v", err)
+	}
+
+	state, err := manager.LoadState()
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+
+	// Quick successive saves must each get their own backup
+	for i := 0; i < 3; i++ {
+		state.Directories[fmt.Sprintf("/dir%d", i)] = true
+		if err := manager.SaveState(state); err != nil {
+			t.Fatalf("Failed to save state: %v", err)
+		}
+	}
+
+	backups, err := ListBackups(manager.BackupDir())
+	if err != nil {
+		t.Fatalf("Failed to list backups: %v", err)
+	}
+	if len(backups) != 3 {
+		t.Fatalf("Expected 3 backups, got %d", len(backups))
+	}
+	for _, backup := range backups {
+		if !backup.Compressed {
+			t.Errorf("Expected %s to be compressed", backup.Name)
+		}
+	}
+
+	t.Run("SkipsIdentical", func(t *testing.T) {
+		if err := manager.SaveState(state); err != nil {
+			t.Fatalf("Failed to save state: %v", err)
+		}
+		if err := manager.SaveState(state); err != nil {
+			t.Fatalf("Failed to save state: %v", err)
+		}
+		again, _ := ListBackups(manager.BackupDir())
+		if len(again) != 4 {
+			t.Errorf("Expected an unchanged state to be backed up once, got %d backups", len(again))
+		}
+	})
+
+	t.Run("LoadBackup", func(t *testing.T) {
+		latest, err := LoadBackup(manager.BackupDir(), "latest")
+		if err != nil {
+			t.Fatalf("Failed to load latest backup: %v", err)
+		}
+		if !reflect.DeepEqual(latest.Directories, state.Directories) {
+			t.Errorf("Expected latest backup to hold the saved state, got %v", latest.Directories)
+		}
+
+		oldest, err := LoadBackup(manager.BackupDir(), backups[len(backups)-1].Name)
+		if err != nil {
+			t.Fatalf("Failed to load oldest backup: %v", err)
+		}
+		if len(oldest.Directories) != 1 {
+			t.Errorf("Expected oldest backup to hold the initial state, got %v", oldest.Directories)
+		}
+	})
+
+	t.Run("PolicyIsRemembered", func(t *testing.T) {
+		policy, err := readBackupPolicy(manager.BackupDir())
+		if err != nil {
+			t.Fatalf("Failed to read backup policy: %v", err)
+		}
+		if policy != (BackupPolicy{Keep: 10, Compress: true}) {
+			t.Errorf("Unexpected remembered policy: %+v", policy)
+		}
+	})
+}
+
+func TestBackupRetention(t *testing.T) {
+	now := time.Date(2024, 3, 20, 12, 30, 0, 0, time.Local)
+
+	// A burst of ten saves in the last minutes, then one backup every six
+	// hours going back three weeks
+	var backups []Backup
+	for i := 0; i < 10; i++ {
+		backups = append(backups, Backup{Name: fmt.Sprintf("burst-%d", i), Time: now.Add(-time.Duration(i) * time.Second)})
+	}
+	for i := 1; i <= 4*21; i++ {
+		backups = append(backups, Backup{Name: fmt.Sprintf("old-%d", i), Time: now.Add(-time.Duration(i) * 6 * time.Hour)})
+	}
+
+	keep := BackupPolicy{Keep: 5}.retained(backups)
+	if len(keep) != 5 || !keep["burst-0"] || !keep["burst-4"] || keep["burst-5"] {
+		t.Errorf("Expected only the 5 newest backups, got %v", keep)
+	}
+
+	// The newest backup of each bucket is kept: burst-0 covers the current
+	// hour, day and ISO week, so older buckets are taken from the six-hourly
+	// backups (old-N is 6N hours old).
+	keep = BackupPolicy{Keep: 5, Hourly: 2, Daily: 3, Weekly: 3}.retained(backups)
+	expected := map[string]bool{
+		"burst-0": true, "burst-1": true, "burst-2": true, "burst-3": true, "burst-4": true,
+		"old-1":  true, // 06:30 on the 20th, the second hour
+		"old-3":  true, // 18:30 on the 19th, the second day
+		"old-7":  true, // 18:30 on the 18th, the third day
+		"old-11": true, // 18:30 on Sunday the 17th, the second week
+		"old-39": true, // 18:30 on Sunday the 10th, the third week
+	}
+	if !reflect.DeepEqual(keep, expected) {
+		t.Errorf("Unexpected retained backups:\nexpected %v\ngot      %v", expected, keep)
+	}
+}
+
+func TestParseBackupName(t *testing.T) {
+	tests := []struct {
+		name       string
+		ok         bool
+		compressed bool
+		time       time.Time
+	}{
+		{"state-20240320-123000.000042.json", true, false, time.Date(2024, 3, 20, 12, 30, 0, 42000, time.Local)},
+		{"state-20240320-123000.000042.json.gz", true, true, time.Date(2024, 3, 20, 12, 30, 0, 42000, time.Local)},
+		{"state-20240320-123000.json", true, false, time.Date(2024, 3, 20, 12, 30, 0, 0, time.Local)},
+		{"policy.json", false, false, time.Time{}},
+		{"state-garbage.json", false, false, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		backup, ok := parseBackupName(tt.name)
+		if ok != tt.ok {
+			t.Errorf("%s: expected ok=%v, got %v", tt.name, tt.ok, ok)
+			continue
+		}
+		if ok && (!backup.Time.Equal(tt.time) || backup.Compressed != tt.compressed) {
+			t.Errorf("%s: got time %v compressed %v", tt.name, backup.Time, backup.Compressed)
+		}
+	}
+}
+
+func TestListBackupsMissingDir(t *testing.T) {
+	backups, err := ListBackups(filepath.Join(t.TempDir(), "missing"))
+	if err != nil || len(backups) != 0 {
+		t.Errorf("Expected no backups and no error, got %v, %v", backups, err)
+	}
+	if _, err := os.Stat(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Error("Listing must not create the backup directory")
+	}
+}
@@ -0,0 +1,223 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ProblemKind identifies a kind of inconsistency found by Check
+type ProblemKind string
+
+// Problems reported by Check
+const (
+	ProblemEscapingSource   ProblemKind = "escaping_source"   // Source path leaves the source root
+	ProblemMissingSource    ProblemKind = "missing_source"    // Source no longer exists
+	ProblemDirectoryMapping ProblemKind = "directory_mapping" // Source is a directory
+	ProblemEmptyMapping     ProblemKind = "empty_mapping"     // Record with no virtual paths and no xattrs
+	ProblemDuplicatePath    ProblemKind = "duplicate_path"    // Virtual path claimed more than once
+	ProblemMissingDirectory ProblemKind = "missing_directory" // Parent directory is not registered
+	ProblemUncleanPath      ProblemKind = "unclean_path"      // Virtual path is relative or not in clean form
+)
+
+// Problem is a single inconsistency between a state and its source tree,
+// together with the ops that repair it
+type Problem struct {
+	Kind   ProblemKind `json:"kind"`
+	Source string      `json:"source,omitempty"`
+	Path   string      `json:"path,omitempty"`
+	Detail string      `json:"detail"`
+	Fix    []Op        `json:"fix,omitempty"`
+}
+
+// String returns a short human readable description of the problem
+func (p Problem) String() string {
+	subject := p.Path
+	if p.Source != "" {
+		subject = p.Source
+		if p.Path != "" {
+			subject = fmt.Sprintf("%s -> %s", p.Path, p.Source)
+		}
+	}
+	return fmt.Sprintf("%s: %s (%s)", p.Kind, subject, p.Detail)
+}
+
+// FixOps returns the ops that repair every problem, in order
+func FixOps(problems []Problem) []Op {
+	var ops []Op
+	for _, p := range problems {
+		ops = append(ops, p.Fix...)
+	}
+	return ops
+}
+
+// Check compares the state against the source tree at sourceRoot and
+// reports every inconsistency, in a stable order. Problems are independent:
+// applying the fixes of all of them leaves a state that checks clean.
+func (s *FSState) Check(sourceRoot string) ([]Problem, error) {
+	info, err := os.Stat(sourceRoot)
+	if err != nil {
+		return nil, fmt.Errorf("cannot check against source root: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("source root %s is not a directory", sourceRoot)
+	}
+
+	sources := make([]string, 0, len(s.Mappings))
+	for source := range s.Mappings {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	var problems []Problem
+	forget := func(kind ProblemKind, source, detail string) {
+		problems = append(problems, Problem{
+			Kind:   kind,
+			Source: source,
+			Detail: detail,
+			Fix:    []Op{{Kind: OpForget, Source: source}},
+		})
+	}
+
+	// Records that survive the per-source checks, for the path checks below
+	var kept []string
+	for _, source := range sources {
+		mapping := s.Mappings[source]
+
+		if escapesRoot(source) {
+			forget(ProblemEscapingSource, source, "source path is outside the source root")
+			continue
+		}
+
+		info, statErr := os.Lstat(filepath.Join(sourceRoot, source))
+		switch {
+		case os.IsNotExist(statErr):
+			forget(ProblemMissingSource, source, "source file does not exist")
+			continue
+		case statErr != nil:
+			return nil, fmt.Errorf("cannot check source %s: %w", source, statErr)
+		case info.IsDir():
+			forget(ProblemDirectoryMapping, source, "source is a directory")
+			continue
+		}
+
+		if mapping.IsEmpty() {
+			forget(ProblemEmptyMapping, source, "mapping has no virtual paths or xattrs")
+			continue
+		}
+		kept = append(kept, source)
+	}
+
+	// The first source in sorted order keeps a duplicated virtual path
+	owner := make(map[string]string)
+	for _, source := range kept {
+		for _, vpath := range s.Mappings[source].VirtualPaths {
+			if cleanVirtualPath(vpath) != vpath {
+				continue
+			}
+			first, claimed := owner[vpath]
+			if !claimed {
+				owner[vpath] = source
+				continue
+			}
+			detail := fmt.Sprintf("already mapped to %s", first)
+			if first == source {
+				detail = "listed more than once"
+			}
+			problems = append(problems, Problem{
+				Kind:   ProblemDuplicatePath,
+				Source: source,
+				Path:   vpath,
+				Detail: detail,
+				Fix:    []Op{{Kind: OpUnmap, Source: source, Path: vpath}},
+			})
+		}
+	}
+
+	// Unclean virtual paths move to their clean form, unless a clean path
+	// already claims it
+	for _, source := range kept {
+		for _, vpath := range s.Mappings[source].VirtualPaths {
+			clean := cleanVirtualPath(vpath)
+			if clean == vpath {
+				continue
+			}
+			p := Problem{
+				Kind:   ProblemUncleanPath,
+				Source: source,
+				Path:   vpath,
+				Detail: fmt.Sprintf("should be %s", clean),
+				Fix:    []Op{{Kind: OpUnmap, Source: source, Path: vpath}},
+			}
+			switch first, claimed := owner[clean]; {
+			case clean == "/":
+				p.Detail = "refers to the root"
+			case claimed:
+				p.Detail = fmt.Sprintf("should be %s, which is already mapped to %s", clean, first)
+			default:
+				owner[clean] = source
+				// Map before unmapping, so that the record is not dropped
+				p.Fix = append([]Op{{Kind: OpMap, Source: source, Path: clean}}, p.Fix...)
+			}
+			problems = append(problems, p)
+		}
+	}
+	var unclean []string
+	for dir := range s.Directories {
+		if cleanVirtualPath(dir) != dir {
+			unclean = append(unclean, dir)
+		}
+	}
+	sort.Strings(unclean)
+	for _, dir := range unclean {
+		clean := cleanVirtualPath(dir)
+		problems = append(problems, Problem{
+			Kind:   ProblemUncleanPath,
+			Path:   dir,
+			Detail: fmt.Sprintf("should be %s", clean),
+			Fix:    []Op{{Kind: OpMkdir, Path: clean}, {Kind: OpRmdir, Path: dir}},
+		})
+	}
+
+	// Parents of directories and surviving virtual paths must be registered
+	paths := make([]string, 0, len(owner)+len(s.Directories))
+	for vpath := range owner {
+		paths = append(paths, vpath)
+	}
+	for dir := range s.Directories {
+		paths = append(paths, cleanVirtualPath(dir))
+	}
+	missing := make(map[string]bool)
+	for _, vpath := range paths {
+		for dir := path.Dir(vpath); dir != "/" && vpath != "/"; dir = path.Dir(dir) {
+			if !s.Directories[dir] {
+				missing[dir] = true
+			}
+		}
+	}
+	dirs := make([]string, 0, len(missing))
+	for dir := range missing {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		problems = append(problems, Problem{
+			Kind:   ProblemMissingDirectory,
+			Path:   dir,
+			Detail: "parent directory is not registered",
+			Fix:    []Op{{Kind: OpMkdir, Path: dir}},
+		})
+	}
+
+	return problems, nil
+}
+
+// escapesRoot returns true if a source path refers to something outside
+// the source root
+func escapesRoot(source string) bool {
+	cleaned := filepath.Clean(source)
+	return cleaned == ".." || strings.HasPrefix(cleaned, "../")
+}
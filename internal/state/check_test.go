@@ -0,0 +1,90 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	sourceRoot := t.TempDir()
+	for _, name := range []string{"a.mkv", "b.mkv", "tagged.mkv", "empty.mkv", "rel.mkv"} {
+		if err := os.WriteFile(filepath.Join(sourceRoot, name), []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create source file: %v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(sourceRoot, "folder"), 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+
+	state := &FSState{
+		Mappings: map[string]FileMapping{
+			"a.mkv":          {VirtualPaths: []string{"/movies/A.mkv", "/shared.mkv"}},
+			"b.mkv":          {VirtualPaths: []string{"/shared.mkv", "/b.mkv", "/b.mkv"}},
+			"tagged.mkv":     {Xattrs: map[string][]byte{"user.tag": []byte("x")}},
+			"empty.mkv":      {},
+			"gone.mkv":       {VirtualPaths: []string{"/gone.mkv"}},
+			"folder":         {VirtualPaths: []string{"/folder"}},
+			"../outside.mkv": {VirtualPaths: []string{"/outside.mkv"}},
+			"rel.mkv":        {VirtualPaths: []string{"tv/rel.mkv", "b.mkv"}},
+		},
+		Directories: map[string]bool{"/": true, "/archive/2020": true, "docs//": true},
+		Version:     CurrentVersion,
+	}
+
+	problems, err := state.Check(sourceRoot)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+
+	type found struct {
+		Kind   ProblemKind
+		Source string
+		Path   string
+	}
+	var got []found
+	for _, p := range problems {
+		got = append(got, found{p.Kind, p.Source, p.Path})
+	}
+	expected := []found{
+		{ProblemEscapingSource, "../outside.mkv", ""},
+		{ProblemEmptyMapping, "empty.mkv", ""},
+		{ProblemDirectoryMapping, "folder", ""},
+		{ProblemMissingSource, "gone.mkv", ""},
+		{ProblemDuplicatePath, "b.mkv", "/shared.mkv"},
+		{ProblemDuplicatePath, "b.mkv", "/b.mkv"},
+		{ProblemUncleanPath, "rel.mkv", "tv/rel.mkv"},
+		{ProblemUncleanPath, "rel.mkv", "b.mkv"},
+		{ProblemUncleanPath, "", "docs//"},
+		{ProblemMissingDirectory, "", "/archive"},
+		{ProblemMissingDirectory, "", "/movies"},
+		{ProblemMissingDirectory, "", "/tv"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Unexpected problems:\nexpected %v\ngot      %v", expected, got)
+	}
+
+	for _, op := range FixOps(problems) {
+		if err := state.Apply(op); err != nil {
+			t.Fatalf("Failed to apply fix %s: %v", op, err)
+		}
+	}
+	if _, exists := state.Mappings["tagged.mkv"]; !exists {
+		t.Error("Expected xattr-only mapping to be kept")
+	}
+	if !reflect.DeepEqual(state.Mappings["b.mkv"].VirtualPaths, []string{"/b.mkv"}) {
+		t.Errorf("Expected b.mkv to keep one /b.mkv, got %q", state.Mappings["b.mkv"].VirtualPaths)
+	}
+	if !reflect.DeepEqual(state.Mappings["rel.mkv"].VirtualPaths, []string{"/tv/rel.mkv"}) {
+		t.Errorf("Expected rel.mkv to be rooted, got %q", state.Mappings["rel.mkv"].VirtualPaths)
+	}
+
+	problems, err = state.Check(sourceRoot)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("Expected fixed state to check clean, got %v", problems)
+	}
+}
@@ -0,0 +1,129 @@
+package state
+
+import (
+	"bytes"
+	"sort"
+)
+
+// ChangeKind describes how an entry differs between two states
+type ChangeKind string
+
+// Kinds of change reported by Diff
+const (
+	ChangeAdded    ChangeKind = "added"
+	ChangeRemoved  ChangeKind = "removed"
+	ChangeModified ChangeKind = "modified"
+	ChangeMoved    ChangeKind = "moved" // Same xattrs and number of virtual paths, different paths
+)
+
+// MappingChange is a difference in the mapping record of one source
+type MappingChange struct {
+	Kind   ChangeKind   `json:"kind"`
+	Source string       `json:"source"`
+	Old    *FileMapping `json:"old,omitempty"`
+	New    *FileMapping `json:"new,omitempty"`
+}
+
+// DirectoryChange is a directory registered in only one of two states
+type DirectoryChange struct {
+	Kind ChangeKind `json:"kind"`
+	Path string     `json:"path"`
+}
+
+// StateDiff lists the differences between two states, sorted by source
+// and path
+type StateDiff struct {
+	Mappings    []MappingChange   `json:"mappings"`
+	Directories []DirectoryChange `json:"directories"`
+}
+
+// Empty returns true if the states are equivalent
+func (d StateDiff) Empty() bool {
+	return len(d.Mappings) == 0 && len(d.Directories) == 0
+}
+
+// Diff compares two states. The order of virtual paths within a mapping is
+// not significant.
+func Diff(from, to *FSState) StateDiff {
+	diff := StateDiff{
+		Mappings:    []MappingChange{},
+		Directories: []DirectoryChange{},
+	}
+
+	for _, source := range unionKeys(from.Mappings, to.Mappings) {
+		old, inOld := from.Mappings[source]
+		updated, inNew := to.Mappings[source]
+		switch {
+		case !inNew:
+			diff.Mappings = append(diff.Mappings, MappingChange{Kind: ChangeRemoved, Source: source, Old: &old})
+		case !inOld:
+			diff.Mappings = append(diff.Mappings, MappingChange{Kind: ChangeAdded, Source: source, New: &updated})
+		case !old.Equal(updated):
+			kind := ChangeModified
+			if old.movedTo(updated) {
+				kind = ChangeMoved
+			}
+			diff.Mappings = append(diff.Mappings, MappingChange{Kind: kind, Source: source, Old: &old, New: &updated})
+		}
+	}
+
+	for _, dir := range unionKeys(from.Directories, to.Directories) {
+		switch {
+		case !to.Directories[dir]:
+			diff.Directories = append(diff.Directories, DirectoryChange{Kind: ChangeRemoved, Path: dir})
+		case !from.Directories[dir]:
+			diff.Directories = append(diff.Directories, DirectoryChange{Kind: ChangeAdded, Path: dir})
+		}
+	}
+	return diff
+}
+
+// Equal returns true if both mappings have the same virtual paths, in any
+// order, and the same xattrs. Fingerprints, histories and inodes are not
+// compared.
+func (fm FileMapping) Equal(other FileMapping) bool {
+	if len(fm.VirtualPaths) != len(other.VirtualPaths) || len(fm.Xattrs) != len(other.Xattrs) {
+		return false
+	}
+	paths := append([]string(nil), fm.VirtualPaths...)
+	otherPaths := append([]string(nil), other.VirtualPaths...)
+	sort.Strings(paths)
+	sort.Strings(otherPaths)
+	for i := range paths {
+		if paths[i] != otherPaths[i] {
+			return false
+		}
+	}
+	for name, value := range fm.Xattrs {
+		otherValue, exists := other.Xattrs[name]
+		if !exists || !bytes.Equal(value, otherValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// movedTo returns true if other has the same xattrs and as many virtual
+// paths as fm, so that the change between them is a move or rename
+func (fm FileMapping) movedTo(other FileMapping) bool {
+	if len(fm.VirtualPaths) == 0 || len(fm.VirtualPaths) != len(other.VirtualPaths) {
+		return false
+	}
+	return FileMapping{Xattrs: fm.Xattrs}.Equal(FileMapping{Xattrs: other.Xattrs})
+}
+
+// unionKeys returns the keys present in any of the maps, sorted
+func unionKeys[V any](maps ...map[string]V) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, m := range maps {
+		for key := range m {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
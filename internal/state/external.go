@@ -0,0 +1,109 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ErrExternalChange indicates that the state file was changed by another
+// process since the Manager last read or wrote it. Saving would silently
+// discard that change, so the Manager refuses until ReadExternal has been
+// called.
+var ErrExternalChange = errors.New("state file was changed by another process")
+
+// fileStamp identifies a version of the state file. Editors that replace
+// the file change its inode; ones that rewrite it in place change its size
+// or modification time.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+	inode   uint64
+}
+
+// statStamp returns the stamp of the file at path
+func statStamp(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	stamp := fileStamp{size: info.Size(), modTime: info.ModTime()}
+	if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+		stamp.inode = sys.Ino
+	}
+	return stamp, nil
+}
+
+// remember records data as the contents of the state file as this Manager
+// last saw it. The caller must hold sm.mu.
+func (sm *Manager) remember(data []byte) {
+	stamp, err := statStamp(sm.statePath)
+	if err != nil {
+		logger.Warn("Cannot stat state file, external changes will not be detected: %v", err)
+		stamp = fileStamp{}
+	}
+	sm.stamp = stamp
+	sm.seen = data
+}
+
+// changedLocked reports whether the state file differs from the version
+// this Manager last read or wrote. A file that was never read, or that has
+// been deleted, has nothing to lose and counts as unchanged. The caller
+// must hold sm.mu.
+func (sm *Manager) changedLocked() (bool, error) {
+	if sm.stamp == (fileStamp{}) {
+		return false, nil
+	}
+	stamp, err := statStamp(sm.statePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check state file: %w", err)
+	}
+	return stamp != sm.stamp, nil
+}
+
+// ExternalChange reports whether another process changed the state file
+// since this Manager last read or wrote it
+func (sm *Manager) ExternalChange() (bool, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.changedLocked()
+}
+
+// ReadExternal reads the state file as another process left it. It returns
+// the state this Manager last read or wrote, to merge against, and the
+// state now in the file. Afterwards the file counts as seen, so the next
+// save replaces it whether or not its contents were taken over; the
+// replaced file is kept as a backup as usual.
+func (sm *Manager) ReadExternal() (base, current *FSState, err error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	logger.Info("Reading externally changed state file: %s", sm.statePath)
+	data, err := os.ReadFile(sm.statePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	seen := sm.seen
+	sm.remember(data)
+
+	if len(seen) == 0 {
+		base = &FSState{Version: CurrentVersion}
+		base.initialize()
+	} else if base, _, err = parseState(seen); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse previous state: %w", err)
+	}
+
+	if len(data) == 0 {
+		return base, nil, fmt.Errorf("state file is empty")
+	}
+	current, _, err = parseState(data)
+	if err != nil {
+		return base, nil, err
+	}
+	return base, current, nil
+}
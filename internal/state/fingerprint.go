@@ -0,0 +1,72 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// FingerprintBlock is how much of the start and of the end of a file is
+// hashed into its fingerprint
+const FingerprintBlock = 64 * 1024
+
+// Fingerprint identifies the content of a source file cheaply, so that the
+// file can be found again after the source renames or re-nests it. Only
+// the first and last FingerprintBlock bytes are read, which keeps it cheap
+// for large files on remote mounts.
+type Fingerprint struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // Unix nanoseconds
+	Hash    string `json:"hash"`  // SHA-256 of the hashed blocks, hex encoded
+}
+
+// ComputeFingerprint reads the fingerprint of the file at path
+func ComputeFingerprint(path string) (*Fingerprint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, file, FingerprintBlock); err != nil && err != io.EOF {
+		return nil, err
+	}
+	// The last block may overlap the first in files under two blocks long
+	if info.Size() > FingerprintBlock {
+		if _, err := file.Seek(-FingerprintBlock, io.SeekEnd); err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(hash, file, FingerprintBlock); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	return &Fingerprint{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Hash:    hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// Current returns true if a file with info still looks like the one the
+// fingerprint was taken of, so that it need not be read again
+func (f *Fingerprint) Current(info os.FileInfo) bool {
+	return f != nil && f.Size == info.Size() && f.ModTime == info.ModTime().UnixNano()
+}
+
+// Matches returns true if both fingerprints were taken of the same
+// content. Modification times are not compared, as copying a file to a new
+// place may not keep them.
+func (f *Fingerprint) Matches(other *Fingerprint) bool {
+	return f != nil && other != nil && f.Size == other.Size && f.Hash == other.Hash
+}
@@ -0,0 +1,227 @@
+package state
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// RootInode is the inode number of the root directory, which is not stored
+const RootInode uint64 = 1
+
+// AssignInodes gives every mapped source and virtual directory an inode
+// number if it has none, and a new one if it shares its number with an
+// earlier one in sorted order, directories first. Inodes of directories
+// that no longer exist are dropped. It returns the ops that record the new
+// numbers, so that they can be journaled.
+func (s *FSState) AssignInodes() []Op {
+	for dir := range s.DirectoryInodes {
+		if !s.Directories[dir] || dir == "/" {
+			delete(s.DirectoryInodes, dir)
+		}
+	}
+
+	dirs := make([]string, 0, len(s.Directories))
+	for dir := range s.Directories {
+		if dir != "/" {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	sources := make([]string, 0, len(s.Mappings))
+	for source, mapping := range s.Mappings {
+		if len(mapping.VirtualPaths) > 0 {
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources)
+
+	used := map[uint64]bool{RootInode: true}
+	for _, inode := range s.DirectoryInodes {
+		s.noteInode(inode)
+	}
+	for _, mapping := range s.Mappings {
+		s.noteInode(mapping.Inode)
+	}
+
+	var ops []Op
+	for _, dir := range dirs {
+		inode := s.DirectoryInodes[dir]
+		if inode == 0 || used[inode] {
+			inode = s.newInode()
+			ops = append(ops, Op{Kind: OpInode, Path: dir, Inode: inode})
+			s.setDirectoryInode(dir, inode)
+		}
+		used[inode] = true
+	}
+	for _, source := range sources {
+		mapping := s.Mappings[source]
+		if mapping.Inode == 0 || used[mapping.Inode] {
+			mapping.Inode = s.newInode()
+			ops = append(ops, Op{Kind: OpInode, Source: source, Inode: mapping.Inode})
+			s.Mappings[source] = mapping
+		}
+		used[mapping.Inode] = true
+	}
+	return ops
+}
+
+// TrackInodes updates the inode numbers after op was applied to the state
+// by other means than Apply, such as the filesystem's path mapper, which
+// shares the state's maps. It drops the inodes of removed directories and
+// numbers the sources and directories op created, returning the ops that
+// record the new numbers. A rename creates nothing: the path mapper moves
+// the inodes of renamed directories with MoveDirectoryInodes when it
+// rewrites their paths.
+func (s *FSState) TrackInodes(op Op) []Op {
+	var created []string
+	switch op.Kind {
+	case OpMap, OpMkdir:
+		created = append(created, op.Path)
+	case OpMove:
+		created = append(created, op.NewPath)
+	case OpRmdir:
+		delete(s.DirectoryInodes, op.Path)
+	}
+
+	var ops []Op
+	for _, vpath := range created {
+		for dir := vpath; dir != "/" && dir != "."; dir = path.Dir(dir) {
+			if s.Directories[dir] && s.DirectoryInodes[dir] == 0 {
+				inode := s.newInode()
+				s.setDirectoryInode(dir, inode)
+				ops = append(ops, Op{Kind: OpInode, Path: dir, Inode: inode})
+			}
+		}
+	}
+	if op.Kind == OpMap {
+		if mapping, exists := s.Mappings[op.Source]; exists && mapping.Inode == 0 {
+			mapping.Inode = s.newInode()
+			s.Mappings[op.Source] = mapping
+			ops = append(ops, Op{Kind: OpInode, Source: op.Source, Inode: mapping.Inode})
+		}
+	}
+	return ops
+}
+
+// InodeOf returns the inode op that sets the current inode number of the
+// source or directory op names, to be used as the inverse of op
+func (s *FSState) InodeOf(op Op) Op {
+	inverse := Op{Kind: OpInode, Source: op.Source, Path: op.Path}
+	if op.Source != "" {
+		inverse.Inode = s.Mappings[op.Source].Inode
+	} else {
+		inverse.Inode = s.DirectoryInodes[op.Path]
+	}
+	return inverse
+}
+
+// applyInode performs an inode op
+func (s *FSState) applyInode(op Op) {
+	s.noteInode(op.Inode)
+	if op.Source != "" {
+		if mapping, exists := s.Mappings[op.Source]; exists {
+			mapping.Inode = op.Inode
+			s.Mappings[op.Source] = mapping
+		}
+		return
+	}
+	switch {
+	case op.Inode == 0:
+		delete(s.DirectoryInodes, op.Path)
+	case s.Directories[op.Path]:
+		s.setDirectoryInode(op.Path, op.Inode)
+	}
+}
+
+// inheritInodes takes the inode numbers of the sources and directories
+// that from also has and s has not numbered yet, unless s already uses the
+// number for something else
+func (s *FSState) inheritInodes(from *FSState) {
+	used := map[uint64]bool{RootInode: true}
+	for _, inode := range s.DirectoryInodes {
+		used[inode] = true
+	}
+	for _, mapping := range s.Mappings {
+		used[mapping.Inode] = true
+	}
+
+	for _, source := range unionKeys(s.Mappings) {
+		mapping := s.Mappings[source]
+		if inode := from.Mappings[source].Inode; mapping.Inode == 0 && !used[inode] {
+			mapping.Inode = inode
+			s.Mappings[source] = mapping
+			used[inode] = true
+		}
+	}
+	for _, dir := range unionKeys(s.Directories) {
+		if inode := from.DirectoryInodes[dir]; s.DirectoryInodes[dir] == 0 && !used[inode] && dir != "/" {
+			s.setDirectoryInode(dir, inode)
+			used[inode] = true
+		}
+	}
+	if from.NextInode > 0 {
+		s.noteInode(from.NextInode - 1)
+	}
+}
+
+// renameDirectoryInodes moves the inodes of a directory and the
+// directories below it along with a rename
+func (s *FSState) renameDirectoryInodes(oldDir, newDir string) {
+	oldPrefix := oldDir + "/"
+	moved := make(map[string]uint64)
+	for dir, inode := range s.DirectoryInodes {
+		switch {
+		case dir == oldDir:
+			moved[newDir] = inode
+		case strings.HasPrefix(dir, oldPrefix):
+			moved[newDir+"/"+strings.TrimPrefix(dir, oldPrefix)] = inode
+		default:
+			continue
+		}
+		delete(s.DirectoryInodes, dir)
+	}
+	for dir, inode := range moved {
+		s.setDirectoryInode(dir, inode)
+	}
+}
+
+// MoveDirectoryInodes moves the inodes of directories whose paths were
+// rewritten by other means than Apply, given as old path to new. All of
+// them are taken out before any is put back, as one directory's new path
+// may be another's old one.
+func (s *FSState) MoveDirectoryInodes(moved map[string]string) {
+	inodes := make(map[string]uint64, len(moved))
+	for oldDir := range moved {
+		if inode, exists := s.DirectoryInodes[oldDir]; exists {
+			inodes[oldDir] = inode
+			delete(s.DirectoryInodes, oldDir)
+		}
+	}
+	for oldDir, inode := range inodes {
+		s.setDirectoryInode(moved[oldDir], inode)
+	}
+}
+
+// setDirectoryInode records the inode number of a directory
+func (s *FSState) setDirectoryInode(dir string, inode uint64) {
+	if s.DirectoryInodes == nil {
+		s.DirectoryInodes = make(map[string]uint64)
+	}
+	s.DirectoryInodes[dir] = inode
+}
+
+// newInode hands out the next inode number
+func (s *FSState) newInode() uint64 {
+	s.noteInode(RootInode)
+	inode := s.NextInode
+	s.NextInode++
+	return inode
+}
+
+// noteInode makes sure inode is never handed out again
+func (s *FSState) noteInode(inode uint64) {
+	if inode >= s.NextInode {
+		s.NextInode = inode + 1
+	}
+}
@@ -0,0 +1,118 @@
+package state
+
+import (
+	"testing"
+)
+
+func TestInodes(t *testing.T) {
+	t.Run("Assign", func(t *testing.T) {
+		s := &FSState{
+			Mappings: map[string]FileMapping{
+				"a.mkv": {VirtualPaths: []string{"/movies/a.mkv"}, Inode: 5},
+				"b.mkv": {VirtualPaths: []string{"/movies/b.mkv"}, Inode: 5},
+				"c.mkv": {VirtualPaths: []string{"/c.mkv"}},
+				"d.mkv": {Xattrs: map[string][]byte{"user.tag": []byte("d")}},
+			},
+			Directories:     map[string]bool{"/": true, "/movies": true},
+			DirectoryInodes: map[string]uint64{"/gone": 3},
+		}
+		ops := s.AssignInodes()
+
+		if len(ops) != 3 {
+			t.Errorf("Expected 3 inodes to be assigned, got %v", ops)
+		}
+		if s.Mappings["a.mkv"].Inode != 5 {
+			t.Errorf("Expected the first holder to keep its inode, got %d", s.Mappings["a.mkv"].Inode)
+		}
+		seen := map[uint64]bool{RootInode: true}
+		for _, inode := range []uint64{s.DirectoryInodes["/movies"], s.Mappings["a.mkv"].Inode, s.Mappings["b.mkv"].Inode, s.Mappings["c.mkv"].Inode} {
+			if inode == 0 || seen[inode] {
+				t.Errorf("Expected distinct inodes, got %v and %+v", s.DirectoryInodes, s.Mappings)
+			}
+			seen[inode] = true
+		}
+		if _, exists := s.DirectoryInodes["/gone"]; exists {
+			t.Error("Expected the inode of a missing directory to be dropped")
+		}
+		if s.Mappings["d.mkv"].Inode != 0 {
+			t.Error("Expected unmapped records to get no inode")
+		}
+		if ops := s.AssignInodes(); len(ops) != 0 {
+			t.Errorf("Expected a second pass to assign nothing, got %v", ops)
+		}
+
+		// The ops reproduce the numbers
+		replayed := &FSState{
+			Mappings: map[string]FileMapping{
+				"a.mkv": {VirtualPaths: []string{"/movies/a.mkv"}, Inode: 5},
+				"b.mkv": {VirtualPaths: []string{"/movies/b.mkv"}, Inode: 5},
+				"c.mkv": {VirtualPaths: []string{"/c.mkv"}},
+			},
+			Directories: map[string]bool{"/": true, "/movies": true},
+		}
+		for _, op := range ops {
+			if err := replayed.Apply(op); err != nil {
+				t.Fatalf("Apply failed: %v", err)
+			}
+		}
+		for source, mapping := range replayed.Mappings {
+			if mapping.Inode != s.Mappings[source].Inode {
+				t.Errorf("Expected %s to get inode %d, got %d", source, s.Mappings[source].Inode, mapping.Inode)
+			}
+		}
+	})
+
+	t.Run("Track", func(t *testing.T) {
+		s := &FSState{
+			Mappings:    map[string]FileMapping{"a.mkv": {VirtualPaths: []string{"/tv/show/a.mkv"}}},
+			Directories: map[string]bool{"/": true, "/tv": true, "/tv/show": true},
+		}
+		if ops := s.TrackInodes(Op{Kind: OpMap, Source: "a.mkv", Path: "/tv/show/a.mkv"}); len(ops) != 3 {
+			t.Fatalf("Expected both directories and the source to be numbered, got %v", ops)
+		}
+		tv, show := s.DirectoryInodes["/tv"], s.DirectoryInodes["/tv/show"]
+
+		// Rename /tv to /series as the path mapper would
+		s.Directories = map[string]bool{"/": true, "/series": true, "/series/show": true}
+		s.Mappings["a.mkv"] = FileMapping{VirtualPaths: []string{"/series/show/a.mkv"}, Inode: s.Mappings["a.mkv"].Inode}
+		if ops := s.TrackInodes(Op{Kind: OpRenameDir, Path: "/tv", NewPath: "/series"}); len(ops) != 0 {
+			t.Errorf("Expected a rename to assign nothing, got %v", ops)
+		}
+		s.MoveDirectoryInodes(map[string]string{"/tv": "/series", "/tv/show": "/series/show"})
+		if s.DirectoryInodes["/series"] != tv || s.DirectoryInodes["/series/show"] != show || len(s.DirectoryInodes) != 2 {
+			t.Errorf("Expected the inodes to move with the directories, got %v", s.DirectoryInodes)
+		}
+
+		if err := s.Apply(Op{Kind: OpRenameDir, Path: "/series", NewPath: "/tv"}); err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+		if s.DirectoryInodes["/tv"] != tv || s.DirectoryInodes["/tv/show"] != show {
+			t.Errorf("Expected Apply to move the inodes too, got %v", s.DirectoryInodes)
+		}
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		base := &FSState{Mappings: map[string]FileMapping{}, Directories: map[string]bool{"/": true}}
+		ours := &FSState{
+			Mappings:    map[string]FileMapping{"a.mkv": {VirtualPaths: []string{"/a.mkv"}, Inode: 2}},
+			Directories: map[string]bool{"/": true},
+			NextInode:   3,
+		}
+		theirs := &FSState{
+			Mappings:    map[string]FileMapping{"b.mkv": {VirtualPaths: []string{"/b.mkv"}, Inode: 2}},
+			Directories: map[string]bool{"/": true},
+			NextInode:   3,
+		}
+		merged, conflicts := Merge(base, ours, theirs)
+		if len(conflicts) != 0 {
+			t.Fatalf("Unexpected conflicts: %v", conflicts)
+		}
+		if merged.Mappings["a.mkv"].Inode != 2 || merged.Mappings["b.mkv"].Inode != 0 {
+			t.Errorf("Expected ours to keep the contested inode, got %+v", merged.Mappings)
+		}
+		merged.AssignInodes()
+		if inode := merged.Mappings["b.mkv"].Inode; inode < 3 {
+			t.Errorf("Expected theirs to get a new inode, got %d", inode)
+		}
+	})
+}
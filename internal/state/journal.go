@@ -0,0 +1,307 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// DefaultCompactEvery is the number of journal records after which the
+// journal is folded into a new snapshot
+const DefaultCompactEvery = 10000
+
+// journalRecord is a single journaled op. On disk each record is one line:
+// the CRC-32 of the JSON payload in hex, a space, the payload and a newline.
+type journalRecord struct {
+	Seq uint64 `json:"seq"`
+	Op
+}
+
+// JournalStore is a Store that appends every op to a journal file next to
+// the state file instead of rewriting the whole state on each change. The
+// state file (written by the wrapped Manager) acts as a snapshot; every
+// CompactEvery records the journal is folded into a fresh snapshot and
+// truncated. Loading replays the journal on top of the snapshot, dropping a
+// torn or corrupt record at the tail left by a crash mid-append.
+type JournalStore struct {
+	manager      *Manager
+	path         string
+	file         *os.File
+	seq          uint64 // last sequence number written
+	records      int    // records since the last snapshot
+	broken       bool   // a failed append may have left a torn record
+	compactEvery int
+	mu           sync.Mutex
+}
+
+// NewJournalStore creates a journal-backed store on top of manager. A
+// compactEvery of zero or less uses DefaultCompactEvery.
+func NewJournalStore(manager *Manager, compactEvery int) *JournalStore {
+	if compactEvery <= 0 {
+		compactEvery = DefaultCompactEvery
+	}
+	return &JournalStore{
+		manager:      manager,
+		path:         manager.Path() + ".journal",
+		compactEvery: compactEvery,
+	}
+}
+
+// LoadState loads the snapshot and replays the journal on top of it
+func (js *JournalStore) LoadState() (*FSState, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	state, err := js.manager.LoadState()
+	if err != nil {
+		return nil, err
+	}
+	js.seq = state.JournalSeq
+
+	logger.Debug("Replaying journal: %s", js.path)
+	f, err := os.OpenFile(js.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+
+	valid, replayed, err := js.replay(f, state)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if info, statErr := f.Stat(); statErr == nil && info.Size() > valid {
+		logger.Warn("Dropping %d bytes of torn or corrupt journal data at offset %d", info.Size()-valid, valid)
+		if truncErr := f.Truncate(valid); truncErr != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to truncate journal: %w", truncErr)
+		}
+		if syncErr := f.Sync(); syncErr != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to sync journal: %w", syncErr)
+		}
+	}
+	if _, seekErr := f.Seek(valid, io.SeekStart); seekErr != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to seek journal: %w", seekErr)
+	}
+
+	js.file = f
+	js.records = replayed
+	state.JournalSeq = js.seq
+	logger.Info("Replayed %d journal records", replayed)
+	return state, nil
+}
+
+// ReplayJournal applies the journal of the state file at statePath to
+// state without modifying or locking anything, for tools that only inspect
+// state. A missing journal is not an error. It returns the number of records
+// applied.
+func ReplayJournal(statePath string, state *FSState) (int, error) {
+	js := &JournalStore{path: statePath + ".journal", seq: state.JournalSeq}
+	f, err := os.Open(js.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer f.Close()
+
+	_, replayed, err := js.replay(f, state)
+	if err != nil {
+		return replayed, err
+	}
+	state.JournalSeq = js.seq
+	return replayed, nil
+}
+
+// replay applies every intact record newer than the snapshot to state. It
+// returns the offset just past the last intact record.
+func (js *JournalStore) replay(r io.Reader, state *FSState) (int64, int, error) {
+	reader := bufio.NewReader(r)
+	var offset int64
+	replayed := 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				logger.Warn("Journal ends with an incomplete record")
+			}
+			return offset, replayed, nil
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read journal: %w", err)
+		}
+
+		record, decodeErr := decodeJournalRecord(line)
+		if decodeErr != nil {
+			logger.Warn("Corrupt journal record at offset %d: %v", offset, decodeErr)
+			return offset, replayed, nil
+		}
+		offset += int64(len(line))
+
+		if record.Seq <= state.JournalSeq {
+			continue
+		}
+		if applyErr := state.Apply(record.Op); applyErr != nil {
+			logger.Warn("Skipping journal record %d (%s): %v", record.Seq, record.Op, applyErr)
+		}
+		js.seq = record.Seq
+		replayed++
+	}
+}
+
+func encodeJournalRecord(record journalRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, 0, len(payload)+10)
+	line = append(line, fmt.Sprintf("%08x ", crc32.ChecksumIEEE(payload))...)
+	line = append(line, payload...)
+	return append(line, '\n'), nil
+}
+
+func decodeJournalRecord(line []byte) (journalRecord, error) {
+	var record journalRecord
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	sum, payload, found := bytes.Cut(line, []byte(" "))
+	if !found {
+		return record, fmt.Errorf("missing checksum")
+	}
+	expected, err := strconv.ParseUint(string(sum), 16, 32)
+	if err != nil {
+		return record, fmt.Errorf("invalid checksum: %w", err)
+	}
+	if crc32.ChecksumIEEE(payload) != uint32(expected) {
+		return record, fmt.Errorf("checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return record, fmt.Errorf("invalid record: %w", err)
+	}
+	return record, nil
+}
+
+// Record appends ops to the journal and syncs it, compacting into a new
+// snapshot once enough records have accumulated. If an append fails, the
+// journal is cut back to where it was, so that later records are not
+// appended after a torn one; if that fails too, the next Record writes a
+// full snapshot instead.
+func (js *JournalStore) Record(current func() *FSState, ops []Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if js.file == nil {
+		return fmt.Errorf("journal is not open")
+	}
+	if js.broken {
+		logger.Warn("Writing a snapshot in place of a journal that may end in a torn record")
+		return js.compact(current())
+	}
+
+	var buf bytes.Buffer
+	seq := js.seq
+	for _, op := range ops {
+		seq++
+		line, err := encodeJournalRecord(journalRecord{Seq: seq, Op: op})
+		if err != nil {
+			return fmt.Errorf("failed to encode journal record: %w", err)
+		}
+		buf.Write(line)
+	}
+
+	logger.Trace("Appending %d journal records", len(ops))
+	offset, err := js.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to find end of journal: %w", err)
+	}
+	if _, err := js.file.Write(buf.Bytes()); err != nil {
+		js.discardFrom(offset)
+		return fmt.Errorf("failed to append to journal: %w", err)
+	}
+	if err := js.file.Sync(); err != nil {
+		js.discardFrom(offset)
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	js.seq = seq
+	js.records += len(ops)
+
+	if js.records >= js.compactEvery {
+		return js.compact(current())
+	}
+	return nil
+}
+
+// discardFrom cuts the journal back to offset after a failed append, or
+// marks it broken if it cannot
+func (js *JournalStore) discardFrom(offset int64) {
+	if err := js.file.Truncate(offset); err != nil {
+		logger.Error("Failed to drop a failed journal append: %v", err)
+		js.broken = true
+		return
+	}
+	if _, err := js.file.Seek(offset, io.SeekStart); err != nil {
+		logger.Error("Failed to seek journal: %v", err)
+		js.broken = true
+	}
+}
+
+// SaveState writes a full snapshot and truncates the journal
+func (js *JournalStore) SaveState(state *FSState) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return js.compact(state)
+}
+
+// compact folds the journal into a new snapshot. The snapshot records the
+// last journal sequence it includes, so a crash between writing it and
+// truncating the journal doesn't replay records twice.
+func (js *JournalStore) compact(state *FSState) error {
+	logger.Debug("Compacting %d journal records into a snapshot", js.records)
+	state.JournalSeq = js.seq
+	if err := js.manager.SaveState(state); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	if js.file != nil {
+		if err := js.file.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate journal: %w", err)
+		}
+		if _, err := js.file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek journal: %w", err)
+		}
+		if err := js.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync journal: %w", err)
+		}
+	}
+	js.records = 0
+	js.broken = false
+	return nil
+}
+
+// Close closes the journal and the underlying Manager
+func (js *JournalStore) Close() error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if js.file != nil {
+		if err := js.file.Close(); err != nil {
+			logger.Warn("Failed to close journal: %v", err)
+		}
+		js.file = nil
+	}
+	return js.manager.Close()
+}
@@ -0,0 +1,155 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openJournalStore(t *testing.T, statePath string, compactEvery int) (*JournalStore, *FSState) {
+	t.Helper()
+	manager, err := NewManager(statePath)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	store := NewJournalStore(manager, compactEvery)
+	state, err := store.LoadState()
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	return store, state
+}
+
+func applyAndRecord(t *testing.T, store *JournalStore, state *FSState, ops ...Op) {
+	t.Helper()
+	for _, op := range ops {
+		if err := state.Apply(op); err != nil {
+			t.Fatalf("Failed to apply %s: %v", op, err)
+		}
+	}
+	if err := store.Record(func() *FSState { return state }, ops); err != nil {
+		t.Fatalf("Failed to record ops: %v", err)
+	}
+}
+
+func TestJournalStore(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	t.Run("Replay", func(t *testing.T) {
+		store, state := openJournalStore(t, statePath, 100)
+		applyAndRecord(t, store, state,
+			Op{Kind: OpMkdir, Path: "/movies"},
+			Op{Kind: OpMap, Source: "movie.mkv", Path: "/movies/Movie.mkv"},
+			Op{Kind: OpSetXattr, Source: "movie.mkv", Name: "user.tag", Value: []byte("tag")},
+		)
+		applyAndRecord(t, store, state,
+			Op{Kind: OpRenameDir, Path: "/movies", NewPath: "/films"},
+		)
+		store.Close()
+
+		store, state = openJournalStore(t, statePath, 100)
+		defer store.Close()
+
+		if !state.Directories["/films"] || state.Directories["/movies"] {
+			t.Errorf("Expected renamed directory after replay, got %v", state.Directories)
+		}
+		mapping := state.Mappings["movie.mkv"]
+		if !mapping.HasVirtualPath("/films/Movie.mkv") {
+			t.Errorf("Expected replayed mapping, got %q", mapping.VirtualPaths)
+		}
+		if string(mapping.Xattrs["user.tag"]) != "tag" {
+			t.Error("Expected replayed xattr")
+		}
+	})
+
+	t.Run("TornTail", func(t *testing.T) {
+		f, err := os.OpenFile(statePath+".journal", os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatalf("Failed to open journal: %v", err)
+		}
+		if _, err := f.WriteString(`1234abcd {"seq":99,"op":"mkdir","pa`); err != nil {
+			t.Fatalf("Failed to write torn record: %v", err)
+		}
+		f.Close()
+
+		store, state := openJournalStore(t, statePath, 100)
+		if !state.Mappings["movie.mkv"].HasVirtualPath("/films/Movie.mkv") {
+			t.Error("Expected intact records to survive a torn tail")
+		}
+
+		applyAndRecord(t, store, state, Op{Kind: OpMkdir, Path: "/tv"})
+		store.Close()
+
+		store, state = openJournalStore(t, statePath, 100)
+		defer store.Close()
+		if !state.Directories["/tv"] {
+			t.Error("Expected records appended after dropping a torn tail to replay")
+		}
+	})
+
+	t.Run("Compaction", func(t *testing.T) {
+		store, state := openJournalStore(t, statePath, 2)
+		applyAndRecord(t, store, state,
+			Op{Kind: OpMkdir, Path: "/a"},
+			Op{Kind: OpMkdir, Path: "/b"},
+		)
+
+		info, err := os.Stat(statePath + ".journal")
+		if err != nil {
+			t.Fatalf("Failed to stat journal: %v", err)
+		}
+		if info.Size() != 0 {
+			t.Errorf("Expected journal to be truncated after compaction, got %d bytes", info.Size())
+		}
+
+		snapshot, err := ReadState(statePath)
+		if err != nil {
+			t.Fatalf("Failed to read snapshot: %v", err)
+		}
+		if !snapshot.Directories["/b"] || !snapshot.Directories["/tv"] {
+			t.Errorf("Expected snapshot to contain all changes, got %v", snapshot.Directories)
+		}
+		if snapshot.JournalSeq == 0 {
+			t.Error("Expected snapshot to record the journal sequence it includes")
+		}
+		store.Close()
+	})
+
+	t.Run("FailedAppend", func(t *testing.T) {
+		store, state := openJournalStore(t, statePath, 100)
+		applyAndRecord(t, store, state, Op{Kind: OpMkdir, Path: "/c"})
+
+		// A read-only handle fails both the append and cutting it back
+		file := store.file
+		readOnly, err := os.Open(statePath + ".journal")
+		if err != nil {
+			t.Fatalf("Failed to open journal: %v", err)
+		}
+		store.file = readOnly
+		op := Op{Kind: OpMkdir, Path: "/d"}
+		if err := state.Apply(op); err != nil {
+			t.Fatalf("Failed to apply %s: %v", op, err)
+		}
+		if err := store.Record(func() *FSState { return state }, []Op{op}); err == nil {
+			t.Fatal("Expected appending to a read-only journal to fail")
+		}
+		readOnly.Close()
+		store.file = file
+
+		// The next change writes a snapshot instead of appending after what
+		// may be a torn record
+		applyAndRecord(t, store, state, Op{Kind: OpMkdir, Path: "/e"})
+		if info, err := os.Stat(statePath + ".journal"); err != nil || info.Size() != 0 {
+			t.Errorf("Expected the journal to be replaced by a snapshot, got %v (%v)", info, err)
+		}
+		store.Close()
+
+		store, state = openJournalStore(t, statePath, 100)
+		defer store.Close()
+		for _, dir := range []string{"/c", "/d", "/e"} {
+			if !state.Directories[dir] {
+				t.Errorf("Expected %s to survive a failed append", dir)
+			}
+		}
+	})
+}
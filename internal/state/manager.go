@@ -6,9 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"sort"
 	"sync"
-	"time"
 
 	"vmapfs/internal/logging"
 )
@@ -17,16 +15,22 @@ var (
 	logger = logging.GetLogger().WithPrefix("state")
 )
 
-// Manager handles loading and saving filesystem state
+// Manager handles loading and saving filesystem state.
+// It holds an exclusive lock on the state file for its whole lifetime, so
+// only one Manager (and so one vmapfs process) can use a state file at a time.
 type Manager struct {
-	statePath   string
-	backupDir   string
-	backupCount int
-	mu          sync.RWMutex
+	statePath string
+	backupDir string
+	policy    BackupPolicy
+	lock      *fileLock
+	stamp     fileStamp // State file as last read or written
+	seen      []byte    // Contents of the state file as last read or written
+	mu        sync.RWMutex
 }
 
 // NewManager creates a new state manager for the given state file path.
-// It ensures the state directory exists and is writable.
+// It ensures the state directory exists and is writable, and fails with
+// ErrLocked if another process is already using the state file.
 func NewManager(statePath string) (*Manager, error) {
 	logger.Debug("Creating new state manager with path: %s", statePath)
 
@@ -52,27 +56,124 @@ func NewManager(statePath string) (*Manager, error) {
 		return nil, fmt.Errorf("failed to create state directory %s: %w", stateDir, mkdirErr)
 	}
 
+	lockPath := absPath + ".lock"
+	logger.Debug("Locking state file: %s", lockPath)
+	lock, lockErr := acquireLock(lockPath)
+	if lockErr != nil {
+		return nil, fmt.Errorf("cannot use state file %s: %w", absPath, lockErr)
+	}
+
 	// Try to create an empty file to verify we have write permissions
 	f, writeErr := os.OpenFile(absPath, os.O_WRONLY|os.O_CREATE, 0644)
 	if writeErr != nil {
+		lock.release()
 		return nil, fmt.Errorf("failed to create state file %s: %w", absPath, writeErr)
 	}
 	f.Close()
 
-	backupDir := filepath.Join(stateDir, ".vmapfs-backups")
+	backupDir := BackupDirFor(absPath)
 	logger.Debug("Creating backup directory: %s", backupDir)
 	if backupDirErr := os.MkdirAll(backupDir, 0755); backupDirErr != nil {
+		lock.release()
 		return nil, fmt.Errorf("failed to create backup directory %s: %w", backupDir, backupDirErr)
 	}
 
+	policy, policyErr := readBackupPolicy(backupDir)
+	if policyErr != nil {
+		logger.Warn("Ignoring unreadable backup policy: %v", policyErr)
+		policy = DefaultBackupPolicy
+	}
+
 	logger.Info("State manager initialization complete")
 	return &Manager{
-		statePath:   absPath,
-		backupDir:   backupDir,
-		backupCount: 5,
+		statePath: absPath,
+		backupDir: backupDir,
+		policy:    policy,
+		lock:      lock,
 	}, nil
 }
 
+// Close releases the lock on the state file. The Manager must not be used
+// afterwards.
+func (sm *Manager) Close() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	logger.Debug("Releasing state file lock")
+	err := sm.lock.release()
+	sm.lock = nil
+	return err
+}
+
+// ReadState loads a state file without locking it, for tools that only need
+// to inspect state. The returned state is upgraded to CurrentVersion in
+// memory but never written back.
+func ReadState(statePath string) (*FSState, error) {
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("state file is empty")
+	}
+	state, _, err := parseState(data)
+	return state, err
+}
+
+// WriteState writes a state file without locking it or taking a backup,
+// for tools that produce new state files. A running instance using
+// statePath will notice the change and reload it.
+func WriteState(statePath string, state *FSState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+	if err := writeFileAtomic(statePath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// ReadStateUnrepaired loads a state file like ReadState, but keeps it as
+// stored: missing parent directories are not registered and empty mapping
+// records are not dropped, so that tools can report them.
+func ReadStateUnrepaired(statePath string) (*FSState, error) {
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("state file is empty")
+	}
+	state, _, err := decodeState(data)
+	if err != nil {
+		return nil, err
+	}
+	state.initialize()
+	return state, nil
+}
+
+// parseState decodes and normalizes state file contents. It also returns
+// the schema version the data was written with.
+func parseState(data []byte) (*FSState, int, error) {
+	state, version, err := decodeState(data)
+	if err != nil {
+		return nil, version, err
+	}
+
+	state.initialize()
+	if cleaned := state.CleanPaths(); len(cleaned) > 0 {
+		logger.Warn("Rewrote %d relative or unclean virtual paths: %v", len(cleaned), cleaned)
+	}
+	if added := state.RepairDirectories(); len(added) > 0 {
+		logger.Warn("Registered %d missing parent directories: %v", len(added), added)
+	}
+	if dropped := state.Compact(); len(dropped) > 0 {
+		logger.Info("Dropped %d empty mapping records", len(dropped))
+	}
+	return state, version, nil
+}
+
 // LoadState loads the filesystem state from disk.
 // If no state file exists, it creates a new one with default values.
 func (sm *Manager) LoadState() (*FSState, error) {
@@ -90,7 +191,7 @@ func (sm *Manager) LoadState() (*FSState, error) {
 				Directories: map[string]bool{
 					"/": true,
 				},
-				Version: 1,
+				Version: CurrentVersion,
 			}
 
 			// Marshal the initial state
@@ -101,10 +202,11 @@ func (sm *Manager) LoadState() (*FSState, error) {
 
 			// Write initial state
 			logger.Debug("Writing initial state file")
-			if readErr := os.WriteFile(sm.statePath, fileData, 0600); readErr != nil {
+			if readErr := writeFileAtomic(sm.statePath, fileData, 0600); readErr != nil {
 				return nil, fmt.Errorf("failed to write initial state: %w", readErr)
 			}
 
+			sm.remember(fileData)
 			logger.Info("Created new state file successfully")
 			return state, nil
 		}
@@ -122,32 +224,62 @@ func (sm *Manager) LoadState() (*FSState, error) {
 	}
 
 	logger.Debug("Parsing existing state file (%d bytes)", len(data))
-	var state FSState
-	if err := json.Unmarshal(data, &state); err != nil {
-		return nil, fmt.Errorf("failed to parse state file: %w", err)
+	state, version, err := parseState(data)
+	if err != nil {
+		return nil, err
 	}
+	sm.remember(data)
 
-	// Ensure required fields are initialized
-	if state.Mappings == nil {
-		state.Mappings = make(map[string]FileMapping)
-	}
-	if state.Directories == nil {
-		state.Directories = make(map[string]bool)
+	if version < CurrentVersion {
+		if err := sm.persistMigration(data, version, state); err != nil {
+			return nil, err
+		}
 	}
-	state.Directories["/"] = true
 
 	logger.Info("State loaded successfully")
-	return &state, nil
+	return state, nil
+}
+
+// persistMigration keeps a copy of the state file as it was before being
+// upgraded from version, then writes the upgraded state in its place. The
+// copy sits next to the state file rather than in the backup directory so
+// backup rotation never removes it.
+func (sm *Manager) persistMigration(original []byte, version int, state *FSState) error {
+	backupPath := fmt.Sprintf("%s.v%d.bak", sm.statePath, version)
+	logger.Info("Backing up version %d state to %s", version, backupPath)
+	if err := writeFileAtomic(backupPath, original, 0600); err != nil {
+		return fmt.Errorf("failed to back up state before migration: %w", err)
+	}
+
+	if err := sm.saveLocked(state); err != nil {
+		return fmt.Errorf("failed to write migrated state: %w", err)
+	}
+	return nil
 }
 
 // SaveState saves the current filesystem state to disk.
-// It automatically creates a backup before saving.
+// It automatically creates a backup before saving. The file is replaced
+// atomically, so a crash mid-save leaves the previous state intact. If
+// another process changed the file since it was last read, SaveState fails
+// with ErrExternalChange rather than overwrite the change.
 func (sm *Manager) SaveState(state *FSState) error {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	return sm.saveLocked(state)
+}
 
+// saveLocked implements SaveState; the caller must hold sm.mu
+func (sm *Manager) saveLocked(state *FSState) error {
 	logger.Debug("Saving state to: %s", sm.statePath)
 
+	changed, err := sm.changedLocked()
+	if err != nil {
+		return err
+	}
+	if changed {
+		return ErrExternalChange
+	}
+
 	// Create backup before saving
 	if backupErr := sm.createBackup(); backupErr != nil {
 		logger.Warn("Failed to create backup: %v", backupErr)
@@ -165,7 +297,7 @@ func (sm *Manager) SaveState(state *FSState) error {
 	}
 
 	logger.Trace("Writing %d bytes of state data", len(data))
-	if err := os.WriteFile(sm.statePath, data, 0600); err != nil {
+	if err := writeFileAtomic(sm.statePath, data, 0600); err != nil {
 		return fmt.Errorf("failed to write state file: %w", err)
 	}
 
@@ -177,72 +309,18 @@ func (sm *Manager) SaveState(state *FSState) error {
 	if len(written) == 0 {
 		return fmt.Errorf("state file is empty after write")
 	}
+	sm.remember(written)
 
 	logger.Debug("State saved and verified successfully")
 	return nil
 }
 
-// createBackup creates a timestamped backup of the current state file
-func (sm *Manager) createBackup() error {
-	// Skip if state file doesn't exist yet
-	if _, err := os.Stat(sm.statePath); os.IsNotExist(err) {
-		return nil
-	}
-
-	data, err := os.ReadFile(sm.statePath)
-	if err != nil {
-		return err
-	}
-
-	timestamp := time.Now().Format("20060102-150405")
-	backupPath := filepath.Join(sm.backupDir, fmt.Sprintf("state-%s.json", timestamp))
-
-	logger.Debug("Creating backup: %s", backupPath)
-	if err := os.WriteFile(backupPath, data, 0600); err != nil {
-		return fmt.Errorf("failed to write backup: %w", err)
-	}
-
-	return sm.cleanupOldBackups()
+// Record persists ops by saving the full state, which already contains them
+func (sm *Manager) Record(current func() *FSState, _ []Op) error {
+	return sm.SaveState(current())
 }
 
-// cleanupOldBackups removes old backup files, keeping only the most recent ones
-func (sm *Manager) cleanupOldBackups() error {
-	entries, err := os.ReadDir(sm.backupDir)
-	if err != nil {
-		return err
-	}
-
-	type backup struct {
-		path    string
-		modTime time.Time
-	}
-
-	backups := make([]backup, 0, len(entries))
-	for _, entry := range entries {
-		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".json" {
-			info, err := entry.Info()
-			if err != nil {
-				continue
-			}
-			backups = append(backups, backup{
-				path:    filepath.Join(sm.backupDir, entry.Name()),
-				modTime: info.ModTime(),
-			})
-		}
-	}
-
-	// Sort by modification time, newest first
-	sort.Slice(backups, func(i, j int) bool {
-		return backups[i].modTime.After(backups[j].modTime)
-	})
-
-	// Remove old backups
-	for i := sm.backupCount; i < len(backups); i++ {
-		logger.Debug("Removing old backup: %s", backups[i].path)
-		if err := os.Remove(backups[i].path); err != nil {
-			return fmt.Errorf("failed to remove old backup %s: %w", backups[i].path, err)
-		}
-	}
-
-	return nil
+// Path returns the absolute path of the state file
+func (sm *Manager) Path() string {
+	return sm.statePath
 }
@@ -0,0 +1,128 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManagerLocking(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	first, err := NewManager(statePath)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+
+	if _, err := NewManager(statePath); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked for a second manager, got %v", err)
+	} else if !strings.Contains(err.Error(), statePath) {
+		t.Errorf("Expected the error to name the state file, got %q", err.Error())
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatalf("Failed to close manager: %v", err)
+	}
+
+	second, err := NewManager(statePath)
+	if err != nil {
+		t.Fatalf("Expected a manager to be allowed after Close, got %v", err)
+	}
+	second.Close()
+}
+
+func TestSaveStateAtomic(t *testing.T) {
+	stateDir := t.TempDir()
+	statePath := filepath.Join(stateDir, "state.json")
+
+	manager, err := NewManager(statePath)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	state, err := manager.LoadState()
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+
+	state.Directories["/movies"] = true
+	state.Mappings["movie.mkv"] = FileMapping{VirtualPaths: []string{"/movies/Movie.mkv"}}
+	if err := manager.SaveState(state); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		t.Fatalf("Failed to read state directory: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp-") {
+			t.Errorf("Expected no temporary files after save, found %q", entry.Name())
+		}
+	}
+
+	info, err := os.Stat(statePath)
+	if err != nil {
+		t.Fatalf("Failed to stat state file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected state file mode 0600, got %v", info.Mode().Perm())
+	}
+
+	loaded, err := ReadState(statePath)
+	if err != nil {
+		t.Fatalf("Failed to read saved state: %v", err)
+	}
+	if !loaded.Mappings["movie.mkv"].HasVirtualPath("/movies/Movie.mkv") {
+		t.Error("Expected saved mapping to be read back")
+	}
+}
+
+func TestExternalChange(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	manager, err := NewManager(statePath)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	state, err := manager.LoadState()
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if err := manager.SaveState(state); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+	if changed, err := manager.ExternalChange(); err != nil || changed {
+		t.Fatalf("Expected no external change after saving, got %v, %v", changed, err)
+	}
+
+	edited := state.Clone()
+	edited.Directories["/edited"] = true
+	data, _ := json.Marshal(edited)
+	if err := writeFileAtomic(statePath, data, 0600); err != nil {
+		t.Fatalf("Failed to edit state: %v", err)
+	}
+	if changed, err := manager.ExternalChange(); err != nil || !changed {
+		t.Fatalf("Expected an external change, got %v, %v", changed, err)
+	}
+	if err := manager.SaveState(state); !errors.Is(err, ErrExternalChange) {
+		t.Fatalf("Expected ErrExternalChange, got %v", err)
+	}
+
+	base, current, err := manager.ReadExternal()
+	if err != nil {
+		t.Fatalf("Failed to read external change: %v", err)
+	}
+	if base.Directories["/edited"] || !current.Directories["/edited"] {
+		t.Errorf("Expected the edit only in the current state, got base %v and current %v", base.Directories, current.Directories)
+	}
+	if err := manager.SaveState(state); err != nil {
+		t.Errorf("Expected saving to succeed once the edit was read, got %v", err)
+	}
+}
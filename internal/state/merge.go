@@ -0,0 +1,278 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ConflictKind identifies a kind of conflict found by Merge
+type ConflictKind string
+
+// Conflicts reported by Merge
+const (
+	ConflictXattr    ConflictKind = "xattr"     // Both sides changed the same xattr differently
+	ConflictPath     ConflictKind = "path"      // Both sides mapped a virtual path to different sources
+	ConflictPathType ConflictKind = "path_type" // A virtual path is a file on one side and a directory on the other
+	ConflictMove     ConflictKind = "move"      // Both sides moved or unmapped the same source differently
+)
+
+// Conflict is a change made differently on both sides of a merge
+type Conflict struct {
+	Kind   ConflictKind `json:"kind"`
+	Source string       `json:"source,omitempty"`
+	Path   string       `json:"path,omitempty"`
+	Name   string       `json:"name,omitempty"`
+	Detail string       `json:"detail"`
+}
+
+// String returns a short human readable description of the conflict
+func (c Conflict) String() string {
+	subject := c.Path
+	switch {
+	case c.Name != "":
+		subject = fmt.Sprintf("%s %s", c.Source, c.Name)
+	case subject == "":
+		subject = c.Source
+	}
+	return fmt.Sprintf("%s: %s (%s)", c.Kind, subject, c.Detail)
+}
+
+// Merge combines the changes that ours and theirs each made to base.
+// Virtual paths, xattrs and directories changed on only one side are taken
+// from that side. Where both sides changed the same thing differently ours
+// is kept and a Conflict is reported, so the result is always usable.
+func Merge(base, ours, theirs *FSState) (*FSState, []Conflict) {
+	merged := &FSState{
+		Mappings:    make(map[string]FileMapping),
+		Directories: make(map[string]bool),
+		Version:     CurrentVersion,
+		JournalSeq:  ours.JournalSeq,
+	}
+	var conflicts []Conflict
+
+	for _, dir := range unionKeys(base.Directories, ours.Directories, theirs.Directories) {
+		if merge3(base.Directories[dir], ours.Directories[dir], theirs.Directories[dir]) {
+			merged.Directories[dir] = true
+		}
+	}
+
+	sources := unionKeys(base.Mappings, ours.Mappings, theirs.Mappings)
+	for _, source := range sources {
+		b, o, t := base.Mappings[source], ours.Mappings[source], theirs.Mappings[source]
+		mapping := FileMapping{VirtualPaths: mergePaths(b.VirtualPaths, o.VirtualPaths, t.VirtualPaths)}
+		if movedApart(b.VirtualPaths, o.VirtualPaths, t.VirtualPaths) {
+			conflicts = append(conflicts, Conflict{
+				Kind:   ConflictMove,
+				Source: source,
+				Detail: fmt.Sprintf("moved to %s in ours and %s in theirs, keeping ours", describePaths(o.VirtualPaths), describePaths(t.VirtualPaths)),
+			})
+			mapping.VirtualPaths = append([]string(nil), o.VirtualPaths...)
+		}
+
+		for _, name := range unionKeys(b.Xattrs, o.Xattrs, t.Xattrs) {
+			value, present, ok := mergeXattr(b.Xattrs, o.Xattrs, t.Xattrs, name)
+			if !ok {
+				conflicts = append(conflicts, Conflict{
+					Kind:   ConflictXattr,
+					Source: source,
+					Name:   name,
+					Detail: "changed differently on both sides, keeping ours",
+				})
+			}
+			if present {
+				if mapping.Xattrs == nil {
+					mapping.Xattrs = make(map[string][]byte)
+				}
+				mapping.Xattrs[name] = value
+			}
+		}
+
+		if !mapping.IsEmpty() {
+			mapping.Fingerprint = mergeFingerprint(o.Fingerprint, t.Fingerprint)
+			mapping.History = mergeHistory(o.History, t.History)
+			merged.Mappings[source] = mapping
+		}
+	}
+
+	conflicts = append(conflicts, resolvePathClaims(merged, ours, sources)...)
+	merged.RepairDirectories()
+	merged.Compact()
+	// Both sides may have handed out the same inode numbers since base, in
+	// which case ours keep theirs and the others are numbered anew on load
+	merged.inheritInodes(ours)
+	merged.inheritInodes(theirs)
+	return merged, conflicts
+}
+
+// resolvePathClaims removes virtual paths that ended up mapped to several
+// sources, or that are also directories, reporting each as a conflict. A
+// path keeps the source ours maps it to, or the first in sorted order.
+func resolvePathClaims(merged, ours *FSState, sources []string) []Conflict {
+	var conflicts []Conflict
+	claims := make(map[string][]string)
+	for _, source := range sources {
+		for _, vpath := range merged.Mappings[source].VirtualPaths {
+			claims[vpath] = append(claims[vpath], source)
+		}
+	}
+
+	paths := make([]string, 0, len(claims))
+	for vpath := range claims {
+		paths = append(paths, vpath)
+	}
+	sort.Strings(paths)
+
+	for _, vpath := range paths {
+		claimants := claims[vpath]
+		if merged.Directories[vpath] {
+			for _, source := range claimants {
+				conflicts = append(conflicts, Conflict{
+					Kind:   ConflictPathType,
+					Source: source,
+					Path:   vpath,
+					Detail: "mapped file on one side, directory on the other, keeping the directory",
+				})
+				merged.unmapPath(source, vpath)
+			}
+			continue
+		}
+		if len(claimants) < 2 {
+			continue
+		}
+
+		keep := claimants[0]
+		for _, source := range claimants {
+			if ours.Mappings[source].HasVirtualPath(vpath) {
+				keep = source
+				break
+			}
+		}
+		for _, source := range claimants {
+			if source == keep {
+				continue
+			}
+			conflicts = append(conflicts, Conflict{
+				Kind:   ConflictPath,
+				Source: source,
+				Path:   vpath,
+				Detail: fmt.Sprintf("also mapped to %s, which is kept", keep),
+			})
+			merged.unmapPath(source, vpath)
+		}
+	}
+	return conflicts
+}
+
+// unmapPath removes a virtual path from a source's mapping
+func (s *FSState) unmapPath(source, vpath string) {
+	mapping := s.Mappings[source]
+	mapping.VirtualPaths = removeString(mapping.VirtualPaths, vpath)
+	s.putMapping(source, mapping)
+}
+
+// merge3 merges the presence of a single item: a side that changed it wins
+func merge3(base, ours, theirs bool) bool {
+	if ours != base {
+		return ours
+	}
+	return theirs
+}
+
+// mergePaths merges the virtual paths of a mapping as sets, keeping the
+// order of ours followed by the paths only theirs added
+func mergePaths(base, ours, theirs []string) []string {
+	var merged []string
+	for _, vpath := range append(append([]string(nil), ours...), theirs...) {
+		if containsString(merged, vpath) {
+			continue
+		}
+		if merge3(containsString(base, vpath), containsString(ours, vpath), containsString(theirs, vpath)) {
+			merged = append(merged, vpath)
+		}
+	}
+	return merged
+}
+
+// movedApart returns true if both sides took virtual paths of a mapping
+// away and ended up with different paths, so that merging them as sets
+// would leave the source in both places
+func movedApart(base, ours, theirs []string) bool {
+	if len(removeAll(base, ours)) == 0 || len(removeAll(base, theirs)) == 0 {
+		return false
+	}
+	return len(removeAll(ours, theirs)) > 0 || len(removeAll(theirs, ours)) > 0
+}
+
+// removeAll returns the entries of list that are not in other
+func removeAll(list, other []string) []string {
+	var rest []string
+	for _, item := range list {
+		if !containsString(other, item) {
+			rest = append(rest, item)
+		}
+	}
+	return rest
+}
+
+// containsString returns true if list contains value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// describePaths lists virtual paths for a conflict
+func describePaths(paths []string) string {
+	if len(paths) == 0 {
+		return "(unmapped)"
+	}
+	return strings.Join(paths, ", ")
+}
+
+// mergeFingerprint returns the fingerprint to keep for a merged mapping.
+// Fingerprints are only a cache, so ours is kept unless only theirs has one.
+func mergeFingerprint(ours, theirs *Fingerprint) *Fingerprint {
+	if ours == nil {
+		ours = theirs
+	}
+	if ours == nil {
+		return nil
+	}
+	fingerprint := *ours
+	return &fingerprint
+}
+
+// mergeHistory returns the source history to keep for a merged mapping:
+// the longer one, as histories only grow, or ours if they are as long
+func mergeHistory(ours, theirs []PreviousSource) []PreviousSource {
+	if len(theirs) > len(ours) {
+		ours = theirs
+	}
+	return append([]PreviousSource(nil), ours...)
+}
+
+// mergeXattr merges a single xattr, returning its value and whether it is
+// still present. ok is false if both sides changed it differently, in which
+// case ours is returned.
+func mergeXattr(base, ours, theirs map[string][]byte, name string) (value []byte, present, ok bool) {
+	b, inBase := base[name]
+	o, inOurs := ours[name]
+	t, inTheirs := theirs[name]
+	same := func(x []byte, inX bool, y []byte, inY bool) bool {
+		return inX == inY && bytes.Equal(x, y)
+	}
+
+	switch {
+	case same(o, inOurs, b, inBase):
+		return t, inTheirs, true
+	case same(t, inTheirs, b, inBase), same(o, inOurs, t, inTheirs):
+		return o, inOurs, true
+	default:
+		return o, inOurs, false
+	}
+}
@@ -0,0 +1,138 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	base := &FSState{
+		Mappings: map[string]FileMapping{
+			"a.mkv": {VirtualPaths: []string{"/movies/a.mkv"}, Xattrs: map[string][]byte{"user.tag": []byte("old")}},
+			"b.mkv": {VirtualPaths: []string{"/movies/b.mkv"}},
+			"c.mkv": {VirtualPaths: []string{"/movies/c.mkv"}},
+		},
+		Directories: map[string]bool{"/": true, "/movies": true, "/old": true},
+		Version:     CurrentVersion,
+	}
+
+	ours := base.Clone()
+	ours.Mappings["a.mkv"] = FileMapping{
+		VirtualPaths: []string{"/movies/a.mkv", "/best/a.mkv"},
+		Xattrs:       map[string][]byte{"user.tag": []byte("ours")},
+	}
+	delete(ours.Mappings, "b.mkv")
+	ours.Mappings["d.mkv"] = FileMapping{VirtualPaths: []string{"/new.mkv"}}
+	ours.Directories["/best"] = true
+
+	theirs := base.Clone()
+	theirs.Mappings["a.mkv"] = FileMapping{
+		VirtualPaths: []string{"/movies/a.mkv"},
+		Xattrs:       map[string][]byte{"user.tag": []byte("theirs"), "user.rating": []byte("5")},
+	}
+	theirs.Mappings["c.mkv"] = FileMapping{VirtualPaths: []string{"/tv/c.mkv"}}
+	theirs.Mappings["e.mkv"] = FileMapping{VirtualPaths: []string{"/new.mkv"}}
+	delete(theirs.Directories, "/old")
+
+	merged, conflicts := Merge(base, ours, theirs)
+
+	expected := map[string]FileMapping{
+		"a.mkv": {
+			VirtualPaths: []string{"/movies/a.mkv", "/best/a.mkv"},
+			Xattrs:       map[string][]byte{"user.tag": []byte("ours"), "user.rating": []byte("5")},
+		},
+		"c.mkv": {VirtualPaths: []string{"/tv/c.mkv"}},
+		"d.mkv": {VirtualPaths: []string{"/new.mkv"}},
+	}
+	if !reflect.DeepEqual(merged.Mappings, expected) {
+		t.Errorf("Unexpected merged mappings:\nexpected %v\ngot      %v", expected, merged.Mappings)
+	}
+	expectedDirs := map[string]bool{"/": true, "/movies": true, "/best": true, "/tv": true}
+	if !reflect.DeepEqual(merged.Directories, expectedDirs) {
+		t.Errorf("Expected directories %v, got %v", expectedDirs, merged.Directories)
+	}
+
+	expectedConflicts := []Conflict{
+		{Kind: ConflictXattr, Source: "a.mkv", Name: "user.tag", Detail: "changed differently on both sides, keeping ours"},
+		{Kind: ConflictPath, Source: "e.mkv", Path: "/new.mkv", Detail: "also mapped to d.mkv, which is kept"},
+	}
+	if !reflect.DeepEqual(conflicts, expectedConflicts) {
+		t.Errorf("Unexpected conflicts:\nexpected %v\ngot      %v", expectedConflicts, conflicts)
+	}
+}
+
+func TestMergeOneSided(t *testing.T) {
+	base := &FSState{
+		Mappings:    map[string]FileMapping{"a.mkv": {VirtualPaths: []string{"/a.mkv"}}},
+		Directories: map[string]bool{"/": true},
+		Version:     CurrentVersion,
+	}
+	edited := base.Clone()
+	edited.Mappings["a.mkv"] = FileMapping{VirtualPaths: []string{"/films/a.mkv"}}
+	edited.Directories["/films"] = true
+
+	for name, merge := range map[string]func() (*FSState, []Conflict){
+		"Ours":   func() (*FSState, []Conflict) { return Merge(base, edited, base) },
+		"Theirs": func() (*FSState, []Conflict) { return Merge(base, base, edited) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			merged, conflicts := merge()
+			if len(conflicts) != 0 {
+				t.Errorf("Expected no conflicts, got %v", conflicts)
+			}
+			if !Diff(edited, merged).Empty() {
+				t.Errorf("Expected the edited state, got %+v", merged)
+			}
+		})
+	}
+}
+
+func TestMergePathType(t *testing.T) {
+	base := &FSState{
+		Mappings:    map[string]FileMapping{},
+		Directories: map[string]bool{"/": true},
+		Version:     CurrentVersion,
+	}
+	ours := base.Clone()
+	ours.Directories["/x"] = true
+	theirs := base.Clone()
+	theirs.Mappings["x.mkv"] = FileMapping{VirtualPaths: []string{"/x"}}
+
+	merged, conflicts := Merge(base, ours, theirs)
+	if len(conflicts) != 1 || conflicts[0].Kind != ConflictPathType {
+		t.Fatalf("Expected a path type conflict, got %v", conflicts)
+	}
+	if !merged.Directories["/x"] || len(merged.Mappings) != 0 {
+		t.Errorf("Expected the directory to be kept, got %+v", merged)
+	}
+}
+
+func TestMergeMoveConflict(t *testing.T) {
+	base := &FSState{
+		Mappings:    map[string]FileMapping{"a.mkv": {VirtualPaths: []string{"/unsorted/a.mkv"}}},
+		Directories: map[string]bool{"/": true, "/unsorted": true},
+		Version:     CurrentVersion,
+	}
+	ours := base.Clone()
+	ours.Mappings["a.mkv"] = FileMapping{VirtualPaths: []string{"/movies/a.mkv"}}
+	theirs := base.Clone()
+	theirs.Mappings["a.mkv"] = FileMapping{VirtualPaths: []string{"/tv/a.mkv"}}
+
+	merged, conflicts := Merge(base, ours, theirs)
+	expected := []Conflict{{
+		Kind:   ConflictMove,
+		Source: "a.mkv",
+		Detail: "moved to /movies/a.mkv in ours and /tv/a.mkv in theirs, keeping ours",
+	}}
+	if !reflect.DeepEqual(conflicts, expected) {
+		t.Errorf("Unexpected conflicts:\nexpected %v\ngot      %v", expected, conflicts)
+	}
+	if paths := merged.Mappings["a.mkv"].VirtualPaths; !reflect.DeepEqual(paths, []string{"/movies/a.mkv"}) {
+		t.Errorf("Expected ours to be kept, got %v", paths)
+	}
+
+	diff := Diff(base, merged)
+	if len(diff.Mappings) != 1 || diff.Mappings[0].Kind != ChangeMoved {
+		t.Errorf("Expected the mapping to show as moved, got %+v", diff.Mappings)
+	}
+}
@@ -0,0 +1,170 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrNewerVersion indicates a state file written by a newer vmapfs
+var ErrNewerVersion = errors.New("state file was written by a newer version of vmapfs")
+
+// Migration upgrades a state document from schema version From to From+1.
+// Migrations work on the raw JSON and must only use their own copies of the
+// old and new layouts, never the current FSState types, so that they keep
+// working as the schema moves on.
+type Migration struct {
+	From        int
+	Description string
+	Apply       func(data []byte) ([]byte, error)
+}
+
+// migrations holds the registered upgrade steps, indexed by From version
+var migrations = map[int]Migration{}
+
+// registerMigration adds an upgrade step. It panics on duplicate steps,
+// which can only happen through a programming error.
+func registerMigration(m Migration) {
+	if _, exists := migrations[m.From]; exists {
+		panic(fmt.Sprintf("duplicate state migration from version %d", m.From))
+	}
+	migrations[m.From] = m
+}
+
+func init() {
+	registerMigration(Migration{
+		From:        1,
+		Description: "allow multiple virtual paths per source",
+		Apply:       migrateV1,
+	})
+	registerMigration(Migration{
+		From:        2,
+		Description: "add source fingerprints, source histories and inode numbers",
+		Apply:       migrateV2,
+	})
+}
+
+// stateVersion returns the schema version of a state document. Files
+// written before the version field existed are treated as version 1.
+func stateVersion(data []byte) (int, error) {
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return 0, fmt.Errorf("failed to parse state file: %w", err)
+	}
+	if header.Version < 1 {
+		return 1, nil
+	}
+	return header.Version, nil
+}
+
+// migrate runs every registered step needed to bring data from version
+// up to CurrentVersion.
+func migrate(data []byte, version int) ([]byte, error) {
+	if version > CurrentVersion {
+		return nil, fmt.Errorf("%w: file is version %d, this build supports up to %d", ErrNewerVersion, version, CurrentVersion)
+	}
+
+	for ; version < CurrentVersion; version++ {
+		m, exists := migrations[version]
+		if !exists {
+			return nil, fmt.Errorf("no migration from state version %d", version)
+		}
+		logger.Info("Migrating state from version %d to %d: %s", version, version+1, m.Description)
+		upgraded, err := m.Apply(data)
+		if err != nil {
+			return nil, fmt.Errorf("migration from version %d failed: %w", version, err)
+		}
+		data = upgraded
+	}
+	return data, nil
+}
+
+// decodeState parses a state file, upgrading older schema versions to
+// CurrentVersion. It also returns the version the file was written with.
+func decodeState(data []byte) (*FSState, int, error) {
+	version, err := stateVersion(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	upgraded, err := migrate(data, version)
+	if err != nil {
+		return nil, version, err
+	}
+
+	var state FSState
+	if err := json.Unmarshal(upgraded, &state); err != nil {
+		return nil, version, fmt.Errorf("failed to parse state file: %w", err)
+	}
+	state.Version = CurrentVersion
+	return &state, version, nil
+}
+
+// fileMappingV1 is the version 1 mapping record, which could only hold a
+// single virtual path per source.
+type fileMappingV1 struct {
+	VirtualPath string            `json:"virtual_path"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// fsStateV1 is the version 1 state file layout
+type fsStateV1 struct {
+	Mappings    map[string]fileMappingV1 `json:"mappings"`
+	Directories map[string]bool          `json:"directories"`
+	Version     int                      `json:"version"`
+}
+
+// fileMappingV2 is the version 2 mapping record
+type fileMappingV2 struct {
+	VirtualPaths []string          `json:"virtual_paths,omitempty"`
+	Xattrs       map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// fsStateV2 is the version 2 state file layout
+type fsStateV2 struct {
+	Mappings    map[string]fileMappingV2 `json:"mappings"`
+	Directories map[string]bool          `json:"directories"`
+	Version     int                      `json:"version"`
+}
+
+// migrateV1 converts a version 1 state, where each source had exactly one
+// virtual_path, to the multi-path layout.
+func migrateV1(data []byte) ([]byte, error) {
+	var old fsStateV1
+	if err := json.Unmarshal(data, &old); err != nil {
+		return nil, err
+	}
+
+	upgraded := fsStateV2{
+		Mappings:    make(map[string]fileMappingV2, len(old.Mappings)),
+		Directories: old.Directories,
+		Version:     2,
+	}
+	for source, mapping := range old.Mappings {
+		migrated := fileMappingV2{Xattrs: mapping.Xattrs}
+		if mapping.VirtualPath != "" {
+			migrated.VirtualPaths = []string{mapping.VirtualPath}
+		}
+		upgraded.Mappings[source] = migrated
+	}
+
+	logger.Debug("Migrated %d mappings from version 1", len(upgraded.Mappings))
+	return json.Marshal(upgraded)
+}
+
+// migrateV2 upgrades a version 2 state. Version 3 only adds optional
+// fields (fingerprints and histories of mapping records, inode numbers),
+// which are filled in as the filesystem runs, so the document is kept as it
+// is, unknown fields included, and only its version changes. The bump keeps
+// older builds, which would drop the new fields on their next save, from
+// loading version 3 files.
+func migrateV2(data []byte) ([]byte, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	doc["version"] = json.RawMessage("3")
+	return json.Marshal(doc)
+}
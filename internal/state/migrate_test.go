@@ -0,0 +1,164 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadStateMigratesV1(t *testing.T) {
+	stateDir := t.TempDir()
+	statePath := filepath.Join(stateDir, "state.json")
+
+	v1 := `{
+  "mappings": {
+    "movie.mkv": {"virtual_path": "/movies/Movie.mkv", "xattrs": {"user.tag": "dGFn"}},
+    "tagged.mkv": {"virtual_path": "", "xattrs": {"user.tag": "dGFn"}}
+  },
+  "directories": {"/": true, "/movies": true},
+  "version": 1
+}`
+	if err := os.WriteFile(statePath, []byte(v1), 0600); err != nil {
+		t.Fatalf("Failed to write state: %v", err)
+	}
+
+	manager, err := NewManager(statePath)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	state, err := manager.LoadState()
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+
+	if state.Version != CurrentVersion {
+		t.Errorf("Expected version %d, got %d", CurrentVersion, state.Version)
+	}
+
+	movie := state.Mappings["movie.mkv"]
+	if len(movie.VirtualPaths) != 1 || movie.VirtualPaths[0] != "/movies/Movie.mkv" {
+		t.Errorf("Expected migrated virtual path, got %q", movie.VirtualPaths)
+	}
+	if string(movie.Xattrs["user.tag"]) != "tag" {
+		t.Errorf("Expected xattrs to be preserved, got %q", movie.Xattrs["user.tag"])
+	}
+
+	tagged := state.Mappings["tagged.mkv"]
+	if len(tagged.VirtualPaths) != 0 {
+		t.Errorf("Expected unmapped source to have no virtual paths, got %q", tagged.VirtualPaths)
+	}
+	if string(tagged.Xattrs["user.tag"]) != "tag" {
+		t.Error("Expected xattr-only mapping to be preserved")
+	}
+
+	backup, err := os.ReadFile(statePath + ".v1.bak")
+	if err != nil {
+		t.Fatalf("Expected pre-migration backup: %v", err)
+	}
+	if string(backup) != v1 {
+		t.Error("Pre-migration backup does not match the original file")
+	}
+
+	onDisk, err := ReadState(statePath)
+	if err != nil {
+		t.Fatalf("Failed to read migrated state: %v", err)
+	}
+	if len(onDisk.Mappings["movie.mkv"].VirtualPaths) != 1 {
+		t.Error("Expected migrated state to be written back")
+	}
+}
+
+func TestLoadStateMigratesV2(t *testing.T) {
+	stateDir := t.TempDir()
+	statePath := filepath.Join(stateDir, "state.json")
+
+	v2 := `{
+  "mappings": {
+    "movie.mkv": {"virtual_paths": ["/movies/Movie.mkv"], "xattrs": {"user.tag": "dGFn"}}
+  },
+  "directories": {"/": true, "/movies": true},
+  "version": 2,
+  "journal_seq": 7
+}`
+	if err := os.WriteFile(statePath, []byte(v2), 0600); err != nil {
+		t.Fatalf("Failed to write state: %v", err)
+	}
+
+	manager, err := NewManager(statePath)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	state, err := manager.LoadState()
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if state.Version != CurrentVersion || state.JournalSeq != 7 {
+		t.Errorf("Expected version %d with journal sequence 7, got %d and %d", CurrentVersion, state.Version, state.JournalSeq)
+	}
+	movie := state.Mappings["movie.mkv"]
+	if !movie.HasVirtualPath("/movies/Movie.mkv") || string(movie.Xattrs["user.tag"]) != "tag" {
+		t.Errorf("Expected the mapping to be kept, got %+v", movie)
+	}
+
+	if _, err := os.Stat(statePath + ".v2.bak"); err != nil {
+		t.Errorf("Expected pre-migration backup: %v", err)
+	}
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		t.Fatalf("Failed to read state: %v", err)
+	}
+	if version, _ := stateVersion(data); version != CurrentVersion {
+		t.Errorf("Expected the file to be written back as version %d, got %d", CurrentVersion, version)
+	}
+}
+
+func TestLoadStateUnversioned(t *testing.T) {
+	data := []byte(`{"mappings": {"a.mkv": {"virtual_path": "/a.mkv"}}, "directories": {"/": true}}`)
+
+	state, version, err := decodeState(data)
+	if err != nil {
+		t.Fatalf("Failed to decode state: %v", err)
+	}
+	if version != 1 {
+		t.Errorf("Expected unversioned state to be treated as version 1, got %d", version)
+	}
+	if !state.Mappings["a.mkv"].HasVirtualPath("/a.mkv") {
+		t.Error("Expected unversioned mapping to be migrated")
+	}
+}
+
+func TestLoadStateRefusesNewerVersion(t *testing.T) {
+	stateDir := t.TempDir()
+	statePath := filepath.Join(stateDir, "state.json")
+
+	newer := []byte(`{"mappings": {}, "directories": {"/": true}, "version": 99}`)
+	if err := os.WriteFile(statePath, newer, 0600); err != nil {
+		t.Fatalf("Failed to write state: %v", err)
+	}
+
+	manager, err := NewManager(statePath)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	if _, err := manager.LoadState(); !errors.Is(err, ErrNewerVersion) {
+		t.Fatalf("Expected ErrNewerVersion, got %v", err)
+	}
+	if _, err := ReadState(statePath); !errors.Is(err, ErrNewerVersion) {
+		t.Fatalf("Expected ErrNewerVersion from ReadState, got %v", err)
+	}
+
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		t.Fatalf("Failed to read state: %v", err)
+	}
+	if string(data) != string(newer) {
+		t.Error("State from a newer version must not be modified")
+	}
+}
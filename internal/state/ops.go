@@ -0,0 +1,227 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OpKind identifies the kind of a state mutation
+type OpKind string
+
+// Mutations that can be applied to an FSState
+const (
+	OpMap         OpKind = "map"         // Add Path as a virtual path of Source
+	OpUnmap       OpKind = "unmap"       // Remove Path from the virtual paths of Source
+	OpMove        OpKind = "move"        // Replace Source's virtual path Path with NewPath
+	OpMkdir       OpKind = "mkdir"       // Register directory Path and its parents
+	OpRmdir       OpKind = "rmdir"       // Unregister directory Path
+	OpRenameDir   OpKind = "rename_dir"  // Move directory Path and everything below it to NewPath
+	OpSetXattr    OpKind = "setxattr"    // Set xattr Name of Source to Value
+	OpRemoveXattr OpKind = "rmxattr"     // Remove xattr Name from Source
+	OpForget      OpKind = "forget"      // Drop the whole mapping record of Source
+	OpRelink      OpKind = "relink"      // Move the whole mapping record of Source to NewSource
+	OpFingerprint OpKind = "fingerprint" // Set the fingerprint of Source to Fingerprint
+	OpRetarget    OpKind = "retarget"    // Move the mapping record of Source to NewSource, setting its History and Fingerprint
+	OpInode       OpKind = "inode"       // Set the inode of Source's record, or of directory Path if Source is empty, to Inode
+)
+
+// Op is a single mutation of the filesystem state. Ops are recorded by the
+// filesystem as it changes state, so that they can be journaled and replayed.
+type Op struct {
+	Kind    OpKind `json:"op"`
+	Source  string `json:"source,omitempty"`
+	Path    string `json:"path,omitempty"`
+	NewPath string `json:"new_path,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Value   []byte `json:"value,omitempty"`
+	// NewSource is the source path a relink or retarget moves a mapping
+	// record to. Path then names the virtual path it was made for, for the
+	// audit log.
+	NewSource string `json:"new_source,omitempty"`
+	// Fingerprint is the fingerprint set by a fingerprint or retarget op,
+	// nil to clear it
+	Fingerprint *Fingerprint `json:"fingerprint,omitempty"`
+	// History is the source history a retarget op leaves the record with
+	History []PreviousSource `json:"history,omitempty"`
+	// Inode is the inode number set by an inode op, zero to clear it
+	Inode uint64 `json:"inode,omitempty"`
+}
+
+// String returns a short human readable description of the op
+func (op Op) String() string {
+	switch op.Kind {
+	case OpMove, OpRenameDir:
+		return fmt.Sprintf("%s %s -> %s", op.Kind, op.Path, op.NewPath)
+	case OpSetXattr, OpRemoveXattr:
+		return fmt.Sprintf("%s %s %s", op.Kind, op.Source, op.Name)
+	case OpMap, OpUnmap:
+		return fmt.Sprintf("%s %s -> %s", op.Kind, op.Path, op.Source)
+	case OpForget, OpFingerprint:
+		return fmt.Sprintf("%s %s", op.Kind, op.Source)
+	case OpInode:
+		if op.Source != "" {
+			return fmt.Sprintf("%s %s %d", op.Kind, op.Source, op.Inode)
+		}
+		return fmt.Sprintf("%s %s %d", op.Kind, op.Path, op.Inode)
+	case OpRelink, OpRetarget:
+		return fmt.Sprintf("%s %s -> %s", op.Kind, op.Source, op.NewSource)
+	default:
+		return fmt.Sprintf("%s %s", op.Kind, op.Path)
+	}
+}
+
+// Apply performs op on the state
+func (s *FSState) Apply(op Op) error {
+	switch op.Kind {
+	case OpMap:
+		mapping := s.Mappings[op.Source]
+		if !mapping.HasVirtualPath(op.Path) {
+			mapping.VirtualPaths = append(mapping.VirtualPaths, op.Path)
+		}
+		s.Mappings[op.Source] = mapping
+		s.registerParents(op.Path)
+
+	case OpUnmap:
+		mapping, exists := s.Mappings[op.Source]
+		if !exists {
+			return nil
+		}
+		mapping.VirtualPaths = removeString(mapping.VirtualPaths, op.Path)
+		s.putMapping(op.Source, mapping)
+
+	case OpMove:
+		mapping, exists := s.Mappings[op.Source]
+		if !exists || !mapping.HasVirtualPath(op.Path) {
+			return fmt.Errorf("cannot move %s: not a virtual path of %s", op.Path, op.Source)
+		}
+		for i, vpath := range mapping.VirtualPaths {
+			if vpath == op.Path {
+				mapping.VirtualPaths[i] = op.NewPath
+			}
+		}
+		s.registerParents(op.NewPath)
+
+	case OpMkdir:
+		s.Directories[op.Path] = true
+		s.registerParents(op.Path)
+
+	case OpRmdir:
+		delete(s.Directories, op.Path)
+		delete(s.DirectoryInodes, op.Path)
+
+	case OpRenameDir:
+		s.renameDirectory(op.Path, op.NewPath)
+
+	case OpSetXattr:
+		mapping := s.Mappings[op.Source]
+		if mapping.Xattrs == nil {
+			mapping.Xattrs = make(map[string][]byte)
+		}
+		mapping.Xattrs[op.Name] = op.Value
+		s.Mappings[op.Source] = mapping
+
+	case OpRemoveXattr:
+		mapping, exists := s.Mappings[op.Source]
+		if !exists || mapping.Xattrs == nil {
+			return nil
+		}
+		delete(mapping.Xattrs, op.Name)
+		if len(mapping.Xattrs) == 0 {
+			mapping.Xattrs = nil
+		}
+		s.putMapping(op.Source, mapping)
+
+	case OpForget:
+		delete(s.Mappings, op.Source)
+
+	case OpRelink, OpRetarget:
+		mapping, exists := s.Mappings[op.Source]
+		if !exists {
+			return fmt.Errorf("cannot %s %s: no mapping record", op.Kind, op.Source)
+		}
+		if _, taken := s.Mappings[op.NewSource]; taken {
+			return fmt.Errorf("cannot %s %s: %s already has a mapping record", op.Kind, op.Source, op.NewSource)
+		}
+		if op.Kind == OpRetarget {
+			mapping.History = append([]PreviousSource(nil), op.History...)
+			mapping.Fingerprint = op.Fingerprint
+		}
+		delete(s.Mappings, op.Source)
+		s.Mappings[op.NewSource] = mapping
+
+	case OpFingerprint:
+		mapping, exists := s.Mappings[op.Source]
+		if !exists {
+			return nil
+		}
+		mapping.Fingerprint = op.Fingerprint
+		s.Mappings[op.Source] = mapping
+
+	case OpInode:
+		s.applyInode(op)
+
+	default:
+		return fmt.Errorf("unknown state operation %q", op.Kind)
+	}
+	return nil
+}
+
+// putMapping stores mapping for source, dropping the record if it is empty
+func (s *FSState) putMapping(source string, mapping FileMapping) {
+	if mapping.IsEmpty() {
+		delete(s.Mappings, source)
+		return
+	}
+	s.Mappings[source] = mapping
+}
+
+// renameDirectory moves a directory and every directory and mapping below it
+func (s *FSState) renameDirectory(oldDir, newDir string) {
+	oldPrefix := oldDir + "/"
+	rename := func(vpath string) (string, bool) {
+		if vpath == oldDir {
+			return newDir, true
+		}
+		if strings.HasPrefix(vpath, oldPrefix) {
+			return newDir + "/" + strings.TrimPrefix(vpath, oldPrefix), true
+		}
+		return vpath, false
+	}
+
+	var moved []string
+	for dir := range s.Directories {
+		if _, ok := rename(dir); ok {
+			moved = append(moved, dir)
+		}
+	}
+	for _, dir := range moved {
+		delete(s.Directories, dir)
+	}
+	for _, dir := range moved {
+		newPath, _ := rename(dir)
+		s.Directories[newPath] = true
+	}
+
+	for _, mapping := range s.Mappings {
+		for i, vpath := range mapping.VirtualPaths {
+			if newPath, ok := rename(vpath); ok {
+				mapping.VirtualPaths[i] = newPath
+			}
+		}
+	}
+	s.renameDirectoryInodes(oldDir, newDir)
+	s.registerParents(newDir)
+}
+
+func removeString(list []string, value string) []string {
+	for i, item := range list {
+		if item == value {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
@@ -0,0 +1,198 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Problems reported by Rebase
+const (
+	ProblemSourceCollision ProblemKind = "source_collision" // New source path is already a mapped source
+)
+
+// RebaseOptions control Rebase
+type RebaseOptions struct {
+	// From is the prefix of the source paths to rewrite. Each of its
+	// segments may be a glob pattern, as understood by path.Match.
+	From string
+	// To replaces the part of a source path matched by From
+	To string
+	// SourceRoot is the source tree every new source path must exist in
+	SourceRoot string
+	// Partial rebases the sources that can be when some can't
+	Partial bool
+}
+
+// Rebased is a source path rewritten by Rebase
+type Rebased struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// RebaseReport describes what a rebase found and changed
+type RebaseReport struct {
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Matched    int       `json:"matched"`
+	Rebased    []Rebased `json:"rebased"`
+	Missing    []Problem `json:"missing"`
+	Collisions []Problem `json:"collisions"`
+	Applied    bool      `json:"applied"`
+}
+
+// Rebase rewrites the source paths under one prefix to another, for when
+// the layout of the source tree changed underneath the state. A mapping
+// keeps its virtual paths and xattrs under its new source path. Sources
+// whose new path does not exist in the source root are missing, and those
+// whose new path is already taken by another source are collisions; either
+// prevents the rebase unless Partial is set, in which case those sources
+// keep their old path. The returned state is nil if nothing was rebased.
+func (s *FSState) Rebase(opts RebaseOptions) (*FSState, RebaseReport, error) {
+	report := RebaseReport{
+		From:       opts.From,
+		To:         opts.To,
+		Rebased:    []Rebased{},
+		Missing:    []Problem{},
+		Collisions: []Problem{},
+	}
+
+	from, err := splitPrefix(opts.From)
+	if err != nil {
+		return nil, report, fmt.Errorf("invalid -from: %w", err)
+	}
+	if len(from) == 0 {
+		return nil, report, fmt.Errorf("the prefix to rebase from is empty")
+	}
+	for _, pattern := range from {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, report, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	to, err := splitPrefix(opts.To)
+	if err != nil {
+		return nil, report, fmt.Errorf("invalid -to: %w", err)
+	}
+	if info, err := os.Stat(opts.SourceRoot); err != nil {
+		return nil, report, fmt.Errorf("cannot verify against source root: %w", err)
+	} else if !info.IsDir() {
+		return nil, report, fmt.Errorf("source root %s is not a directory", opts.SourceRoot)
+	}
+
+	var candidates []Rebased
+	for _, source := range unionKeys(s.Mappings) {
+		rebased, ok := rebasePath(source, from, to)
+		if !ok {
+			continue
+		}
+		report.Matched++
+		if rebased != source {
+			candidates = append(candidates, Rebased{Old: source, New: rebased})
+		}
+	}
+
+	// A new path may be taken by a source that is itself being rebased away
+	leaving := make(map[string]bool, len(candidates))
+	for _, c := range candidates {
+		leaving[c.Old] = true
+	}
+	claimed := make(map[string]string, len(candidates))
+	for _, c := range candidates {
+		problem := func(kind ProblemKind, detail string) Problem {
+			return Problem{Kind: kind, Source: c.Old, Detail: detail}
+		}
+		if owner, taken := claimed[c.New]; taken {
+			report.Collisions = append(report.Collisions, problem(ProblemSourceCollision,
+				fmt.Sprintf("%s is also the new path of %s", c.New, owner)))
+			continue
+		}
+		if _, exists := s.Mappings[c.New]; exists && !leaving[c.New] {
+			report.Collisions = append(report.Collisions, problem(ProblemSourceCollision,
+				fmt.Sprintf("%s is already mapped", c.New)))
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(opts.SourceRoot, c.New))
+		switch {
+		case os.IsNotExist(err):
+			report.Missing = append(report.Missing, problem(ProblemMissingSource,
+				fmt.Sprintf("%s does not exist", c.New)))
+			continue
+		case err != nil:
+			return nil, report, fmt.Errorf("cannot check source %s: %w", c.New, err)
+		case info.IsDir():
+			report.Missing = append(report.Missing, problem(ProblemDirectoryMapping,
+				fmt.Sprintf("%s is a directory", c.New)))
+			continue
+		}
+		claimed[c.New] = c.Old
+		report.Rebased = append(report.Rebased, c)
+	}
+
+	// A source that keeps its path because it can't be rebased is still
+	// in the way of the source whose new path it is
+	for blocked := true; blocked; {
+		blocked = false
+		moving := make(map[string]bool, len(report.Rebased))
+		for _, r := range report.Rebased {
+			moving[r.Old] = true
+		}
+		kept := report.Rebased[:0]
+		for _, r := range report.Rebased {
+			if leaving[r.New] && !moving[r.New] {
+				report.Collisions = append(report.Collisions, Problem{
+					Kind:   ProblemSourceCollision,
+					Source: r.Old,
+					Detail: fmt.Sprintf("%s is already mapped and can't be rebased", r.New),
+				})
+				blocked = true
+				continue
+			}
+			kept = append(kept, r)
+		}
+		report.Rebased = kept
+	}
+
+	if len(report.Rebased) == 0 || (!opts.Partial && (len(report.Missing) > 0 || len(report.Collisions) > 0)) {
+		return nil, report, nil
+	}
+
+	result := s.Clone()
+	for _, r := range report.Rebased {
+		delete(result.Mappings, r.Old)
+	}
+	for _, r := range report.Rebased {
+		result.Mappings[r.New] = s.Mappings[r.Old].Clone()
+	}
+	return result, report, nil
+}
+
+// splitPrefix splits a source path prefix into its segments, rejecting
+// prefixes that leave the source root
+func splitPrefix(prefix string) ([]string, error) {
+	cleaned := path.Clean(strings.Trim(filepath.ToSlash(prefix), "/"))
+	if cleaned == "." {
+		return nil, nil
+	}
+	if escapesRoot(cleaned) {
+		return nil, fmt.Errorf("%s is outside the source root", prefix)
+	}
+	return strings.Split(cleaned, "/"), nil
+}
+
+// rebasePath replaces the leading segments of source that match from with
+// to, and returns false if they don't match
+func rebasePath(source string, from, to []string) (string, bool) {
+	segments := strings.Split(source, "/")
+	if len(segments) < len(from) {
+		return "", false
+	}
+	for i, pattern := range from {
+		if matched, _ := path.Match(pattern, segments[i]); !matched {
+			return "", false
+		}
+	}
+	rebased := append(append([]string(nil), to...), segments[len(from):]...)
+	return path.Join(rebased...), len(rebased) > 0
+}
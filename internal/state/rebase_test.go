@@ -0,0 +1,137 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRebase(t *testing.T) {
+	sourceRoot := t.TempDir()
+	for _, name := range []string{"torrents/a.mkv", "torrents/show/b.mkv", "zurg/x/c.mkv", "zurg/y/c.mkv"} {
+		full := filepath.Join(sourceRoot, name)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(full, []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	newState := func() *FSState {
+		return &FSState{
+			Mappings: map[string]FileMapping{
+				"__all__/a.mkv":      {VirtualPaths: []string{"/movies/a.mkv"}, Xattrs: map[string][]byte{"user.tag": []byte("a")}},
+				"__all__/show/b.mkv": {VirtualPaths: []string{"/shows/b.mkv"}},
+				"__all__/gone.mkv":   {VirtualPaths: []string{"/movies/gone.mkv"}},
+				"other/a.mkv":        {VirtualPaths: []string{"/other/a.mkv"}},
+			},
+			Directories: map[string]bool{"/": true},
+			Version:     CurrentVersion,
+		}
+	}
+
+	t.Run("Missing", func(t *testing.T) {
+		original := newState()
+		opts := RebaseOptions{From: "__all__", To: "torrents", SourceRoot: sourceRoot}
+		result, report, err := original.Rebase(opts)
+		if err != nil {
+			t.Fatalf("Rebase failed: %v", err)
+		}
+		if result != nil {
+			t.Error("Expected a missing source to prevent the rebase")
+		}
+		if report.Matched != 3 || len(report.Rebased) != 2 || len(report.Missing) != 1 || report.Missing[0].Source != "__all__/gone.mkv" {
+			t.Errorf("Unexpected report: %+v", report)
+		}
+
+		opts.Partial = true
+		result, _, err = original.Rebase(opts)
+		if err != nil {
+			t.Fatalf("Rebase failed: %v", err)
+		}
+		if result == nil {
+			t.Fatal("Expected a partial rebase")
+		}
+		if got := result.Mappings["torrents/a.mkv"]; !reflect.DeepEqual(got, original.Mappings["__all__/a.mkv"]) {
+			t.Errorf("Expected the mapping to move with its source, got %+v", got)
+		}
+		if _, exists := result.Mappings["torrents/show/b.mkv"]; !exists {
+			t.Error("Expected nested sources to be rebased")
+		}
+		if _, exists := result.Mappings["__all__/gone.mkv"]; !exists {
+			t.Error("Expected the missing source to keep its old path")
+		}
+		if _, exists := result.Mappings["other/a.mkv"]; !exists {
+			t.Error("Expected sources outside the prefix to be left alone")
+		}
+		if _, exists := original.Mappings["__all__/a.mkv"]; !exists {
+			t.Error("Expected Rebase to leave the original state alone")
+		}
+	})
+
+	t.Run("Glob", func(t *testing.T) {
+		original := &FSState{
+			Mappings: map[string]FileMapping{
+				"mnt/x/c.mkv":     {VirtualPaths: []string{"/c1.mkv"}},
+				"mnt/y/z/c.mkv":   {VirtualPaths: []string{"/c2.mkv"}},
+				"other/x/c.mkv":   {VirtualPaths: []string{"/c3.mkv"}},
+				"mnt/x/c.mkv.nfo": {Xattrs: map[string][]byte{"user.tag": []byte("nfo")}},
+			},
+			Directories: map[string]bool{"/": true},
+		}
+		result, report, err := original.Rebase(RebaseOptions{From: "m?t/*", To: "zurg/x", SourceRoot: sourceRoot, Partial: true})
+		if err != nil {
+			t.Fatalf("Rebase failed: %v", err)
+		}
+		if report.Matched != 3 {
+			t.Errorf("Expected 3 matches, got %d", report.Matched)
+		}
+		want := []Rebased{{Old: "mnt/x/c.mkv", New: "zurg/x/c.mkv"}}
+		if !reflect.DeepEqual(report.Rebased, want) {
+			t.Errorf("Expected %v rebased, got %v", want, report.Rebased)
+		}
+		if len(report.Missing) != 2 {
+			t.Errorf("Expected 2 missing sources, got %v", report.Missing)
+		}
+		if result == nil || !result.Mappings["zurg/x/c.mkv"].HasVirtualPath("/c1.mkv") {
+			t.Error("Expected mnt/x/c.mkv to be rebased")
+		}
+
+		if _, _, err := original.Rebase(RebaseOptions{From: "mnt/[", To: "x", SourceRoot: sourceRoot}); err == nil {
+			t.Error("Expected an invalid pattern to be rejected")
+		}
+		if _, _, err := original.Rebase(RebaseOptions{From: "mnt", To: "../x", SourceRoot: sourceRoot}); err == nil {
+			t.Error("Expected a prefix outside the source root to be rejected")
+		}
+	})
+
+	t.Run("Collisions", func(t *testing.T) {
+		original := &FSState{
+			Mappings: map[string]FileMapping{
+				"zurg/x/c.mkv": {VirtualPaths: []string{"/kept.mkv"}},
+				"a/x/c.mkv":    {VirtualPaths: []string{"/a.mkv"}},
+				"b/y/c.mkv":    {VirtualPaths: []string{"/b.mkv"}},
+				"b/z/c.mkv":    {VirtualPaths: []string{"/z.mkv"}},
+			},
+			Directories: map[string]bool{"/": true},
+		}
+		_, report, err := original.Rebase(RebaseOptions{From: "a", To: "zurg", SourceRoot: sourceRoot})
+		if err != nil {
+			t.Fatalf("Rebase failed: %v", err)
+		}
+		if len(report.Collisions) != 1 || report.Collisions[0].Source != "a/x/c.mkv" {
+			t.Errorf("Expected a collision with an existing source, got %v", report.Collisions)
+		}
+
+		// Both collapse onto the same new path
+		_, report, err = original.Rebase(RebaseOptions{From: "b/*", To: "zurg/y", SourceRoot: sourceRoot})
+		if err != nil {
+			t.Fatalf("Rebase failed: %v", err)
+		}
+		if len(report.Rebased) != 1 || len(report.Collisions) != 1 {
+			t.Errorf("Expected one rebase and one collision, got %+v", report)
+		}
+	})
+}
@@ -0,0 +1,312 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Record is one row of a state exported for bulk editing: a virtual path
+// of a source file, or a directory if Source is empty. A source mapped to
+// several paths has one record per path, with its xattrs on the first.
+// Sources that only carry xattrs have a record without a path.
+type Record struct {
+	Source string            `json:"source,omitempty"`
+	Path   string            `json:"path,omitempty"`
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// Records flattens the state into records, sorted by source. Directories
+// are only listed if nothing else is below them, as the parents of every
+// record are registered again on import.
+func (s *FSState) Records() []Record {
+	var records []Record
+
+	implied := make(map[string]bool)
+	markParents := func(vpath string) {
+		for dir := path.Dir(vpath); dir != "/" && !implied[dir]; dir = path.Dir(dir) {
+			implied[dir] = true
+		}
+	}
+	for _, mapping := range s.Mappings {
+		for _, vpath := range mapping.VirtualPaths {
+			markParents(vpath)
+		}
+	}
+	for dir := range s.Directories {
+		if dir != "/" {
+			markParents(dir)
+		}
+	}
+	for _, dir := range unionKeys(s.Directories) {
+		if dir != "/" && !implied[dir] {
+			records = append(records, Record{Path: dir})
+		}
+	}
+
+	for _, source := range unionKeys(s.Mappings) {
+		mapping := s.Mappings[source]
+		if len(mapping.VirtualPaths) == 0 {
+			records = append(records, Record{Source: source, Xattrs: mapping.Clone().Xattrs})
+			continue
+		}
+		for i, vpath := range mapping.VirtualPaths {
+			record := Record{Source: source, Path: vpath}
+			if i == 0 {
+				record.Xattrs = mapping.Clone().Xattrs
+			}
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// ImportMode selects how Import combines records with the existing state
+type ImportMode string
+
+// Import modes
+const (
+	ImportMerge   ImportMode = "merge"   // Add the records to the existing mappings
+	ImportReplace ImportMode = "replace" // The records become the whole state
+)
+
+// Problems reported by Import
+const (
+	ProblemInvalidPath      ProblemKind = "invalid_path"      // Virtual path is not usable
+	ProblemConflictingXattr ProblemKind = "conflicting_xattr" // Records of a source set an xattr differently
+	ProblemPathCollision    ProblemKind = "path_collision"    // Virtual path is already taken
+)
+
+// ImportOptions control Import
+type ImportOptions struct {
+	Mode ImportMode
+	// SourceRoot is the source tree every record's source must exist in
+	SourceRoot string
+	// Reserved are root names that cannot be used in the virtual tree
+	Reserved []string
+	// SkipCollisions imports the other records when some collide
+	SkipCollisions bool
+}
+
+// ImportReport describes what an import found and changed
+type ImportReport struct {
+	Mode       ImportMode `json:"mode"`
+	Records    int        `json:"records"`
+	Invalid    []Problem  `json:"invalid"`
+	Collisions []Problem  `json:"collisions"`
+	Changes    StateDiff  `json:"changes"`
+	Applied    bool       `json:"applied"`
+}
+
+// Import applies records to a copy of the state, as a whole or not at all.
+// Every record is validated against the source root first; if any is
+// invalid nothing is imported. Records whose virtual path is taken, by a
+// directory, by another source or by an earlier record, are collisions:
+// they prevent the import unless SkipCollisions is set, in which case only
+// they are left out. The returned state is nil if nothing was imported,
+// and the report's Changes say what the import changes either way.
+func (s *FSState) Import(records []Record, opts ImportOptions) (*FSState, ImportReport, error) {
+	report := ImportReport{
+		Mode:       opts.Mode,
+		Records:    len(records),
+		Invalid:    []Problem{},
+		Collisions: []Problem{},
+	}
+
+	var result *FSState
+	switch opts.Mode {
+	case ImportMerge:
+		result = s.Clone()
+	case ImportReplace:
+		result = &FSState{Version: CurrentVersion, JournalSeq: s.JournalSeq, NextInode: s.NextInode}
+		result.initialize()
+	default:
+		return nil, report, fmt.Errorf("unknown import mode %q", opts.Mode)
+	}
+	if info, err := os.Stat(opts.SourceRoot); err != nil {
+		return nil, report, fmt.Errorf("cannot validate against source root: %w", err)
+	} else if !info.IsDir() {
+		return nil, report, fmt.Errorf("source root %s is not a directory", opts.SourceRoot)
+	}
+
+	xattrs := make(map[string]map[string][]byte)
+	valid := make([]Record, 0, len(records))
+	for _, record := range records {
+		problem, err := validateRecord(record, opts)
+		if err != nil {
+			return nil, report, err
+		}
+		if problem != nil {
+			report.Invalid = append(report.Invalid, *problem)
+			continue
+		}
+		if record.Source != "" {
+			if conflict := collectXattrs(xattrs, record); conflict != nil {
+				report.Invalid = append(report.Invalid, *conflict)
+				continue
+			}
+		}
+		valid = append(valid, record)
+	}
+
+	// Virtual paths already taken, and directories that have to exist
+	owners := make(map[string]string)
+	for source, mapping := range result.Mappings {
+		for _, vpath := range mapping.VirtualPaths {
+			owners[vpath] = source
+		}
+	}
+	dirs := make(map[string]bool)
+	for dir := range result.Directories {
+		dirs[dir] = true
+	}
+
+	var ops []Op
+	for _, record := range valid {
+		if record.Path == "" {
+			continue
+		}
+		if detail := collision(record, owners, dirs); detail != "" {
+			report.Collisions = append(report.Collisions, Problem{
+				Kind:   ProblemPathCollision,
+				Source: record.Source,
+				Path:   record.Path,
+				Detail: detail,
+			})
+			continue
+		}
+		for dir := path.Dir(record.Path); dir != "/"; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+		if record.Source == "" {
+			dirs[record.Path] = true
+			ops = append(ops, Op{Kind: OpMkdir, Path: record.Path})
+			continue
+		}
+		owners[record.Path] = record.Source
+		ops = append(ops, Op{Kind: OpMap, Source: record.Source, Path: record.Path})
+	}
+	for _, source := range unionKeys(xattrs) {
+		for _, name := range unionKeys(xattrs[source]) {
+			ops = append(ops, Op{Kind: OpSetXattr, Source: source, Name: name, Value: xattrs[source][name]})
+		}
+	}
+
+	for _, op := range ops {
+		if err := result.Apply(op); err != nil {
+			return nil, report, fmt.Errorf("failed to apply %s: %w", op, err)
+		}
+	}
+	result.Compact()
+	report.Changes = Diff(s, result)
+
+	if len(report.Invalid) > 0 || (len(report.Collisions) > 0 && !opts.SkipCollisions) {
+		return nil, report, nil
+	}
+	result.inheritInodes(s)
+	return result, report, nil
+}
+
+// validateRecord checks a record against the source root, returning the
+// problem that makes it unusable, if any
+func validateRecord(record Record, opts ImportOptions) (*Problem, error) {
+	invalid := func(kind ProblemKind, detail string) (*Problem, error) {
+		return &Problem{Kind: kind, Source: record.Source, Path: record.Path, Detail: detail}, nil
+	}
+
+	if record.Path != "" {
+		if detail := checkVirtualPath(record.Path, opts.Reserved); detail != "" {
+			return invalid(ProblemInvalidPath, detail)
+		}
+	}
+	if record.Source == "" {
+		if record.Path == "" {
+			return invalid(ProblemInvalidPath, "record has neither a source nor a path")
+		}
+		if len(record.Xattrs) > 0 {
+			return invalid(ProblemInvalidPath, "directories cannot have xattrs")
+		}
+		return nil, nil
+	}
+
+	if escapesRoot(record.Source) || filepath.IsAbs(record.Source) {
+		return invalid(ProblemEscapingSource, "source path is outside the source root")
+	}
+	info, err := os.Lstat(filepath.Join(opts.SourceRoot, record.Source))
+	switch {
+	case os.IsNotExist(err):
+		return invalid(ProblemMissingSource, "source file does not exist")
+	case err != nil:
+		return nil, fmt.Errorf("cannot check source %s: %w", record.Source, err)
+	case info.IsDir():
+		return invalid(ProblemDirectoryMapping, "source is a directory")
+	}
+	return nil, nil
+}
+
+// checkVirtualPath returns why vpath cannot be used in the virtual tree,
+// or an empty string if it can
+func checkVirtualPath(vpath string, reserved []string) string {
+	if !strings.HasPrefix(vpath, "/") || path.Clean(vpath) != vpath {
+		return "virtual path must be absolute and clean"
+	}
+	if vpath == "/" {
+		return "virtual path is the root"
+	}
+	top := strings.SplitN(vpath[1:], "/", 2)[0]
+	for _, name := range reserved {
+		if top == name {
+			return fmt.Sprintf("%s is reserved", name)
+		}
+	}
+	return ""
+}
+
+// collectXattrs adds a record's xattrs to those of its source, returning a
+// problem if an earlier record set one of them to a different value
+func collectXattrs(xattrs map[string]map[string][]byte, record Record) *Problem {
+	collected := xattrs[record.Source]
+	for name, value := range record.Xattrs {
+		if existing, ok := collected[name]; ok && !bytes.Equal(existing, value) {
+			return &Problem{
+				Kind:   ProblemConflictingXattr,
+				Source: record.Source,
+				Path:   record.Path,
+				Detail: fmt.Sprintf("xattr %s is set differently by another record", name),
+			}
+		}
+	}
+	for name, value := range record.Xattrs {
+		if collected == nil {
+			collected = make(map[string][]byte)
+			xattrs[record.Source] = collected
+		}
+		collected[name] = value
+	}
+	return nil
+}
+
+// collision returns why a record's virtual path is taken, or an empty
+// string if the record can be imported
+func collision(record Record, owners map[string]string, dirs map[string]bool) string {
+	for dir := path.Dir(record.Path); dir != "/"; dir = path.Dir(dir) {
+		if owner, ok := owners[dir]; ok {
+			return fmt.Sprintf("parent %s is mapped to %s", dir, owner)
+		}
+	}
+	owner, taken := owners[record.Path]
+	switch {
+	case record.Source == "" && taken:
+		return fmt.Sprintf("already mapped to %s", owner)
+	case record.Source == "":
+		return ""
+	case dirs[record.Path]:
+		return "path is a directory"
+	case taken && owner != record.Source:
+		return fmt.Sprintf("already mapped to %s", owner)
+	}
+	return ""
+}
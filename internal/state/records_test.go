@@ -0,0 +1,177 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRecordsRoundTrip(t *testing.T) {
+	sourceRoot := t.TempDir()
+	for _, name := range []string{"a.mkv", "b.mkv", "c.mkv"} {
+		if err := os.WriteFile(filepath.Join(sourceRoot, name), []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to create source file: %v", err)
+		}
+	}
+	original := &FSState{
+		Mappings: map[string]FileMapping{
+			"a.mkv": {VirtualPaths: []string{"/movies/a.mkv", "/best/a.mkv"}, Xattrs: map[string][]byte{"user.tag": []byte("x")}},
+			"b.mkv": {VirtualPaths: []string{"/movies/b.mkv"}},
+			"c.mkv": {Xattrs: map[string][]byte{"user.tag": []byte("y")}},
+		},
+		Directories: map[string]bool{"/": true, "/movies": true, "/best": true, "/empty": true, "/empty/nested": true},
+		Version:     CurrentVersion,
+	}
+
+	records := original.Records()
+	expected := []Record{
+		{Path: "/empty/nested"},
+		{Source: "a.mkv", Path: "/movies/a.mkv", Xattrs: map[string][]byte{"user.tag": []byte("x")}},
+		{Source: "a.mkv", Path: "/best/a.mkv"},
+		{Source: "b.mkv", Path: "/movies/b.mkv"},
+		{Source: "c.mkv", Xattrs: map[string][]byte{"user.tag": []byte("y")}},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Unexpected records:\nexpected %+v\ngot      %+v", expected, records)
+	}
+
+	empty := &FSState{Version: CurrentVersion}
+	empty.initialize()
+	imported, report, err := empty.Import(records, ImportOptions{Mode: ImportReplace, SourceRoot: sourceRoot})
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if imported == nil {
+		t.Fatalf("Expected the import to succeed, got %+v", report)
+	}
+	if diff := Diff(original, imported); !diff.Empty() {
+		t.Errorf("Expected the state to survive a round trip, got %+v", diff)
+	}
+}
+
+func TestImport(t *testing.T) {
+	sourceRoot := t.TempDir()
+	for _, name := range []string{"a.mkv", "b.mkv", "c.mkv"} {
+		if err := os.WriteFile(filepath.Join(sourceRoot, name), []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to create source file: %v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(sourceRoot, "dir"), 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	current := &FSState{
+		Mappings: map[string]FileMapping{
+			"a.mkv": {VirtualPaths: []string{"/movies/a.mkv"}, Xattrs: map[string][]byte{"user.tag": []byte("old")}},
+		},
+		Directories: map[string]bool{"/": true, "/movies": true, "/tv": true},
+		Version:     CurrentVersion,
+	}
+	opts := ImportOptions{Mode: ImportMerge, SourceRoot: sourceRoot, Reserved: []string{"_UNSORTED"}}
+
+	t.Run("Merge", func(t *testing.T) {
+		records := []Record{
+			{Source: "a.mkv", Path: "/best/a.mkv", Xattrs: map[string][]byte{"user.rating": []byte("5")}},
+			{Source: "b.mkv", Path: "/movies/b.mkv"},
+		}
+		imported, report, err := current.Import(records, opts)
+		if err != nil || imported == nil {
+			t.Fatalf("Expected the import to succeed, got %v, %+v", err, report)
+		}
+		expected := FileMapping{
+			VirtualPaths: []string{"/movies/a.mkv", "/best/a.mkv"},
+			Xattrs:       map[string][]byte{"user.tag": []byte("old"), "user.rating": []byte("5")},
+		}
+		if !reflect.DeepEqual(imported.Mappings["a.mkv"], expected) {
+			t.Errorf("Expected %+v, got %+v", expected, imported.Mappings["a.mkv"])
+		}
+		if !imported.Mappings["b.mkv"].HasVirtualPath("/movies/b.mkv") || !imported.Directories["/best"] {
+			t.Errorf("Expected the new mapping and its directory, got %+v", imported)
+		}
+		if len(current.Mappings) != 1 {
+			t.Error("Expected the current state to be left alone")
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		records := []Record{
+			{Source: "b.mkv", Path: "/movies/b.mkv"},
+			{Source: "missing.mkv", Path: "/movies/missing.mkv"},
+			{Source: "../etc/passwd", Path: "/passwd"},
+			{Source: "dir", Path: "/dir"},
+			{Source: "c.mkv", Path: "movies/c.mkv"},
+			{Source: "c.mkv", Path: "/_UNSORTED/c.mkv"},
+		}
+		imported, report, err := current.Import(records, opts)
+		if err != nil {
+			t.Fatalf("Import failed: %v", err)
+		}
+		if imported != nil {
+			t.Error("Expected nothing to be imported")
+		}
+		var kinds []ProblemKind
+		for _, p := range report.Invalid {
+			kinds = append(kinds, p.Kind)
+		}
+		expected := []ProblemKind{ProblemMissingSource, ProblemEscapingSource, ProblemDirectoryMapping, ProblemInvalidPath, ProblemInvalidPath}
+		if !reflect.DeepEqual(kinds, expected) {
+			t.Errorf("Expected problems %v, got %v", expected, kinds)
+		}
+	})
+
+	t.Run("Collisions", func(t *testing.T) {
+		records := []Record{
+			{Source: "b.mkv", Path: "/movies/a.mkv"},
+			{Source: "b.mkv", Path: "/tv"},
+			{Source: "b.mkv", Path: "/movies/b.mkv"},
+			{Source: "c.mkv", Path: "/movies/b.mkv"},
+			{Source: "c.mkv", Path: "/movies/b.mkv/c.mkv"},
+			{Source: "c.mkv", Path: "/movies/c.mkv"},
+		}
+		imported, report, err := current.Import(records, opts)
+		if err != nil {
+			t.Fatalf("Import failed: %v", err)
+		}
+		if imported != nil {
+			t.Error("Expected collisions to prevent the import")
+		}
+		var details []string
+		for _, p := range report.Collisions {
+			details = append(details, p.Path+": "+p.Detail)
+		}
+		expected := []string{
+			"/movies/a.mkv: already mapped to a.mkv",
+			"/tv: path is a directory",
+			"/movies/b.mkv: already mapped to b.mkv",
+			"/movies/b.mkv/c.mkv: parent /movies/b.mkv is mapped to b.mkv",
+		}
+		if !reflect.DeepEqual(details, expected) {
+			t.Errorf("Unexpected collisions:\nexpected %q\ngot      %q", expected, details)
+		}
+
+		opts := opts
+		opts.SkipCollisions = true
+		imported, _, err = current.Import(records, opts)
+		if err != nil || imported == nil {
+			t.Fatalf("Expected the import to skip collisions, got %v", err)
+		}
+		if !reflect.DeepEqual(imported.Mappings["b.mkv"].VirtualPaths, []string{"/movies/b.mkv"}) ||
+			!reflect.DeepEqual(imported.Mappings["c.mkv"].VirtualPaths, []string{"/movies/c.mkv"}) {
+			t.Errorf("Expected only the records without collisions, got %+v", imported.Mappings)
+		}
+	})
+
+	t.Run("ConflictingXattrs", func(t *testing.T) {
+		records := []Record{
+			{Source: "b.mkv", Path: "/movies/b.mkv", Xattrs: map[string][]byte{"user.tag": []byte("x")}},
+			{Source: "b.mkv", Path: "/tv/b.mkv", Xattrs: map[string][]byte{"user.tag": []byte("y")}},
+		}
+		_, report, err := current.Import(records, opts)
+		if err != nil {
+			t.Fatalf("Import failed: %v", err)
+		}
+		if len(report.Invalid) != 1 || report.Invalid[0].Kind != ProblemConflictingXattr {
+			t.Errorf("Expected a conflicting xattr, got %+v", report.Invalid)
+		}
+	})
+}
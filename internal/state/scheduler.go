@@ -0,0 +1,114 @@
+package state
+
+import (
+	"sync"
+	"time"
+)
+
+// SaveOptions controls how often state changes are written to disk.
+//
+// With a zero Debounce every change is saved before the operation that made
+// it returns, so an acknowledged change survives a crash. With a non-zero
+// Debounce changes are acknowledged immediately and written once no further
+// change has arrived for Debounce, but never later than MaxDelay after the
+// first unsaved change. A crash can therefore lose up to MaxDelay worth of
+// changes; a clean unmount or SIGTERM flushes them.
+type SaveOptions struct {
+	// Debounce is the quiet period to wait for before saving
+	Debounce time.Duration
+	// MaxDelay bounds how long a steady stream of changes can postpone a save
+	MaxDelay time.Duration
+}
+
+// SaveScheduler coalesces bursts of state changes into a single save.
+type SaveScheduler struct {
+	save    func() error
+	opts    SaveOptions
+	timer   *time.Timer
+	dirty   bool
+	first   time.Time // time of the first unsaved change
+	mu      sync.Mutex
+	flushMu sync.Mutex // serializes calls to save
+}
+
+// NewSaveScheduler creates a scheduler that calls save once changes have
+// settled according to opts. A MaxDelay shorter than Debounce is raised to
+// Debounce.
+func NewSaveScheduler(save func() error, opts SaveOptions) *SaveScheduler {
+	if opts.MaxDelay < opts.Debounce {
+		opts.MaxDelay = opts.Debounce
+	}
+	logger.Debug("Creating save scheduler (debounce=%v, max delay=%v)", opts.Debounce, opts.MaxDelay)
+	return &SaveScheduler{
+		save: save,
+		opts: opts,
+	}
+}
+
+// Schedule records that the state has changed and (re)arms the save timer.
+func (s *SaveScheduler) Schedule() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if !s.dirty {
+		s.dirty = true
+		s.first = now
+	}
+
+	delay := s.opts.Debounce
+	if remaining := s.first.Add(s.opts.MaxDelay).Sub(now); remaining < delay {
+		delay = remaining
+	}
+	if delay < 0 {
+		delay = 0
+	}
+
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = time.AfterFunc(delay, func() {
+		if err := s.Flush(); err != nil {
+			logger.Error("Scheduled state save failed: %v", err)
+		}
+	})
+	logger.Trace("State save scheduled in %v", delay)
+}
+
+// Flush writes any pending changes immediately. If the save fails the
+// changes stay pending and are retried on the next Flush or Schedule.
+func (s *SaveScheduler) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	s.dirty = false
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.mu.Unlock()
+
+	logger.Debug("Flushing pending state changes")
+	if err := s.save(); err != nil {
+		s.mu.Lock()
+		if !s.dirty {
+			s.dirty = true
+			s.first = time.Now()
+		}
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Pending returns true if there are changes that have not been saved yet
+func (s *SaveScheduler) Pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dirty
+}
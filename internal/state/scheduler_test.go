@@ -0,0 +1,74 @@
+package state
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSaveScheduler(t *testing.T) {
+	t.Run("CoalescesBursts", func(t *testing.T) {
+		var saves int32
+		s := NewSaveScheduler(func() error {
+			atomic.AddInt32(&saves, 1)
+			return nil
+		}, SaveOptions{Debounce: 50 * time.Millisecond, MaxDelay: time.Second})
+
+		for i := 0; i < 100; i++ {
+			s.Schedule()
+		}
+		if got := atomic.LoadInt32(&saves); got != 0 {
+			t.Errorf("Expected no saves during the debounce window, got %d", got)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+		if got := atomic.LoadInt32(&saves); got != 1 {
+			t.Errorf("Expected a single coalesced save, got %d", got)
+		}
+		if s.Pending() {
+			t.Error("Expected no pending changes after the save")
+		}
+	})
+
+	t.Run("MaxDelay", func(t *testing.T) {
+		var saves int32
+		s := NewSaveScheduler(func() error {
+			atomic.AddInt32(&saves, 1)
+			return nil
+		}, SaveOptions{Debounce: 50 * time.Millisecond, MaxDelay: 100 * time.Millisecond})
+
+		deadline := time.Now().Add(300 * time.Millisecond)
+		for time.Now().Before(deadline) {
+			s.Schedule()
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := atomic.LoadInt32(&saves); got < 2 {
+			t.Errorf("Expected continuous changes to be saved every MaxDelay, got %d saves", got)
+		}
+		if err := s.Flush(); err != nil {
+			t.Errorf("Flush failed: %v", err)
+		}
+	})
+
+	t.Run("Flush", func(t *testing.T) {
+		var saves int32
+		s := NewSaveScheduler(func() error {
+			atomic.AddInt32(&saves, 1)
+			return nil
+		}, SaveOptions{Debounce: time.Hour, MaxDelay: time.Hour})
+
+		s.Schedule()
+		if err := s.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+		if got := atomic.LoadInt32(&saves); got != 1 {
+			t.Errorf("Expected Flush to save once, got %d", got)
+		}
+		if err := s.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+		if got := atomic.LoadInt32(&saves); got != 1 {
+			t.Errorf("Expected Flush without changes to be a no-op, got %d saves", got)
+		}
+	})
+}
@@ -0,0 +1,22 @@
+package state
+
+// Store persists the filesystem state. Manager stores the whole state as a
+// single JSON file; JournalStore appends each change to a journal and only
+// periodically rewrites the full state.
+type Store interface {
+	// LoadState loads the filesystem state, creating an empty one if none exists
+	LoadState() (*FSState, error)
+	// SaveState writes a complete snapshot of state
+	SaveState(state *FSState) error
+	// Record persists ops, which have already been applied to the state
+	// current returns. Stores that append ops only call current when they
+	// write a full snapshot.
+	Record(current func() *FSState, ops []Op) error
+	// Close releases the store; it must not be used afterwards
+	Close() error
+}
+
+var (
+	_ Store = (*Manager)(nil)
+	_ Store = (*JournalStore)(nil)
+)
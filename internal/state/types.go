@@ -1,18 +1,121 @@
 // Package state provides persistent state management for the virtual filesystem.
 package state
 
+import "time"
+
+// CurrentVersion is the state schema version written by this build.
+const CurrentVersion = 3
+
 // FSState represents the filesystem state
 type FSState struct {
-	// Map of source paths to their virtual path and xattrs
+	// Map of source paths to their virtual paths and xattrs
 	Mappings map[string]FileMapping `json:"mappings"`
 	// Set of virtual directories (stored as map for quick lookup)
 	Directories map[string]bool `json:"directories"`
-	// Version for future compatibility
+	// Version of the state schema, see CurrentVersion
 	Version int `json:"version"`
+	// Sequence number of the last journal record included in this state
+	JournalSeq uint64 `json:"journal_seq,omitempty"`
+	// Inode numbers of the virtual directories other than the root
+	DirectoryInodes map[string]uint64 `json:"directory_inodes,omitempty"`
+	// Next inode number to hand out, see AssignInodes
+	NextInode uint64 `json:"next_inode,omitempty"`
 }
 
-// FileMapping represents a single file's virtual mapping and attributes
+// FileMapping represents a single source file's virtual mappings and attributes.
+// A source can appear at any number of virtual paths; the xattrs are shared
+// between all of them.
 type FileMapping struct {
-	VirtualPath string            `json:"virtual_path"`
-	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	VirtualPaths []string          `json:"virtual_paths,omitempty"`
+	Xattrs       map[string][]byte `json:"xattrs,omitempty"`
+	// Fingerprint of the source, if known, for finding it again after the
+	// source tree renames it. It is a cache, not part of the mapping itself.
+	Fingerprint *Fingerprint `json:"fingerprint,omitempty"`
+	// History lists the sources the mapping was retargeted away from,
+	// oldest first
+	History []PreviousSource `json:"history,omitempty"`
+	// Inode number shared by all virtual paths of the source, so that it
+	// stays the same across restarts and renames
+	Inode uint64 `json:"inode,omitempty"`
+}
+
+// PreviousSource is a source a mapping pointed at before it was retargeted
+type PreviousSource struct {
+	Source   string    `json:"source"`
+	Replaced time.Time `json:"replaced"`
+}
+
+// HasVirtualPath returns true if vpath is one of the mapping's virtual paths
+func (fm FileMapping) HasVirtualPath(vpath string) bool {
+	for _, p := range fm.VirtualPaths {
+		if p == vpath {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEmpty returns true if the mapping has neither virtual paths nor xattrs,
+// so that it carries no information and can be dropped. A fingerprint,
+// history or inode alone does not count.
+func (fm FileMapping) IsEmpty() bool {
+	return len(fm.VirtualPaths) == 0 && len(fm.Xattrs) == 0
+}
+
+// initialize ensures the required fields of a decoded state are set
+func (s *FSState) initialize() {
+	if s.Mappings == nil {
+		s.Mappings = make(map[string]FileMapping)
+	}
+	if s.Directories == nil {
+		s.Directories = make(map[string]bool)
+	}
+	if s.DirectoryInodes == nil {
+		s.DirectoryInodes = make(map[string]uint64)
+	}
+	s.Directories["/"] = true
+}
+
+// Clone returns a deep copy of the state
+func (s *FSState) Clone() *FSState {
+	clone := &FSState{
+		Mappings:        make(map[string]FileMapping, len(s.Mappings)),
+		Directories:     make(map[string]bool, len(s.Directories)),
+		Version:         s.Version,
+		JournalSeq:      s.JournalSeq,
+		DirectoryInodes: make(map[string]uint64, len(s.DirectoryInodes)),
+		NextInode:       s.NextInode,
+	}
+	for source, mapping := range s.Mappings {
+		clone.Mappings[source] = mapping.Clone()
+	}
+	for dir, exists := range s.Directories {
+		clone.Directories[dir] = exists
+	}
+	for dir, inode := range s.DirectoryInodes {
+		clone.DirectoryInodes[dir] = inode
+	}
+	return clone
+}
+
+// Clone returns a deep copy of the mapping
+func (fm FileMapping) Clone() FileMapping {
+	clone := FileMapping{Inode: fm.Inode}
+	if fm.VirtualPaths != nil {
+		clone.VirtualPaths = append([]string(nil), fm.VirtualPaths...)
+	}
+	if fm.Xattrs != nil {
+		clone.Xattrs = make(map[string][]byte, len(fm.Xattrs))
+		for name, value := range fm.Xattrs {
+			clone.Xattrs[name] = append([]byte(nil), value...)
+		}
+	}
+	if fm.Fingerprint != nil {
+		fingerprint := *fm.Fingerprint
+		clone.Fingerprint = &fingerprint
+	}
+	if fm.History != nil {
+		clone.History = append([]PreviousSource(nil), fm.History...)
+	}
+	return clone
 }
@@ -0,0 +1,108 @@
+package state
+
+import (
+	"path"
+	"sort"
+)
+
+// RepairDirectories registers every missing ancestor of a mapped virtual
+// path or virtual directory, so that everything stored in the state is
+// reachable from the root. It returns the directories that were added.
+func (s *FSState) RepairDirectories() []string {
+	var added []string
+	var dirs []string
+	for dir := range s.Directories {
+		dirs = append(dirs, dir)
+	}
+	for _, dir := range dirs {
+		if dir != "/" {
+			added = append(added, s.registerParents(dir)...)
+		}
+	}
+	for _, mapping := range s.Mappings {
+		for _, vpath := range mapping.VirtualPaths {
+			added = append(added, s.registerParents(vpath)...)
+		}
+	}
+
+	sort.Strings(added)
+	return added
+}
+
+// CleanPaths rewrites virtual paths and directories that are relative or not
+// in clean form, such as "movies//a.mkv", to their rooted clean form, which
+// is what the filesystem looks them up by. Virtual paths that clean to the
+// root are dropped. It returns the paths that were rewritten or dropped.
+func (s *FSState) CleanPaths() []string {
+	var cleaned []string
+	for source, mapping := range s.Mappings {
+		var paths []string
+		changed := false
+		for _, vpath := range mapping.VirtualPaths {
+			clean := cleanVirtualPath(vpath)
+			if clean != vpath {
+				cleaned = append(cleaned, vpath)
+				changed = true
+			}
+			if clean == "/" || containsString(paths, clean) {
+				changed = true
+				continue
+			}
+			paths = append(paths, clean)
+		}
+		if changed {
+			mapping.VirtualPaths = paths
+			s.Mappings[source] = mapping
+		}
+	}
+
+	for dir := range s.Directories {
+		if clean := cleanVirtualPath(dir); clean != dir {
+			cleaned = append(cleaned, dir)
+			delete(s.Directories, dir)
+			s.Directories[clean] = true
+		}
+	}
+
+	sort.Strings(cleaned)
+	return cleaned
+}
+
+// Compact drops mapping records that have neither virtual paths nor xattrs.
+// Records that only carry xattrs are kept. It returns the dropped sources.
+func (s *FSState) Compact() []string {
+	var dropped []string
+	for source, mapping := range s.Mappings {
+		if mapping.IsEmpty() {
+			dropped = append(dropped, source)
+		}
+	}
+	for _, source := range dropped {
+		delete(s.Mappings, source)
+	}
+
+	sort.Strings(dropped)
+	return dropped
+}
+
+// registerParents registers every missing ancestor directory of vpath and
+// returns the ones that were added
+func (s *FSState) registerParents(vpath string) []string {
+	var added []string
+	// Relative paths end in "." rather than the root
+	for dir := path.Dir(vpath); dir != "."; dir = path.Dir(dir) {
+		if !s.Directories[dir] {
+			s.Directories[dir] = true
+			added = append(added, dir)
+		}
+		if dir == "/" {
+			break
+		}
+	}
+	return added
+}
+
+// cleanVirtualPath returns vpath in rooted clean form
+func cleanVirtualPath(vpath string) string {
+	return path.Clean("/" + vpath)
+}
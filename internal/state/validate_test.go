@@ -0,0 +1,120 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRepairDirectories(t *testing.T) {
+	state := &FSState{
+		Mappings: map[string]FileMapping{
+			"ep1.mkv": {VirtualPaths: []string{"/tv/Show/Season 01/ep1.mkv"}},
+			"movie.mkv": {VirtualPaths: []string{
+				"/movies/Movie.mkv",
+				"/favourites/Movie.mkv",
+			}},
+		},
+		Directories: map[string]bool{
+			"/":                true,
+			"/movies":          true,
+			"/archive/2020/Q1": true,
+		},
+		Version: CurrentVersion,
+	}
+
+	added := state.RepairDirectories()
+
+	expected := []string{
+		"/archive",
+		"/archive/2020",
+		"/favourites",
+		"/tv",
+		"/tv/Show",
+		"/tv/Show/Season 01",
+	}
+	if !reflect.DeepEqual(added, expected) {
+		t.Errorf("Expected added directories %v, got %v", expected, added)
+	}
+	for _, dir := range expected {
+		if !state.Directories[dir] {
+			t.Errorf("Expected %q to be registered", dir)
+		}
+	}
+
+	if again := state.RepairDirectories(); len(again) != 0 {
+		t.Errorf("Expected a repaired state to need no further repair, got %v", again)
+	}
+}
+
+func TestCleanPaths(t *testing.T) {
+	data := []byte(`{
+  "mappings": {
+    "a.mkv": {"virtual_paths": ["movies/a.mkv", "/movies/a.mkv"]},
+    "b.mkv": {"virtual_paths": ["/tv//Show/./b.mkv", ".."]}
+  },
+  "directories": {"/": true, "archive/2020": true},
+  "version": 3
+}`)
+	state, _, err := parseState(data)
+	if err != nil {
+		t.Fatalf("Failed to parse state: %v", err)
+	}
+
+	if paths := state.Mappings["a.mkv"].VirtualPaths; !reflect.DeepEqual(paths, []string{"/movies/a.mkv"}) {
+		t.Errorf("Expected a relative path to be rooted, got %q", paths)
+	}
+	if paths := state.Mappings["b.mkv"].VirtualPaths; !reflect.DeepEqual(paths, []string{"/tv/Show/b.mkv"}) {
+		t.Errorf("Expected an unclean path to be cleaned, got %q", paths)
+	}
+	expected := map[string]bool{
+		"/": true, "/movies": true, "/tv": true, "/tv/Show": true, "/archive": true, "/archive/2020": true,
+	}
+	if !reflect.DeepEqual(state.Directories, expected) {
+		t.Errorf("Expected directories %v, got %v", expected, state.Directories)
+	}
+
+	// Ops naming relative paths must not hang either
+	if err := state.Apply(Op{Kind: OpMap, Source: "c.mkv", Path: "other/c.mkv"}); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if !state.Directories["other"] {
+		t.Error("Expected the relative parent to be registered")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	state := &FSState{
+		Mappings: map[string]FileMapping{
+			"mapped.mkv": {VirtualPaths: []string{"/mapped.mkv"}},
+			"tagged.mkv": {Xattrs: map[string][]byte{"user.tag": []byte("x")}},
+			"empty.mkv":  {},
+			"blank.mkv":  {VirtualPaths: []string{}, Xattrs: map[string][]byte{}},
+		},
+		Directories: map[string]bool{"/": true},
+		Version:     CurrentVersion,
+	}
+
+	dropped := state.Compact()
+
+	if expected := []string{"blank.mkv", "empty.mkv"}; !reflect.DeepEqual(dropped, expected) {
+		t.Errorf("Expected dropped %v, got %v", expected, dropped)
+	}
+	for _, source := range []string{"mapped.mkv", "tagged.mkv"} {
+		if _, exists := state.Mappings[source]; !exists {
+			t.Errorf("Expected %q to be kept", source)
+		}
+	}
+
+	if err := state.Apply(Op{Kind: OpUnmap, Source: "mapped.mkv", Path: "/mapped.mkv"}); err != nil {
+		t.Fatalf("Failed to unmap: %v", err)
+	}
+	if _, exists := state.Mappings["mapped.mkv"]; exists {
+		t.Error("Expected unmapping the last virtual path to drop the record")
+	}
+	if err := state.Apply(Op{Kind: OpRemoveXattr, Source: "tagged.mkv", Name: "user.tag"}); err != nil {
+		t.Fatalf("Failed to remove xattr: %v", err)
+	}
+	if _, exists := state.Mappings["tagged.mkv"]; exists {
+		t.Error("Expected removing the last xattr to drop the record")
+	}
+}